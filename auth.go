@@ -0,0 +1,130 @@
+package signalr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxAuthRounds limits the number of challenges answered per request.
+const maxAuthRounds = 3
+
+// Authenticator performs challenge-response authentication, such as NTLM or
+// Negotiate (SPNEGO) provided by SSPI or GSSAPI, which may take multiple round
+// trips.
+//
+// HTTP requests are retried while the server responds with 401 Unauthorized
+// and Authorize returns a new token. The websocket handshake carries only the
+// token returned for no challenges, because every handshake opens a new
+// network connection: stateless schemes like Kerberos work, while NTLM, which
+// authenticates the connection, does not.
+type Authenticator interface {
+	// Authorize returns Authorization header value for req. challenges
+	// holds WWW-Authenticate values of the previous 401 response and is
+	// empty before the first attempt. Empty value means no authorization
+	// for the first attempt, and giving up afterwards.
+	Authorize(ctx context.Context, req *http.Request, challenges []string) (string, error)
+}
+
+// authTransport answers authentication challenges of requests sent through
+// base transport.
+type authTransport struct {
+	base http.RoundTripper
+	auth Authenticator
+}
+
+// CloseIdleConnections closes idle connections of base transport.
+func (t *authTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	token, err := t.auth.Authorize(ctx, req, nil)
+	if err != nil {
+		return nil, &AuthError{cause: err}
+	}
+
+	for round := 0; ; round++ {
+		r := req.Clone(ctx)
+		if token != "" {
+			r.Header.Set("Authorization", token)
+		}
+
+		if round > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, &AuthError{cause: errors.New("request body can not be replayed")}
+			}
+
+			if r.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		res, err := t.base.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+
+		challenges := res.Header.Values("WWW-Authenticate")
+		if res.StatusCode != http.StatusUnauthorized || len(challenges) == 0 || round == maxAuthRounds {
+			return res, nil
+		}
+
+		next, err := t.auth.Authorize(ctx, req, challenges)
+		if err != nil {
+			_ = res.Body.Close()
+			return nil, &AuthError{cause: err}
+		}
+
+		if next == "" {
+			return res, nil
+		}
+
+		// drain body so that the connection, which NTLM authenticates, is
+		// reused for the next round
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxErrorBodySize))
+		_ = res.Body.Close()
+
+		token = next
+	}
+}
+
+// handshakeHeaders returns headers of websocket handshake with endpoint,
+// authorized by Authenticator if it is set.
+func (c *Conn) handshakeHeaders(ctx context.Context, endpoint string) (http.Header, error) {
+	headers := c.config.connectHeaders()
+
+	auth := c.config.Authenticator
+	if auth == nil {
+		return headers, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := auth.Authorize(ctx, req, nil)
+	if err != nil {
+		return nil, &AuthError{cause: err}
+	}
+
+	if token == "" {
+		return headers, nil
+	}
+
+	headers = headers.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+
+	headers.Set("Authorization", token)
+
+	return headers, nil
+}
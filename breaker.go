@@ -0,0 +1,95 @@
+package signalr
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CircuitBreaker prevents reconnect storms against a struggling server. After
+// Threshold consecutive connections lived shorter than MinLifetime, the
+// breaker opens and reconnect waits for Cooldown. After cool-down a single
+// short-lived connection opens the breaker again.
+type CircuitBreaker struct {
+	// The number of consecutive short-lived connections opening the breaker,
+	// zero disables the breaker.
+	Threshold int
+
+	// Connections dropped sooner than this after being established are
+	// short-lived.
+	MinLifetime time.Duration
+
+	// The time to wait before reconnecting once the breaker is open.
+	Cooldown time.Duration
+
+	// OnOpen is called when the breaker opens. It must not block.
+	OnOpen func(BreakerOpen)
+}
+
+// BreakerOpen describes opening of the circuit breaker.
+type BreakerOpen struct {
+	// the number of consecutive short-lived connections
+	ShortLived int
+
+	// the time reconnect waits for
+	Cooldown time.Duration
+}
+
+// breaker tracks lifetime of connections.
+type breaker struct {
+	mtx        sync.Mutex
+	connected  time.Time
+	shortLived int
+}
+
+// connected records the time the connection was established.
+func (c *Conn) connected() {
+	c.breaker.mtx.Lock()
+	c.breaker.connected = c.config.Clock.Now()
+	c.breaker.mtx.Unlock()
+}
+
+// cooldown waits before reestablishing dropped connection if it was one too
+// many short-lived connections in a row.
+func (c *Conn) cooldown(ctx context.Context) error {
+	cfg := c.config.Breaker
+	if cfg.Threshold <= 0 {
+		return nil
+	}
+
+	b := &c.breaker
+
+	b.mtx.Lock()
+	if c.config.Clock.Now().Sub(b.connected) < cfg.MinLifetime {
+		b.shortLived++
+	} else {
+		b.shortLived = 0
+	}
+
+	shortLived := b.shortLived
+	if shortLived >= cfg.Threshold {
+		// half-open: the next short-lived connection opens the breaker again
+		b.shortLived = cfg.Threshold - 1
+	}
+	b.mtx.Unlock()
+
+	if shortLived < cfg.Threshold {
+		return nil
+	}
+
+	c.log(LevelWarn, "connection is flapping, cooling down", "short_lived", shortLived, "cooldown", cfg.Cooldown)
+
+	if cfg.OnOpen != nil {
+		cfg.OnOpen(BreakerOpen{ShortLived: shortLived, Cooldown: cfg.Cooldown})
+	}
+
+	timer := c.config.Clock.NewTimer(cfg.Cooldown)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
@@ -0,0 +1,77 @@
+package signalr
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NameCase controls casing of hub and method names sent to the server, see
+// MethodNames and HubNames.
+type NameCase int
+
+const (
+	// names are sent as given
+	KeepCase NameCase = iota
+
+	// names are sent in camelCase, e.g. GetURL as getURL and URLFor as
+	// urlFor, as expected by ASP.NET Core hubs following JavaScript
+	// conventions
+	CamelCase
+
+	// names are sent in PascalCase, e.g. getOrders as GetOrders, as
+	// declared by .NET hubs
+	PascalCase
+)
+
+// apply converts name to the case.
+func (nc NameCase) apply(name string) string {
+	switch nc {
+	case CamelCase:
+		return camelCase(name)
+	case PascalCase:
+		return pascalCase(name)
+	default:
+		return name
+	}
+}
+
+// camelCase lowers the leading run of upper-case letters, leaving the last one
+// upper-case if it starts the next word, so that initialisms are lowered as a
+// whole.
+func camelCase(name string) string {
+	runes := []rune(name)
+
+	for i, r := range runes {
+		if !unicode.IsUpper(r) {
+			break
+		}
+
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+
+		runes[i] = unicode.ToLower(r)
+	}
+
+	return string(runes)
+}
+
+func pascalCase(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	if r == utf8.RuneError || unicode.IsUpper(r) {
+		return name
+	}
+
+	return string(unicode.ToUpper(r)) + name[size:]
+}
+
+// methodKey returns the name callback streams of method are registered under,
+// which is folded to lower case when calls are matched case-insensitively.
+func methodKey(method string, foldCase bool) string {
+	if foldCase {
+		return strings.ToLower(method)
+	}
+
+	return method
+}
@@ -4,99 +4,520 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
 type Client struct {
+	shutdown    int32
+	running     int32
 	hub         string
 	conn        *Conn
+	config      clientConfig
+	codec       codec
 	invocations *invocations
-	callbacks   *callbacks
+	callbacks   *dispatcher
+	declared    *declarations
+	errs        chan error
+
+	// signalled on reconnect, so that Run replays declared calls
+	replays chan struct{}
+
+	// sends calls made with Enqueue, nil unless WriteJournal is set
+	journal *journal
+
+	// goroutines of handlers registered by Handle
+	handlers sync.WaitGroup
+
+	// error returned by the latest Run
+	mtx sync.Mutex
+	err error
 }
 
 type Invocation struct {
-	ctx    context.Context
-	id     int
-	method string
-	ch     chan invocationResult
-	err    error
+	ctx     context.Context
+	id      uint64
+	method  string
+	started time.Time
+	codec   codec
+	ch      chan invocationResult
+	err     error
+
+	// taken from ctx, see WithCorrelationID
+	correlationID string
+
+	// epoch of the connection the invocation was sent over, once it is sent
+	epoch uint64
+	sent  bool
 }
 
 type CallbackStream struct {
 	ctx    context.Context
 	cancel context.CancelFunc
+	config callbackConfig
+	codec  codec
 	ch     chan callbackResult
+
+	// err is set before the stream is cancelled by the client
+	err error
+
+	// closed once the stream is removed from the client
+	removed chan struct{}
+
+	// records lag of calls read from the stream, registered under key
+	lag *lagRecorder
+	key string
+
+	// keys of recently delivered calls, nil unless Dedupe is set
+	dedupe *dedupeWindow
+
+	// message read but not acknowledged, the number of times it was
+	// delivered and the reason it was not, see RequireAck
+	unacked    *callbackResult
+	deliveries int
+	nacked     error
+
+	// passes message abandoned by the reader to dead letter handler
+	abandon func(ClientMsg, error)
+
+	// state of iteration with Next
+	iter callbackIter
 }
 
-func NewClient(hub string, conn *Conn) *Client {
-	return &Client{
-		hub:         hub,
+// callbackIter holds the message read by CallbackStream.Next, or the reason
+// the stream stopped.
+type callbackIter struct {
+	current callbackResult
+	err     error
+}
+
+// NewClient creates a client of the hub. Callback settings, such as
+// MaxMessageProcessDuration, are taken from the Config of conn.
+func NewClient(hub string, conn *Conn, opts ...ClientOpt) *Client {
+	cfg := newDefaultClientConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	codec := codec{useNumber: cfg.UseNumber, types: cfg.TypeCodecs}
+
+	if conn.events == nil {
+		conn.events = make(eventChan, eventBufferSize)
+	}
+
+	foldCase := cfg.MethodNames != KeepCase
+
+	callbacks := newDispatcher(cfg.DispatchShards, conn.config.MaxMessageProcessDuration, func(callbacks *callbacks) {
+		callbacks.foldCase = foldCase
+		callbacks.deadLetter = cfg.DeadLetter
+		callbacks.clock = conn.config.Clock
+		callbacks.codec = codec
+		callbacks.fanOut = cfg.FanOut
+		callbacks.events = conn.events
+
+		if cfg.MessageTimestamp != nil {
+			callbacks.lag = newLagRecorder(cfg.MessageTimestamp, conn.config.Clock)
+		}
+	})
+
+	callbacks.foldCase = foldCase
+	callbacks.ordered = cfg.OrderedDelivery
+
+	invocations := newInvocations()
+	invocations.clock = conn.config.Clock
+	invocations.codec = codec
+	invocations.events = conn.events
+	if cfg.InvocationIDs != nil {
+		invocations.nextID = cfg.InvocationIDs
+	}
+
+	c := &Client{
+		hub:         cfg.HubNames.apply(hub),
 		conn:        conn,
-		invocations: newInvocations(),
-		callbacks:   newCallbacks(conn.config.MaxMessageProcessDuration),
+		config:      cfg,
+		codec:       codec,
+		invocations: invocations,
+		callbacks:   callbacks,
+		declared:    &declarations{},
+		errs:        make(chan error, 1),
+		replays:     make(chan struct{}, 1),
 	}
+
+	invocations.logger = LoggerFunc(c.log)
+
+	if cfg.UnknownMessages != IgnoreUnknown || cfg.Unhandled != nil {
+		invocations.unhandled = c.unhandled
+		for _, shard := range callbacks.all() {
+			shard.unhandled = c.unhandled
+		}
+	}
+
+	if cfg.Journal.Journal != nil {
+		c.journal = newJournal(cfg.Journal, conn.config.Clock)
+	}
+
+	conn.onReconnected(func() {
+		c.invocations.replaced(conn.epoch())
+
+		select {
+		case c.replays <- struct{}{}:
+		default:
+		}
+
+		if c.journal != nil {
+			c.journal.flush()
+		}
+	})
+
+	return c
 }
 
-// Close closes underlying websocket connection
+// Close closes underlying websocket connection, see Conn.Close. Run returns
+// nil after close.
 func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
+// CloseContext closes underlying websocket connection, see Conn.CloseContext.
+// Run returns nil after close.
+func (c *Client) CloseContext(ctx context.Context) error {
+	return c.conn.CloseContext(ctx)
+}
+
+// Shutdown gracefully closes the client: it stops accepting new invocations,
+// waits for in-flight invocations to complete (or ctx to be done), flushes
+// pending writes and closes the connection. Run returns nil after shutdown.
+func (c *Client) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&c.shutdown, 1)
+	c.invocations.shutdown()
+
+	waitErr := c.invocations.wait(ctx)
+
+	if err := c.conn.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	return waitErr
+}
+
+// LastMessageID returns ID of the last received message. It is used to resume
+// the stream on reconnect.
+func (c *Client) LastMessageID() string {
+	return c.conn.State().MessageID
+}
+
+// NegotiateInfo returns values provided by the server in negotiate response,
+// see Conn.NegotiateInfo.
+func (c *Client) NegotiateInfo() NegotiateInfo {
+	return c.conn.NegotiateInfo()
+}
+
+// Metadata describes the current connection, see Conn.Metadata.
+func (c *Client) Metadata() ConnMetadata {
+	return c.conn.Metadata()
+}
+
+// Renegotiate obtains a fresh connection token and transparently replaces
+// underlying connection, see Conn.Renegotiate.
+func (c *Client) Renegotiate(ctx context.Context) error {
+	return c.conn.Renegotiate(ctx)
+}
+
+// Run reads and dispatches messages until ctx is done, the client is closed or
+// reading fails. Callback streams are closed when Run returns.
+//
+// Run leaves no goroutines behind: once it returns, handlers registered by
+// Handle have returned, and so have declared calls being replayed and the
+// goroutines reading the connection and pinging the server. Reconnects
+// happening while Run is not running are replayed by the next Run.
 func (c *Client) Run(ctx context.Context) error {
+	c.setErr(nil)
+
+	err := c.run(ctx)
+	c.callbacks.removeAll()
+	c.handlers.Wait()
+
+	c.setErr(err)
+	c.conn.events.emit(Closed{Err: err})
+
+	return err
+}
+
+// Err returns the error returned by Run, so that supervisors and health
+// endpoints can report why the connection died. It is nil while Run is
+// running and after Run returned nil. The reason of the latest reconnect is
+// reported by Stats.
+func (c *Client) Err() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.err
+}
+
+// Events returns lifecycle events of the client, such as reconnects and
+// dropped messages, for logging and alerting. Events are buffered, including
+// those emitted by Dial; once the buffer is full, further events are dropped
+// until they are read, so that a slow reader never blocks the client. The
+// channel is shared by all readers and is never closed.
+func (c *Client) Events() <-chan Event {
+	return c.conn.events
+}
+
+func (c *Client) setErr(err error) {
+	c.mtx.Lock()
+	c.err = err
+	c.mtx.Unlock()
+}
+
+// run reads and dispatches messages until ctx is done or reading fails.
+// Callback streams are left intact, so they can continue after reconnect.
+func (c *Client) run(ctx context.Context) error {
+	atomic.StoreInt32(&c.running, 1)
+	defer atomic.StoreInt32(&c.running, 0)
+
 	g, ctx := errgroup.WithContext(ctx)
 
 	message := make(chan Message)
 	defer close(message)
 
+	c.callbacks.start(ctx)
+	defer c.callbacks.stop()
+
 	g.Go(func() error {
+		stop := func() error {
+			c.invocations.removeAll()
+			return c.conn.interrupt()
+		}
+
 		for {
 			select {
 			case <-ctx.Done():
-				c.invocations.removeAll()
-				c.callbacks.removeAll()
-				return c.conn.Close()
+				return stop()
+			case err := <-c.errs:
+				_ = stop()
+				return err
 			case msg := <-message:
-				c.invocations.process(&msg)
-				c.callbacks.process(&msg)
+				if err := c.dispatch(&msg); err != nil {
+					_ = stop()
+					return err
+				}
 			}
 		}
 	})
 
+	g.Go(func() error {
+		c.conn.pinger(ctx)
+		return nil
+	})
+
+	g.Go(func() error {
+		c.invocations.expire(ctx, c.config.InvocationTimeout)
+		return nil
+	})
+
+	g.Go(func() error {
+		c.replayer(ctx)
+		return nil
+	})
+
+	if c.journal != nil {
+		g.Go(func() error {
+			c.flusher(ctx)
+			return nil
+		})
+	}
+
 	g.Go(func() error {
 		for {
 			var msg Message
 			if err := c.conn.ReadMessage(ctx, &msg); err != nil {
 				return fmt.Errorf("failed to read message from websocket: %w", err)
 			}
-			message <- msg
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case message <- msg:
+			}
 		}
 	})
-	return g.Wait()
+
+	g.Go(func() error {
+		c.conn.acknowledge(ctx)
+		return nil
+	})
+
+	err := g.Wait()
+	if atomic.LoadInt32(&c.shutdown) == 1 || c.conn.isClosed() {
+		return nil
+	}
+
+	if err != nil {
+		c.conn.stats.fail(err)
+	}
+
+	return err
 }
 
+// unhandled passes message which matches neither pending invocation nor
+// callback stream to OnUnhandledMessage hook and reports it according to
+// UnknownMessages mode. It must not block, as it is called while dispatching
+// is locked.
+func (c *Client) unhandled(msg UnhandledMessage) {
+	if c.config.Unhandled != nil {
+		c.config.Unhandled(msg)
+	}
+
+	if c.config.UnknownMessages == IgnoreUnknown {
+		return
+	}
+
+	unknown := UnknownMessage{Method: msg.Call.Method}
+	if msg.Completion != nil {
+		unknown.InvocationID = msg.Completion.InvocationID
+	}
+
+	c.conn.events.emit(unknown)
+
+	if c.config.UnknownMessages == FailOnUnknown {
+		c.fail(&UnknownMessageError{Method: unknown.Method, InvocationID: unknown.InvocationID})
+	}
+}
+
+// log logs message of the client along with its hub and connection ID.
+func (c *Client) log(level LogLevel, msg string, keyvals ...interface{}) {
+	c.conn.log(level, msg, append([]interface{}{"hub", c.hub}, keyvals...)...)
+}
+
+// dispatch delivers message to pending invocations and callback streams.
+// Panics, e.g. in user provided validators or transforms, are converted to
+// errors.
+func (c *Client) dispatch(msg *Message) (err error) {
+	defer recoverPanic(LoggerFunc(c.log), &err)
+
+	c.invocations.process(msg)
+	c.callbacks.process(msg)
+
+	return nil
+}
+
+// Invoke calls method of the hub with given arguments, whose result is read
+// by Unmarshal of the returned invocation. It is safe to invoke methods from
+// multiple goroutines concurrently.
 func (c *Client) Invoke(ctx context.Context, method string, args ...interface{}) *Invocation {
-	rawArgs, err := marshalArgs(args)
+	rawArgs, err := c.codec.marshalArgs(args)
+	if err != nil {
+		return &Invocation{err: fmt.Errorf("failed to marshal args: %w", err)}
+	}
+
+	return c.InvokeRaw(ctx, method, rawArgs)
+}
+
+// InvokeRaw calls method of the hub with arguments which are already encoded,
+// e.g. replayed or templated payloads, skipping their encoding. Arguments are
+// sent as is, invalid JSON fails the invocation without sending it.
+func (c *Client) InvokeRaw(ctx context.Context, method string, rawArgs []json.RawMessage) *Invocation {
+	return c.invoke(ctx, method, ClientMsg{Args: rawArgs})
+}
+
+// InvokeNamed calls method of the hub bound by parameter name rather than by
+// position, with arguments keyed by parameter name. Classic servers receive
+// the arguments as an object in place of the array; ASP.NET Core servers,
+// which bind by position only, receive the object as the single argument.
+func (c *Client) InvokeNamed(ctx context.Context, method string, args map[string]interface{}) *Invocation {
+	namedArgs, err := c.codec.marshalNamedArgs(args)
 	if err != nil {
 		return &Invocation{err: fmt.Errorf("failed to marshal args: %w", err)}
 	}
 
-	inv := c.invocations.create(ctx, method)
+	return c.invoke(ctx, method, ClientMsg{NamedArgs: namedArgs})
+}
+
+// invoke sends invocation of method with arguments of req.
+func (c *Client) invoke(ctx context.Context, method string, req ClientMsg) *Invocation {
+	inv, err := c.invocations.create(ctx, method)
+	if err != nil {
+		return &Invocation{err: err}
+	}
 
-	req := ClientMsg{Hub: c.hub, Method: method, Args: rawArgs, InvocationID: inv.id}
+	req.Hub = c.hub
+	req.Method = c.config.MethodNames.apply(method)
+	req.InvocationID = inv.id
+	req.Headers = correlationHeaders(ctx)
 
-	if err := c.conn.WriteMessage(ctx, req); err != nil {
+	epoch, err := c.conn.writeMessage(ctx, req)
+	if err != nil {
 		c.invocations.remove(inv.id)
 		return &Invocation{err: err}
 	}
 
+	c.invocations.sent(inv, epoch)
+
 	return inv
 }
 
-func (c *Client) Callback(ctx context.Context, method string) (*CallbackStream, error) {
-	return c.callbacks.create(ctx, method)
+// Send invokes method without waiting for its result, which suits
+// high-frequency notifications. The invocation carries no ID and is not
+// tracked, so the response of the server is ignored.
+func (c *Client) Send(ctx context.Context, method string, args ...interface{}) error {
+	rawArgs, err := c.codec.marshalArgs(args)
+	if err != nil {
+		return fmt.Errorf("failed to marshal args: %w", err)
+	}
+
+	if c.invocations.isShutdown() {
+		return &ShutdownError{}
+	}
+
+	return c.conn.WriteMessage(ctx, ClientMsg{Hub: c.hub, Method: c.config.MethodNames.apply(method), Args: rawArgs, Headers: correlationHeaders(ctx)})
+}
+
+// PendingInvocations returns invocations waiting for a response, the oldest
+// first, which helps to find calls the server never responds to.
+func (c *Client) PendingInvocations() []PendingInvocation {
+	return c.invocations.pending()
+}
+
+// CallbackStats returns per-method statistics of callback streams sorted by
+// method name, which helps to find lagging subscriptions.
+func (c *Client) CallbackStats() []CallbackStats {
+	return c.callbacks.stats()
+}
+
+// CloseCallbacks closes all callback streams and handlers of the client, e.g.
+// to unsubscribe from every feed before resubscribing. Streams report
+// context.Canceled, and messages waiting to be read are passed to dead letter
+// handler. The client keeps running and accepts new callbacks.
+func (c *Client) CloseCallbacks() {
+	c.callbacks.closeAll()
+}
+
+func (c *Client) Callback(ctx context.Context, method string, opts ...CallbackOpt) (*CallbackStream, error) {
+	cfg := callbackConfig{ProcessDuration: c.callbacks.maxMessageProcessDuration}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return c.callbacks.create(ctx, method, cfg)
+}
+
+// CallbackPattern returns stream receiving calls of every method matching
+// pattern which has no stream registered by Callback, e.g. MethodPrefix("uE.")
+// for hubs encoding market symbols into method names. A call matching
+// multiple patterns is delivered to streams of each. The method called is
+// reported by ReadRaw and by Method after Next.
+func (c *Client) CallbackPattern(ctx context.Context, pattern MethodPattern, opts ...CallbackOpt) (*CallbackStream, error) {
+	cfg := callbackConfig{ProcessDuration: c.callbacks.maxMessageProcessDuration}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return c.callbacks.createPattern(ctx, pattern, cfg)
 }
 
 func (r *Invocation) Unmarshal(dest interface{}) error {
@@ -112,7 +533,31 @@ func (r *Invocation) Unmarshal(dest interface{}) error {
 			return res.err
 		}
 
-		return json.Unmarshal(res.result, dest)
+		return r.codec.unmarshal(res.result, dest)
+	}
+}
+
+// WriteTo waits for the result of the invocation and writes it to w as raw
+// JSON, as received from the server, instead of decoding it. Very large
+// results, such as full order book snapshots, can be piped to a file, or to
+// json.Decoder through io.Pipe to be decoded token by token, without keeping
+// a decoded copy in memory. Like Unmarshal, it consumes the result.
+func (r *Invocation) WriteTo(w io.Writer) (int64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	select {
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	case res := <-r.ch:
+		if res.err != nil {
+			return 0, res.err
+		}
+
+		n, err := w.Write(res.result)
+
+		return int64(n), err
 	}
 }
 
@@ -120,8 +565,30 @@ func (r *Invocation) Exec() error {
 	return r.err
 }
 
+// wait waits for invocation to complete ignoring its result.
+func (r *Invocation) wait() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case res, ok := <-r.ch:
+		if !ok {
+			return context.Canceled
+		}
+
+		return res.err
+	}
+}
+
 func (s *CallbackStream) Read(args ...interface{}) error {
-	res := s.readResult()
+	return s.scan(s.readResult(), args)
+}
+
+// scan decodes arguments of the message read by the stream into args.
+func (s *CallbackStream) scan(res callbackResult, args []interface{}) error {
 	if res.err != nil {
 		return res.err
 	}
@@ -130,29 +597,121 @@ func (s *CallbackStream) Read(args ...interface{}) error {
 		return nil
 	}
 
-	if err := unmarshalArgs(res.message.Args, args); err != nil {
+	if err := s.codec.unmarshalArgs(res.message.Args, args); err != nil {
 		return fmt.Errorf("failed to unmarshal message: %v", err)
 	}
 
 	return nil
 }
 
+// ReadRaw reads the next message without decoding its arguments, so that
+// large payloads can be decoded partially or later. The message carries hub
+// and method names along with arguments as sent by the server, or as returned
+// by TransformArgs if the stream has any.
+func (s *CallbackStream) ReadRaw() (ClientMsg, error) {
+	res := s.readResult()
+
+	return res.message, res.err
+}
+
+// Next reads the next message, which is then decoded by Scan, and reports
+// whether there was one. Once the stream is stopped, or ctx is done, Next
+// returns false and Err reports the reason:
+//
+//	for stream.Next(ctx) {
+//		if err := stream.Scan(&a, &b); err != nil {
+//			...
+//		}
+//	}
+//
+//	if err := stream.Err(); err != nil {
+//		...
+//	}
+//
+// Next and Scan must not be used concurrently with each other or with Read.
+func (s *CallbackStream) Next(ctx context.Context) bool {
+	if s.iter.err != nil {
+		return false
+	}
+
+	res, ok := s.receive(ctx)
+	if !ok {
+		s.iter = callbackIter{err: res.err}
+		return false
+	}
+
+	s.iter = callbackIter{current: res}
+
+	return true
+}
+
+// Scan decodes arguments of the message read by Next into args, or returns
+// error of the message, such as ValidationError. Scan with no arguments only
+// reports the error.
+func (s *CallbackStream) Scan(args ...interface{}) error {
+	if s.iter.err != nil {
+		return s.iter.err
+	}
+
+	return s.scan(s.iter.current, args)
+}
+
+// Method returns name of the method called by the message read by Next, which
+// tells apart calls received by stream registered with CallbackPattern.
+func (s *CallbackStream) Method() string {
+	return s.iter.current.message.Method
+}
+
+// Err returns the reason Next stopped reading messages.
+func (s *CallbackStream) Err() error {
+	return s.iter.err
+}
+
 func (s *CallbackStream) readResult() callbackResult {
+	res, _ := s.receive(context.Background())
+	return res
+}
+
+// receive reads the next message, reporting false once the stream is stopped
+// or ctx is done.
+func (s *CallbackStream) receive(ctx context.Context) (callbackResult, bool) {
+	if s.unacked != nil {
+		if res, ok := s.redeliver(); ok {
+			return res, true
+		}
+	}
+
 	// ensure non-blocking read of backlog
 	select {
 	case <-s.ctx.Done():
-		return callbackResult{err: s.ctx.Err()}
+		return callbackResult{err: s.ctxErr()}, false
+	case <-ctx.Done():
+		return callbackResult{err: ctx.Err()}, false
 	default:
 	}
 
 	select {
 	case <-s.ctx.Done():
-		return callbackResult{err: s.ctx.Err()}
+		return callbackResult{err: s.ctxErr()}, false
+	case <-ctx.Done():
+		return callbackResult{err: ctx.Err()}, false
 	case res, ok := <-s.ch:
 		if !ok {
-			return callbackResult{err: context.Canceled}
+			if s.err != nil {
+				return callbackResult{err: s.err}, false
+			}
+
+			return callbackResult{err: context.Canceled}, false
 		}
-		return res
+
+		s.lag.read(s.key, res.received)
+
+		if s.config.RequireAck && res.err == nil {
+			s.unacked = &res
+			s.deliveries = 1
+		}
+
+		return res, true
 	}
 }
 
@@ -160,67 +719,153 @@ func (s *CallbackStream) Close() {
 	s.cancel()
 }
 
-func marshalArgs(src []interface{}) ([]json.RawMessage, error) {
-	res := make([]json.RawMessage, len(src))
-	for i, v := range src {
-		data, err := json.Marshal(v)
-		if err != nil {
-			return nil, err
-		}
+// Ack acknowledges the message read last from stream registered with
+// RequireAck, so that the next read returns the next message. Ack must not be
+// used concurrently with reads.
+func (s *CallbackStream) Ack() {
+	s.unacked = nil
+	s.nacked = nil
+}
 
-		res[i] = json.RawMessage(data)
+// Nack reports that the message read last from stream registered with
+// RequireAck failed to be processed, which is passed to dead letter handler as
+// the cause of UnacknowledgedError once the message is delivered as many times
+// as allowed. The message is redelivered by the next read, as is any message
+// which is not acknowledged.
+func (s *CallbackStream) Nack(err error) {
+	if s.unacked != nil {
+		s.nacked = err
 	}
-
-	return res, nil
 }
 
-func unmarshalArgs(src []json.RawMessage, dest []interface{}) error {
-	if len(src) != len(dest) {
-		return fmt.Errorf("invalid number of arguments: expected %d, got %d", len(src), len(dest))
-	}
+// redeliver returns the message which was read but not acknowledged, unless
+// it was delivered as many times as allowed or the stream is stopped, in
+// which case it is abandoned and false is returned.
+func (s *CallbackStream) redeliver() (callbackResult, bool) {
+	res := *s.unacked
+
+	var reason error
 
-	for i, v := range src {
-		if err := json.Unmarshal(v, dest[i]); err != nil {
-			return err
+	select {
+	case <-s.ctx.Done():
+		reason = s.ctxErr()
+	default:
+		if limit := s.config.MaxDeliveries; limit <= 0 || s.deliveries < limit {
+			s.deliveries++
+			return res, true
 		}
+
+		reason = &UnacknowledgedError{Method: res.message.Method, Deliveries: s.deliveries, cause: s.nacked}
 	}
 
-	return nil
+	s.Ack()
+	s.abandon(res.message, reason)
+
+	return callbackResult{}, false
+}
+
+// ctxErr returns the reason the stream was stopped.
+func (s *CallbackStream) ctxErr() error {
+	if s.err != nil {
+		return s.err
+	}
+
+	return s.ctx.Err()
 }
 
 type invocations struct {
-	mtx  sync.Mutex
-	id   int
-	data map[int]*Invocation
+	mtx    sync.Mutex
+	nextID func() uint64
+	clock  Clock
+	codec  codec
+	closed bool
+	empty  chan struct{}
+	data   map[uint64]*Invocation
+
+	// report completions
+	events eventChan
+	logger Logger
+
+	// called with completions of unknown invocations, nil if ignored
+	unhandled func(UnhandledMessage)
+
+	// the latest connection epoch, invocations sent over connections of
+	// earlier epochs are lost
+	epoch uint64
 }
 
 func newInvocations() *invocations {
 	return &invocations{
-		id:   1,
-		data: make(map[int]*Invocation),
+		nextID: sequentialIDs(),
+		clock:  systemClock{},
+		data:   make(map[uint64]*Invocation),
+		logger: nopLogger{},
 	}
 }
 
-func (i *invocations) create(ctx context.Context, method string) *Invocation {
+func (i *invocations) create(ctx context.Context, method string) (*Invocation, error) {
 	i.mtx.Lock()
 	defer i.mtx.Unlock()
 
-	id := i.id
-	i.id++
+	if i.closed {
+		return nil, &ShutdownError{}
+	}
+
+	id := i.nextID()
 
 	inv := &Invocation{
-		ctx:    ctx,
-		id:     id,
-		method: method,
-		ch:     make(chan invocationResult, 1),
+		ctx:           ctx,
+		id:            id,
+		method:        method,
+		started:       i.clock.Now(),
+		codec:         i.codec,
+		ch:            make(chan invocationResult, 1),
+		correlationID: CorrelationID(ctx),
 	}
 
 	i.data[id] = inv
 
-	return inv
+	return inv, nil
+}
+
+// sent records epoch of the connection invocation was sent over, failing the
+// invocation if the connection was already replaced.
+func (i *invocations) sent(inv *Invocation, epoch uint64) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if i.data[inv.id] != inv {
+		return
+	}
+
+	inv.epoch = epoch
+	inv.sent = true
+
+	if epoch < i.epoch {
+		i.complete(inv, invocationResult{err: &InvocationLostError{method: inv.method, id: inv.id}})
+	}
 }
 
-func (i *invocations) remove(id int) {
+// replaced fails invocations sent over connections preceding given epoch, so
+// that their responses, which are lost, are not waited for.
+func (i *invocations) replaced(epoch uint64) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if epoch <= i.epoch {
+		return
+	}
+
+	i.epoch = epoch
+
+	for _, inv := range i.data {
+		if inv.sent && inv.epoch < epoch {
+			i.complete(inv, invocationResult{err: &InvocationLostError{method: inv.method, id: inv.id}})
+		}
+	}
+}
+
+func (i *invocations) remove(id uint64) {
 	i.mtx.Lock()
 	defer i.mtx.Unlock()
 
@@ -231,6 +876,7 @@ func (i *invocations) remove(id int) {
 
 	close(inv.ch)
 	delete(i.data, id)
+	i.notifyEmpty()
 }
 
 func (i *invocations) process(msg *Message) {
@@ -241,25 +887,131 @@ func (i *invocations) process(msg *Message) {
 
 	inv, ok := i.data[id]
 	if !ok {
+		// messages carrying calls have no invocation ID
+		if id != 0 && i.unhandled != nil {
+			i.unhandled(UnhandledMessage{Completion: completionOf(msg)})
+		}
+
 		return
 	}
 
 	var err error
 	if msg.Error != "" {
-		err = &InvocationError{
-			method:  inv.method,
-			id:      id,
-			message: msg.Error,
+		invErr := &InvocationError{
+			HubError:   msg.HubError,
+			StackTrace: msg.StackTrace,
+			method:     inv.method,
+			id:         id,
+			message:    msg.Error,
+		}
+
+		if msg.ErrorDetail != nil {
+			invErr.Data = *msg.ErrorDetail
 		}
+
+		err = invErr
 	}
 
+	i.complete(inv, invocationResult{result: msg.Result, err: err})
+}
+
+// complete delivers result of pending invocation, forgets it and reports its
+// completion.
+func (i *invocations) complete(inv *Invocation, res invocationResult) {
 	select {
 	case <-inv.ctx.Done():
-	case inv.ch <- invocationResult{result: msg.Result, err: err}:
+	case inv.ch <- res:
 	}
 
 	close(inv.ch)
-	delete(i.data, id)
+	delete(i.data, inv.id)
+	i.notifyEmpty()
+
+	ev := InvocationCompleted{
+		Method:        inv.method,
+		ID:            inv.id,
+		CorrelationID: inv.correlationID,
+		Duration:      i.clock.Now().Sub(inv.started),
+		Err:           res.err,
+	}
+	i.events.emit(ev)
+
+	keyvals := []interface{}{"method", ev.Method, "invocation_id", ev.ID, "duration", ev.Duration}
+	if ev.CorrelationID != "" {
+		keyvals = append(keyvals, "correlation_id", ev.CorrelationID)
+	}
+	if ev.Err != nil {
+		keyvals = append(keyvals, "error", ev.Err)
+	}
+
+	i.logger.Log(LevelDebug, "invocation completed", keyvals...)
+}
+
+// pending returns pending invocations sorted by age.
+func (i *invocations) pending() []PendingInvocation {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	now := i.clock.Now()
+
+	res := make([]PendingInvocation, 0, len(i.data))
+	for _, inv := range i.data {
+		res = append(res, PendingInvocation{ID: inv.id, Method: inv.method, Age: now.Sub(inv.started)})
+	}
+
+	sort.Slice(res, func(a, b int) bool {
+		if res[a].Age != res[b].Age {
+			return res[a].Age > res[b].Age
+		}
+
+		return res[a].ID < res[b].ID
+	})
+
+	return res
+}
+
+// expire fails invocations pending for longer than timeout until ctx is done.
+// Zero timeout disables expiration.
+func (i *invocations) expire(ctx context.Context, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	for {
+		timer := i.clock.NewTimer(i.expireStale(timeout))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// expireStale fails invocations pending for longer than timeout and returns
+// the time until the oldest of remaining ones becomes stale.
+func (i *invocations) expireStale(timeout time.Duration) time.Duration {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	now := i.clock.Now()
+	next := timeout
+
+	for _, inv := range i.data {
+		age := now.Sub(inv.started)
+		if age < timeout {
+			if left := timeout - age; left < next {
+				next = left
+			}
+
+			continue
+		}
+
+		i.complete(inv, invocationResult{err: &InvocationTimeoutError{Age: age, method: inv.method, id: inv.id}})
+	}
+
+	return next
 }
 
 func (i *invocations) removeAll() {
@@ -270,96 +1022,559 @@ func (i *invocations) removeAll() {
 		close(inv.ch)
 	}
 
-	i.data = make(map[int]*Invocation)
+	i.data = make(map[uint64]*Invocation)
+	i.notifyEmpty()
+}
+
+// len returns the number of pending invocations.
+func (i *invocations) len() int {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	return len(i.data)
+}
+
+// shutdown prevents creation of new invocations.
+func (i *invocations) shutdown() {
+	i.mtx.Lock()
+	i.closed = true
+	i.mtx.Unlock()
+}
+
+// isShutdown reports whether creation of new invocations is prevented.
+func (i *invocations) isShutdown() bool {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	return i.closed
+}
+
+// wait blocks until there are no pending invocations or ctx is done.
+func (i *invocations) wait(ctx context.Context) error {
+	i.mtx.Lock()
+	if len(i.data) == 0 {
+		i.mtx.Unlock()
+		return nil
+	}
+
+	if i.empty == nil {
+		i.empty = make(chan struct{})
+	}
+	empty := i.empty
+	i.mtx.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-empty:
+		return nil
+	}
+}
+
+func (i *invocations) notifyEmpty() {
+	if len(i.data) == 0 && i.empty != nil {
+		close(i.empty)
+		i.empty = nil
+	}
 }
 
 type callbacks struct {
+	// the number of messages dropped, updated atomically as streams abandon
+	// messages without the lock, first to be aligned for atomic access
+	dropped int64
+
 	mtx                       sync.Mutex
 	maxMessageProcessDuration time.Duration
-	data                      map[string]*CallbackStream
+	data                      map[string][]*CallbackStream
+	slow                      map[string]int
+	duplicates                map[string]int
+	clock                     Clock
+	codec                     codec
+	deadLetter                func(DeadLetter)
+	events                    eventChan
+
+	// called with calls of methods without streams, nil if ignored
+	unhandled func(UnhandledMessage)
+
+	// called with calls of methods without streams before they are reported
+	// as unhandled, returns whether the call was delivered
+	fallback func(ClientMsg) bool
+
+	// patterns of streams keyed like data, nil unless streams are
+	// registered by pattern
+	patterns map[string]MethodPattern
+
+	// allow multiple streams per method
+	fanOut bool
+
+	// match calls to streams case-insensitively, see MethodNames
+	foldCase bool
+
+	// measures lag of calls carrying timestamps, nil unless
+	// MessageTimestamp is set
+	lag *lagRecorder
 }
 
 func newCallbacks(maxMessageProcessDuration time.Duration) *callbacks {
 	return &callbacks{
-		data:                      make(map[string]*CallbackStream),
+		data:                      make(map[string][]*CallbackStream),
+		slow:                      make(map[string]int),
+		duplicates:                make(map[string]int),
+		clock:                     systemClock{},
 		maxMessageProcessDuration: maxMessageProcessDuration,
 	}
 }
 
-func (c *callbacks) create(ctx context.Context, method string) (*CallbackStream, error) {
+// create registers stream receiving calls of method, or of methods matching
+// pattern if it is not nil, in which case method is the string of pattern.
+func (c *callbacks) create(ctx context.Context, method string, pattern MethodPattern, cfg callbackConfig) (*CallbackStream, error) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	if cb, ok := c.data[method]; ok {
+	if pattern == nil {
+		method = methodKey(method, c.foldCase)
+	}
+
+	// closed streams are removed once the next call is processed
+	var streams []*CallbackStream
+	for _, cb := range c.data[method] {
 		select {
 		case <-cb.ctx.Done():
 		default:
-			return nil, &DuplicateCallbackError{method: method}
+			streams = append(streams, cb)
 		}
 	}
 
+	if len(streams) > 0 && !c.fanOut {
+		return nil, &DuplicateCallbackError{method: method}
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 
 	res := &CallbackStream{
-		ctx:    ctx,
-		cancel: cancel,
-		ch:     make(chan callbackResult, 16),
+		ctx:     ctx,
+		cancel:  cancel,
+		config:  cfg,
+		codec:   c.codec,
+		ch:      make(chan callbackResult, callbackBufferSize),
+		removed: make(chan struct{}),
+		lag:     c.lag,
+		key:     method,
+	}
+
+	if cfg.Dedupe != nil {
+		res.dedupe = newDedupeWindow(cfg.Dedupe, cfg.DedupeWindow)
 	}
 
-	c.data[method] = res
+	res.abandon = c.abandon
+
+	c.data[method] = append(c.data[method], res)
+
+	if pattern != nil {
+		if c.patterns == nil {
+			c.patterns = make(map[string]MethodPattern)
+		}
+
+		c.patterns[method] = pattern
+	}
+
+	// remove the stream as soon as it is closed, rather than once the next
+	// call of the method arrives
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mtx.Lock()
+			defer c.mtx.Unlock()
+
+			c.stop(method, res, ctx.Err())
+		case <-res.removed:
+		}
+	}()
 
 	return res, nil
 }
 
 func (c *callbacks) process(msg *Message) {
-	if len(msg.Messages) == 0 {
+	c.processBatch(msg.Messages, nil, nil)
+}
+
+// processBatch delivers calls to their streams. Calls numbered by seqs are
+// marked as done in reorder, which passes on calls without streams in order.
+func (c *callbacks) processBatch(msgs []ClientMsg, seqs []uint64, reorder *reorderBuffer) {
+	if len(msgs) == 0 {
 		return
 	}
 
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	for _, clientMsg := range msg.Messages {
-		method := clientMsg.Method
-		callback, ok := c.data[method]
-		if !ok {
+	for i, clientMsg := range msgs {
+		method := methodKey(clientMsg.Method, c.foldCase)
+
+		callbacks := c.data[method]
+
+		if seqs != nil && len(callbacks) == 0 {
+			reorder.done(seqs[i], &msgs[i])
 			continue
 		}
 
-		// if in given time it is not managing to write message we will cancel the context
-		wrCtx, wrCtxCancel := context.WithTimeout(callback.ctx, c.maxMessageProcessDuration)
+		if len(callbacks) == 0 {
+			delivered := c.fallback != nil && c.fallback(clientMsg)
+			if !delivered && c.unhandled != nil {
+				c.unhandled(UnhandledMessage{Call: clientMsg})
+			}
+
+			continue
+		}
+
+		received := c.lag.received(method, clientMsg)
+
+		// stop replaces the slice, so that it can be iterated over
+		for _, callback := range callbacks {
+			c.deliver(method, callback, clientMsg, received)
+		}
+
+		// calls read after this one are held back until it is delivered
+		if seqs != nil {
+			reorder.done(seqs[i], nil)
+		}
+	}
+}
+
+// match delivers call to streams of every pattern matching its method and
+// reports whether there were any.
+func (c *callbacks) match(clientMsg ClientMsg) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var keys []string
+	for key, pattern := range c.patterns {
+		if pattern.MatchMethod(clientMsg.Method) {
+			keys = append(keys, key)
+		}
+	}
+
+	// deliver in a stable order
+	sort.Strings(keys)
 
+	for _, key := range keys {
+		received := c.lag.received(key, clientMsg)
+
+		for _, callback := range c.data[key] {
+			c.deliver(key, callback, clientMsg, received)
+		}
+	}
+
+	return len(keys) > 0
+}
+
+// deliver passes message to callback stream registered under method, which is
+// the string of pattern for streams registered by pattern, stopping the stream
+// if it is closed or does not read the message in time. Received is the time
+// the call was received, zero unless its lag is measured.
+func (c *callbacks) deliver(method string, callback *CallbackStream, clientMsg ClientMsg, received time.Time) {
+	if callback.dedupe.seen(clientMsg) {
+		c.duplicates[method]++
+		return
+	}
+
+	res := callbackResult{message: clientMsg, received: received}
+	if args, err := transformArgs(clientMsg.Args, callback.config.Transforms); err != nil {
+		res.err = &TransformError{method: clientMsg.Method, cause: err}
+	} else {
+		res.message.Args = args
+	}
+
+	if validate := callback.config.Validate; validate != nil && res.err == nil {
+		if err := validate(res.message.Args); err != nil {
+			res.err = &ValidationError{method: clientMsg.Method, cause: err}
+		}
+	}
+
+	// if in given time it is not managing to write message we will cancel
+	// the stream, zero duration blocks until the message is consumed
+	var (
+		timer   Timer
+		timeout <-chan time.Time
+	)
+	if d := callback.config.ProcessDuration; d > 0 {
+		timer = c.clock.NewTimer(d)
+		timeout = timer.C()
+	}
+
+	var reason error
+
+	// closed stream must not receive messages even if its buffer has room
+	select {
+	case <-callback.ctx.Done():
+		reason = callback.ctx.Err()
+	default:
 		select {
 		case <-callback.ctx.Done():
-			close(callback.ch)
-			delete(c.data, method)
-		case callback.ch <- callbackResult{message: clientMsg}:
-		case <-wrCtx.Done():
+			reason = callback.ctx.Err()
+		case callback.ch <- res:
+		case <-timeout:
+			c.slow[method]++
+			c.events.emit(SlowConsumer{Method: method, Timeout: callback.config.ProcessDuration})
+			callback.err = &SlowConsumerError{Method: method, Timeout: callback.config.ProcessDuration}
 			callback.cancel()
-			close(callback.ch)
-			delete(c.data, method)
+			reason = callback.err
+		}
+	}
+
+	if reason != nil {
+		c.stop(method, callback, reason)
+		c.abandon(clientMsg, reason)
+	}
+
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// abandon drops message which was not delivered to callback stream. It does
+// not need the lock, as streams abandon messages they redeliver while
+// dispatching may wait for them with the lock held.
+func (c *callbacks) abandon(clientMsg ClientMsg, reason error) {
+	atomic.AddInt64(&c.dropped, 1)
+	c.events.emit(MessageDropped{Method: clientMsg.Method, Reason: reason})
+
+	if c.deadLetter != nil {
+		c.deadLetter(DeadLetter{Message: clientMsg, Reason: reason})
+	}
+}
+
+// stop removes stopped callback stream, unless it was already removed, and
+// passes messages waiting in its buffer to dead letter handler.
+func (c *callbacks) stop(method string, callback *CallbackStream, reason error) {
+	select {
+	case <-callback.removed:
+		return
+	default:
+	}
+
+	queued := len(callback.ch)
+	atomic.AddInt64(&c.dropped, int64(queued))
+
+	for i := 0; i < queued; i++ {
+		c.events.emit(MessageDropped{Method: method, Reason: reason})
+	}
+
+	close(callback.ch)
+	close(callback.removed)
+
+	var streams []*CallbackStream
+	for _, cb := range c.data[method] {
+		if cb != callback {
+			streams = append(streams, cb)
+		}
+	}
+
+	if len(streams) == 0 {
+		delete(c.data, method)
+		delete(c.patterns, method)
+	} else {
+		c.data[method] = streams
+	}
+
+	if c.deadLetter == nil {
+		return
+	}
+
+	for res := range callback.ch {
+		if res.err == nil {
+			c.deadLetter(DeadLetter{Message: res.message, Reason: reason})
+		}
+	}
+}
+
+// closeAll closes all callback streams, which report context.Canceled.
+func (c *callbacks) closeAll() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for method, streams := range c.data {
+		for _, callback := range streams {
+			callback.cancel()
+			c.stop(method, callback, context.Canceled)
+		}
+	}
+}
+
+func (c *callbacks) stats() []CallbackStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	stats := make(map[string]*CallbackStats)
+	for method, streams := range c.data {
+		s := &CallbackStats{Method: method, Subscribers: len(streams)}
+		for _, callback := range streams {
+			s.Queued += len(callback.ch)
+			s.Capacity += cap(callback.ch)
+		}
+
+		stats[method] = s
+	}
+
+	for method, n := range c.slow {
+		s, ok := stats[method]
+		if !ok {
+			s = &CallbackStats{Method: method}
+			stats[method] = s
+		}
+
+		s.SlowConsumers = n
+	}
+
+	for method, n := range c.duplicates {
+		s, ok := stats[method]
+		if !ok {
+			s = &CallbackStats{Method: method}
+			stats[method] = s
+		}
+
+		s.Duplicates = n
+	}
+
+	for method, lag := range c.lag.stats() {
+		s, ok := stats[method]
+		if !ok {
+			s = &CallbackStats{Method: method}
+			stats[method] = s
 		}
 
-		wrCtxCancel()
+		s.NetworkLag = lag.network
+		s.ConsumerLag = lag.consumer
+	}
+
+	res := make([]CallbackStats, 0, len(stats))
+	for _, s := range stats {
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Method < res[j].Method })
+
+	return res
+}
+
+// counts returns the number of open callback streams and messages dropped so
+// far.
+func (c *callbacks) counts() (registered int, dropped int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, streams := range c.data {
+		registered += len(streams)
 	}
+
+	return registered, atomic.LoadInt64(&c.dropped)
+}
+
+// backlog returns the largest number of messages waiting to be read from a
+// single callback stream.
+func (c *callbacks) backlog() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var res int
+	for _, streams := range c.data {
+		for _, callback := range streams {
+			if n := len(callback.ch); n > res {
+				res = n
+			}
+		}
+	}
+
+	return res
 }
 
 func (c *callbacks) removeAll() {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	for _, callback := range c.data {
-		select {
-		case <-callback.ctx.Done():
-		case callback.ch <- callbackResult{err: context.Canceled}:
+	for _, streams := range c.data {
+		for _, callback := range streams {
+			select {
+			case <-callback.ctx.Done():
+			case callback.ch <- callbackResult{err: context.Canceled}:
+			}
+
+			close(callback.ch)
+			close(callback.removed)
 		}
+	}
 
-		close(callback.ch)
+	c.data = make(map[string][]*CallbackStream)
+}
+
+// DeadLetter is a message which could not be delivered to callback stream.
+type DeadLetter struct {
+	Message ClientMsg
+
+	// the reason the stream was stopped, e.g. SlowConsumerError
+	Reason error
+}
+
+// UnhandledMessage is a message which matches neither pending invocation nor
+// callback stream, see OnUnhandledMessage.
+type UnhandledMessage struct {
+	// call of hub method, with arguments as received, zero for completions
+	Call ClientMsg
+
+	// completion of invocation, nil for calls
+	Completion *Message
+}
+
+// completionOf returns copy of message holding only its completion.
+func completionOf(msg *Message) *Message {
+	return &Message{
+		InvocationID: msg.InvocationID,
+		Error:        msg.Error,
+		ErrorDetail:  msg.ErrorDetail,
+		HubError:     msg.HubError,
+		StackTrace:   msg.StackTrace,
+		Result:       msg.Result,
 	}
+}
+
+// CallbackStats describes callback streams of a hub method.
+type CallbackStats struct {
+	Method string
+
+	// the number of open streams, more than one only with FanOut
+	Subscribers int
+
+	// the number of messages waiting to be read and the buffer size, summed
+	// over the streams
+	Queued   int
+	Capacity int
 
-	c.data = make(map[string]*CallbackStream)
+	// the number of times the stream was stopped because it was not read
+	// within MaxMessageProcessDuration
+	SlowConsumers int
+
+	// the number of calls skipped as duplicates, see Dedupe
+	Duplicates int
+
+	// lag of calls carrying timestamps, see MessageTimestamp: from the
+	// timestamp until the call was received, and from then until it was
+	// read from the stream
+	NetworkLag  LagStats
+	ConsumerLag LagStats
 }
 
+// PendingInvocation describes an invocation waiting for a response.
+type PendingInvocation struct {
+	ID     uint64
+	Method string
+
+	// the time elapsed since the invocation was sent
+	Age time.Duration
+}
+
+// callbackBufferSize is the number of messages buffered for callback stream.
+const callbackBufferSize = 16
+
 type invocationResult struct {
 	result json.RawMessage
 	err    error
@@ -368,4 +1583,7 @@ type invocationResult struct {
 type callbackResult struct {
 	message ClientMsg
 	err     error
+
+	// the time the call was received, zero unless its lag is measured
+	received time.Time
 }
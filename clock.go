@@ -0,0 +1,53 @@
+package signalr
+
+import "time"
+
+// Clock is a source of time used to track keepalives and message process
+// durations. It can be replaced to make tests and simulations deterministic.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single event timer created by Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// systemClock is a Clock backed by the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{timer: time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// sequentialIDs returns invocation ID generator producing 1, 2, 3 and so on,
+// skipping zero if it ever wraps around.
+func sequentialIDs() func() uint64 {
+	var id uint64
+	return func() uint64 {
+		id++
+		if id == 0 {
+			id++
+		}
+
+		return id
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/r0bot/signalr/v2"
+)
+
+type InvokeCommand struct {
+	method  string
+	args    []json.RawMessage
+	listen  bool
+	methods map[string]bool
+}
+
+func (c *InvokeCommand) Parse(args []string) {
+	var callbacks string
+
+	fs := flag.NewFlagSet("invoke", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: signalr-cli invoke [-listen] [-callbacks METHOD,...] METHOD [ARG...]")
+		fmt.Fprintln(fs.Output(), "each ARG must be a valid JSON value, e.g. '\"USD-BTC\"' or '[1,2]'")
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&c.listen, "listen", false, "keep printing callback messages after invocation completes")
+	fs.StringVar(&callbacks, "callbacks", "", "comma separated list of callback methods to print (default all)")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	c.method = fs.Arg(0)
+	for _, arg := range fs.Args()[1:] {
+		if !json.Valid([]byte(arg)) {
+			fmt.Fprintf(os.Stderr, "invalid JSON argument %q\n", arg)
+			os.Exit(1)
+		}
+
+		c.args = append(c.args, json.RawMessage(arg))
+	}
+
+	c.methods = make(map[string]bool)
+	for _, method := range strings.Split(callbacks, ",") {
+		if method != "" {
+			c.methods[method] = true
+		}
+	}
+}
+
+func (c *InvokeCommand) Run(ctx context.Context, conn *signalr.Conn, config *Config) error {
+	const invocationID = 1
+
+	args := c.args
+	if args == nil {
+		args = []json.RawMessage{}
+	}
+
+	req := signalr.ClientMsg{
+		InvocationID: invocationID,
+		Hub:          config.Hub,
+		Method:       c.method,
+		Args:         args,
+	}
+
+	if err := conn.WriteMessage(ctx, req); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	done := false
+
+	for !done || c.listen {
+		var msg signalr.Message
+		if err := conn.ReadMessage(ctx, &msg); err != nil {
+			return err
+		}
+
+		if err := printCallbacks(enc, &msg, c.methods); err != nil {
+			return err
+		}
+
+		if done || msg.InvocationID != invocationID {
+			continue
+		}
+
+		done = true
+
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+
+		result := msg.Result
+		if result == nil {
+			result = json.RawMessage("null")
+		}
+
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
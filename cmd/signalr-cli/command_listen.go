@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/r0bot/signalr/v2"
+)
+
+type ListenCommand struct {
+	methods map[string]bool
+}
+
+func (c *ListenCommand) Parse(args []string) {
+	c.methods = make(map[string]bool, len(args))
+	for _, method := range args {
+		c.methods[method] = true
+	}
+}
+
+func (c *ListenCommand) Run(ctx context.Context, conn *signalr.Conn, config *Config) error {
+	enc := json.NewEncoder(os.Stdout)
+
+	for {
+		var msg signalr.Message
+		if err := conn.ReadMessage(ctx, &msg); err != nil {
+			return err
+		}
+
+		if err := printCallbacks(enc, &msg, c.methods); err != nil {
+			return err
+		}
+	}
+}
+
+// printCallbacks writes hub method calls contained in msg as JSON lines. When
+// methods is empty, all calls are printed.
+func printCallbacks(enc *json.Encoder, msg *signalr.Message, methods map[string]bool) error {
+	for _, clientMsg := range msg.Messages {
+		if len(methods) != 0 && !methods[clientMsg.Method] {
+			continue
+		}
+
+		if err := enc.Encode(clientMsg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
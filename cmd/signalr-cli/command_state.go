@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/r0bot/signalr/v2"
+)
+
+type StateCommand struct{}
+
+func (c *StateCommand) Parse(args []string) {}
+
+func (c *StateCommand) Run(ctx context.Context, conn *signalr.Conn, config *Config) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(conn.State())
+}
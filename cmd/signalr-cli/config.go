@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/r0bot/signalr/v2"
+)
+
+type Config struct {
+	Endpoint string
+	Hub      string
+	Protocol string
+	Headers  http.Header
+	Timeout  time.Duration
+	Command  Command
+}
+
+type Command interface {
+	Parse(args []string)
+	Run(ctx context.Context, conn *signalr.Conn, config *Config) error
+}
+
+func parseArgs(args []string) *Config {
+	config := Config{Headers: make(http.Header)}
+
+	fs := flag.NewFlagSet("signalr-cli", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: signalr-cli -endpoint URL -hub HUB COMMAND [ARGS]")
+		fmt.Fprintln(fs.Output(), "commands:")
+		fmt.Fprintln(fs.Output(), " - state\tNegotiate, connect and print connection state")
+		fmt.Fprintln(fs.Output(), " - listen METHOD...\tPrint callback messages for given hub methods")
+		fmt.Fprintln(fs.Output(), " - invoke METHOD [ARG...]\tInvoke hub method with JSON encoded arguments")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&config.Endpoint, "endpoint", "", "SignalR endpoint, e.g. https://socket.bittrex.com/signalr")
+	fs.StringVar(&config.Hub, "hub", "", "hub name")
+	fs.StringVar(&config.Protocol, "protocol", "1.5", "client protocol version")
+	fs.DurationVar(&config.Timeout, "timeout", 10*time.Second, "connection timeout")
+	fs.Var(headerFlag(config.Headers), "header", "additional HTTP header in \"Name: value\" form (repeatable)")
+	_ = fs.Parse(args)
+
+	if config.Endpoint == "" || config.Hub == "" {
+		fmt.Fprintln(os.Stderr, "-endpoint and -hub are required")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	switch fs.Arg(0) {
+	case "state":
+		config.Command = &StateCommand{}
+	case "listen":
+		config.Command = &ListenCommand{}
+	case "invoke":
+		config.Command = &InvokeCommand{}
+	default:
+		fmt.Fprintf(os.Stderr, "invalid command %q\n", fs.Arg(0))
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	config.Command.Parse(fs.Args()[1:])
+
+	return &config
+}
+
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var b strings.Builder
+	for name, values := range h {
+		for _, value := range values {
+			fmt.Fprintf(&b, "%s: %s\n", name, value)
+		}
+	}
+
+	return b.String()
+}
+
+func (h headerFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid header %q", value)
+	}
+
+	http.Header(h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+
+	return nil
+}
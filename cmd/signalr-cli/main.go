@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/r0bot/signalr/v2"
+)
+
+func main() {
+	config := parseArgs(os.Args[1:])
+
+	err := run(config)
+	switch {
+	case errors.Is(err, context.Canceled):
+		os.Exit(130)
+	case err != nil:
+		log.Fatal(err)
+	}
+}
+
+func run(config *Config) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// handle Ctrl-C gracefully
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	dctx, dcancel := context.WithTimeout(ctx, config.Timeout)
+	defer dcancel()
+
+	conn, err := signalr.Dial(
+		dctx,
+		config.Endpoint,
+		signalr.Hubs(config.Hub),
+		signalr.Protocol(config.Protocol),
+		signalr.Headers(config.Headers),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", config.Endpoint, err)
+	}
+
+	defer conn.Close()
+
+	return config.Command.Run(ctx, conn, config)
+}
@@ -0,0 +1,93 @@
+package signalr
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// maxBatchSize limits the size of a frame coalescing messages, well below the
+// default maximum message size of ASP.NET Core servers. Larger messages are
+// sent in frames of their own.
+const maxBatchSize = 16 * 1024
+
+// writeBatch holds messages coalesced into a single frame, see CoalesceWrites.
+type writeBatch struct {
+	buf bytes.Buffer
+
+	// batch sent before this one, nil if it was already sent
+	prev *writeBatch
+
+	// closed once the batch is sent, with epoch of the connection it was
+	// sent to or the error
+	done  chan struct{}
+	epoch uint64
+	err   error
+}
+
+// batcher collects messages written within coalescing window of the first
+// one, see CoalesceWrites.
+type batcher struct {
+	mtx     sync.Mutex
+	pending *writeBatch
+	last    *writeBatch
+}
+
+// coalesce adds data to the pending batch, starting a new one sent once the
+// coalescing window elapses if there is none or data does not fit, and waits
+// for the batch to be sent. Batches are sent in the order they were started,
+// independently of ctx, which only bounds the wait. Data is appended as is, so
+// it has to end with the delimiter of messages of the protocol.
+func (c *Conn) coalesce(ctx context.Context, data []byte) (uint64, error) {
+	b := &c.batcher
+
+	b.mtx.Lock()
+
+	batch := b.pending
+	if batch == nil || batch.buf.Len()+len(data) > maxBatchSize {
+		batch = &writeBatch{prev: b.last, done: make(chan struct{})}
+		b.pending = batch
+		b.last = batch
+
+		go c.flush(batch)
+	}
+
+	batch.buf.Write(data)
+
+	b.mtx.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-batch.done:
+		return batch.epoch, batch.err
+	}
+}
+
+// flush sends batch once the coalescing window elapses and the previous batch
+// is sent.
+func (c *Conn) flush(batch *writeBatch) {
+	timer := c.config.Clock.NewTimer(c.config.CoalesceWindow)
+	<-timer.C()
+
+	if batch.prev != nil {
+		<-batch.prev.done
+	}
+
+	b := &c.batcher
+
+	b.mtx.Lock()
+	if b.pending == batch {
+		b.pending = nil
+	}
+	if b.last == batch {
+		b.last = nil
+	}
+	batch.prev = nil
+	b.mtx.Unlock()
+
+	// writes are bounded by WriteTimeout rather than by contexts of the
+	// writers waiting for the batch
+	batch.epoch, batch.err = c.send(context.Background(), batch.buf.Bytes())
+	close(batch.done)
+}
@@ -0,0 +1,219 @@
+package signalr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// codec encodes arguments sent to the hub, and decodes arguments and results
+// received from it.
+type codec struct {
+	// decode numbers into json.Number instead of float64
+	useNumber bool
+
+	// codecs of types registered by TypeCodec
+	types map[reflect.Type]typeCodec
+}
+
+// typeCodec encodes values of a registered type and decodes them into
+// pointers to the type.
+type typeCodec struct {
+	encode func(v interface{}) ([]byte, error)
+	decode func(data []byte, v interface{}) error
+}
+
+// marshal encodes v like json.Marshal.
+func (c codec) marshal(v interface{}) ([]byte, error) {
+	if tc, ok := c.types[reflect.TypeOf(v)]; ok {
+		return tc.encode(v)
+	}
+
+	return json.Marshal(v)
+}
+
+// marshalArgs encodes arguments of an invocation. Arguments which are already
+// encoded as json.RawMessage are used as is, and validated once the message is
+// encoded.
+func (c codec) marshalArgs(src []interface{}) ([]json.RawMessage, error) {
+	res := make([]json.RawMessage, len(src))
+	for i, v := range src {
+		if raw, ok := v.(json.RawMessage); ok {
+			res[i] = raw
+			continue
+		}
+
+		data, err := c.marshal(v)
+		if err != nil {
+			return nil, err
+		}
+
+		res[i] = json.RawMessage(data)
+	}
+
+	return res, nil
+}
+
+// marshalNamedArgs encodes arguments of an invocation bound by parameter name,
+// like marshalArgs.
+func (c codec) marshalNamedArgs(src map[string]interface{}) (map[string]json.RawMessage, error) {
+	res := make(map[string]json.RawMessage, len(src))
+	for name, v := range src {
+		if raw, ok := v.(json.RawMessage); ok {
+			res[name] = raw
+			continue
+		}
+
+		data, err := c.marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("argument %q: %w", name, err)
+		}
+
+		res[name] = json.RawMessage(data)
+	}
+
+	return res, nil
+}
+
+// unmarshal decodes data into v like json.Unmarshal, decoding byte slices
+// leniently, see decodeBytes.
+func (c codec) unmarshal(data []byte, v interface{}) error {
+	if t := reflect.TypeOf(v); t != nil && t.Kind() == reflect.Ptr {
+		if tc, ok := c.types[t.Elem()]; ok {
+			return tc.decode(data, v)
+		}
+	}
+
+	if p, ok := v.(*[]byte); ok {
+		b, err := decodeBytes(data)
+		if err != nil {
+			return err
+		}
+
+		*p = b
+
+		return nil
+	}
+
+	if !c.useNumber || len(bytes.TrimSpace(data)) == 0 {
+		return json.Unmarshal(data, v)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level value")
+	}
+
+	return nil
+}
+
+// unmarshalArgs decodes arguments of a call into dest.
+func (c codec) unmarshalArgs(src []json.RawMessage, dest []interface{}) error {
+	if len(src) != len(dest) {
+		return fmt.Errorf("invalid number of arguments: expected %d, got %d", len(src), len(dest))
+	}
+
+	for i, v := range src {
+		if err := c.unmarshal(v, dest[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeBytes decodes binary value the way .NET serializers send byte arrays:
+// as base64 string, which encoding/json decodes with padding and the standard
+// alphabet only, also accepting it unpadded or URL-safe, or as an array of
+// numbers, as lists of bytes are sent. Byte slices are encoded as standard
+// base64 strings, which .NET decodes into byte arrays.
+func decodeBytes(data []byte) ([]byte, error) {
+	// encoding/json decodes null and arrays of numbers
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		var b []byte
+		if err := json.Unmarshal(data, &b); err != nil {
+			return nil, err
+		}
+
+		return b, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+
+	encoding := base64.StdEncoding
+	if strings.ContainsAny(s, "-_") {
+		encoding = base64.URLEncoding
+	}
+
+	if !strings.HasSuffix(s, "=") && len(s)%4 != 0 {
+		encoding = encoding.WithPadding(base64.NoPadding)
+	}
+
+	b, err := encoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64: %w", err)
+	}
+
+	return b, nil
+}
+
+// encodeDotNetDate encodes t as "\/Date(ms)\/" string, escaping slashes as
+// ASP.NET serializers do.
+func encodeDotNetDate(t time.Time) ([]byte, error) {
+	return []byte(`"\/Date(` + strconv.FormatInt(t.UnixMilli(), 10) + `)\/"`), nil
+}
+
+// decodeDotNetDate decodes "/Date(ms)/" string with optional time zone offset,
+// or RFC 3339 string.
+func decodeDotNetDate(data []byte) (time.Time, error) {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return time.Time{}, err
+	}
+
+	if !strings.HasPrefix(s, "/Date(") || !strings.HasSuffix(s, ")/") {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+
+	value := s[len("/Date(") : len(s)-len(")/")]
+
+	// time zone offset follows milliseconds, which may be negative
+	loc := time.UTC
+	if i := strings.LastIndexAny(value, "+-"); i > 0 {
+		offset, err := strconv.Atoi(value[i+1:])
+		if err != nil || len(value[i+1:]) != 4 {
+			return time.Time{}, fmt.Errorf("invalid date %q", s)
+		}
+
+		seconds := (offset/100*60 + offset%100) * 60
+		if value[i] == '-' {
+			seconds = -seconds
+		}
+
+		loc = time.FixedZone("", seconds)
+		value = value[:i]
+	}
+
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", s)
+	}
+
+	return time.UnixMilli(ms).In(loc), nil
+}
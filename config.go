@@ -1,145 +1,1169 @@
 package signalr
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strings"
 	"time"
-
-	"github.com/cenkalti/backoff/v4"
 )
 
-type DialOpt func(*config)
+type DialOpt func(*Config)
 
 func HTTPClient(client *http.Client) DialOpt {
-	return func(c *config) {
+	return func(c *Config) {
 		c.Client = client
 	}
 }
 
+// Transport sets HTTP transport used for negotiate, start and abort requests.
+// Transport is shared, not copied, so its connection pool is reused across
+// dials and reconnects; it may use HTTP/2. Default websocket dialer reuses
+// its proxy and TLS configuration, including ClientSessionCache, so setting
+// the cache allows TLS session resumption for websocket handshakes.
+func Transport(transport *http.Transport) DialOpt {
+	return func(c *Config) {
+		c.Transport = transport
+	}
+}
+
 func Dialer(dialer WebsocketDialerFunc) DialOpt {
-	return func(c *config) {
+	return func(c *Config) {
 		c.Dialer = dialer
 	}
 }
 
+// Protocol sets client protocol version requested from the server, one of
+// 1.2, 1.3, 1.4, 1.5, 2.0 or 2.1.
 func Protocol(protocol string) DialOpt {
-	return func(c *config) {
+	return func(c *Config) {
 		c.Protocol = protocol
 	}
 }
 
+// NetDialContext sets a function used to open network connections for both
+// HTTP requests and websocket connection. It allows pinning source addresses,
+// using custom resolvers or dialing through tunnels. HTTP client has to use
+// *http.Transport (or the default transport) for the option to take effect.
+func NetDialContext(fn func(ctx context.Context, network, addr string) (net.Conn, error)) DialOpt {
+	return func(c *Config) {
+		c.NetDialContext = fn
+	}
+}
+
+// Proxy sets a function returning proxy URL for both HTTP requests and
+// websocket connection, e.g. http.ProxyURL. User info of the URL is used to
+// authenticate: basic credentials with HTTP proxies, which are also used for
+// CONNECT, and username and password with SOCKS5 proxies. HTTP client has to
+// use *http.Transport (or the default transport) for the option to take
+// effect.
+func Proxy(proxy ProxyFunc) DialOpt {
+	return func(c *Config) {
+		c.Proxy = proxy
+	}
+}
+
+// ProxyCredentials sets username and password used to authenticate with the
+// proxy set by Proxy option or configured in the transport, which by default
+// is taken from environment. It overrides user info of proxy URLs.
+func ProxyCredentials(username, password string) DialOpt {
+	return func(c *Config) {
+		c.ProxyUser = url.UserPassword(username, password)
+	}
+}
+
+// RotateAddresses makes HTTP requests and websocket connection resolve host of
+// the endpoint on every dial and try its addresses in turns, starting from the
+// address following the one tried first by the previous dial. It spreads
+// connections over servers behind DNS round robin and lets reconnect skip dead
+// addresses. HTTP client has to use *http.Transport (or the default transport)
+// for the option to take effect.
+func RotateAddresses() DialOpt {
+	return func(c *Config) {
+		c.RotateAddresses = true
+	}
+}
+
+// CacheNegotiate makes the client keep the negotiate response of every endpoint
+// for the disconnect timeout the server advertised in it, and reuse its
+// connection token when the connection is renegotiated, e.g. by Renegotiate,
+// RunWithReconnect or failover, within that time. It skips the negotiate
+// request, which halves the time to reestablish connections behind slow
+// HTTPS handshakes. The response is negotiated again if the server rejects
+// the cached token, and once authorization expires, see TokenExpired.
+// Responses of ASP.NET Core servers, whose tokens are valid for a single
+// connection, are not cached.
+func CacheNegotiate() DialOpt {
+	return func(c *Config) {
+		c.CacheNegotiate = true
+	}
+}
+
+// IPFamily restricts HTTP requests and websocket connection to IPv4 or IPv6
+// addresses of the endpoint host, or makes them try one family before the
+// other, which avoids long connect hangs with broken dual-stack routing. HTTP
+// client has to use *http.Transport (or the default transport) for the option
+// to take effect.
+func IPFamily(mode IPFamilyMode) DialOpt {
+	return func(c *Config) {
+		c.IPFamily = mode
+	}
+}
+
+// TLSKeyLog makes TLS connections of both HTTP requests and websocket
+// connection write their secrets to w in NSS key log format, so that captured
+// traffic can be decrypted, e.g. by Wireshark. It is meant for debugging only,
+// as it compromises security of the connections. HTTP client has to use
+// *http.Transport (or the default transport) for the option to take effect.
+func TLSKeyLog(w io.Writer) DialOpt {
+	return func(c *Config) {
+		c.TLSKeyLogWriter = w
+	}
+}
+
+// Authentication sets authenticator answering challenges of the server, e.g.
+// NTLM or Negotiate of Windows integrated authentication, see Authenticator.
+func Authentication(auth Authenticator) DialOpt {
+	return func(c *Config) {
+		c.Authenticator = auth
+	}
+}
+
+// TokenExpired sets a function reporting whether error of reading or
+// reconnecting means that authorization expired. The connection is then
+// renegotiated, evaluating ParamsFunc again for fresh tokens, instead of
+// failing. By default handshakes rejected with 401 Unauthorized or 403
+// Forbidden and connections closed with policy violation (1008) are treated as
+// expired, nil disables renegotiation.
+func TokenExpired(fn func(err error) bool) DialOpt {
+	return func(c *Config) {
+		c.TokenExpired = fn
+	}
+}
+
+// tokenExpired is the default TokenExpired function.
+func tokenExpired(err error) bool {
+	if IsCloseError(err, ClosePolicyViolation) {
+		return true
+	}
+
+	code, _ := responseStatus(err)
+
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+// UnixSocket makes HTTP requests and websocket connection go through unix
+// domain socket at given path. Endpoint URL is still used for the Host header
+// and request paths.
+func UnixSocket(path string) DialOpt {
+	return NetDialContext(func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	})
+}
+
+// Endpoints sets alternative endpoints used when the primary one passed to
+// Dial is unavailable, both on dial and when reconnect fails.
+func Endpoints(endpoints ...string) DialOpt {
+	return func(c *Config) {
+		c.Endpoints = endpoints
+	}
+}
+
+// Failover sets the order in which endpoints are tried, FailoverPriority by
+// default.
+func Failover(strategy FailoverStrategy) DialOpt {
+	return func(c *Config) {
+		c.Failover = strategy
+	}
+}
+
 func Params(params url.Values) DialOpt {
-	return func(c *config) {
+	return func(c *Config) {
 		c.Params = params
 	}
 }
 
+// ParamsFunc sets a function returning additional query parameters. It is
+// evaluated on dial and before every reconnect, so it can provide dynamic
+// values such as short-lived auth tokens. Returned values override Params.
+func ParamsFunc(fn func(ctx context.Context) (url.Values, error)) DialOpt {
+	return func(c *Config) {
+		c.ParamsFunc = fn
+	}
+}
+
 func Headers(headers http.Header) DialOpt {
-	return func(c *config) {
+	return func(c *Config) {
 		c.Headers = headers
 	}
 }
 
+// Retry sets retry policy for all connection steps.
+func Retry(policy RetryPolicy) DialOpt {
+	return func(c *Config) {
+		c.NegotiateRetry = policy
+		c.ConnectRetry = policy
+		c.ReconnectRetry = policy
+		c.StartRetry = policy
+	}
+}
+
+// NegotiateRetry sets retry policy for the negotiate step.
+func NegotiateRetry(policy RetryPolicy) DialOpt {
+	return func(c *Config) {
+		c.NegotiateRetry = policy
+	}
+}
+
+// ConnectRetry sets retry policy for the connect step.
+func ConnectRetry(policy RetryPolicy) DialOpt {
+	return func(c *Config) {
+		c.ConnectRetry = policy
+	}
+}
+
+// ReconnectRetry sets retry policy for the reconnect step.
+func ReconnectRetry(policy RetryPolicy) DialOpt {
+	return func(c *Config) {
+		c.ReconnectRetry = policy
+	}
+}
+
+// StartRetry sets retry policy for the start step. Transient failures, such
+// as failed requests and error statuses, are retried; responses the server
+// answered the start request with, but which are not valid, are not.
+func StartRetry(policy RetryPolicy) DialOpt {
+	return func(c *Config) {
+		c.StartRetry = policy
+	}
+}
+
 // The maximum number of times to re-attempt a negotiation.
 func MaxNegotiateRetries(retries int) DialOpt {
-	return func(c *config) {
-		c.MaxNegotiateRetries = retries
+	return func(c *Config) {
+		c.NegotiateRetry.MaxRetries = retries
 	}
 }
 
 // The maximum number of times to re-attempt a connection.
 func MaxConnectRetries(retries int) DialOpt {
-	return func(c *config) {
-		c.MaxConnectRetries = retries
+	return func(c *Config) {
+		c.ConnectRetry.MaxRetries = retries
 	}
 }
 
 func MaxReconnectRetries(retries int) DialOpt {
-	return func(c *config) {
-		c.MaxReconnectRetries = retries
+	return func(c *Config) {
+		c.ReconnectRetry.MaxRetries = retries
 	}
 }
 
 // The maximum number of times to re-attempt a start command.
 func MaxStartRetries(retries int) DialOpt {
-	return func(c *config) {
-		c.MaxStartRetries = retries
+	return func(c *Config) {
+		c.StartRetry.MaxRetries = retries
 	}
 }
 
 // The time to wait before retrying, in the event that an error occurs
 // when contacting the SignalR service.
 func RetryInterval(interval time.Duration) DialOpt {
-	return func(c *config) {
-		c.RetryInterval = interval
+	return func(c *Config) {
+		c.NegotiateRetry.Interval = interval
+		c.ConnectRetry.Interval = interval
+		c.ReconnectRetry.Interval = interval
+		c.StartRetry.Interval = interval
 	}
 }
 
 // The maximum amount of time to spend retrying a reconnect attempt.
 func MaxReconnectDuration(duration time.Duration) DialOpt {
-	return func(c *config) {
+	return func(c *Config) {
 		c.MaxReconnectDuration = duration
 	}
 }
 
 // MaxMessageProcessDuration the maximum amount of time to spend on processing message
 func MaxMessageProcessDuration(duration time.Duration) DialOpt {
-	return func(c *config) {
+	return func(c *Config) {
 		c.MaxMessageProcessDuration = duration
 	}
 }
 
-type config struct {
-	Client                    *http.Client
-	Dialer                    WebsocketDialerFunc
-	Protocol                  string
-	Params                    url.Values
-	Headers                   http.Header
-	MaxNegotiateRetries       int
-	MaxConnectRetries         int
-	MaxReconnectRetries       int
-	MaxReconnectDuration      time.Duration
-	MaxStartRetries           int
-	RetryInterval             time.Duration
+// MaxMessageSize sets the maximum size of a message received from the server
+// in bytes. Larger messages fail the read with MessageTooLargeError and the
+// connection is closed. Zero means no limit.
+func MaxMessageSize(size int64) DialOpt {
+	return func(c *Config) {
+		c.MaxMessageSize = size
+	}
+}
+
+// Resume makes Dial attempt to reconnect to the connection described by state
+// saved by a previous process (see Conn.State) instead of negotiating a new
+// one, reducing messages missed during restarts. Dial falls back to
+// negotiation if reconnect fails or connection data differs, and always
+// negotiates connections to ASP.NET Core servers. NegotiateInfo of resumed
+// connections holds only DisconnectTimeout saved with state.
+func Resume(state State) DialOpt {
+	return func(c *Config) {
+		c.Resume = &state
+	}
+}
+
+// CloseTimeout sets the maximum amount of time Close waits for websocket close
+// frame to be written.
+func CloseTimeout(timeout time.Duration) DialOpt {
+	return func(c *Config) {
+		c.CloseTimeout = timeout
+	}
+}
+
+// Subprotocols sets websocket subprotocols requested in connect and reconnect
+// handshakes.
+func Subprotocols(protocols ...string) DialOpt {
+	return func(c *Config) {
+		c.Subprotocols = protocols
+	}
+}
+
+// Origin sets Origin header of connect and reconnect handshakes, which some
+// gateways check.
+func Origin(origin string) DialOpt {
+	return func(c *Config) {
+		c.Origin = origin
+	}
+}
+
+// NegotiateURLMode defines how the URL returned by negotiate is used to build
+// URLs of subsequent requests.
+type NegotiateURLMode int
+
+const (
+	// IgnoreNegotiateURL builds all URLs from the endpoint.
+	IgnoreNegotiateURL NegotiateURLMode = iota
+
+	// MergeNegotiateURL appends path returned by negotiate to the endpoint
+	// unless the endpoint already ends with it. It suits servers behind
+	// reverse proxies, which mount SignalR at a path prefix the server is not
+	// aware of, given the endpoint is the prefix.
+	MergeNegotiateURL
+)
+
+// NegotiateURL sets how the URL returned by negotiate is used, it is ignored
+// by default.
+func NegotiateURL(mode NegotiateURLMode) DialOpt {
+	return func(c *Config) {
+		c.NegotiateURL = mode
+	}
+}
+
+// Breaker sets circuit breaker delaying reconnect and renegotiate after too
+// many short-lived connections in a row. It is disabled by default.
+func Breaker(breaker CircuitBreaker) DialOpt {
+	return func(c *Config) {
+		c.Breaker = breaker
+	}
+}
+
+// TimeSource sets the clock used to track keepalives and message process
+// durations. It is meant for deterministic tests and simulations.
+func TimeSource(clock Clock) DialOpt {
+	return func(c *Config) {
+		c.Clock = clock
+	}
+}
+
+// Logging sets logger receiving diagnostic messages.
+func Logging(logger Logger) DialOpt {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+// OnKeepalive sets a function called with the arrival time of each keepalive
+// message, which lets applications implement their own liveness checks and
+// latency measurements. It is called from the reading goroutine, so it should
+// not block.
+func OnKeepalive(fn func(time.Time)) DialOpt {
+	return func(c *Config) {
+		c.OnKeepalive = fn
+	}
+}
+
+// PingInterval sets the interval of pings sent to ASP.NET Core servers while
+// nothing else is written, which keeps quiet connections from being dropped
+// for inactivity. Pings received from the server are answered as well. Zero
+// disables pings. It should be less than half of the client timeout
+// configured on the server, 30 seconds by default.
+func PingInterval(interval time.Duration) DialOpt {
+	return func(c *Config) {
+		c.PingInterval = interval
+	}
+}
+
+// ReadTimeout sets the maximum amount of time to wait for the next frame from
+// the server, independently of context passed to reads. Keepalives count as
+// frames, so the timeout should exceed the keepalive interval of the server.
+// It detects connections silently dropped by NATs and firewalls, which
+// otherwise block reads indefinitely: the connection is reestablished as if
+// it was closed abnormally. Zero, the default, means no limit.
+func ReadTimeout(timeout time.Duration) DialOpt {
+	return func(c *Config) {
+		c.ReadTimeout = timeout
+	}
+}
+
+// HandshakeTimeout sets the maximum amount of time to wait for the websocket
+// handshake of connect and reconnect to complete, and for ASP.NET Core servers
+// to answer the protocol handshake. Every attempt of ConnectRetry and
+// ReconnectRetry is bounded separately, independently of context passed to
+// Dial. Zero means no limit; the default is 45 seconds.
+func HandshakeTimeout(timeout time.Duration) DialOpt {
+	return func(c *Config) {
+		c.HandshakeTimeout = timeout
+	}
+}
+
+// InitTimeout sets the maximum amount of time to wait for the init message
+// the server sends once the connection is started. Servers which never send
+// it would otherwise block Dial until its context is done. Zero means no
+// limit; the default is 30 seconds.
+func InitTimeout(timeout time.Duration) DialOpt {
+	return func(c *Config) {
+		c.InitTimeout = timeout
+	}
+}
+
+// WriteTimeout sets the maximum amount of time to wait for a frame to be
+// written, independently of context passed to writes. Zero, the default,
+// means no limit.
+func WriteTimeout(timeout time.Duration) DialOpt {
+	return func(c *Config) {
+		c.WriteTimeout = timeout
+	}
+}
+
+// CoalesceWrites makes messages written within window of the first one share a
+// single frame where the server protocol allows it, trading latency for fewer
+// frames when many small messages are sent. Classic servers parse a single
+// request per frame, so messages sent to them keep their own frames. Zero, the
+// default, disables coalescing.
+func CoalesceWrites(window time.Duration) DialOpt {
+	return func(c *Config) {
+		c.CoalesceWindow = window
+	}
+}
+
+// StatefulReconnect requests stateful reconnect from ASP.NET Core 8 servers,
+// so that connection dropped briefly is reestablished without losing messages
+// in either direction. Messages the server did not acknowledge yet are kept in
+// a buffer of bufferSize bytes, writes wait for acknowledgements while it is
+// full; non-positive size means 100000 bytes. Servers which do not support it
+// keep replacing dropped connections by new ones.
+func StatefulReconnect(bufferSize int) DialOpt {
+	return func(c *Config) {
+		c.StatefulReconnect = true
+		c.ReplayBufferSize = bufferSize
+	}
+}
+
+// OnMessagesMissed sets a function called when messages were missed while
+// reconnecting, so consumers can refetch snapshots of the affected data.
+func OnMessagesMissed(fn func(MessagesMissed)) DialOpt {
+	return func(c *Config) {
+		c.OnMessagesMissed = fn
+	}
+}
+
+// MessageIDGap sets a function reporting whether there is a gap between two
+// message IDs. By default message IDs are treated as sequential integers.
+func MessageIDGap(fn func(prev, next string) bool) DialOpt {
+	return func(c *Config) {
+		c.MessageIDGap = fn
+	}
+}
+
+type ClientOpt func(*clientConfig)
+
+// MaxBacklog sets the number of messages waiting to be read from a callback
+// stream at which the client is reported unhealthy, see Client.Healthy.
+func MaxBacklog(n int) ClientOpt {
+	return func(c *clientConfig) {
+		c.MaxBacklog = n
+	}
+}
+
+// OnDeadLetter sets a function receiving messages which could not be delivered
+// because callback stream was stopped, either cancelled or not read in time,
+// and messages which were not acknowledged, see RequireAck.
+// It is called while dispatching of calls is blocked, so it should not block.
+func OnDeadLetter(fn func(DeadLetter)) ClientOpt {
+	return func(c *clientConfig) {
+		c.DeadLetter = fn
+	}
+}
+
+// InvocationIDs sets invocation ID generator. It is called under a lock, so it
+// does not need to be safe for concurrent use, but it must not return IDs of
+// pending invocations or zero, which marks untracked invocations sent by
+// Client.Send. By default IDs are sequential starting from 1.
+func InvocationIDs(next func() uint64) ClientOpt {
+	return func(c *clientConfig) {
+		c.InvocationIDs = next
+	}
+}
+
+// InvocationTimeout makes Run fail invocations which were not responded to
+// within timeout with InvocationTimeoutError, which guards against servers
+// never responding to certain calls. Zero timeout, the default, lets
+// invocations wait until their context is done.
+func InvocationTimeout(timeout time.Duration) ClientOpt {
+	return func(c *clientConfig) {
+		c.InvocationTimeout = timeout
+	}
+}
+
+// UseNumber makes numbers in arguments and results unmarshalled into
+// interface{} values decode as json.Number instead of float64, so that prices
+// and quantities sent by exchange feeds keep their precision. Values
+// unmarshalled into typed fields, such as decimal types implementing
+// json.Unmarshaler, are not affected.
+func UseNumber() ClientOpt {
+	return func(c *clientConfig) {
+		c.UseNumber = true
+	}
+}
+
+// FanOut allows registering multiple callback streams and handlers for the
+// same hub method, so that different parts of an application can observe the
+// same feed. Every stream receives every call, and a slow stream delays the
+// others as much as MaxMessageProcessDuration allows. Without FanOut, Callback
+// and Handle return DuplicateCallbackError for a method which is already
+// registered.
+func FanOut() ClientOpt {
+	return func(c *clientConfig) {
+		c.FanOut = true
+	}
+}
+
+// TypeCodec registers functions encoding arguments of type T and decoding
+// arguments and results unmarshalled into T, e.g. to exchange time.Time in
+// .NET format (see DotNetDate), decimal types or GUIDs without wrapper types.
+// Codecs apply to top-level arguments and results of exactly type T, values
+// nested in other types are encoded by encoding/json as usual.
+func TypeCodec[T any](encode func(T) ([]byte, error), decode func([]byte) (T, error)) ClientOpt {
+	return func(c *clientConfig) {
+		if c.TypeCodecs == nil {
+			c.TypeCodecs = make(map[reflect.Type]typeCodec)
+		}
+
+		c.TypeCodecs[reflect.TypeOf((*T)(nil)).Elem()] = typeCodec{
+			encode: func(v interface{}) ([]byte, error) {
+				return encode(v.(T))
+			},
+			decode: func(data []byte, v interface{}) error {
+				res, err := decode(data)
+				if err != nil {
+					return err
+				}
+
+				*v.(*T) = res
+
+				return nil
+			},
+		}
+	}
+}
+
+// DotNetDate exchanges time.Time arguments and results in the "/Date(ms)/"
+// format of ASP.NET JSON serializers, see TypeCodec. Decoding accepts time
+// zone offsets, like "/Date(1577836800000+0100)/", and RFC 3339 strings.
+func DotNetDate() ClientOpt {
+	return TypeCodec(encodeDotNetDate, decodeDotNetDate)
+}
+
+// DispatchShards splits callback streams into n shards by method name, each
+// with its own lock, queue and goroutine, for feeds pushing many messages of
+// many methods. A stream which does not keep up then delays only methods of its
+// shard, rather than all of them. Calls of a method are delivered in order,
+// while calls of methods in different shards may be delivered out of order
+// relative to each other. By default there is a single shard and calls are
+// delivered in the order they were received.
+func DispatchShards(n int) ClientOpt {
+	return func(c *clientConfig) {
+		c.DispatchShards = n
+	}
+}
+
+// OrderedDelivery makes sharded dispatch pass calls of methods without streams
+// to streams registered by CallbackPattern and to OnUnhandledMessage in the
+// order they were read, e.g. for a pattern stream maintaining an order book
+// from calls of several methods. Calls are numbered as they are read and held
+// back until the calls read before them are delivered by their shards, so a
+// shard falling behind delays these calls of every shard. It has no effect
+// without DispatchShards, as calls are then always delivered in order.
+func OrderedDelivery() ClientOpt {
+	return func(c *clientConfig) {
+		c.OrderedDelivery = true
+	}
+}
+
+// WriteJournal makes Client.Enqueue store calls in cfg.Journal, which Run
+// sends once the connection is up and replays after reconnect and restart.
+func WriteJournal(cfg JournalConfig) ClientOpt {
+	return func(c *clientConfig) {
+		c.Journal = cfg
+	}
+}
+
+// UnknownMessageMode defines how the client treats completions of unknown
+// invocations and calls of methods without callback streams.
+type UnknownMessageMode int
+
+const (
+	// IgnoreUnknown silently drops unknown messages.
+	IgnoreUnknown UnknownMessageMode = iota
+
+	// ReportUnknown emits UnknownMessage event for every unknown message.
+	ReportUnknown
+
+	// FailOnUnknown emits UnknownMessage event and makes Run return
+	// UnknownMessageError, which catches integration bugs early.
+	FailOnUnknown
+)
+
+// UnknownMessages sets how the client treats completions for invocation IDs
+// which are not pending and calls of methods without callback streams, they
+// are ignored by default. Completions arriving after InvocationTimeout expired
+// their invocations are unknown too.
+func UnknownMessages(mode UnknownMessageMode) ClientOpt {
+	return func(c *clientConfig) {
+		c.UnknownMessages = mode
+	}
+}
+
+// OnUnhandledMessage sets a function receiving calls of methods without
+// callback streams and completions of invocations which are not pending, which
+// allows custom routing, e.g. of methods whose names embed market symbols. It
+// is called while dispatching of calls is blocked, so it should not block, and
+// with DispatchShards it may be called concurrently.
+func OnUnhandledMessage(fn func(UnhandledMessage)) ClientOpt {
+	return func(c *clientConfig) {
+		c.Unhandled = fn
+	}
+}
+
+// MethodNames converts names of hub methods invoked by the client to the case,
+// e.g. CamelCase for ASP.NET Core hubs, whose JSON protocol is case-sensitive,
+// so that Go-style names can be used on both sides. Calls received from the
+// server are then matched to callback streams case-insensitively, like classic
+// servers match invocations; CallbackStats report methods in lower case.
+// Patterns of CallbackPattern are matched as they are.
+func MethodNames(nc NameCase) ClientOpt {
+	return func(c *clientConfig) {
+		c.MethodNames = nc
+	}
+}
+
+// HubNames converts the name of the hub sent with every invocation to the
+// case.
+func HubNames(nc NameCase) ClientOpt {
+	return func(c *clientConfig) {
+		c.HubNames = nc
+	}
+}
+
+// MessageTimestamp sets a function extracting the time the server sent a
+// call, e.g. from an argument holding a Unix timestamp, reporting false for
+// calls without one. CallbackStats then report per method how long calls took
+// to arrive and how long they waited to be read from callback streams, which
+// tells network lag from slow consumers. Lag depends on the server and client
+// clocks being in sync.
+func MessageTimestamp(fn func(ClientMsg) (time.Time, bool)) ClientOpt {
+	return func(c *clientConfig) {
+		c.MessageTimestamp = fn
+	}
+}
+
+type clientConfig struct {
+	MaxBacklog        int
+	DeadLetter        func(DeadLetter)
+	InvocationIDs     func() uint64
+	InvocationTimeout time.Duration
+	UseNumber         bool
+	TypeCodecs        map[reflect.Type]typeCodec
+	FanOut            bool
+	Journal           JournalConfig
+	DispatchShards    int
+	OrderedDelivery   bool
+	UnknownMessages   UnknownMessageMode
+	Unhandled         func(UnhandledMessage)
+	MethodNames       NameCase
+	HubNames          NameCase
+	MessageTimestamp  func(ClientMsg) (time.Time, bool)
+}
+
+func newDefaultClientConfig() clientConfig {
+	return clientConfig{
+		MaxBacklog: callbackBufferSize,
+	}
+}
+
+type CallbackOpt func(*callbackConfig)
+
+// Validate sets a function checking arguments of every received call before
+// it is delivered. Calls failing validation are reported through the stream as
+// ValidationError, and the stream continues with subsequent calls. It can be
+// backed by a JSON Schema library or by custom checks.
+func Validate(fn func(args []json.RawMessage) error) CallbackOpt {
+	return func(c *callbackConfig) {
+		c.Validate = fn
+	}
+}
+
+// TransformArgs sets a pipeline of transforms applied in order to every
+// argument of received calls, before validation and unmarshalling. Calls which
+// fail to transform are reported through the stream as TransformError.
+func TransformArgs(transforms ...ArgTransform) CallbackOpt {
+	return func(c *callbackConfig) {
+		c.Transforms = transforms
+	}
+}
+
+// ProcessDuration overrides MaxMessageProcessDuration for the callback. Zero
+// duration makes the client wait until the message is consumed, which blocks
+// dispatching of all other messages meanwhile.
+func ProcessDuration(duration time.Duration) CallbackOpt {
+	return func(c *callbackConfig) {
+		c.ProcessDuration = duration
+	}
+}
+
+// Dedupe sets a function extracting identity of received calls, e.g. a
+// sequence number or message ID argument, and skips calls whose key was seen
+// among the last window calls delivered to the stream, which guards against
+// duplicates delivered by replay after reconnect or by flaky gateways. The
+// least recently seen keys are forgotten first; non-positive window remembers
+// 1024 keys. Calls for which the function reports false are always delivered.
+// Skipped calls are counted by CallbackStats.
+func Dedupe(window int, key func(ClientMsg) (string, bool)) CallbackOpt {
+	return func(c *callbackConfig) {
+		c.Dedupe = key
+		c.DedupeWindow = window
+	}
+}
+
+// RequireAck makes the stream hold every message read until it is
+// acknowledged with CallbackStream.Ack, for consumers which must not lose
+// messages they fail to process, e.g. when writing them to a database. A
+// message read again without acknowledgment is redelivered, ahead of the
+// messages after it, up to maxDeliveries times in total, and then passed to
+// dead letter handler with UnacknowledgedError; non-positive maxDeliveries
+// redelivers until the message is acknowledged. Unacknowledged message of
+// stopped stream is passed to dead letter handler by the next read. Handlers
+// registered with Client.Handle acknowledge calls they handle without error,
+// and calls they fail to handle are redelivered rather than failing Run.
+func RequireAck(maxDeliveries int) CallbackOpt {
+	return func(c *callbackConfig) {
+		c.RequireAck = true
+		c.MaxDeliveries = maxDeliveries
+	}
+}
+
+type callbackConfig struct {
+	Transforms      []ArgTransform
+	Validate        func(args []json.RawMessage) error
+	ProcessDuration time.Duration
+	Dedupe          func(ClientMsg) (string, bool)
+	DedupeWindow    int
+	RequireAck      bool
+	MaxDeliveries   int
+}
+
+// Config holds all connection settings. It is populated with defaults and
+// modified by DialOpt functions, custom options can set its fields directly.
+// Dial validates it before connecting and the client reads its callback
+// settings from the config of the connection.
+type Config struct {
+	// HTTP client used for negotiate, start and abort requests
+	Client *http.Client
+
+	// transport replacing the one of Client
+	Transport *http.Transport
+
+	// creates websocket dialer from HTTP client
+	Dialer WebsocketDialerFunc
+
+	// client protocol version, one of supported versions
+	Protocol string
+
+	// fallback endpoints and the order in which they are tried
+	Endpoints []string
+	Failover  FailoverStrategy
+
+	// how the URL returned by negotiate is used
+	NegotiateURL NegotiateURLMode
+
+	// replaces network dialer of the transport
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// replaces proxy of the transport and sets its credentials
+	Proxy     ProxyFunc
+	ProxyUser *url.Userinfo
+
+	// receives TLS secrets of the transport
+	TLSKeyLogWriter io.Writer
+
+	// dials resolved addresses of endpoint host in turns
+	RotateAddresses bool
+
+	// reuse negotiate responses while the server keeps the connection
+	CacheNegotiate bool
+
+	// which addresses of endpoint host are dialed
+	IPFamily IPFamilyMode
+
+	// authenticates HTTP requests and websocket handshakes
+	Authenticator Authenticator
+
+	// reports errors caused by expired authorization
+	TokenExpired func(err error) bool
+
+	// query parameters and headers sent with every request
+	Params     url.Values
+	ParamsFunc func(ctx context.Context) (url.Values, error)
+	Headers    http.Header
+
+	// websocket subprotocols and Origin header sent with connect and
+	// reconnect handshakes
+	Subprotocols []string
+	Origin       string
+
+	// retry policies of the connection sequence steps
+	NegotiateRetry RetryPolicy
+	ConnectRetry   RetryPolicy
+	ReconnectRetry RetryPolicy
+	StartRetry     RetryPolicy
+
+	// the maximum amount of time spent reconnecting
+	MaxReconnectDuration time.Duration
+
+	// the maximum amount of time a message waits to be read from a callback
+	// stream, zero blocks until it is read
 	MaxMessageProcessDuration time.Duration
+
+	// the maximum size of a received message in bytes, zero means no limit
+	MaxMessageSize int64
+
+	// the maximum amount of time Close waits for close frame to be written
+	CloseTimeout time.Duration
+
+	// the interval of pings sent to ASP.NET Core servers while nothing else
+	// is written, zero disables pings
+	PingInterval time.Duration
+
+	// the maximum amount of time to wait for the next frame, including
+	// keepalives, and for a frame to be written, zero means no limit
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// the maximum amount of time to wait for the websocket handshake and for
+	// the init message, zero means no limit
+	HandshakeTimeout time.Duration
+	InitTimeout      time.Duration
+
+	// the time messages wait for others to share their frame, zero disables
+	// coalescing
+	CoalesceWindow time.Duration
+
+	// whether stateful reconnect is requested from ASP.NET Core servers, and
+	// the size of buffer of messages the server did not acknowledge
+	StatefulReconnect bool
+	ReplayBufferSize  int
+
+	Logger  Logger
+	Clock   Clock
+	Breaker CircuitBreaker
+
+	// state of the connection to resume
+	Resume *State
+
+	OnMessagesMissed func(MessagesMissed)
+	OnKeepalive      func(time.Time)
+	MessageIDGap     func(prev, next string) bool
 }
 
-func (c config) NegotiateBackoff() backoff.BackOff {
-	return constantBackoff(c.RetryInterval, c.MaxNegotiateRetries)
+// DefaultConfig returns config used by Dial before options are applied.
+func DefaultConfig() Config {
+	return newDefaultConfig()
 }
 
-func (c config) ConnectBackoff() backoff.BackOff {
-	return constantBackoff(c.RetryInterval, c.MaxConnectRetries)
+// Validate returns ConfigError describing the first invalid setting.
+func (c Config) Validate() error {
+	if _, ok := parseProtocolVersion(c.Protocol); !ok {
+		return &ConfigError{Field: "Protocol", cause: &UnsupportedProtocolError{protocol: c.Protocol}}
+	}
+
+	required := []struct {
+		field string
+		unset bool
+	}{
+		{"Client", c.Client == nil},
+		{"Dialer", c.Dialer == nil},
+		{"Logger", c.Logger == nil},
+		{"Clock", c.Clock == nil},
+		{"MessageIDGap", c.MessageIDGap == nil},
+	}
+	for _, r := range required {
+		if r.unset {
+			return &ConfigError{Field: r.field, cause: errors.New("must be set")}
+		}
+	}
+
+	for i, endpoint := range c.Endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return &ConfigError{Field: fmt.Sprintf("Endpoints[%d]", i), cause: err}
+		}
+
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return &ConfigError{Field: fmt.Sprintf("Endpoints[%d]", i), cause: fmt.Errorf("unsupported scheme %q", u.Scheme)}
+		}
+	}
+
+	positive := []struct {
+		field string
+		value time.Duration
+	}{
+		{"MaxReconnectDuration", c.MaxReconnectDuration},
+		{"CloseTimeout", c.CloseTimeout},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			return &ConfigError{Field: p.field, cause: fmt.Errorf("must be positive, got %v", p.value)}
+		}
+	}
+
+	nonNegative := []struct {
+		field string
+		value int64
+	}{
+		{"MaxMessageProcessDuration", int64(c.MaxMessageProcessDuration)},
+		{"MaxMessageSize", c.MaxMessageSize},
+		{"CoalesceWindow", int64(c.CoalesceWindow)},
+		{"PingInterval", int64(c.PingInterval)},
+		{"ReadTimeout", int64(c.ReadTimeout)},
+		{"WriteTimeout", int64(c.WriteTimeout)},
+		{"HandshakeTimeout", int64(c.HandshakeTimeout)},
+		{"InitTimeout", int64(c.InitTimeout)},
+		{"Breaker.Threshold", int64(c.Breaker.Threshold)},
+		{"Breaker.MinLifetime", int64(c.Breaker.MinLifetime)},
+		{"Breaker.Cooldown", int64(c.Breaker.Cooldown)},
+	}
+	for _, n := range nonNegative {
+		if n.value < 0 {
+			return &ConfigError{Field: n.field, cause: errors.New("must not be negative")}
+		}
+	}
+
+	policies := []struct {
+		field  string
+		policy RetryPolicy
+	}{
+		{"NegotiateRetry", c.NegotiateRetry},
+		{"ConnectRetry", c.ConnectRetry},
+		{"ReconnectRetry", c.ReconnectRetry},
+		{"StartRetry", c.StartRetry},
+	}
+	for _, p := range policies {
+		if p.policy.MaxRetries < 0 || p.policy.Interval < 0 {
+			return &ConfigError{Field: p.field, cause: errors.New("retries and interval must not be negative")}
+		}
+	}
+
+	return nil
 }
 
-func (c config) ReconnectBackoff() backoff.BackOff {
-	return constantBackoff(c.RetryInterval, c.MaxReconnectRetries)
+// httpClient returns HTTP client used for connection, with transport adjusted
+// by the transport options and requests authorized by Authenticator. Provided
+// client and transport are never modified.
+func (c Config) httpClient() *http.Client {
+	client := c.transportClient()
+	if c.Authenticator == nil {
+		return client
+	}
+
+	authenticated := *client
+
+	base := authenticated.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	authenticated.Transport = &authTransport{base: base, auth: c.Authenticator}
+
+	return &authenticated
 }
 
-func (c config) StartBackoff() backoff.BackOff {
-	return constantBackoff(c.RetryInterval, c.MaxStartRetries)
+func (c Config) transportClient() *http.Client {
+	modified := c.NetDialContext != nil || c.Proxy != nil || c.ProxyUser != nil || c.TLSKeyLogWriter != nil || c.RotateAddresses || c.IPFamily != AnyIPFamily
+	if c.Transport == nil && !modified {
+		return c.Client
+	}
+
+	client := *c.Client
+	if c.Transport != nil {
+		client.Transport = c.Transport
+	}
+
+	if !modified {
+		return &client
+	}
+
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return &client
+	}
+
+	if c.NetDialContext != nil {
+		transport.DialContext = c.NetDialContext
+	}
+
+	if c.RotateAddresses || c.IPFamily != AnyIPFamily {
+		transport.DialContext = newResolvingDialer(transport.DialContext, c.IPFamily, c.RotateAddresses).DialContext
+	}
+
+	if c.Proxy != nil {
+		transport.Proxy = c.Proxy
+	}
+
+	if c.ProxyUser != nil && transport.Proxy != nil {
+		transport.Proxy = proxyWithUser(transport.Proxy, c.ProxyUser)
+	}
+
+	// websocket dialer clones TLS config of the transport along with the
+	// writer
+	if c.TLSKeyLogWriter != nil {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+
+		transport.TLSClientConfig.KeyLogWriter = c.TLSKeyLogWriter
+	}
+
+	client.Transport = transport
+
+	return &client
 }
 
-var newDefaultConfig = func() config {
-	return config{
+// proxyWithUser sets user info of proxy URLs returned by proxy.
+func proxyWithUser(proxy ProxyFunc, user *url.Userinfo) ProxyFunc {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if u == nil || err != nil {
+			return u, err
+		}
+
+		withUser := *u
+		withUser.User = user
+
+		return &withUser, nil
+	}
+}
+
+// connectHeaders returns headers of websocket handshake.
+func (c Config) connectHeaders() http.Header {
+	if len(c.Subprotocols) == 0 && c.Origin == "" {
+		return c.Headers
+	}
+
+	headers := c.Headers.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+
+	if len(c.Subprotocols) != 0 {
+		headers.Set("Sec-WebSocket-Protocol", strings.Join(c.Subprotocols, ", "))
+	}
+
+	if c.Origin != "" {
+		headers.Set("Origin", c.Origin)
+	}
+
+	return headers
+}
+
+// endpointURL merges configured query parameters into endpoint.
+func (c Config) endpointURL(ctx context.Context, endpoint string) (string, error) {
+	if len(c.Params) == 0 && c.ParamsFunc == nil {
+		return endpoint, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	for key, values := range c.Params {
+		query[key] = values
+	}
+
+	if c.ParamsFunc != nil {
+		params, err := c.ParamsFunc(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get query params: %w", err)
+		}
+
+		for key, values := range params {
+			query[key] = values
+		}
+	}
+
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+var newDefaultConfig = func() Config {
+	defaultRetry := RetryPolicy{
+		MaxRetries:      5,
+		Interval:        1 * time.Second,
+		HonorRetryAfter: true,
+	}
+
+	return Config{
 		Client:                    http.DefaultClient,
 		Dialer:                    NewDefaultDialer,
 		Protocol:                  "1.5",
 		Params:                    make(url.Values),
 		Headers:                   make(http.Header),
-		MaxNegotiateRetries:       5,
-		MaxConnectRetries:         5,
-		MaxReconnectRetries:       5,
+		NegotiateRetry:            defaultRetry,
+		ConnectRetry:              defaultRetry,
+		ReconnectRetry:            defaultRetry,
+		StartRetry:                defaultRetry,
 		MaxReconnectDuration:      5 * time.Minute,
-		MaxStartRetries:           5,
-		RetryInterval:             1 * time.Second,
 		MaxMessageProcessDuration: 10 * time.Second,
+		MessageIDGap:              sequentialMessageIDGap,
+		Logger:                    nopLogger{},
+		CloseTimeout:              time.Second,
+		PingInterval:              15 * time.Second,
+		HandshakeTimeout:          45 * time.Second,
+		InitTimeout:               30 * time.Second,
+		Clock:                     systemClock{},
+		TokenExpired:              tokenExpired,
 	}
 }
-
-func constantBackoff(interval time.Duration, maxRetries int) backoff.BackOff {
-	return backoff.WithMaxRetries(
-		backoff.NewConstantBackOff(interval),
-		uint64(maxRetries),
-	)
-}
@@ -1,33 +1,70 @@
 package signalr
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/cenkalti/backoff/v4"
+	"github.com/gorilla/websocket"
 )
 
+// maxErrorBodySize limits the size of response body kept in errors.
+const maxErrorBodySize = 4096
+
 // Conn represents a SignalR connection
 type Conn struct {
-	rmtx, wmtx sync.Mutex
-	client     *http.Client
-	dialer     WebsocketDialer
-	conn       WebsocketConn
-	endpoint   string
-	config     *config
-	state      *State
+	rmtx, wmtx  sync.Mutex
+	closeOnce   sync.Once
+	closeErr    error
+	closed      int32
+	closing     int32
+	lastRead    int64
+	lastWrite   int64
+	reconnected bool
+	client      *http.Client
+	dialer      WebsocketDialer
+	endpoints   []string
+	config      *Config
+	stats       connStats
+	breaker     breaker
+	batcher     batcher
+	pings       chan struct{}
+	acks        chan struct{}
+	events      eventChan
+
+	// negotiate responses reused by redial, nil unless CacheNegotiate is set
+	negotiations *negotiateCache
+
+	// mtx guards fields below, which are replaced on reconnect, renegotiate
+	// and failover
+	mtx      sync.Mutex
+	conn     WebsocketConn
+	state    *State
+	info     NegotiateInfo
+	endpoint int
+	hooks    []func()
+
+	// generation counts connections established with the server, it is
+	// not changed by reconnect which resumes the same connection
+	generation uint64
 }
 
-// State represents a SignalR connection state
+// State represents a SignalR connection state. It can be saved and passed to
+// Resume option to resume the connection after process restart.
 type State struct {
 	ConnectionData  string
 	ConnectionID    string
@@ -35,15 +72,44 @@ type State struct {
 	GroupsToken     string
 	MessageID       string
 	Protocol        string
+
+	// the time the server keeps the connection after it drops, so that
+	// resumed connection is not reconnected once the server forgot it
+	DisconnectTimeout time.Duration
+
+	// whether ASP.NET Core server supports stateful reconnect of the
+	// connection, see StatefulReconnect
+	StatefulReconnect bool
+}
+
+// update updates state using values from received message.
+func (s *State) update(messageID, groupsToken string) {
+	// Update the groups token.
+	if groupsToken != "" {
+		s.GroupsToken = groupsToken
+	}
+
+	// Update the current message ID.
+	if messageID != "" {
+		s.MessageID = messageID
+	}
 }
 
 // Dial connects to Signalr endpoint
 func Dial(ctx context.Context, endpoint, cdata string, opts ...DialOpt) (*Conn, error) {
+	if err := validateConnectionData(cdata); err != nil {
+		return nil, err
+	}
+
 	cfg := newDefaultConfig()
 	for _, opt := range opts {
 		opt(&cfg)
 	}
 
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
 	client := cfg.Client
 
 	if client.Jar == nil {
@@ -55,122 +121,867 @@ func Dial(ctx context.Context, endpoint, cdata string, opts ...DialOpt) (*Conn,
 		client.Jar = jar
 	}
 
+	client = cfg.httpClient()
+
+	c := &Conn{
+		client:    client,
+		dialer:    cfg.Dialer(client),
+		endpoints: append([]string{endpoint}, cfg.Endpoints...),
+		config:    &cfg,
+		pings:     make(chan struct{}, 1),
+		acks:      make(chan struct{}, 1),
+		events:    make(eventChan, eventBufferSize),
+	}
+
+	if cfg.CacheNegotiate {
+		c.negotiations = newNegotiateCache()
+	}
+
+	// messages buffered by stateful reconnect do not survive the process
+	if resumed := cfg.Resume; resumed != nil && resumed.ConnectionToken != "" && resumed.ConnectionData == cdata && resumed.Protocol != CoreProtocol && protocolOf(resumed).canReconnect() {
+		state := *resumed
+
+		conn, err := c.resume(ctx, &state)
+		if err == nil {
+			c.conn = conn
+			c.state = &state
+			c.info = NegotiateInfo{DisconnectTimeout: state.DisconnectTimeout}
+			c.generation = 1
+			c.touch()
+			c.connected()
+			c.events.emit(Connected{Endpoint: endpoint})
+
+			return c, nil
+		}
+
+		cfg.Logger.Log(LevelInfo, "failed to resume session, negotiating", "endpoint", endpoint, "error", err)
+	}
+
 	state := State{
 		ConnectionData: cdata,
 		Protocol:       cfg.Protocol,
 	}
 
-	if err := negotiate(ctx, client, endpoint, cfg.Headers, &state, cfg.NegotiateBackoff()); err != nil {
-		return nil, &NegotiateError{cause: err}
+	conn, info, idx, err := c.dial(ctx, &state)
+	if err != nil {
+		return nil, err
 	}
 
-	dialer := cfg.Dialer(client)
+	c.conn = conn
+	c.state = &state
+	c.info = info
+	c.endpoint = idx
+	c.generation = 1
+	c.touch()
+	c.connected()
+	c.events.emit(Connected{Endpoint: c.Endpoint()})
 
-	conn, err := connect(ctx, dialer, endpoint, "connect", cfg.Headers, &state, cfg.ConnectBackoff())
+	return c, nil
+}
+
+// dial runs connection sequence against configured endpoints in the order
+// defined by failover strategy, returning connection to the first endpoint
+// which succeeds along with its index.
+func (c *Conn) dial(ctx context.Context, state *State) (WebsocketConn, NegotiateInfo, int, error) {
+	// initial dial always starts from the primary endpoint
+	var first int
+
+	c.mtx.Lock()
+	redial := c.conn != nil
+	if redial {
+		first = c.config.Failover.first(c.endpoint, len(c.endpoints))
+	}
+	c.mtx.Unlock()
+
+	// pooled connections keep addresses resolved before the connection was
+	// dropped, which may belong to a server that failed over
+	if redial {
+		c.client.CloseIdleConnections()
+	}
+
+	initial := *state
+
+	var err error
+	for i := 0; i < len(c.endpoints); i++ {
+		idx := (first + i) % len(c.endpoints)
+
+		*state = initial
+
+		var (
+			conn WebsocketConn
+			info NegotiateInfo
+		)
+		conn, info, err = c.dialEndpoint(ctx, c.endpoints[idx], state)
+		if err == nil {
+			return conn, info, idx, nil
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, NegotiateInfo{}, 0, err
+}
+
+// dialEndpoint runs the connection sequence against endpoint. The negotiate
+// step is skipped when its response is cached, see CacheNegotiate, unless the
+// server rejects the cached token.
+func (c *Conn) dialEndpoint(ctx context.Context, endpoint string, state *State) (WebsocketConn, NegotiateInfo, error) {
+	if cached, ok := c.negotiations.get(endpoint, c.config.Clock.Now()); ok {
+		initial := *state
+
+		conn, info, err := c.runSequence(ctx, endpoint, state, &cached)
+		if err == nil || ctx.Err() != nil {
+			return conn, info, err
+		}
+
+		c.negotiations.drop(endpoint)
+		c.log(LevelInfo, "cached negotiation failed, negotiating", "endpoint", endpoint, "error", err)
+
+		*state = initial
+	}
+
+	return c.runSequence(ctx, endpoint, state, nil)
+}
+
+// runSequence implements the negotiate, connect and start steps of the
+// SignalR connection sequence. Response of the negotiate step is taken from
+// cached when it is not nil.
+func (c *Conn) runSequence(ctx context.Context, endpoint string, state *State, cached *negotiation) (WebsocketConn, NegotiateInfo, error) {
+	cfg := c.config
+	ctx = withSetupTrace(ctx, c.events)
+
+	u, err := cfg.endpointURL(ctx, endpoint)
 	if err != nil {
-		return nil, &ConnectError{cause: err}
+		return nil, NegotiateInfo{}, err
 	}
 
-	err = start(ctx, client, conn, endpoint, cfg.Headers, &state, cfg.StartBackoff())
+	var info NegotiateInfo
+	if cached != nil {
+		info = cached.info
+		cached.restore(state)
+	} else {
+		info, err = negotiate(ctx, c.client, u, cfg.Headers, state, cfg.NegotiateRetry, cfg.StatefulReconnect)
+		if err != nil {
+			return nil, NegotiateInfo{}, newNegotiateError(err)
+		}
+
+		c.negotiations.put(endpoint, info, state, cfg.Clock.Now())
+		c.events.emit(Negotiated{Endpoint: endpoint, Info: info})
+	}
+
+	proto, err := selectProtocol(cfg.Protocol, state)
+	if err != nil {
+		return nil, NegotiateInfo{}, newNegotiateError(err)
+	}
+
+	u, err = mergeNegotiateURL(u, info.URL, cfg.NegotiateURL)
+	if err != nil {
+		return nil, NegotiateInfo{}, newNegotiateError(err)
+	}
+
+	headers, err := c.handshakeHeaders(ctx, u)
 	if err != nil {
-		return nil, &StartError{cause: err}
+		return nil, NegotiateInfo{}, &ConnectError{cause: err}
 	}
 
-	return &Conn{
-		client:   client,
-		dialer:   dialer,
-		conn:     conn,
-		endpoint: endpoint,
-		config:   &cfg,
-		state:    &state,
-	}, nil
+	conn, err := connect(ctx, c.dialer, u, "connect", headers, state, cfg.ConnectRetry, cfg.HandshakeTimeout)
+	if err != nil {
+		return nil, NegotiateInfo{}, &ConnectError{cause: err}
+	}
+
+	wrapped := c.wrap(conn)
+
+	conn, err = proto.handshake(ctx, c, wrapped, u, state)
+	if err != nil {
+		_ = wrapped.Close()
+		return nil, NegotiateInfo{}, newStartError(err)
+	}
+
+	return conn, info, nil
 }
 
 func (c *Conn) State() *State {
-	c.rmtx.Lock()
+	c.mtx.Lock()
 	state := *c.state
-	c.rmtx.Unlock()
+	c.mtx.Unlock()
 
 	return &state
 }
 
+// NegotiateInfo returns values provided by the server in response to the
+// latest negotiate request.
+func (c *Conn) NegotiateInfo() NegotiateInfo {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.info
+}
+
+// Endpoint returns the endpoint current connection was established with.
+func (c *Conn) Endpoint() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.endpoints[c.endpoint]
+}
+
+// Metadata describes the current connection, e.g. to correlate client logs
+// with server-side traces. Network details are reported if the websocket
+// connection implements MetadataProvider, as connections of the default dialer
+// do.
+func (c *Conn) Metadata() ConnMetadata {
+	conn, state := c.current()
+
+	md := metadataOf(conn)
+	md.ConnectionID = state.ConnectionID
+
+	return md
+}
+
+// log logs message of the connection along with its ID, once it is known.
+func (c *Conn) log(level LogLevel, msg string, keyvals ...interface{}) {
+	var id string
+
+	c.mtx.Lock()
+	if c.state != nil {
+		id = c.state.ConnectionID
+	}
+	c.mtx.Unlock()
+
+	if id != "" {
+		keyvals = append([]interface{}{"connection_id", id}, keyvals...)
+	}
+
+	c.config.Logger.Log(level, msg, keyvals...)
+}
+
+// connectionURL returns base URL of requests to the current connection.
+func (c *Conn) connectionURL(ctx context.Context) (string, error) {
+	endpoint, err := c.config.endpointURL(ctx, c.Endpoint())
+	if err != nil {
+		return "", err
+	}
+
+	return mergeNegotiateURL(endpoint, c.NegotiateInfo().URL, c.config.NegotiateURL)
+}
+
+// current returns current websocket connection and a copy of its state.
+func (c *Conn) current() (WebsocketConn, State) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.conn, *c.state
+}
+
+// replace swaps current connection with a freshly dialed one and returns the
+// old connection.
+func (c *Conn) replace(conn WebsocketConn, state *State, info NegotiateInfo, endpoint int) WebsocketConn {
+	// wait for pending write to complete before swapping connections
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	old := c.conn
+	c.conn = conn
+	c.state = state
+	c.info = info
+	c.endpoint = endpoint
+	c.generation++
+
+	return old
+}
+
+// epoch returns generation of the current connection. Responses to messages
+// sent over connections of earlier generations are lost.
+func (c *Conn) epoch() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.generation
+}
+
+// Renegotiate obtains a fresh connection token by running the whole
+// negotiate, connect and start sequence again, and transparently replaces
+// underlying websocket connection. Pending reads continue on the new
+// connection; responses to invocations sent over the old connection are lost.
+func (c *Conn) Renegotiate(ctx context.Context) error {
+	if c.isClosed() {
+		return net.ErrClosed
+	}
+
+	if err := c.cooldown(ctx); err != nil {
+		return err
+	}
+
+	_, current := c.current()
+
+	state := State{
+		ConnectionData: current.ConnectionData,
+		Protocol:       c.config.Protocol,
+	}
+
+	conn, info, idx, err := c.dial(ctx, &state)
+	if err != nil {
+		return err
+	}
+
+	old := c.replace(conn, &state, info, idx)
+
+	// interrupt pending read on the old connection
+	_ = old.Close()
+
+	c.reestablished()
+
+	return nil
+}
+
 // ReadMessage reads single message from websocket
 func (c *Conn) ReadMessage(ctx context.Context, msg *Message) error {
+	return c.read(ctx, msg)
+}
+
+// ReadRaw reads payload of the next frame other than keepalive as is, which
+// allows handling non-standard payloads such as custom envelopes or binary
+// frames. Dropped connection is reestablished and connection state is updated
+// from standard messages, like with ReadMessage.
+func (c *Conn) ReadRaw(ctx context.Context) ([]byte, error) {
+	var msg rawMessage
+	if err := c.read(ctx, &msg); err != nil {
+		return nil, err
+	}
+
+	return msg.data, nil
+}
+
+// read reads single message from websocket, reconnecting if needed.
+func (c *Conn) read(ctx context.Context, msg envelope) error {
 	c.rmtx.Lock()
 	defer c.rmtx.Unlock()
 
-	err := readMessage(ctx, c.conn, msg, c.state)
-	if IsCloseError(err, 1000, 1001, 1006) {
+	conn, state := c.current()
+
+	err := protocolOf(&state).read(ctx, conn, msg, c.keepalive)
+	if err != nil {
+		// connection was replaced by Renegotiate while reading
+		if next, _ := c.current(); next != conn {
+			conn = next
+			err = c.readNext(ctx, conn, msg)
+		}
+	}
+
+	var (
+		closeErr       *CloseError
+		serverCloseErr *serverCloseError
+	)
+
+	temporary := errors.As(err, &closeErr) && closeErr.Temporary() ||
+		errors.As(err, &serverCloseErr) && serverCloseErr.allowReconnect
+
+	if temporary && atomic.LoadInt32(&c.closing) == 0 {
+		c.reconnecting(err)
+
+		if err := c.cooldown(ctx); err != nil {
+			return &ReadError{cause: err}
+		}
+
 		dctx, cancel := context.WithTimeout(ctx, c.config.MaxReconnectDuration)
 		defer cancel()
 
-		var conn WebsocketConn
-		conn, err = connect(dctx, c.dialer, c.endpoint, "reconnect", c.config.Headers, c.state, c.config.ReconnectBackoff())
+		// server closing the connection forgets its session, which can
+		// not be resumed
+		if errors.As(err, &serverCloseErr) {
+			conn, err = c.redial(dctx, &state)
+		} else {
+			conn, err = c.reconnect(dctx, &state)
+		}
 		if err != nil {
-			return &ConnectError{cause: err}
+			return err
 		}
 
-		c.conn = conn
-
 		// read message again
-		err = readMessage(ctx, conn, msg, c.state)
+		err = c.readNext(ctx, conn, msg)
+	}
+
+	if c.expired(err) && atomic.LoadInt32(&c.closing) == 0 {
+		c.log(LevelInfo, "authorization expired, renegotiating", "error", err)
+		c.reconnecting(err)
+
+		// cached tokens carry the expired authorization
+		c.negotiations.clear()
+
+		dctx, cancel := context.WithTimeout(ctx, c.config.MaxReconnectDuration)
+		defer cancel()
+
+		conn, err = c.redial(dctx, &state)
+		if err != nil {
+			return err
+		}
+
+		err = c.readNext(ctx, conn, msg)
+	}
+
+	if errors.As(err, &serverCloseErr) {
+		atomic.StoreInt32(&c.closing, 1)
+		return &ServerDisconnectedError{Reason: serverCloseErr.reason}
 	}
 
 	if err != nil {
-		return &ReadError{cause: err}
+		err = &ReadError{cause: err}
+		c.stats.fail(err)
+		return err
+	}
+
+	c.touch()
+
+	messageID, groupsToken, disconnect := msg.envelope()
+
+	c.mtx.Lock()
+	prevMessageID := c.state.MessageID
+	c.state.update(messageID, groupsToken)
+	c.mtx.Unlock()
+
+	if c.reconnected && messageID != "" {
+		c.reconnected = false
+		c.detectGap(prevMessageID, messageID)
+	}
+
+	if disconnect {
+		atomic.StoreInt32(&c.closing, 1)
+		return &ServerDisconnectedError{}
 	}
 
 	return nil
 }
 
-// Send sends a message to the websocket connection.
-func (c *Conn) WriteMessage(ctx context.Context, msg ClientMsg) error {
+// readNext reads the next message from conn, which was established by
+// reconnect or renegotiate, using protocol of the current connection.
+func (c *Conn) readNext(ctx context.Context, conn WebsocketConn, msg envelope) error {
+	_, state := c.current()
+	return protocolOf(&state).read(ctx, conn, msg, c.keepalive)
+}
+
+// resume reconnects to a connection established by another process, whose
+// state was saved. It does not retry, so that dial falls back to negotiation
+// quickly.
+func (c *Conn) resume(ctx context.Context, state *State) (WebsocketConn, error) {
+	ctx = withSetupTrace(ctx, c.events)
+
+	endpoint, err := c.config.endpointURL(ctx, c.endpoints[0])
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := c.handshakeHeaders(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := connect(ctx, c.dialer, endpoint, "reconnect", headers, state, RetryPolicy{}, c.config.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// report messages missed while the process was down
+	c.reconnected = true
+
+	return c.wrap(conn), nil
+}
+
+// reconnecting records the reason of reconnect and reports its first attempt.
+func (c *Conn) reconnecting(reason error) {
+	c.stats.reconnecting(reason)
+	c.events.emit(Reconnecting{Attempt: 1, Reason: reason})
+}
+
+// reconnect reestablishes dropped connection to the current endpoint. If that
+// fails and there are other endpoints configured, it fails over to them
+// running the whole connection sequence.
+func (c *Conn) reconnect(ctx context.Context, state *State) (WebsocketConn, error) {
+	// server forgets the connection once disconnect timeout elapses, and
+	// rejects reconnect with the stale token
+	window, open := c.reconnectWindow()
+	if !protocolOf(state).canReconnect() {
+		return c.redial(ctx, state)
+	}
+
+	if !open {
+		c.log(LevelInfo, "disconnect timeout elapsed, renegotiating", "endpoint", c.Endpoint())
+		return c.redial(ctx, state)
+	}
+
+	endpoint, err := c.connectionURL(ctx)
+	if err != nil {
+		return nil, &ConnectError{cause: err}
+	}
+
+	headers, err := c.handshakeHeaders(ctx, endpoint)
+	if err != nil {
+		return nil, &ConnectError{cause: err}
+	}
+
+	rctx := withSetupTrace(ctx, c.events)
+	if window > 0 {
+		var cancel context.CancelFunc
+		rctx, cancel = context.WithTimeout(rctx, window)
+		defer cancel()
+	}
+
+	policy := c.config.ReconnectRetry
+	policy.onRetry = func(attempt int, delay time.Duration, err error) {
+		c.events.emit(Reconnecting{Attempt: attempt, Delay: delay, Reason: err})
+	}
+
+	conn, err := connect(rctx, c.dialer, endpoint, "reconnect", headers, state, policy, c.config.HandshakeTimeout)
+	if err == nil {
+		if conn, err = c.reattach(rctx, state, c.wrap(conn)); err == nil {
+			c.reconnected = true
+			c.reestablished()
+
+			return conn, nil
+		}
+	}
+
+	// ASP.NET Core server forgets the session once it fails to resume, the
+	// connection is replaced by a new one
+	elapsed := ctx.Err() == nil && rctx.Err() != nil
+	if len(c.endpoints) < 2 && !c.expired(err) && !elapsed && state.Protocol != CoreProtocol {
+		return nil, &ConnectError{cause: err}
+	}
+
+	return c.redial(ctx, state)
+}
+
+// reattach makes websocket reestablished by reconnect the current connection
+// once the session of the dropped connection is resumed over it. Writes wait
+// for it, so that messages sent again by stateful reconnect precede new ones.
+func (c *Conn) reattach(ctx context.Context, state *State, conn WebsocketConn) (WebsocketConn, error) {
 	c.wmtx.Lock()
 	defer c.wmtx.Unlock()
 
-	data, err := json.Marshal(msg)
+	dropped, _ := c.current()
+
+	resumed, err := protocolOf(state).resume(ctx, dropped, conn)
 	if err != nil {
-		return &WriteError{cause: err}
+		_ = conn.Close()
+		return nil, err
 	}
 
-	if err := c.conn.WriteMessage(ctx, textMessage, data); err != nil {
-		return &WriteError{cause: err}
+	c.mtx.Lock()
+	c.conn = resumed
+	c.mtx.Unlock()
+
+	return resumed, nil
+}
+
+// reconnectWindow returns time left to reconnect before disconnect timeout
+// advertised by the server elapses since the latest message was received.
+// Zero duration means that there is no timeout.
+func (c *Conn) reconnectWindow() (time.Duration, bool) {
+	timeout := c.NegotiateInfo().DisconnectTimeout
+	if timeout <= 0 {
+		return 0, true
 	}
 
-	return nil
+	left := timeout - c.config.Clock.Now().Sub(c.LastRead())
+
+	return left, left > 0
+}
+
+// redial replaces dropped connection running the whole connection sequence,
+// which fails over to other endpoints and obtains fresh tokens.
+func (c *Conn) redial(ctx context.Context, state *State) (WebsocketConn, error) {
+	next := State{
+		ConnectionData: state.ConnectionData,
+		Protocol:       c.config.Protocol,
+	}
+
+	conn, info, idx, err := c.dial(ctx, &next)
+	if err != nil {
+		return nil, err
+	}
+
+	// server may keep the old connection open, e.g. after sending close
+	// message allowing reconnect
+	if old := c.replace(conn, &next, info, idx); old != nil {
+		_ = old.Close()
+	}
+
+	c.reestablished()
+
+	return conn, nil
+}
+
+// expired reports whether err means that authorization of the connection
+// expired, see TokenExpired option.
+func (c *Conn) expired(err error) bool {
+	return c.config.TokenExpired != nil && c.config.TokenExpired(err)
+}
+
+// wrap limits the size of messages read from freshly established connection,
+// bounds its reads and writes by timeouts and counts its frames.
+func (c *Conn) wrap(conn WebsocketConn) WebsocketConn {
+	return &countConn{
+		WebsocketConn: withDeadlines(limitMessageSize(conn, c.config.MaxMessageSize), c.config.ReadTimeout, c.config.WriteTimeout),
+		stats:         &c.stats,
+	}
+}
+
+// reestablished records that the connection was reestablished and notifies
+// about it.
+func (c *Conn) reestablished() {
+	atomic.AddInt64(&c.stats.reconnects, 1)
+	c.connected()
+	c.events.emit(Reconnected{Endpoint: c.Endpoint()})
+	c.reconnectedHooks()
+}
+
+// onReconnected registers a function called after connection is
+// reestablished by reconnect, failover or renegotiate. It must not block.
+func (c *Conn) onReconnected(fn func()) {
+	c.mtx.Lock()
+	c.hooks = append(c.hooks, fn)
+	c.mtx.Unlock()
+}
+
+func (c *Conn) reconnectedHooks() {
+	c.mtx.Lock()
+	hooks := c.hooks
+	c.mtx.Unlock()
+
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// touch records the time of the latest activity on the connection.
+func (c *Conn) touch() {
+	atomic.StoreInt64(&c.lastRead, c.config.Clock.Now().UnixNano())
+}
+
+// keepalive records keepalive arrival and lets pinger answer it.
+func (c *Conn) keepalive() {
+	c.touch()
+
+	select {
+	case c.pings <- struct{}{}:
+	default:
+	}
+
+	if c.config.OnKeepalive != nil {
+		c.config.OnKeepalive(c.LastRead())
+	}
+}
+
+// LastRead returns the time when the latest message, including keepalive, was
+// received.
+func (c *Conn) LastRead() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastRead))
+}
+
+// detectGap reports missed messages if message IDs received before and after
+// reconnect are not consecutive.
+func (c *Conn) detectGap(prev, next string) {
+	if c.config.OnMessagesMissed == nil || prev == "" {
+		return
+	}
+
+	if c.config.MessageIDGap(prev, next) {
+		c.config.OnMessagesMissed(MessagesMissed{PrevMessageID: prev, MessageID: next})
+	}
+}
+
+// WriteMessage sends a message to the websocket connection. It is safe for
+// concurrent use: writes are serialized, as websocket connections support a
+// single writer, and wait while the connection is being replaced.
+func (c *Conn) WriteMessage(ctx context.Context, msg ClientMsg) error {
+	_, err := c.writeMessage(ctx, msg)
+	return err
+}
+
+// writeMessage sends a message returning epoch of the connection it was
+// written to.
+func (c *Conn) writeMessage(ctx context.Context, msg ClientMsg) (uint64, error) {
+	_, state := c.current()
+
+	e := getEncoder()
+	defer putEncoder(e)
+
+	if err := protocolOf(&state).marshal(e, msg); err != nil {
+		return 0, &WriteError{cause: err}
+	}
+
+	if c.config.CoalesceWindow > 0 && protocolOf(&state).canBatch() {
+		return c.coalesce(ctx, e.buf.Bytes())
+	}
+
+	return c.send(ctx, e.buf.Bytes())
 }
 
-// Close closes underlying websocket connection
+// WriteRaw sends data as is in a text frame to the websocket connection.
+// Messages sent to ASP.NET Core servers must end with the record separator
+// (0x1E).
+func (c *Conn) WriteRaw(ctx context.Context, data []byte) error {
+	return c.write(ctx, data)
+}
+
+// write sends a text frame to the websocket connection, see send.
+func (c *Conn) write(ctx context.Context, data []byte) error {
+	_, err := c.send(ctx, data)
+	return err
+}
+
+// send writes a text frame to the websocket connection holding write lock, as
+// every write to the underlying connection must, and returns epoch of the
+// connection.
+func (c *Conn) send(ctx context.Context, data []byte) (uint64, error) {
+	// buffer of messages kept for stateful reconnect may be full, while acks
+	// and other messages the server does not count must not wait for it
+	current, _ := c.current()
+	if s := sessionOf(current); s != nil && countSequenced(data) != 0 {
+		if err := s.wait(ctx); err != nil {
+			return 0, &WriteError{cause: err}
+		}
+	}
+
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+
+	// connection is replaced holding write lock
+	epoch := c.epoch()
+
+	conn, _ := c.current()
+	if err := conn.WriteMessage(ctx, textMessage, data); err != nil {
+		err = &WriteError{cause: err}
+		c.stats.fail(err)
+		return epoch, err
+	}
+
+	atomic.StoreInt64(&c.lastWrite, c.config.Clock.Now().UnixNano())
+
+	return epoch, nil
+}
+
+// Close closes connection waiting at most CloseTimeout for the close frame to
+// be written, see CloseContext.
 func (c *Conn) Close() error {
-	return c.conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.CloseTimeout)
+	defer cancel()
+
+	return c.CloseContext(ctx)
+}
+
+// CloseContext waits for pending writes to complete, sends websocket close
+// frame and closes underlying websocket connection. Writing the close frame is
+// bounded by ctx. Connection is not reestablished after close, and pending
+// reads return promptly. It is safe to call Close, CloseContext and Shutdown
+// multiple times and concurrently, subsequent calls return the result of the
+// first one.
+func (c *Conn) CloseContext(ctx context.Context) error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.close(ctx, false)
+	})
+
+	return c.closeErr
+}
+
+// Shutdown waits for pending writes to complete, notifies server using abort
+// request and websocket close frame and closes underlying websocket connection.
+// Connection is not reestablished after shutdown.
+func (c *Conn) Shutdown(ctx context.Context) error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.close(ctx, true)
+	})
+
+	return c.closeErr
+}
+
+// isClosed reports whether connection was closed by Close, CloseContext or
+// Shutdown.
+func (c *Conn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// interrupt closes current websocket connection making pending reads fail,
+// while the connection can still be renegotiated.
+func (c *Conn) interrupt() error {
+	conn, _ := c.current()
+	return conn.Close()
+}
+
+func (c *Conn) close(ctx context.Context, abortRequest bool) error {
+	atomic.StoreInt32(&c.closed, 1)
+	atomic.StoreInt32(&c.closing, 1)
+
+	// wait for pending write to be flushed
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+
+	conn, state := c.current()
+
+	var abortErr error
+	if v, _ := parseProtocolVersion(state.Protocol); abortRequest && v.hasAbort() {
+		if endpoint, err := c.connectionURL(ctx); err == nil {
+			abortErr = abort(ctx, c.client, endpoint, c.config.Headers, &state)
+		} else {
+			abortErr = err
+		}
+	}
+
+	data := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	writeErr := conn.WriteMessage(ctx, closeMessage, data)
+
+	if err := conn.Close(); err != nil {
+		return err
+	}
+
+	if writeErr != nil {
+		return &WriteError{cause: writeErr}
+	}
+
+	return abortErr
 }
 
-// negotiate implements the negotiate step of the SignalR connection sequence.
-func negotiate(ctx context.Context, client *http.Client, endpoint string, headers http.Header, state *State, bo backoff.BackOff) error {
+// negotiate implements the negotiate step of the SignalR connection sequence,
+// requesting stateful reconnect from ASP.NET Core servers if stateful is set.
+func negotiate(ctx context.Context, client *http.Client, endpoint string, headers http.Header, state *State, policy RetryPolicy, stateful bool) (NegotiateInfo, error) {
 	// Reset Token
 	state.ConnectionToken = ""
 
 	// Make a "negotiate" URL.
 	endpoint, err := makeURL(endpoint, "negotiate", state)
 	if err != nil {
-		return err
+		return NegotiateInfo{}, err
 	}
 
-	return backoff.Retry(func() error {
-		req, err := prepareRequest(ctx, endpoint, headers)
+	// ASP.NET Core servers accept negotiate requests only via POST, classic
+	// servers are tried first
+	method := http.MethodGet
+
+	var info NegotiateInfo
+	err = policy.retry(ctx, func() error {
+		httpRes, err := negotiateRequest(ctx, client, method, endpoint, headers)
 		if err != nil {
-			return fmt.Errorf("failed to prepare request: %w", err)
+			return err
 		}
 
-		// Perform the request.
-		httpRes, err := client.Do(req)
-		if err != nil {
-			return fmt.Errorf("request failed: %w", err)
+		if httpRes.StatusCode == http.StatusMethodNotAllowed && method == http.MethodGet {
+			_ = httpRes.Body.Close()
+
+			method = http.MethodPost
+			endpoint = coreNegotiateURL(endpoint, stateful)
+
+			if httpRes, err = negotiateRequest(ctx, client, method, endpoint, headers); err != nil {
+				return err
+			}
 		}
 		defer httpRes.Body.Close()
 
 		if httpRes.StatusCode != http.StatusOK {
-			return fmt.Errorf("request failed: %s", httpRes.Status)
+			return newStatusError(httpRes)
 		}
 
 		data, err := ioutil.ReadAll(httpRes.Body)
@@ -189,13 +1000,69 @@ func negotiate(ctx context.Context, client *http.Client, endpoint string, header
 
 		// Update the protocol version.
 		state.Protocol = res.ProtocolVersion
+		if res.core() {
+			state.Protocol = CoreProtocol
+		}
+
+		state.StatefulReconnect = stateful && res.statefulReconnect()
+
+		info = res.info()
+		state.DisconnectTimeout = info.DisconnectTimeout
 
 		return nil
-	}, backoff.WithContext(bo, ctx))
+	})
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.code == http.StatusTooManyRequests {
+		return info, &ThrottledError{RetryAfter: statusErr.retryAfter, cause: err}
+	}
+
+	return info, err
+}
+
+func negotiateRequest(ctx context.Context, client *http.Client, method, endpoint string, headers http.Header) (*http.Response, error) {
+	ctx, traced := traceStep(ctx, "negotiate", endpoint)
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+
+	req.Header = headers
+
+	// Perform the request.
+	res, err := client.Do(req)
+	traced(err)
+
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+
+	return res, nil
+}
+
+// coreNegotiateURL requests version 1 of the ASP.NET Core negotiate protocol,
+// which provides connection token separate from connection ID, and stateful
+// reconnect if stateful is set.
+func coreNegotiateURL(endpoint string, stateful bool) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+
+	query := u.Query()
+	query.Set("negotiateVersion", "1")
+	if stateful {
+		query.Set("useStatefulReconnect", "true")
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
 }
 
 // connect implements the connect step of the SignalR connection sequence.
-func connect(ctx context.Context, dialer WebsocketDialer, endpoint, command string, headers http.Header, state *State, bo backoff.BackOff) (WebsocketConn, error) {
+// Every attempt to dial is bounded by timeout.
+func connect(ctx context.Context, dialer WebsocketDialer, endpoint, command string, headers http.Header, state *State, policy RetryPolicy, timeout time.Duration) (WebsocketConn, error) {
 	// Example connect URL:
 	// https://socket.bittrex.com/signalr/connect?
 	//   transport=webSockets&
@@ -204,48 +1071,72 @@ func connect(ctx context.Context, dialer WebsocketDialer, endpoint, command stri
 	//   connectionData=%5B%7B%22name%22%3A%22corehub%22%7D%5D&
 	//   tid=5
 	// -> returns connection ID. (e.g.: d-F2577E41-B,0|If60z,0|If600,1)
-	endpoint, err := makeURL(endpoint, command, state)
+	endpoint, err := protocolOf(state).connectURL(endpoint, command, state)
 	if err != nil {
 		return nil, err
 	}
 
 	var conn WebsocketConn
-	err = backoff.Retry(func() error {
+	err = policy.retry(ctx, func() error {
 		var (
 			status int
 			err    error
 		)
-		conn, status, err = dialer.Dial(ctx, endpoint, headers)
+		dctx, cancel, bounded := withDeadline(ctx, timeout)
+		defer cancel()
+
+		tctx, traced := traceStep(dctx, command, endpoint)
+		conn, status, err = dialer.Dial(tctx, endpoint, headers)
+		traced(err)
+
+		err = stepTimedOut(ctx, bounded, err, "handshake", timeout)
+
+		var handshakeErr *HandshakeError
+		if err != nil && status != 0 && !errors.As(err, &handshakeErr) {
+			err = &HandshakeError{StatusCode: status, cause: err}
+		}
+
 		if err != nil {
 			return &DialError{status: status, cause: err}
 		}
 
 		return nil
-	}, backoff.WithContext(bo, ctx))
+	})
 
 	return conn, err
 }
 
-// Start implements the start step of the SignalR connection sequence.
-func start(ctx context.Context, client *http.Client, conn WebsocketConn, endpoint string, headers http.Header, state *State, bo backoff.BackOff) error {
+// Start implements the start step of the SignalR connection sequence. The init
+// message is awaited once the server started the connection, for at most
+// initTimeout. The returned connection yields frames the server sent before
+// the init message first.
+func start(ctx context.Context, client *http.Client, conn WebsocketConn, endpoint string, headers http.Header, state *State, policy RetryPolicy, initTimeout time.Duration) (WebsocketConn, error) {
 	endpoint, err := makeURL(endpoint, "start", state)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req, err := prepareRequest(ctx, endpoint, headers)
 	if err != nil {
-		return fmt.Errorf("failed to prepare request: %w", err)
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
 	}
 
-	// Perform the request in a retry loop.
-	return backoff.Retry(func() error {
-		httpRes, err := client.Do(req)
+	// Perform the request in a retry loop; only transient failures are
+	// retried, as the server rejects invalid requests again.
+	err = policy.retry(ctx, func() error {
+		tctx, traced := traceStep(ctx, "start", endpoint)
+		httpRes, err := client.Do(req.WithContext(tctx))
+		traced(err)
+
 		if err != nil {
 			return fmt.Errorf("request failed: %w", err)
 		}
 		defer httpRes.Body.Close()
 
+		if httpRes.StatusCode != http.StatusOK {
+			return newStatusError(httpRes)
+		}
+
 		data, err := ioutil.ReadAll(httpRes.Body)
 		if err != nil {
 			return fmt.Errorf("read failed: %w", err)
@@ -253,24 +1144,155 @@ func start(ctx context.Context, client *http.Client, conn WebsocketConn, endpoin
 
 		var res startResponse
 		if err := json.Unmarshal(data, &res); err != nil {
-			return err
+			return &stopRetry{cause: err}
 		}
 
 		if res.Response != "started" {
-			return &InvalidStartResponseError{actual: res.Response}
+			return &stopRetry{cause: &InvalidStartResponseError{actual: res.Response}}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the websocket is not usable after a failed read, so the init message is
+	// not awaited again by retries of the start request
+	return readInitMessage(ctx, conn, state, initTimeout)
+}
+
+// the maximum number of frames buffered while waiting for the init message
+const initFrameLimit = 1000
+
+// readInitMessage waits for the init message sent by the server once the
+// transport is connected, for at most timeout. Some servers send keepalives
+// or buffered messages first; keepalives are skipped and messages buffered,
+// to be read from the returned connection before the following frames.
+func readInitMessage(ctx context.Context, conn WebsocketConn, state *State, timeout time.Duration) (WebsocketConn, error) {
+	rctx, cancel, bounded := withDeadline(ctx, timeout)
+	defer cancel()
+
+	var pending [][]byte
+
+	for {
+		var frame json.RawMessage
+		if err := readMessage(rctx, conn, &frame, nil); err != nil {
+			return nil, &ReadError{cause: stepTimedOut(ctx, bounded, err, "init", timeout)}
 		}
 
 		var msg Message
-		if err := readMessage(ctx, conn, &msg, state); err != nil {
-			return &ReadError{cause: err}
+		if err := json.Unmarshal(frame, &msg); err != nil {
+			return nil, &ReadError{cause: err}
 		}
 
-		if msg.Status != statusStarted {
-			return &InvalidInitMessageError{actual: msg.Status}
+		switch msg.Status {
+		case statusStarted:
+			state.update(msg.MessageID, msg.GroupsToken)
+			return requeue(conn, pending), nil
+		case 0:
+			if len(pending) == initFrameLimit {
+				return nil, &InvalidInitMessageError{actual: msg.Status}
+			}
+
+			pending = append(pending, frame)
+		default:
+			return nil, &InvalidInitMessageError{actual: msg.Status}
 		}
+	}
+}
 
-		return nil
-	}, backoff.WithContext(bo, ctx))
+// requeueConn returns frames read ahead before reading from the connection.
+type requeueConn struct {
+	WebsocketConn
+	pending [][]byte
+}
+
+// requeue makes frames read from conn ahead of time be read again.
+func requeue(conn WebsocketConn, frames [][]byte) WebsocketConn {
+	if len(frames) == 0 {
+		return conn
+	}
+
+	return &requeueConn{WebsocketConn: conn, pending: frames}
+}
+
+func (c *requeueConn) ReadMessage(ctx context.Context) (messageType int, p []byte, err error) {
+	if len(c.pending) == 0 {
+		return c.WebsocketConn.ReadMessage(ctx)
+	}
+
+	p = c.pending[0]
+	c.pending = c.pending[1:]
+
+	return textMessage, p, nil
+}
+
+func (c *requeueConn) NextReader(ctx context.Context) (messageType int, r io.Reader, err error) {
+	if len(c.pending) == 0 {
+		return nextReader(ctx, c.WebsocketConn)
+	}
+
+	messageType, p, err := c.ReadMessage(ctx)
+
+	return messageType, bytes.NewReader(p), err
+}
+
+func (c *requeueConn) Metadata() ConnMetadata {
+	return metadataOf(c.WebsocketConn)
+}
+
+// abort implements the abort step of the SignalR connection sequence.
+func abort(ctx context.Context, client *http.Client, endpoint string, headers http.Header, state *State) error {
+	endpoint, err := makeURL(endpoint, "abort", state)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to prepare request: %w", err)
+	}
+
+	req.Header = headers
+
+	httpRes, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer httpRes.Body.Close()
+
+	if httpRes.StatusCode != http.StatusOK {
+		return newStatusError(httpRes)
+	}
+
+	return nil
+}
+
+// mergeNegotiateURL appends path returned by negotiate to endpoint in
+// MergeNegotiateURL mode, unless the endpoint already ends with it.
+func mergeNegotiateURL(endpoint, negotiated string, mode NegotiateURLMode) (string, error) {
+	if mode != MergeNegotiateURL || negotiated == "" {
+		return endpoint, nil
+	}
+
+	n, err := url.Parse(negotiated)
+	if err != nil {
+		return "", fmt.Errorf("invalid negotiate URL: %w", err)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	base := strings.TrimSuffix(u.Path, "/")
+	path := strings.TrimSuffix(n.Path, "/")
+	if !strings.HasSuffix(base, path) {
+		u.Path = base + path
+	}
+
+	return u.String(), nil
 }
 
 func makeURL(endpoint, command string, state *State) (string, error) {
@@ -298,11 +1320,8 @@ func makeURL(endpoint, command string, state *State) (string, error) {
 	}
 
 	switch command {
-	case "negotiate":
-		u.Path += "/negotiate"
 	case "connect":
 		connectURL(u, query)
-		u.Path += "/connect"
 	case "reconnect":
 		connectURL(u, query)
 		if groupsToken := state.GroupsToken; groupsToken != "" {
@@ -311,12 +1330,13 @@ func makeURL(endpoint, command string, state *State) (string, error) {
 		if messageID := state.MessageID; messageID != "" {
 			query.Set("messageId", messageID)
 		}
-		u.Path += "/reconnect"
-	case "start":
+	case "start", "abort":
 		query.Set("transport", "webSockets")
-		u.Path += "/start"
 	}
 
+	// endpoints mounted at a path prefix may be given with trailing slash
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + command
+
 	// Set the parameters.
 	u.RawQuery = query.Encode()
 
@@ -340,8 +1360,7 @@ func prepareRequest(ctx context.Context, u string, headers http.Header) (*http.R
 	// Make the GET request object.
 	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
-		err = fmt.Errorf("get request creation failed")
-		return nil, err
+		return nil, fmt.Errorf("get request creation failed: %w", err)
 	}
 
 	// Add all header values.
@@ -349,3 +1368,14 @@ func prepareRequest(ctx context.Context, u string, headers http.Header) (*http.R
 
 	return req, nil
 }
+
+func newStatusError(res *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+
+	return &statusError{
+		code:       res.StatusCode,
+		status:     res.Status,
+		body:       body,
+		retryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+}
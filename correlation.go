@@ -0,0 +1,35 @@
+package signalr
+
+import "context"
+
+// CorrelationHeader is the name of the invocation header carrying correlation
+// ID to ASP.NET Core servers. Classic protocol has no invocation headers, so
+// there the ID is only reported locally.
+const CorrelationHeader = "correlation-id"
+
+type correlationKey struct{}
+
+// WithCorrelationID returns ctx carrying correlation ID, e.g. trace ID of the
+// request being served. Invocations made with the context send it in their
+// headers where the protocol allows, and report it in logs and
+// InvocationCompleted events.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns correlation ID carried by ctx, or empty string.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// correlationHeaders returns invocation headers carrying correlation ID of
+// ctx, nil if there is none.
+func correlationHeaders(ctx context.Context) map[string]string {
+	id := CorrelationID(ctx)
+	if id == "" {
+		return nil
+	}
+
+	return map[string]string{CorrelationHeader: id}
+}
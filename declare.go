@@ -0,0 +1,88 @@
+package signalr
+
+import (
+	"context"
+	"sync"
+)
+
+// Declaration is a hub method call replayed after every reconnect, see
+// Client.Declare.
+type Declaration struct {
+	Method string
+	Args   []interface{}
+}
+
+type declarations struct {
+	mtx  sync.Mutex
+	data []Declaration
+}
+
+// Declare invokes hub method, e.g. a subscription to a feed, and remembers the
+// call so it is replayed after every reconnect, failover or renegotiate. If
+// replaying fails, Run returns ReplayError.
+func (c *Client) Declare(ctx context.Context, method string, args ...interface{}) error {
+	if err := c.Invoke(ctx, method, args...).wait(); err != nil {
+		return err
+	}
+
+	c.declared.mtx.Lock()
+	c.declared.data = append(c.declared.data, Declaration{Method: method, Args: args})
+	c.declared.mtx.Unlock()
+
+	return nil
+}
+
+// Undeclare stops replaying all calls of hub method.
+func (c *Client) Undeclare(method string) {
+	c.declared.mtx.Lock()
+	defer c.declared.mtx.Unlock()
+
+	res := c.declared.data[:0]
+	for _, d := range c.declared.data {
+		if d.Method != method {
+			res = append(res, d)
+		}
+	}
+
+	c.declared.data = res
+}
+
+// Declarations returns calls replayed after reconnect.
+func (c *Client) Declarations() []Declaration {
+	c.declared.mtx.Lock()
+	defer c.declared.mtx.Unlock()
+
+	return append([]Declaration(nil), c.declared.data...)
+}
+
+// replayer replays declared calls after every reconnect until ctx is done.
+func (c *Client) replayer(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.replays:
+			c.replay(ctx)
+		}
+	}
+}
+
+func (c *Client) replay(ctx context.Context) {
+	rctx, cancel := context.WithTimeout(ctx, c.conn.config.MaxReconnectDuration)
+	defer cancel()
+
+	for _, d := range c.Declarations() {
+		inv := c.Invoke(rctx, d.Method, d.Args...)
+		if err := inv.wait(); err != nil {
+			// Run is returning
+			if ctx.Err() != nil {
+				return
+			}
+
+			c.log(LevelError, "failed to replay declared call", "method", d.Method, "invocation_id", inv.id, "error", err)
+			c.fail(&ReplayError{Method: d.Method, cause: err})
+
+			return
+		}
+	}
+}
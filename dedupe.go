@@ -0,0 +1,54 @@
+package signalr
+
+import "container/list"
+
+// defaultDedupeWindow is the number of keys remembered by Dedupe with
+// non-positive window.
+const defaultDedupeWindow = 1024
+
+// dedupeWindow remembers keys of the most recent calls delivered to callback
+// stream, evicting the least recently seen key once it is full.
+type dedupeWindow struct {
+	key  func(ClientMsg) (string, bool)
+	size int
+
+	// keys ordered from the most recently seen
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+func newDedupeWindow(key func(ClientMsg) (string, bool), size int) *dedupeWindow {
+	if size <= 0 {
+		size = defaultDedupeWindow
+	}
+
+	return &dedupeWindow{key: key, size: size, order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+// seen remembers key of call and reports whether it is already remembered.
+// Calls without key are never seen. Nil window sees nothing.
+func (w *dedupeWindow) seen(clientMsg ClientMsg) bool {
+	if w == nil {
+		return false
+	}
+
+	key, ok := w.key(clientMsg)
+	if !ok {
+		return false
+	}
+
+	if el, ok := w.keys[key]; ok {
+		w.order.MoveToFront(el)
+		return true
+	}
+
+	w.keys[key] = w.order.PushFront(key)
+
+	if w.order.Len() > w.size {
+		oldest := w.order.Back()
+		w.order.Remove(oldest)
+		delete(w.keys, oldest.Value.(string))
+	}
+
+	return false
+}
@@ -0,0 +1,283 @@
+package signalr
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dispatcher splits callback streams into shards by method name, each with its
+// own lock, so that calls of different methods are delivered independently.
+// While Run runs a sharded dispatcher, every shard is fed by its own queue and
+// goroutine, and a stream blocking delivery delays only methods of its shard.
+// Calls of a method are always delivered in order. Streams registered by
+// pattern are kept apart, and receive calls of methods without streams from
+// every shard. With OrderedDelivery, these are passed on in the order calls
+// were read, rather than in the order shards process them.
+type dispatcher struct {
+	shards                    []*callbacks
+	maxMessageProcessDuration time.Duration
+
+	// streams registered by pattern, receiving calls of methods without
+	// streams in their shards
+	patterns *callbacks
+
+	// shard calls by method names folded to lower case, see MethodNames
+	foldCase bool
+
+	// pass calls without streams on in the order they were read, see
+	// OrderedDelivery
+	ordered bool
+
+	// queues of shards, nil unless workers are started
+	queues  []chan batch
+	done    <-chan struct{}
+	workers sync.WaitGroup
+
+	// numbers calls queued to shards and restores their order, nil unless
+	// workers are started with ordered delivery
+	seq     uint64
+	reorder *reorderBuffer
+}
+
+// batch holds calls queued to a shard, numbered in the order they were read
+// if delivery is ordered.
+type batch struct {
+	msgs []ClientMsg
+	seqs []uint64
+}
+
+func newDispatcher(shards int, maxMessageProcessDuration time.Duration, configure func(*callbacks)) *dispatcher {
+	if shards < 1 {
+		shards = 1
+	}
+
+	d := &dispatcher{
+		shards:                    make([]*callbacks, shards),
+		maxMessageProcessDuration: maxMessageProcessDuration,
+		patterns:                  newCallbacks(maxMessageProcessDuration),
+	}
+
+	configure(d.patterns)
+
+	for i := range d.shards {
+		d.shards[i] = newCallbacks(maxMessageProcessDuration)
+		configure(d.shards[i])
+		d.shards[i].fallback = d.patterns.match
+	}
+
+	return d
+}
+
+// shard returns index of the shard holding streams of method.
+func (d *dispatcher) shard(method string) int {
+	if len(d.shards) == 1 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(methodKey(method, d.foldCase)))
+
+	return int(h.Sum32() % uint32(len(d.shards)))
+}
+
+// start starts a goroutine per shard processing its queue until stop is called.
+// Processing is synchronous with a single shard, so nothing is started.
+func (d *dispatcher) start(ctx context.Context) {
+	if len(d.shards) == 1 {
+		return
+	}
+
+	d.queues = make([]chan batch, len(d.shards))
+	d.done = ctx.Done()
+
+	// calls dropped by previous run left gaps in numbering, so it starts
+	// over
+	if d.ordered {
+		d.seq = 0
+		d.reorder = newReorderBuffer(d.fallback)
+	}
+
+	for i := range d.shards {
+		queue := make(chan batch, callbackBufferSize)
+		d.queues[i] = queue
+
+		d.workers.Add(1)
+
+		go func(shard *callbacks) {
+			defer d.workers.Done()
+
+			for b := range queue {
+				shard.processBatch(b.msgs, b.seqs, d.reorder)
+			}
+		}(d.shards[i])
+	}
+}
+
+// stop waits for queued calls to be delivered and for the goroutines started
+// by start to return. It must not be called concurrently with process.
+func (d *dispatcher) stop() {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+
+	d.workers.Wait()
+	d.queues = nil
+	d.reorder = nil
+}
+
+// process delivers calls to streams of their methods. With workers started,
+// calls are queued to their shards; once ctx passed to start is done, calls
+// are dropped rather than queued, as Run is returning.
+func (d *dispatcher) process(msg *Message) {
+	if len(msg.Messages) == 0 {
+		return
+	}
+
+	if len(d.shards) == 1 {
+		d.shards[0].process(msg)
+		return
+	}
+
+	batches := make([]batch, len(d.shards))
+	for _, clientMsg := range msg.Messages {
+		i := d.shard(clientMsg.Method)
+		batches[i].msgs = append(batches[i].msgs, clientMsg)
+
+		if d.reorder != nil {
+			batches[i].seqs = append(batches[i].seqs, d.seq)
+			d.seq++
+		}
+	}
+
+	for i, b := range batches {
+		if len(b.msgs) == 0 {
+			continue
+		}
+
+		if d.queues == nil {
+			d.shards[i].process(&Message{Messages: b.msgs})
+			continue
+		}
+
+		select {
+		case <-d.done:
+			return
+		case d.queues[i] <- b:
+		}
+	}
+}
+
+// fallback delivers call of method without stream to streams registered by
+// pattern, or reports it as unhandled.
+func (d *dispatcher) fallback(clientMsg ClientMsg) {
+	if !d.patterns.match(clientMsg) && d.patterns.unhandled != nil {
+		d.patterns.unhandled(UnhandledMessage{Call: clientMsg})
+	}
+}
+
+// reorderBuffer passes calls on in the order they were numbered, holding calls
+// processed ahead of their turn until the calls preceding them are processed.
+type reorderBuffer struct {
+	mtx  sync.Mutex
+	next uint64
+
+	// processed calls waiting for their turn, nil for calls which need not
+	// be passed on
+	pending map[uint64]*ClientMsg
+
+	pass func(ClientMsg)
+}
+
+func newReorderBuffer(pass func(ClientMsg)) *reorderBuffer {
+	return &reorderBuffer{pending: make(map[uint64]*ClientMsg), pass: pass}
+}
+
+// done marks call numbered seq as processed, passing on clientMsg unless it is
+// nil once all preceding calls are processed. Calls are passed on with the
+// buffer locked, so one at a time.
+func (b *reorderBuffer) done(seq uint64, clientMsg *ClientMsg) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.pending[seq] = clientMsg
+
+	for {
+		msg, ok := b.pending[b.next]
+		if !ok {
+			return
+		}
+
+		delete(b.pending, b.next)
+		b.next++
+
+		if msg != nil {
+			b.pass(*msg)
+		}
+	}
+}
+
+func (d *dispatcher) create(ctx context.Context, method string, cfg callbackConfig) (*CallbackStream, error) {
+	return d.shards[d.shard(method)].create(ctx, method, nil, cfg)
+}
+
+// createPattern registers stream receiving calls of methods matching pattern.
+// Calls are delivered to it by workers of their shards, one at a time.
+func (d *dispatcher) createPattern(ctx context.Context, pattern MethodPattern, cfg callbackConfig) (*CallbackStream, error) {
+	return d.patterns.create(ctx, pattern.String(), pattern, cfg)
+}
+
+// all returns shards along with streams registered by pattern.
+func (d *dispatcher) all() []*callbacks {
+	return append(d.shards[:len(d.shards):len(d.shards)], d.patterns)
+}
+
+func (d *dispatcher) stats() []CallbackStats {
+	res := make([]CallbackStats, 0)
+	for _, shard := range d.all() {
+		res = append(res, shard.stats()...)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Method < res[j].Method })
+
+	return res
+}
+
+// counts returns the number of open callback streams and messages dropped so
+// far.
+func (d *dispatcher) counts() (registered int, dropped int64) {
+	for _, shard := range d.all() {
+		r, n := shard.counts()
+		registered += r
+		dropped += n
+	}
+
+	return registered, dropped
+}
+
+// backlog returns the largest number of messages waiting to be read from a
+// single callback stream.
+func (d *dispatcher) backlog() int {
+	var res int
+	for _, shard := range d.all() {
+		if n := shard.backlog(); n > res {
+			res = n
+		}
+	}
+
+	return res
+}
+
+func (d *dispatcher) removeAll() {
+	for _, shard := range d.all() {
+		shard.removeAll()
+	}
+}
+
+func (d *dispatcher) closeAll() {
+	for _, shard := range d.all() {
+		shard.closeAll()
+	}
+}
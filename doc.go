@@ -16,6 +16,27 @@ At a high level, the WebSocket portion of SignalR goes through the following ste
 	- connect: attempt to connect to the websocket endpoint
 	- start: make the WebSocket connection usable by SignalR connections
 
+The package implements the classic ASP.NET SignalR protocol (version 1.5) and
+the JSON hub protocol of ASP.NET Core SignalR, which is selected automatically
+when the server answers negotiate request the Core way. Client and Conn work
+the same with both. Client results of ASP.NET Core 7, where the server invokes
+a client method and awaits its return value, are returned by handlers
+registered by Client.HandleResult. Reconnect to a classic server resumes the
+stream of messages from the last message ID the client has seen, and the
+server replays messages it buffered in the meantime (see MessagesMissed for
+gaps). Dropped connection to a Core server is replaced by a new one, unless
+StatefulReconnect is requested from ASP.NET Core 8 server supporting it: then
+the connection is reestablished and both sides send again messages the other
+did not acknowledge.
+
+Calls of hub methods are delivered to callback streams and handlers in the
+order they were received. With DispatchShards, calls of methods in different
+shards may overtake each other, which matters to streams registered by
+CallbackPattern receiving calls of several methods; OrderedDelivery restores
+the order for them. Handlers process their calls one at a time, while
+different handlers run concurrently. Flaky gateways and replay after
+reconnect may deliver a call twice, which Dedupe skips.
+
 See the provided examples for how to use this library.
 */
 package signalr
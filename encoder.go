@@ -0,0 +1,53 @@
+package signalr
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// maxPooledEncoderSize limits the size of buffers kept for reuse, so that an
+// occasional large message does not pin its buffer.
+const maxPooledEncoderSize = 64 << 10
+
+// encoder encodes outgoing messages into a reusable buffer.
+type encoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var encoders = sync.Pool{
+	New: func() interface{} {
+		e := &encoder{}
+		e.enc = json.NewEncoder(&e.buf)
+
+		return e
+	},
+}
+
+func getEncoder() *encoder {
+	e := encoders.Get().(*encoder)
+	e.buf.Reset()
+
+	return e
+}
+
+func putEncoder(e *encoder) {
+	if e.buf.Cap() > maxPooledEncoderSize {
+		return
+	}
+
+	encoders.Put(e)
+}
+
+// encode appends JSON encoding of v to the buffer.
+func (e *encoder) encode(v interface{}) error {
+	if err := e.enc.Encode(v); err != nil {
+		return err
+	}
+
+	// drop newline terminating every value written by json.Encoder
+	e.buf.Truncate(e.buf.Len() - 1)
+
+	return nil
+}
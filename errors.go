@@ -3,10 +3,23 @@ package signalr
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
+// NegotiateError is returned when negotiate step fails. StatusCode and Body
+// are set when server responded with unexpected HTTP status.
 type NegotiateError struct {
-	cause error
+	StatusCode int
+	Body       []byte
+	cause      error
+}
+
+func newNegotiateError(err error) *NegotiateError {
+	e := &NegotiateError{cause: err}
+	e.StatusCode, e.Body = responseStatus(err)
+
+	return e
 }
 
 func (e *NegotiateError) Error() string {
@@ -29,8 +42,19 @@ func (e *ConnectError) Unwrap() error {
 	return e.cause
 }
 
+// StartError is returned when start step fails. StatusCode and Body are set
+// when server responded with unexpected HTTP status.
 type StartError struct {
-	cause error
+	StatusCode int
+	Body       []byte
+	cause      error
+}
+
+func newStartError(err error) *StartError {
+	e := &StartError{cause: err}
+	e.StatusCode, e.Body = responseStatus(err)
+
+	return e
 }
 
 func (e *StartError) Error() string {
@@ -41,6 +65,34 @@ func (e *StartError) Unwrap() error {
 	return e.cause
 }
 
+type InvalidConnectionDataError struct {
+	data   string
+	reason string
+}
+
+func (e *InvalidConnectionDataError) Error() string {
+	return fmt.Sprintf("invalid connection data %q: %s", e.data, e.reason)
+}
+
+type UnsupportedProtocolError struct {
+	protocol string
+}
+
+func (e *UnsupportedProtocolError) Error() string {
+	return fmt.Sprintf("unsupported client protocol %q", e.protocol)
+}
+
+// IncompatibleProtocolError is returned when the server responds to negotiate
+// request with protocol version the client can not speak.
+type IncompatibleProtocolError struct {
+	Client string
+	Server string
+}
+
+func (e *IncompatibleProtocolError) Error() string {
+	return fmt.Sprintf("server protocol %q is incompatible with client protocol %q", e.Server, e.Client)
+}
+
 type DialError struct {
 	status int
 	cause  error
@@ -58,19 +110,68 @@ func (e *DialError) Unwrap() error {
 	return e.cause
 }
 
+// HandshakeError is returned when server rejects websocket handshake.
+type HandshakeError struct {
+	StatusCode int
+	Body       []byte
+	cause      error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake failed (%d): %v", e.StatusCode, e.cause)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.cause
+}
+
+// CloseError is returned when websocket connection is closed by the server.
+// Websocket close codes, see RFC 6455 section 7.4.1.
+const (
+	CloseNormal              = 1000
+	CloseGoingAway           = 1001
+	CloseProtocolError       = 1002
+	CloseUnsupportedData     = 1003
+	CloseNoStatus            = 1005
+	CloseAbnormal            = 1006
+	CloseInvalidPayload      = 1007
+	ClosePolicyViolation     = 1008
+	CloseMessageTooBig       = 1009
+	CloseMandatoryExtension  = 1010
+	CloseInternalServerError = 1011
+	CloseServiceRestart      = 1012
+	CloseTryAgainLater       = 1013
+)
+
+// CloseError is returned when websocket connection is closed, carrying the
+// close code and reason text sent by the server.
 type CloseError struct {
-	code int
-	text string
+	Code int
+	Text string
+}
+
+// Temporary reports whether the connection was closed for a transient reason,
+// so that reconnecting may succeed. Closures caused by protocol violations,
+// unsupported data and application defined codes are permanent.
+func (e *CloseError) Temporary() bool {
+	switch e.Code {
+	case CloseNormal, CloseGoingAway, CloseNoStatus, CloseAbnormal,
+		CloseInternalServerError, CloseServiceRestart, CloseTryAgainLater:
+		return true
+	default:
+		return false
+	}
 }
 
 func (e *CloseError) Error() string {
-	if e.text != "" {
-		return fmt.Sprintf("websocket closed %d: %s", e.code, e.text)
+	if e.Text != "" {
+		return fmt.Sprintf("websocket closed %d: %s", e.Code, e.Text)
 	}
 
-	return fmt.Sprintf("websocket closed %d", e.code)
+	return fmt.Sprintf("websocket closed %d", e.Code)
 }
 
+// IsCloseError reports whether err is CloseError with one of codes.
 func IsCloseError(err error, codes ...int) bool {
 	closeErr := &CloseError{}
 	if !errors.As(err, &closeErr) {
@@ -78,7 +179,7 @@ func IsCloseError(err error, codes ...int) bool {
 	}
 
 	for _, code := range codes {
-		if closeErr.code == code {
+		if closeErr.Code == code {
 			return true
 		}
 	}
@@ -86,6 +187,117 @@ func IsCloseError(err error, codes ...int) bool {
 	return false
 }
 
+// statusError is returned when server responds with unexpected HTTP status.
+type statusError struct {
+	code       int
+	status     string
+	body       []byte
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("request failed: %s", e.status)
+}
+
+// responseStatus extracts HTTP status code and response body from err.
+func responseStatus(err error) (int, []byte) {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code, statusErr.body
+	}
+
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) {
+		return handshakeErr.StatusCode, handshakeErr.Body
+	}
+
+	return 0, nil
+}
+
+// AuthError is returned when Authenticator fails to authorize a request.
+type AuthError struct {
+	cause error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication failed: %v", e.cause)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.cause
+}
+
+// ConfigError is returned by Config.Validate and Dial when a setting is
+// invalid.
+type ConfigError struct {
+	Field string
+	cause error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config %s: %v", e.Field, e.cause)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.cause
+}
+
+// ThrottledError is returned when server keeps responding with 429 Too Many
+// Requests after retries are exhausted. RetryAfter holds the duration
+// advertised by the server, zero if there was none.
+type ThrottledError struct {
+	RetryAfter time.Duration
+	cause      error
+}
+
+func (e *ThrottledError) Error() string {
+	if e.RetryAfter == 0 {
+		return fmt.Sprintf("throttled by server: %v", e.cause)
+	}
+
+	return fmt.Sprintf("throttled by server, retry after %v: %v", e.RetryAfter, e.cause)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return e.cause
+}
+
+// MessageTooLargeError is returned when the server sends a message exceeding
+// the limit set by MaxMessageSize option.
+type MessageTooLargeError struct {
+	Limit int64
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message exceeds the limit of %d bytes", e.Limit)
+}
+
+// ServerDisconnectedError is returned when server sends the disconnect command,
+// instructing client to stop and not to reconnect.
+type ServerDisconnectedError struct {
+	// the error sent by ASP.NET Core server along with close message, empty
+	// if there was none
+	Reason string
+}
+
+func (e *ServerDisconnectedError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("server requested disconnect: %s", e.Reason)
+	}
+
+	return "server requested disconnect"
+}
+
+// serverCloseError is returned when ASP.NET Core server sends close message.
+type serverCloseError struct {
+	reason         string
+	allowReconnect bool
+}
+
+func (e *serverCloseError) Error() string {
+	return fmt.Sprintf("server closed connection: %s", e.reason)
+}
+
 type ReadError struct {
 	cause error
 }
@@ -134,12 +346,228 @@ func (e *DuplicateCallbackError) Error() string {
 	return fmt.Sprintf("duplicate callback for method %q", e.method)
 }
 
+// ValidationError is delivered through callback stream when received call
+// fails validation set by Validate option.
+type ValidationError struct {
+	method string
+	cause  error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s call: %v", e.method, e.cause)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.cause
+}
+
+// TransformError is delivered through callback stream when arguments of
+// received call fail to transform, see TransformArgs option.
+type TransformError struct {
+	method string
+	cause  error
+}
+
+func (e *TransformError) Error() string {
+	return fmt.Sprintf("failed to transform %s call: %v", e.method, e.cause)
+}
+
+func (e *TransformError) Unwrap() error {
+	return e.cause
+}
+
+// SlowConsumerError is returned from callback stream stopped because it was not
+// read within MaxMessageProcessDuration.
+type SlowConsumerError struct {
+	Method  string
+	Timeout time.Duration
+}
+
+func (e *SlowConsumerError) Error() string {
+	return fmt.Sprintf("callback %s stopped: message not consumed within %s", e.Method, e.Timeout)
+}
+
+// UnacknowledgedError is passed to dead letter handler with message which was
+// delivered by stream registered with RequireAck as many times as allowed
+// without being acknowledged. It wraps the error passed to Nack, if any.
+type UnacknowledgedError struct {
+	Method     string
+	Deliveries int
+	cause      error
+}
+
+func (e *UnacknowledgedError) Error() string {
+	if e.cause == nil {
+		return fmt.Sprintf("%s message not acknowledged after %d deliveries", e.Method, e.Deliveries)
+	}
+
+	return fmt.Sprintf("%s message not acknowledged after %d deliveries: %v", e.Method, e.Deliveries, e.cause)
+}
+
+func (e *UnacknowledgedError) Unwrap() error {
+	return e.cause
+}
+
+// UnknownMessageError is returned from Client.Run in FailOnUnknown mode when
+// the server sends a completion of unknown invocation or a call of method
+// without callback streams.
+type UnknownMessageError struct {
+	// the method called, empty for completions
+	Method string
+
+	// the ID of completed invocation, zero for calls
+	InvocationID uint64
+}
+
+func (e *UnknownMessageError) Error() string {
+	if e.Method == "" {
+		return fmt.Sprintf("completion of unknown invocation %d", e.InvocationID)
+	}
+
+	return fmt.Sprintf("call of method %s without callback", e.Method)
+}
+
+// HandlerError is returned from Client.Run when handler registered with
+// Client.Handle fails.
+type HandlerError struct {
+	Method string
+	cause  error
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("%s handler failed: %v", e.Method, e.cause)
+}
+
+func (e *HandlerError) Unwrap() error {
+	return e.cause
+}
+
+// ReplayError is returned from Client.Run when declared subscription failed to
+// be replayed after reconnect.
+type ReplayError struct {
+	Method string
+	cause  error
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("failed to replay %s: %v", e.Method, e.cause)
+}
+
+func (e *ReplayError) Unwrap() error {
+	return e.cause
+}
+
+// JournalError is returned from Client.Enqueue, and from Client.Run, when
+// Journal fails to store or remove calls.
+type JournalError struct {
+	cause error
+}
+
+func (e *JournalError) Error() string {
+	return fmt.Sprintf("journal failed: %v", e.cause)
+}
+
+func (e *JournalError) Unwrap() error {
+	return e.cause
+}
+
+// InvocationError is returned when server fails to execute invoked method.
+// HubError, Data and StackTrace carry details of hub exceptions, when provided
+// by the server.
 type InvocationError struct {
-	method  string
-	id      int
-	message string
+	HubError   bool
+	Data       map[string]interface{}
+	StackTrace string
+	method     string
+	id         uint64
+	message    string
 }
 
 func (e *InvocationError) Error() string {
 	return fmt.Sprintf("failed to invoke %q (%d): %s", e.method, e.id, e.message)
 }
+
+// InvocationTimeoutError is returned when server did not respond to invocation
+// within InvocationTimeout.
+type InvocationTimeoutError struct {
+	// the time elapsed since the invocation was sent
+	Age    time.Duration
+	method string
+	id     uint64
+}
+
+func (e *InvocationTimeoutError) Error() string {
+	return fmt.Sprintf("no response to %q (%d) in %s", e.method, e.id, e.Age)
+}
+
+// SetupTimeoutError is returned when a step of the connection sequence did not
+// complete in time, see HandshakeTimeout and InitTimeout.
+type SetupTimeoutError struct {
+	// the step which timed out: handshake or init
+	Step    string
+	Timeout time.Duration
+	cause   error
+}
+
+func (e *SetupTimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s: %v", e.Step, e.Timeout, e.cause)
+}
+
+func (e *SetupTimeoutError) Unwrap() error {
+	return e.cause
+}
+
+// InvocationLostError is returned when connection, which invocation was sent
+// over, was replaced by renegotiate or failover before server responded. The
+// response can not arrive over the new connection.
+type InvocationLostError struct {
+	method string
+	id     uint64
+}
+
+func (e *InvocationLostError) Error() string {
+	return fmt.Sprintf("response to %q (%d) lost with replaced connection", e.method, e.id)
+}
+
+type DuplicateClientError struct {
+	name string
+}
+
+func (e *DuplicateClientError) Error() string {
+	return fmt.Sprintf("duplicate client %q", e.name)
+}
+
+type UnhealthyError struct {
+	names []string
+}
+
+func (e *UnhealthyError) Error() string {
+	return fmt.Sprintf("clients not connected: %s", strings.Join(e.names, ", "))
+}
+
+// HealthCheckError is returned by Client.Healthy describing why the client is
+// considered unhealthy.
+type HealthCheckError struct {
+	reason string
+}
+
+func (e *HealthCheckError) Error() string {
+	return fmt.Sprintf("client is unhealthy: %s", e.reason)
+}
+
+// PanicError is returned when a panic was recovered while dispatching
+// messages or running handlers.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("recovered from panic: %v", e.Value)
+}
+
+type ShutdownError struct{}
+
+func (e *ShutdownError) Error() string {
+	return "client is shutting down"
+}
@@ -0,0 +1,111 @@
+package signalr
+
+import "time"
+
+// Event is a lifecycle event of the client, delivered by Client.Events. It is
+// one of Negotiated, Connected, Reconnecting, Reconnected, InvocationCompleted,
+// UnknownMessage, MessageDropped, SlowConsumer, SetupTiming and Closed.
+type Event interface {
+	event()
+}
+
+// Negotiated is emitted once negotiate request to the endpoint succeeds.
+type Negotiated struct {
+	Endpoint string
+	Info     NegotiateInfo
+}
+
+// Connected is emitted once Dial establishes the connection.
+type Connected struct {
+	Endpoint string
+}
+
+// Reconnecting is emitted before every attempt to reestablish dropped
+// connection.
+type Reconnecting struct {
+	// the number of the attempt, starting at 1
+	Attempt int
+
+	// the time waited before the attempt
+	Delay time.Duration
+
+	// the error which dropped the connection or failed the previous attempt
+	Reason error
+}
+
+// Reconnected is emitted once the connection is reestablished, either by
+// reconnect or renegotiate.
+type Reconnected struct {
+	Endpoint string
+}
+
+// InvocationCompleted is emitted once the server responds to invocation, or it
+// fails without the response, e.g. times out or is lost with the connection.
+type InvocationCompleted struct {
+	Method string
+	ID     uint64
+
+	// see WithCorrelationID
+	CorrelationID string
+
+	// the time since the invocation was made
+	Duration time.Duration
+
+	// the error the invocation failed with
+	Err error
+}
+
+// UnknownMessage is emitted for every completion of unknown invocation and
+// call of method without callback streams, see UnknownMessages.
+type UnknownMessage struct {
+	// the method called, empty for completions
+	Method string
+
+	// the ID of completed invocation, zero for calls
+	InvocationID uint64
+}
+
+// MessageDropped is emitted for every message which was not delivered to a
+// callback stream, see OnDeadLetter.
+type MessageDropped struct {
+	Method string
+	Reason error
+}
+
+// SlowConsumer is emitted when a callback stream is stopped because it did
+// not read a message in time, see SlowConsumerError.
+type SlowConsumer struct {
+	Method  string
+	Timeout time.Duration
+}
+
+// Closed is emitted when Run returns.
+type Closed struct {
+	// the error returned by Run
+	Err error
+}
+
+func (Negotiated) event()          {}
+func (Connected) event()           {}
+func (Reconnecting) event()        {}
+func (Reconnected) event()         {}
+func (InvocationCompleted) event() {}
+func (UnknownMessage) event()      {}
+func (MessageDropped) event()      {}
+func (SlowConsumer) event()        {}
+func (SetupTiming) event()         {}
+func (Closed) event()              {}
+
+// the number of events buffered for a slow reader of Client.Events
+const eventBufferSize = 64
+
+// eventChan delivers events without blocking; events are dropped when nobody
+// reads them. Emitting to nil eventChan is a no-op.
+type eventChan chan Event
+
+func (ch eventChan) emit(ev Event) {
+	select {
+	case ch <- ev:
+	default:
+	}
+}
@@ -0,0 +1,183 @@
+// Command azure is a client of a hub hosted by Azure SignalR Service in
+// serverless mode, whose clients are authorized by a negotiate function of
+// Azure Functions:
+//
+//	[FunctionName("negotiate")]
+//	public static SignalRConnectionInfo Negotiate(
+//	    [HttpTrigger(AuthorizationLevel.Anonymous, "post")] HttpRequest req,
+//	    [SignalRConnectionInfo(HubName = "chat")] SignalRConnectionInfo info)
+//	{
+//	    return info;
+//	}
+//
+// The function responds with the URL of the hub on the service and an access
+// token, which is sent as bearer token with every request to the service.
+// Tokens expire, typically after an hour; once the service rejects the token,
+// a new one is requested from the function. The connection is renegotiated
+// whenever it drops, as stateful reconnect is not requested (see
+// signalr.StatefulReconnect).
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/r0bot/signalr/v2"
+)
+
+func main() {
+	functions := flag.String("functions", "http://localhost:7071/api", "base URL of the function app")
+	key := flag.String("key", "", "function key, if the negotiate function requires one")
+	user := flag.String("user", "", "user ID passed to the negotiate function")
+	target := flag.String("target", "newMessage", "method called by the hub")
+	flag.Parse()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	auth := &functionAuth{endpoint: strings.TrimSuffix(*functions, "/") + "/negotiate", key: *key, user: *user}
+
+	dctx, dcancel := context.WithTimeout(ctx, 30*time.Second)
+	defer dcancel()
+
+	// the function tells where the hub is, the service then negotiates the
+	// connection like any ASP.NET Core server
+	info, err := auth.refresh(dctx)
+	if err != nil {
+		//nolint:gocritic
+		log.Fatal(err)
+	}
+
+	conn, err := signalr.Dial(dctx, info.URL, "",
+		signalr.Authentication(auth),
+		signalr.MaxReconnectDuration(time.Minute),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client := signalr.NewClient("", conn)
+	defer client.Close()
+
+	err = client.Handle(*target, func(ctx context.Context, args []json.RawMessage) error {
+		for _, arg := range args {
+			fmt.Printf("%s ", arg)
+		}
+
+		fmt.Println()
+
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		for ev := range client.Events() {
+			switch ev := ev.(type) {
+			case signalr.Reconnected:
+				log.Printf("reconnected to %s", ev.Endpoint)
+			case signalr.Closed:
+				return
+			}
+		}
+	}()
+
+	// renegotiate dropped connections, backing off while the service is
+	// unavailable
+	policy := signalr.RetryPolicy{
+		MaxRetries: 10,
+		Backoff:    func() backoff.BackOff { return backoff.NewExponentialBackOff() },
+	}
+
+	if err := client.RunWithReconnect(ctx, policy); err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+}
+
+// connectionInfo is the response of the negotiate function.
+type connectionInfo struct {
+	URL         string `json:"url"`
+	AccessToken string `json:"accessToken"`
+}
+
+// functionAuth authorizes requests to the service with access tokens issued
+// by the negotiate function, requesting a new token once the service rejects
+// the current one.
+type functionAuth struct {
+	endpoint string
+	key      string
+	user     string
+
+	mtx   sync.Mutex
+	token string
+}
+
+func (a *functionAuth) Authorize(ctx context.Context, _ *http.Request, challenges []string) (string, error) {
+	a.mtx.Lock()
+	token := a.token
+	a.mtx.Unlock()
+
+	if len(challenges) > 0 || token == "" {
+		info, err := a.refresh(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		token = info.AccessToken
+	}
+
+	return "Bearer " + token, nil
+}
+
+// refresh calls the negotiate function for a new access token.
+func (a *functionAuth) refresh(ctx context.Context) (connectionInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, nil)
+	if err != nil {
+		return connectionInfo{}, err
+	}
+
+	if a.key != "" {
+		req.Header.Set("x-functions-key", a.key)
+	}
+
+	if a.user != "" {
+		req.Header.Set("x-ms-signalr-userid", a.user)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return connectionInfo{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return connectionInfo{}, fmt.Errorf("negotiate function responded with %s", res.Status)
+	}
+
+	var info connectionInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return connectionInfo{}, err
+	}
+
+	if info.URL == "" || info.AccessToken == "" {
+		return connectionInfo{}, errors.New("negotiate function responded without URL or access token")
+	}
+
+	a.mtx.Lock()
+	a.token = info.AccessToken
+	a.mtx.Unlock()
+
+	return info, nil
+}
@@ -0,0 +1,95 @@
+// Command core-chat is a client of the ChatHub of the ASP.NET Core SignalR
+// tutorial, which broadcasts messages sent by SendMessage to all clients as
+// ReceiveMessage calls:
+//
+//	public class ChatHub : Hub
+//	{
+//	    public async Task SendMessage(string user, string message)
+//	    {
+//	        await Clients.All.SendAsync("ReceiveMessage", user, message);
+//	    }
+//	}
+//
+// It prints received messages and sends every line read from stdin.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/r0bot/signalr/v2"
+	"golang.org/x/sync/errgroup"
+)
+
+func main() {
+	endpoint := flag.String("url", "https://localhost:5001/chatHub", "URL of the hub")
+	user := flag.String("user", "gopher", "name messages are sent by")
+	flag.Parse()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	dctx, dcancel := context.WithTimeout(ctx, 10*time.Second)
+	defer dcancel()
+
+	// Core servers are detected by negotiate, they take no connection data
+	// as hubs are mapped to URLs
+	conn, err := signalr.Dial(dctx, *endpoint, "")
+	if err != nil {
+		//nolint:gocritic
+		log.Fatal(err)
+	}
+
+	if state := conn.State(); state.Protocol != signalr.CoreProtocol {
+		log.Fatalf("expected ASP.NET Core server, got protocol %s", state.Protocol)
+	}
+
+	// Core hubs have no names on the wire
+	client := signalr.NewClient("", conn)
+	defer client.Close()
+
+	err = client.Handle("ReceiveMessage", func(ctx context.Context, args []json.RawMessage) error {
+		var from, message string
+		if len(args) != 2 || json.Unmarshal(args[0], &from) != nil || json.Unmarshal(args[1], &message) != nil {
+			return fmt.Errorf("unexpected arguments %s", args)
+		}
+
+		fmt.Printf("%s: %s\n", from, message)
+
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	errg, ctx := errgroup.WithContext(ctx)
+	errg.Go(func() error { return client.Run(ctx) })
+	errg.Go(func() error {
+		defer cancel()
+
+		lines := bufio.NewScanner(os.Stdin)
+		for lines.Scan() {
+			ictx, icancel := context.WithTimeout(ctx, 5*time.Second)
+			err := client.Invoke(ictx, "SendMessage", *user, lines.Text()).Exec()
+			icancel()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return lines.Err()
+	})
+
+	if err := errg.Wait(); err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,24 @@
+package signalr
+
+// FailoverStrategy defines the order in which endpoints are tried.
+type FailoverStrategy int
+
+const (
+	// FailoverPriority always tries endpoints in the order they were given,
+	// starting from the primary one.
+	FailoverPriority FailoverStrategy = iota
+
+	// FailoverRoundRobin starts from the endpoint following the one used
+	// by the previous connection.
+	FailoverRoundRobin
+)
+
+// first returns index of the endpoint to try first, given index of the
+// endpoint used by the previous connection.
+func (s FailoverStrategy) first(current, count int) int {
+	if s == FailoverRoundRobin && count != 0 {
+		return (current + 1) % count
+	}
+
+	return 0
+}
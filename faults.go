@@ -0,0 +1,251 @@
+package signalr
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Faults describes faults injected into websocket connections by
+// FaultInjector. The zero value injects no faults.
+type Faults struct {
+	// delay of every frame read or written
+	Latency time.Duration
+
+	// probabilities, between 0 and 1, of dropping a received frame and of
+	// delivering it twice
+	DropRate      float64
+	DuplicateRate float64
+
+	// the number of frames read from a connection before it is disconnected,
+	// zero disables
+	DisconnectAfter int
+
+	// the amount of time after which a connection is disconnected, zero
+	// disables
+	DisconnectEvery time.Duration
+
+	// source of random drops and duplicates, seeded with the current time if
+	// nil; a seeded source makes runs reproducible
+	Rand *rand.Rand
+
+	// clock timing latency and disconnects, system clock if nil
+	Clock Clock
+}
+
+// FaultInjector decorates websocket dialer so that connections it dials suffer
+// from faults, which lets tests validate reconnect and backpressure handling
+// under adverse conditions:
+//
+//	conn, err := signalr.Dial(ctx, endpoint, cdata,
+//		signalr.Dialer(signalr.FaultInjector(signalr.NewDefaultDialer, signalr.Faults{
+//			DropRate:        0.01,
+//			DisconnectEvery: time.Minute,
+//		})),
+//	)
+//
+// Injected disconnects close the connection and fail reads with CloseError
+// carrying CloseAbnormal code, as network failures do.
+func FaultInjector(dialer WebsocketDialerFunc, faults Faults) WebsocketDialerFunc {
+	if faults.Rand == nil {
+		faults.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	if faults.Clock == nil {
+		faults.Clock = systemClock{}
+	}
+
+	// random source is shared by connections of all dialers
+	injector := &faultInjector{faults: faults}
+
+	return func(client *http.Client) WebsocketDialer {
+		return &faultDialer{dialer: dialer(client), injector: injector}
+	}
+}
+
+type faultInjector struct {
+	faults Faults
+	mtx    sync.Mutex
+}
+
+// chance reports whether an event of probability p happens.
+func (i *faultInjector) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	return i.faults.Rand.Float64() < p
+}
+
+type faultDialer struct {
+	dialer   WebsocketDialer
+	injector *faultInjector
+}
+
+func (d *faultDialer) Dial(ctx context.Context, u string, headers http.Header) (WebsocketConn, int, error) {
+	conn, status, err := d.dialer.Dial(ctx, u, headers)
+	if err != nil {
+		return conn, status, err
+	}
+
+	return newFaultConn(conn, d.injector), status, nil
+}
+
+// faultConn injects faults into websocket connection. Reads are serialized by
+// Conn, so read state needs no locking.
+type faultConn struct {
+	WebsocketConn
+	injector *faultInjector
+
+	// frames read so far, and frame to be delivered again
+	frames    int
+	duplicate *faultFrame
+
+	// closed by scheduled disconnect and by Close respectively
+	disconnected chan struct{}
+	done         chan struct{}
+	once         sync.Once
+}
+
+type faultFrame struct {
+	messageType int
+	data        []byte
+}
+
+func newFaultConn(conn WebsocketConn, injector *faultInjector) *faultConn {
+	c := &faultConn{
+		WebsocketConn: conn,
+		injector:      injector,
+		disconnected:  make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	if d := injector.faults.DisconnectEvery; d > 0 {
+		timer := injector.faults.Clock.NewTimer(d)
+
+		go func() {
+			defer timer.Stop()
+
+			select {
+			case <-timer.C():
+				close(c.disconnected)
+				_ = c.WebsocketConn.Close()
+			case <-c.done:
+			}
+		}()
+	}
+
+	return c
+}
+
+func (c *faultConn) ReadMessage(ctx context.Context) (int, []byte, error) {
+	faults := c.injector.faults
+
+	if frame := c.duplicate; frame != nil {
+		c.duplicate = nil
+		return frame.messageType, frame.data, nil
+	}
+
+	for {
+		if n := faults.DisconnectAfter; n > 0 && c.frames >= n {
+			_ = c.Close()
+			return 0, nil, errInjectedDisconnect()
+		}
+
+		messageType, data, err := c.read(ctx)
+		if err != nil {
+			return messageType, data, err
+		}
+
+		c.frames++
+
+		if err := c.delay(ctx); err != nil {
+			return 0, nil, err
+		}
+
+		if c.injector.chance(faults.DropRate) {
+			continue
+		}
+
+		if c.injector.chance(faults.DuplicateRate) {
+			c.duplicate = &faultFrame{messageType: messageType, data: append([]byte(nil), data...)}
+		}
+
+		return messageType, data, nil
+	}
+}
+
+// read reads the next frame, failing once the connection is disconnected by
+// schedule, even if the underlying read does not return on close.
+func (c *faultConn) read(ctx context.Context) (int, []byte, error) {
+	if c.injector.faults.DisconnectEvery <= 0 {
+		return c.WebsocketConn.ReadMessage(ctx)
+	}
+
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-c.disconnected:
+			cancel()
+		case <-rctx.Done():
+		}
+	}()
+
+	messageType, data, err := c.WebsocketConn.ReadMessage(rctx)
+	if err != nil {
+		select {
+		case <-c.disconnected:
+			return 0, nil, errInjectedDisconnect()
+		default:
+		}
+	}
+
+	return messageType, data, err
+}
+
+func (c *faultConn) WriteMessage(ctx context.Context, messageType int, p []byte) error {
+	if err := c.delay(ctx); err != nil {
+		return err
+	}
+
+	return c.WebsocketConn.WriteMessage(ctx, messageType, p)
+}
+
+func (c *faultConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+
+	return c.WebsocketConn.Close()
+}
+
+func (c *faultConn) Metadata() ConnMetadata {
+	return metadataOf(c.WebsocketConn)
+}
+
+// delay waits for the latency to pass.
+func (c *faultConn) delay(ctx context.Context) error {
+	d := c.injector.faults.Latency
+	if d <= 0 {
+		return nil
+	}
+
+	timer := c.injector.faults.Clock.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+func errInjectedDisconnect() error {
+	return &CloseError{Code: CloseAbnormal, Text: "injected disconnect"}
+}
@@ -0,0 +1,219 @@
+package signalr
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileJournal is Journal storing calls in a file, as a log of appended and
+// removed entries which is synced to disk on every change and compacted when
+// the journal is opened. A file must be used by a single journal at a time.
+type FileJournal struct {
+	path string
+
+	mtx     sync.Mutex
+	file    *os.File
+	entries []JournalEntry
+}
+
+// fileRecord is a line of journal file, holding either appended entry or ID of
+// removed one.
+type fileRecord struct {
+	Append *JournalEntry `json:",omitempty"`
+	Remove uint64        `json:",omitempty"`
+}
+
+// OpenFileJournal opens journal stored in file at path, creating it if it does
+// not exist. A truncated last record, left by a crash while it was written, is
+// ignored.
+func OpenFileJournal(path string) (*FileJournal, error) {
+	entries, err := readJournalFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &FileJournal{path: path, entries: entries}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func readJournalFile(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+
+	for scanner.Scan() {
+		var rec fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// only the last record can be truncated
+			if scanner.Scan() {
+				return nil, fmt.Errorf("corrupted journal %s: %w", path, err)
+			}
+
+			break
+		}
+
+		switch {
+		case rec.Append != nil:
+			entries = append(entries, *rec.Append)
+		case rec.Remove != 0:
+			entries = removeEntry(entries, rec.Remove)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// compact replaces journal file with one holding only stored entries.
+func (j *FileJournal) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for i := range j.entries {
+		if err := writeRecord(w, fileRecord{Append: &j.entries[i]}); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return err
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0)
+
+	return err
+}
+
+func writeRecord(w *bufio.Writer, rec fileRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	return w.WriteByte('\n')
+}
+
+// write appends a record to the journal file and syncs it to disk.
+func (j *FileJournal) write(rec fileRecord) error {
+	if j.file == nil {
+		return os.ErrClosed
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+// Append implements Journal.
+func (j *FileJournal) Append(entry JournalEntry) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if err := j.write(fileRecord{Append: &entry}); err != nil {
+		return err
+	}
+
+	j.entries = append(j.entries, entry)
+
+	return nil
+}
+
+// Remove implements Journal.
+func (j *FileJournal) Remove(id uint64) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if err := j.write(fileRecord{Remove: id}); err != nil {
+		return err
+	}
+
+	j.entries = removeEntry(j.entries, id)
+
+	return nil
+}
+
+// Entries implements Journal.
+func (j *FileJournal) Entries() ([]JournalEntry, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	return append([]JournalEntry(nil), j.entries...), nil
+}
+
+// Close closes the journal file.
+func (j *FileJournal) Close() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+
+	err := j.file.Close()
+	j.file = nil
+
+	return err
+}
+
+func removeEntry(entries []JournalEntry, id uint64) []JournalEntry {
+	res := entries[:0:0]
+	for _, entry := range entries {
+		if entry.ID != id {
+			res = append(res, entry)
+		}
+	}
+
+	return res
+}
@@ -1,6 +1,6 @@
 module github.com/r0bot/signalr/v2
 
-go 1.15
+go 1.18
 
 require (
 	github.com/cenkalti/backoff/v4 v4.1.0
@@ -10,3 +10,9 @@ require (
 	github.com/stretchr/testify v1.6.1
 	golang.org/x/sync v0.0.0-20201020160332-67f06af15bc9
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+)
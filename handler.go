@@ -0,0 +1,134 @@
+package signalr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// HandlerFunc processes arguments of a single hub method call.
+type HandlerFunc func(ctx context.Context, args []json.RawMessage) error
+
+// Handle registers fn to be called for every call of hub method, as an
+// alternative to reading CallbackStream. Calls are handled sequentially on a
+// dedicated goroutine. If fn returns an error or panics, the handler is
+// deregistered and Run returns HandlerError. The handler is also deregistered
+// when Run returns, which cancels context passed to fn and waits for fn to
+// return. With RequireAck, calls fn fails to handle are redelivered instead.
+func (c *Client) Handle(method string, fn HandlerFunc, opts ...CallbackOpt) error {
+	return c.handleCalls(method, opts, func(ctx context.Context, msg ClientMsg) error {
+		return c.handle(ctx, method, fn, msg.Args)
+	})
+}
+
+// ResultHandlerFunc processes arguments of a single hub method call, returning
+// the result awaited by the server.
+type ResultHandlerFunc func(ctx context.Context, args []json.RawMessage) (interface{}, error)
+
+// HandleResult registers fn to be called for every call of client method by
+// ASP.NET Core server awaiting its result, which is sent back to the server
+// along with the error returned by fn or the panic it raised. Failing to send
+// the result is logged, as the server fails the call once the connection
+// drops. Calls not awaiting result are handled like by Handle, their results
+// are discarded. Classic servers can not invoke client methods this way.
+func (c *Client) HandleResult(method string, fn ResultHandlerFunc, opts ...CallbackOpt) error {
+	return c.handleCalls(method, opts, func(ctx context.Context, msg ClientMsg) error {
+		var res interface{}
+
+		err := c.handle(ctx, method, func(ctx context.Context, args []json.RawMessage) (err error) {
+			res, err = fn(ctx, args)
+			return err
+		}, msg.Args)
+
+		if msg.ResultID == "" {
+			return err
+		}
+
+		completion := &Completion{}
+		if err != nil {
+			completion.Error = err.Error()
+		} else if completion.Result, err = c.codec.marshal(res); err != nil {
+			completion.Error = fmt.Sprintf("failed to marshal result: %v", err)
+		}
+
+		if err := c.conn.WriteMessage(ctx, ClientMsg{ResultID: msg.ResultID, Completion: completion}); err != nil {
+			c.log(LevelWarn, "failed to send result", "method", method, "invocation_id", msg.ResultID, "error", err)
+		}
+
+		return nil
+	})
+}
+
+// handleCalls delivers calls of method to fn on a dedicated goroutine, see
+// Handle.
+func (c *Client) handleCalls(method string, opts []CallbackOpt, fn func(ctx context.Context, msg ClientMsg) error) error {
+	stream, err := c.Callback(context.Background(), method, opts...)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(stream.ctx)
+
+	c.handlers.Add(2)
+
+	go func() {
+		defer c.handlers.Done()
+
+		select {
+		case <-stream.removed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	go func() {
+		defer c.handlers.Done()
+		defer stream.Close()
+		defer cancel()
+
+		for {
+			res := stream.readResult()
+			if errors.Is(res.err, context.Canceled) {
+				return
+			}
+
+			err := res.err
+			if err == nil {
+				err = fn(ctx, res.message)
+
+				if stream.config.RequireAck {
+					if err != nil {
+						stream.Nack(err)
+					} else {
+						stream.Ack()
+					}
+
+					continue
+				}
+			}
+
+			if err != nil {
+				c.fail(&HandlerError{Method: method, cause: err})
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (c *Client) handle(ctx context.Context, method string, fn HandlerFunc, args []json.RawMessage) (err error) {
+	defer recoverPanic(LoggerFunc(c.log), &err, "method", method)
+
+	return fn(ctx, args)
+}
+
+// fail reports an asynchronous error making Run return. Only the first error
+// is kept.
+func (c *Client) fail(err error) {
+	select {
+	case c.errs <- err:
+	default:
+	}
+}
@@ -0,0 +1,44 @@
+package signalr
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Healthy returns nil if the client is running and its connection is alive,
+// otherwise HealthCheckError. The connection is considered dead if no message,
+// including keepalive, was received within keepalive timeout advertised by the
+// server. The client is also unhealthy if callback streams are not read fast
+// enough and their backlog reaches MaxBacklog. It is suitable for readiness
+// probes.
+func (c *Client) Healthy(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if atomic.LoadInt32(&c.shutdown) == 1 {
+		return &HealthCheckError{reason: "client is shut down"}
+	}
+
+	if atomic.LoadInt32(&c.running) == 0 {
+		return &HealthCheckError{reason: "client is not running"}
+	}
+
+	if atomic.LoadInt32(&c.conn.closing) == 1 {
+		return &HealthCheckError{reason: "connection is closed"}
+	}
+
+	if timeout := c.conn.NegotiateInfo().KeepAliveTimeout; timeout > 0 {
+		if elapsed := c.conn.config.Clock.Now().Sub(c.conn.LastRead()); elapsed > timeout {
+			return &HealthCheckError{reason: fmt.Sprintf("no messages received for %s", elapsed.Round(time.Millisecond))}
+		}
+	}
+
+	if backlog := c.callbacks.backlog(); c.config.MaxBacklog > 0 && backlog >= c.config.MaxBacklog {
+		return &HealthCheckError{reason: fmt.Sprintf("%d messages waiting in callback stream", backlog)}
+	}
+
+	return nil
+}
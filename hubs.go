@@ -0,0 +1,60 @@
+package signalr
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+type hubName struct {
+	Name string `json:"name"`
+}
+
+// Hubs builds connection data for given hub names, e.g.
+//
+//	signalr.Dial(ctx, endpoint, signalr.Hubs("corehub"))
+//
+// Names are validated by Dial.
+func Hubs(names ...string) string {
+	hubs := make([]hubName, len(names))
+	for i, name := range names {
+		hubs[i] = hubName{Name: name}
+	}
+
+	data, _ := json.Marshal(hubs)
+
+	return string(data)
+}
+
+// validateConnectionData checks that connection data is either empty
+// (persistent connection) or a list of unique non-empty hub names.
+func validateConnectionData(cdata string) error {
+	if cdata == "" {
+		return nil
+	}
+
+	var hubs []hubName
+	if err := json.Unmarshal([]byte(cdata), &hubs); err != nil {
+		return &InvalidConnectionDataError{data: cdata, reason: err.Error()}
+	}
+
+	if len(hubs) == 0 {
+		return &InvalidConnectionDataError{data: cdata, reason: "no hubs"}
+	}
+
+	seen := make(map[string]bool, len(hubs))
+	for _, hub := range hubs {
+		// hub names are case insensitive
+		name := strings.ToLower(strings.TrimSpace(hub.Name))
+
+		switch {
+		case name == "":
+			return &InvalidConnectionDataError{data: cdata, reason: "empty hub name"}
+		case seen[name]:
+			return &InvalidConnectionDataError{data: cdata, reason: "duplicate hub " + hub.Name}
+		}
+
+		seen[name] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+//go:build integration
+
+// Package integration runs the client against real ASP.NET SignalR servers,
+// classic and Core, started in Docker containers by testcontainers:
+//
+//	cd integration && go test -tags integration ./...
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/r0bot/signalr/v2"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// server describes a test server image built from testdata.
+type server struct {
+	name string
+
+	// path of hub endpoint
+	path string
+
+	// interval of keepalives sent by the server
+	keepalive time.Duration
+}
+
+var servers = []server{
+	{name: "classic", path: "/signalr", keepalive: 2 * time.Second},
+	{name: "core", path: "/echo", keepalive: time.Second},
+}
+
+func TestIntegration(t *testing.T) {
+	for _, srv := range servers {
+		srv := srv
+
+		t.Run(srv.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			defer cancel()
+
+			addr := startServer(ctx, t, srv)
+
+			t.Run("negotiate", func(t *testing.T) {
+				client := dial(ctx, t, srv, addr)
+
+				info := client.NegotiateInfo()
+				if info.ConnectionID == "" || info.KeepAliveTimeout <= 0 {
+					t.Errorf("unexpected negotiate response %+v", info)
+				}
+			})
+
+			t.Run("invoke", func(t *testing.T) {
+				client := dial(ctx, t, srv, addr)
+
+				var res string
+				if err := client.Invoke(ctx, "Echo", "hello").Unmarshal(&res); err != nil {
+					t.Fatal(err)
+				} else if res != "hello" {
+					t.Errorf("expected hello, got %q", res)
+				}
+
+				var invErr *signalr.InvocationError
+				if err := client.Invoke(ctx, "Fail").Unmarshal(&res); !errors.As(err, &invErr) {
+					t.Errorf("expected InvocationError, got %v", err)
+				}
+			})
+
+			t.Run("callbacks", func(t *testing.T) {
+				client := dial(ctx, t, srv, addr)
+
+				stream, err := client.Callback(ctx, "message")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer stream.Close()
+
+				for i := 0; i < 3; i++ {
+					exp := fmt.Sprintf("message %d", i)
+					if err := client.Invoke(ctx, "Broadcast", exp).Exec(); err != nil {
+						t.Fatal(err)
+					}
+
+					var msg string
+					if err := stream.Read(&msg); err != nil {
+						t.Fatal(err)
+					} else if msg != exp {
+						t.Errorf("expected %q, got %q", exp, msg)
+					}
+				}
+			})
+
+			t.Run("reconnect", func(t *testing.T) {
+				p := newProxy(t, addr)
+				client := dial(ctx, t, srv, p.addr())
+
+				p.drop()
+
+				// invocations fail until the connection is reestablished
+				deadline := time.Now().Add(time.Minute)
+				for {
+					var res string
+					err := client.Invoke(ctx, "Echo", "again").Unmarshal(&res)
+					if err == nil && res == "again" {
+						break
+					}
+
+					if time.Now().After(deadline) {
+						t.Fatalf("connection was not reestablished: %v", err)
+					}
+
+					time.Sleep(100 * time.Millisecond)
+				}
+
+				if n := client.Stats().Reconnects; n == 0 {
+					t.Error("expected connection to be reestablished")
+				}
+			})
+
+			t.Run("keepalive", func(t *testing.T) {
+				client := dial(ctx, t, srv, addr)
+
+				time.Sleep(3 * srv.keepalive)
+
+				stats := client.Stats()
+				if stats.Keepalives == 0 || stats.Reconnects != 0 {
+					t.Errorf("expected keepalives without reconnects, got %+v", stats)
+				}
+
+				if err := client.Invoke(ctx, "Echo", "alive").Exec(); err != nil {
+					t.Error(err)
+				}
+			})
+		})
+	}
+}
+
+// startServer builds and starts server image, returning its address.
+func startServer(ctx context.Context, t *testing.T, srv server) string {
+	t.Helper()
+
+	dir, err := filepath.Abs(filepath.Join("testdata", srv.name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			FromDockerfile: testcontainers.FromDockerfile{Context: dir},
+			ExposedPorts:   []string{"8080/tcp"},
+			WaitingFor:     wait.ForHTTP("/health").WithPort("8080/tcp").WithStartupTimeout(5 * time.Minute),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to start %s server: %v", srv.name, err)
+	}
+
+	t.Cleanup(func() {
+		_ = container.Terminate(context.Background())
+	})
+
+	host, err := container.Host(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := container.MappedPort(ctx, "8080/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return net.JoinHostPort(host, port.Port())
+}
+
+// dial connects to echo hub of server at addr and runs the client until the
+// test ends.
+func dial(ctx context.Context, t *testing.T, srv server, addr string) *signalr.Client {
+	t.Helper()
+
+	conn, err := signalr.Dial(ctx, "http://"+addr+srv.path, `[{"name":"echo"}]`,
+		signalr.RetryInterval(100*time.Millisecond),
+		signalr.MaxReconnectDuration(time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := signalr.NewClient("echo", conn)
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- client.Run(ctx) }()
+
+	t.Cleanup(func() {
+		cancel()
+
+		if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("client failed: %v", err)
+		}
+
+		_ = client.Close()
+	})
+
+	return client
+}
+
+// proxy forwards TCP connections to the server, so that tests can drop them
+// as network failures would.
+type proxy struct {
+	listener net.Listener
+	target   string
+
+	mtx   sync.Mutex
+	conns []net.Conn
+}
+
+func newProxy(t *testing.T, target string) *proxy {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &proxy{listener: l, target: target}
+	go p.serve()
+
+	t.Cleanup(func() {
+		_ = l.Close()
+		p.drop()
+	})
+
+	return p
+}
+
+func (p *proxy) addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *proxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			_ = conn.Close()
+			continue
+		}
+
+		p.mtx.Lock()
+		p.conns = append(p.conns, conn, upstream)
+		p.mtx.Unlock()
+
+		go pipe(conn, upstream)
+		go pipe(upstream, conn)
+	}
+}
+
+// drop closes all connections open so far.
+func (p *proxy) drop() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+
+	p.conns = nil
+}
+
+func pipe(dst, src net.Conn) {
+	_, _ = io.Copy(dst, src)
+	_ = dst.Close()
+}
@@ -0,0 +1,53 @@
+using System;
+using System.Threading;
+using Microsoft.AspNet.SignalR;
+using Microsoft.AspNet.SignalR.Hubs;
+using Microsoft.Owin.Hosting;
+using Owin;
+
+namespace Server
+{
+    public static class Program
+    {
+        public static void Main()
+        {
+            using (WebApp.Start<Startup>("http://+:8080"))
+            {
+                Console.WriteLine("listening on :8080");
+                Thread.Sleep(Timeout.Infinite);
+            }
+        }
+    }
+
+    public class Startup
+    {
+        public void Configuration(IAppBuilder app)
+        {
+            // keepalives every 2 seconds, the shortest the server allows
+            GlobalHost.Configuration.DisconnectTimeout = TimeSpan.FromSeconds(6);
+            GlobalHost.Configuration.KeepAlive = TimeSpan.FromSeconds(2);
+
+            app.Map("/health", health => health.Run(context => context.Response.WriteAsync("ok")));
+            app.MapSignalR(new HubConfiguration { EnableDetailedErrors = true });
+        }
+    }
+
+    [HubName("echo")]
+    public class EchoHub : Hub
+    {
+        public string Echo(string message)
+        {
+            return message;
+        }
+
+        public void Broadcast(string message)
+        {
+            Clients.Caller.message(message);
+        }
+
+        public void Fail()
+        {
+            throw new HubException("failed");
+        }
+    }
+}
@@ -0,0 +1,27 @@
+using Microsoft.AspNetCore.SignalR;
+
+var builder = WebApplication.CreateBuilder(args);
+
+// keepalives every second, so that tests do not wait long for them
+builder.Services.AddSignalR(options =>
+{
+    options.KeepAliveInterval = TimeSpan.FromSeconds(1);
+    options.EnableDetailedErrors = true;
+});
+
+var app = builder.Build();
+
+app.UseWebSockets();
+app.MapGet("/health", () => "ok");
+app.MapHub<EchoHub>("/echo");
+
+app.Run("http://0.0.0.0:8080");
+
+public class EchoHub : Hub
+{
+    public string Echo(string message) => message;
+
+    public Task Broadcast(string message) => Clients.Caller.SendAsync("message", message);
+
+    public void Fail() => throw new HubException("failed");
+}
@@ -0,0 +1,29 @@
+//go:build go1.23
+
+package signalr
+
+import (
+	"context"
+	"iter"
+)
+
+// Messages returns iterator over messages read by Next, paired with errors of
+// individual messages, such as ValidationError. Iteration ends once the stream
+// is stopped or ctx is done, Err reports the reason:
+//
+//	for msg, err := range stream.Messages(ctx) {
+//		...
+//	}
+//
+//	if err := stream.Err(); err != nil {
+//		...
+//	}
+func (s *CallbackStream) Messages(ctx context.Context) iter.Seq2[ClientMsg, error] {
+	return func(yield func(ClientMsg, error) bool) {
+		for s.Next(ctx) {
+			if !yield(s.iter.current.message, s.iter.current.err) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+//go:build go1.23
+
+package signalr
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCallbackMessages(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg})
+
+	stream, err := client.Callback(ctx, "method")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	client.callbacks.process(&Message{Messages: []ClientMsg{
+		{Method: "method", Args: []json.RawMessage{json.RawMessage(`1`)}},
+		{Method: "method", Args: []json.RawMessage{json.RawMessage(`2`)}},
+		{Method: "method", Args: []json.RawMessage{json.RawMessage(`3`)}},
+	}})
+
+	var args []string
+	for msg, err := range stream.Messages(ctx) {
+		if !expectNoError(t, err) {
+			return
+		}
+
+		args = append(args, string(msg.Args[0]))
+		if len(args) == 2 {
+			break
+		}
+	}
+
+	if len(args) != 2 || args[0] != "1" || args[1] != "2" {
+		t.Errorf("expected arguments [1 2], got %v", args)
+	}
+
+	// iteration resumes with the next message
+	for msg := range stream.Messages(ctx) {
+		if string(msg.Args[0]) != "3" {
+			t.Errorf("expected argument 3, got %s", msg.Args[0])
+		}
+
+		stream.Close()
+	}
+
+	if err := stream.Err(); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
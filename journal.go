@@ -0,0 +1,278 @@
+package signalr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// defaultJournalTimeout bounds attempts to send journaled calls when neither
+// JournalConfig.Timeout nor InvocationTimeout is set.
+const defaultJournalTimeout = 30 * time.Second
+
+// Journal persists calls made with Client.Enqueue until the server responds to
+// them, so that commands issued while the connection is down, e.g. order
+// cancellations, survive a crash and are sent once the connection is back.
+// FileJournal stores calls in a local file; embedded databases, such as bbolt
+// or SQLite, can implement Journal too. Implementations must be safe for
+// concurrent use.
+type Journal interface {
+	// Append stores the entry durably before it returns.
+	Append(entry JournalEntry) error
+
+	// Remove deletes the entry of given ID, if it is stored.
+	Remove(id uint64) error
+
+	// Entries returns stored entries in the order they were appended.
+	Entries() ([]JournalEntry, error)
+}
+
+// JournalEntry is a call stored in Journal.
+type JournalEntry struct {
+	// unique within the journal, increasing in the order of calls
+	ID uint64
+
+	Method string
+	Args   []json.RawMessage
+
+	// the time the call was made
+	Queued time.Time
+}
+
+// JournalConfig configures persistence of calls made with Client.Enqueue, see
+// WriteJournal.
+type JournalConfig struct {
+	Journal Journal
+
+	// Calls older than MaxAge are not sent, but removed and passed to
+	// OnExpired. Zero MaxAge keeps calls until they are sent.
+	MaxAge time.Duration
+
+	// OnExpired is called with every call which expired before it could be
+	// sent. It must not block.
+	OnExpired func(JournalEntry)
+
+	// OnConflict is called with every call the server failed to execute,
+	// e.g. cancellation of an order filled while the client was offline,
+	// along with InvocationError. Such calls are removed from the journal
+	// rather than retried. It must not block.
+	OnConflict func(JournalEntry, error)
+
+	// Timeout bounds every attempt to send a call and receive the response.
+	// Zero uses InvocationTimeout of the client, or 30 seconds if that is
+	// not set either.
+	Timeout time.Duration
+
+	// Backoff creates backoff curve used between attempts to send a call
+	// which failed or timed out while connected, e.g.
+	// backoff.NewExponentialBackOff, which is used when it is not set.
+	// Calls are sent again after reconnect regardless of it.
+	Backoff func() backoff.BackOff
+}
+
+// journal sends calls stored in Journal in order.
+type journal struct {
+	config JournalConfig
+	clock  Clock
+
+	// signalled when a call is appended or the connection is reestablished
+	flushes chan struct{}
+
+	mtx    sync.Mutex
+	nextID uint64
+}
+
+func newJournal(cfg JournalConfig, clock Clock) *journal {
+	if cfg.Backoff == nil {
+		cfg.Backoff = func() backoff.BackOff {
+			bo := backoff.NewExponentialBackOff()
+			bo.MaxElapsedTime = 0
+
+			return bo
+		}
+	}
+
+	return &journal{
+		config:  cfg,
+		clock:   clock,
+		flushes: make(chan struct{}, 1),
+	}
+}
+
+// append stores a call, assigning it ID following IDs of stored calls, which
+// may have been appended by a previous process.
+func (j *journal) append(method string, args []json.RawMessage) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.nextID == 0 {
+		entries, err := j.config.Journal.Entries()
+		if err != nil {
+			return &JournalError{cause: err}
+		}
+
+		j.nextID = 1
+		for _, entry := range entries {
+			if entry.ID >= j.nextID {
+				j.nextID = entry.ID + 1
+			}
+		}
+	}
+
+	entry := JournalEntry{ID: j.nextID, Method: method, Args: args, Queued: j.clock.Now()}
+	if err := j.config.Journal.Append(entry); err != nil {
+		return &JournalError{cause: err}
+	}
+
+	j.nextID++
+	j.flush()
+
+	return nil
+}
+
+// flush makes flusher send stored calls.
+func (j *journal) flush() {
+	select {
+	case j.flushes <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue stores call of hub method in the journal set by WriteJournal and
+// returns once it is stored. Run sends stored calls in order as soon as the
+// connection is up, including calls stored by a previous process, and removes
+// them once the server responds. A call is sent again after reconnect if the
+// response was not received, so hub methods should be idempotent.
+func (c *Client) Enqueue(ctx context.Context, method string, args ...interface{}) error {
+	if c.journal == nil {
+		return &ConfigError{Field: "Journal", cause: errors.New("must be set to enqueue calls")}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	rawArgs, err := c.codec.marshalArgs(args)
+	if err != nil {
+		return fmt.Errorf("failed to marshal args: %w", err)
+	}
+
+	return c.journal.append(method, rawArgs)
+}
+
+// flusher sends stored calls when Run starts, after every reconnect and when a
+// call is enqueued, until ctx is done. Calls which fail to be sent or answered
+// are retried with backoff until they succeed or the next flush.
+func (c *Client) flusher(ctx context.Context) {
+	c.journal.flush()
+
+	var (
+		bo    backoff.BackOff
+		timer Timer
+		retry <-chan time.Time
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+
+			return
+		case <-c.journal.flushes:
+		case <-retry:
+		}
+
+		if timer != nil {
+			timer.Stop()
+			timer, retry = nil, nil
+		}
+
+		if c.flushJournal(ctx) || ctx.Err() != nil {
+			bo = nil
+			continue
+		}
+
+		if bo == nil {
+			bo = c.journal.config.Backoff()
+		}
+
+		delay := bo.NextBackOff()
+		if delay == backoff.Stop {
+			bo = nil
+			continue
+		}
+
+		timer = c.journal.clock.NewTimer(delay)
+		retry = timer.C()
+	}
+}
+
+// flushJournal sends stored calls in order, stopping at the first call which
+// fails to be sent or answered, and reports whether stored calls were sent.
+func (c *Client) flushJournal(ctx context.Context) bool {
+	cfg := c.journal.config
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = c.config.InvocationTimeout
+	}
+	if timeout <= 0 {
+		timeout = defaultJournalTimeout
+	}
+
+	entries, err := cfg.Journal.Entries()
+	if err != nil {
+		c.fail(&JournalError{cause: err})
+		return true
+	}
+
+	for _, entry := range entries {
+		if cfg.MaxAge > 0 && c.journal.clock.Now().Sub(entry.Queued) > cfg.MaxAge {
+			if err := cfg.Journal.Remove(entry.ID); err != nil {
+				c.fail(&JournalError{cause: err})
+				return true
+			}
+
+			if cfg.OnExpired != nil {
+				cfg.OnExpired(entry)
+			}
+
+			continue
+		}
+
+		ictx, cancel := context.WithTimeout(ctx, timeout)
+		inv := c.InvokeRaw(ictx, entry.Method, entry.Args)
+		err := inv.wait()
+		cancel()
+
+		var invErr *InvocationError
+		if err != nil && !errors.As(err, &invErr) {
+			// Run is returning
+			if ctx.Err() != nil {
+				return false
+			}
+
+			c.log(LevelWarn, "failed to send journaled call", "method", entry.Method, "invocation_id", inv.id, "error", err)
+
+			return false
+		}
+
+		if err := cfg.Journal.Remove(entry.ID); err != nil {
+			c.fail(&JournalError{cause: err})
+			return true
+		}
+
+		if invErr != nil && cfg.OnConflict != nil {
+			cfg.OnConflict(entry, invErr)
+		}
+	}
+
+	return true
+}
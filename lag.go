@@ -0,0 +1,111 @@
+package signalr
+
+import (
+	"sync"
+	"time"
+)
+
+// LagStats summarizes delivery lag of calls of a hub method, see
+// MessageTimestamp.
+type LagStats struct {
+	// the number of calls measured
+	Count int64
+
+	Last time.Duration
+	Mean time.Duration
+	Max  time.Duration
+}
+
+func (s *LagStats) add(lag time.Duration) {
+	s.Mean = time.Duration((int64(s.Mean)*s.Count + int64(lag)) / (s.Count + 1))
+	s.Count++
+	s.Last = lag
+
+	if lag > s.Max {
+		s.Max = lag
+	}
+}
+
+// methodLag holds delivery lag of calls of a method.
+type methodLag struct {
+	network  LagStats
+	consumer LagStats
+}
+
+// lagRecorder measures delivery lag of calls carrying timestamps. It has its
+// own lock, as streams record lag while they are read, which must not wait for
+// dispatching blocked on a full stream.
+type lagRecorder struct {
+	timestamp func(ClientMsg) (time.Time, bool)
+	clock     Clock
+
+	mtx     sync.Mutex
+	methods map[string]*methodLag
+}
+
+func newLagRecorder(timestamp func(ClientMsg) (time.Time, bool), clock Clock) *lagRecorder {
+	return &lagRecorder{timestamp: timestamp, clock: clock, methods: make(map[string]*methodLag)}
+}
+
+// received records network lag of call delivered to streams registered under
+// method, returning the time it was received, zero if the call carries no
+// timestamp. Nil recorder records nothing.
+func (r *lagRecorder) received(method string, clientMsg ClientMsg) time.Time {
+	if r == nil {
+		return time.Time{}
+	}
+
+	sent, ok := r.timestamp(clientMsg)
+	if !ok {
+		return time.Time{}
+	}
+
+	now := r.clock.Now()
+
+	r.mtx.Lock()
+	r.lag(method).network.add(now.Sub(sent))
+	r.mtx.Unlock()
+
+	return now
+}
+
+// read records consumer lag of call received at given time, once it is read
+// from stream registered under method.
+func (r *lagRecorder) read(method string, received time.Time) {
+	if r == nil || received.IsZero() {
+		return
+	}
+
+	now := r.clock.Now()
+
+	r.mtx.Lock()
+	r.lag(method).consumer.add(now.Sub(received))
+	r.mtx.Unlock()
+}
+
+func (r *lagRecorder) lag(method string) *methodLag {
+	lag, ok := r.methods[method]
+	if !ok {
+		lag = &methodLag{}
+		r.methods[method] = lag
+	}
+
+	return lag
+}
+
+// stats returns lag of every method measured so far.
+func (r *lagRecorder) stats() map[string]methodLag {
+	if r == nil {
+		return nil
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	res := make(map[string]methodLag, len(r.methods))
+	for method, lag := range r.methods {
+		res[method] = *lag
+	}
+
+	return res
+}
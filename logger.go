@@ -0,0 +1,71 @@
+package signalr
+
+// LogLevel is severity of a log message.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Logger receives diagnostic messages along with alternating key and value
+// pairs describing them.
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// LoggerFunc is an adapter allowing use of ordinary functions as Logger.
+type LoggerFunc func(level LogLevel, msg string, keyvals ...interface{})
+
+func (f LoggerFunc) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	f(level, msg, keyvals...)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(LogLevel, string, ...interface{}) {}
+
+// SugaredLogger is implemented by *zap.SugaredLogger of go.uber.org/zap, so
+// that it can be used without the package depending on zap.
+type SugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// ZapLogger adapts zap logger to Logger. Messages are logged along with the
+// connection ID and, where they apply, hub, method and invocation ID:
+//
+//	signalr.Logging(signalr.ZapLogger(logger.Sugar()))
+func ZapLogger(logger SugaredLogger) Logger {
+	return LoggerFunc(func(level LogLevel, msg string, keyvals ...interface{}) {
+		switch level {
+		case LevelDebug:
+			logger.Debugw(msg, keyvals...)
+		case LevelInfo:
+			logger.Infow(msg, keyvals...)
+		case LevelWarn:
+			logger.Warnw(msg, keyvals...)
+		default:
+			logger.Errorw(msg, keyvals...)
+		}
+	})
+}
@@ -0,0 +1,224 @@
+package signalr
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// ClientFunc creates a new client. It is called by Manager every time managed
+// client has to be (re)started, so it should dial a fresh connection.
+type ClientFunc func(ctx context.Context) (*Client, error)
+
+type ManagerOpt func(*managerConfig)
+
+// RestartBackoff sets backoff policy used between restarts of a failed client.
+func RestartBackoff(fn func() backoff.BackOff) ManagerOpt {
+	return func(c *managerConfig) {
+		c.RestartBackoff = fn
+	}
+}
+
+type managerConfig struct {
+	RestartBackoff func() backoff.BackOff
+}
+
+func newDefaultManagerConfig() managerConfig {
+	return managerConfig{
+		RestartBackoff: func() backoff.BackOff {
+			bo := backoff.NewExponentialBackOff()
+			bo.MaxElapsedTime = 0
+			return bo
+		},
+	}
+}
+
+// Manager supervises multiple clients, restarting failed ones with backoff.
+type Manager struct {
+	mtx     sync.Mutex
+	config  managerConfig
+	ctx     context.Context
+	wg      sync.WaitGroup
+	entries map[string]*managedClient
+}
+
+// ClientStatus describes the state of a managed client.
+type ClientStatus struct {
+	Name      string
+	Connected bool
+	Restarts  int
+	LastError error
+	Since     time.Time
+}
+
+type managedClient struct {
+	name   string
+	fn     ClientFunc
+	client *Client
+	status ClientStatus
+}
+
+func NewManager(opts ...ManagerOpt) *Manager {
+	cfg := newDefaultManagerConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return &Manager{
+		config:  cfg,
+		entries: make(map[string]*managedClient),
+	}
+}
+
+// Add registers a new client under given name. If manager is already running,
+// client is started immediately.
+func (m *Manager) Add(name string, fn ClientFunc) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, ok := m.entries[name]; ok {
+		return &DuplicateClientError{name: name}
+	}
+
+	entry := &managedClient{
+		name:   name,
+		fn:     fn,
+		status: ClientStatus{Name: name},
+	}
+	m.entries[name] = entry
+
+	if m.ctx != nil {
+		m.start(m.ctx, entry)
+	}
+
+	return nil
+}
+
+// Client returns currently running client with given name or nil if it is
+// not connected.
+func (m *Manager) Client(name string) *Client {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	entry, ok := m.entries[name]
+	if !ok {
+		return nil
+	}
+
+	return entry.client
+}
+
+// Status returns status of all managed clients sorted by name.
+func (m *Manager) Status() []ClientStatus {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	res := make([]ClientStatus, 0, len(m.entries))
+	for _, entry := range m.entries {
+		res = append(res, entry.status)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
+
+// Health returns nil if all managed clients are connected, otherwise
+// UnhealthyError listing the disconnected ones.
+func (m *Manager) Health() error {
+	var names []string
+	for _, status := range m.Status() {
+		if !status.Connected {
+			names = append(names, status.Name)
+		}
+	}
+
+	if len(names) != 0 {
+		return &UnhealthyError{names: names}
+	}
+
+	return nil
+}
+
+// Run starts all registered clients and supervises them until ctx is done.
+func (m *Manager) Run(ctx context.Context) error {
+	m.mtx.Lock()
+	m.ctx = ctx
+	for _, entry := range m.entries {
+		m.start(ctx, entry)
+	}
+	m.mtx.Unlock()
+
+	<-ctx.Done()
+
+	m.wg.Wait()
+
+	m.mtx.Lock()
+	m.ctx = nil
+	m.mtx.Unlock()
+
+	return ctx.Err()
+}
+
+func (m *Manager) start(ctx context.Context, entry *managedClient) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.supervise(ctx, entry)
+	}()
+}
+
+func (m *Manager) supervise(ctx context.Context, entry *managedClient) {
+	bo := backoff.WithContext(m.config.RestartBackoff(), ctx)
+
+	for {
+		client, err := entry.fn(ctx)
+		if err == nil {
+			bo.Reset()
+
+			m.update(entry, func(status *ClientStatus) {
+				entry.client = client
+				status.Connected = true
+				status.Since = time.Now()
+			})
+
+			err = client.Run(ctx)
+		}
+
+		if ctx.Err() != nil {
+			m.update(entry, func(status *ClientStatus) {
+				entry.client = nil
+				status.Connected = false
+			})
+			return
+		}
+
+		m.update(entry, func(status *ClientStatus) {
+			entry.client = nil
+			status.Connected = false
+			status.LastError = err
+			status.Since = time.Now()
+			status.Restarts++
+		})
+
+		delay := bo.NextBackOff()
+		if delay == backoff.Stop {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (m *Manager) update(entry *managedClient, fn func(status *ClientStatus)) {
+	m.mtx.Lock()
+	fn(&entry.status)
+	m.mtx.Unlock()
+}
@@ -1,14 +1,22 @@
 package signalr
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"sync"
+	"time"
 )
 
 var (
 	textMessage   = 1
+	closeMessage  = 8
 	statusStarted = 1
 )
 
@@ -21,7 +29,7 @@ type Message struct {
 	// groups token – an encrypted string representing group membership
 	GroupsToken string `json:"G"`
 
-	InvocationID int `json:"I,string"`
+	InvocationID uint64 `json:"I,string"`
 
 	// an array containing actual data
 	Messages []ClientMsg `json:"M"`
@@ -34,14 +42,64 @@ type Message struct {
 	ErrorDetail *map[string]interface{} `json:"D"`
 	HubError    bool                    `json:"H"`
 
+	// stack trace (if detailed error reporting is turned on on the server)
+	StackTrace string `json:"T"`
+
 	// result
 	Result json.RawMessage `json:"R"`
+
+	// indicates that the server asked client to disconnect and not to
+	// reconnect (sent as "D":1)
+	Disconnect bool `json:"-"`
+}
+
+// envelope is implemented by messages carrying connection state updates.
+type envelope interface {
+	envelope() (messageID, groupsToken string, disconnect bool)
+}
+
+func (m *Message) envelope() (messageID, groupsToken string, disconnect bool) {
+	return m.MessageID, m.GroupsToken, m.Disconnect
+}
+
+// UnmarshalJSON decodes message. "D" field carries either hub error data or
+// the disconnect command, depending on its type.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type message Message
+
+	raw := struct {
+		*message
+		D json.RawMessage `json:"D"`
+	}{message: (*message)(m)}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	m.ErrorDetail = nil
+	m.Disconnect = false
+
+	switch d := bytes.TrimSpace(raw.D); {
+	case len(d) == 0, bytes.Equal(d, []byte("null")):
+	case bytes.Equal(d, []byte("1")), bytes.Equal(d, []byte("true")):
+		m.Disconnect = true
+	default:
+		var detail map[string]interface{}
+		if err := json.Unmarshal(d, &detail); err != nil {
+			return err
+		}
+
+		m.ErrorDetail = &detail
+	}
+
+	return nil
 }
 
 // ClientMsg represents a message sent to the Hubs API from the client.
 type ClientMsg struct {
-	// invocation identifier – allows to match up responses with requests
-	InvocationID int `json:"I"`
+	// invocation identifier – allows to match up responses with requests,
+	// omitted for invocations sent by Client.Send
+	InvocationID uint64 `json:"I,omitempty"`
 
 	// the name of the hub
 	Hub string `json:"H"`
@@ -55,6 +113,30 @@ type ClientMsg struct {
 
 	// state – a dictionary containing additional custom data (optional)
 	State *json.RawMessage `json:"S,omitempty"`
+
+	// invocation headers, sent only by protocols supporting them
+	Headers map[string]string `json:"-"`
+
+	// arguments bound by parameter name, sent instead of Args when not nil,
+	// see Client.InvokeNamed
+	NamedArgs map[string]json.RawMessage `json:"-"`
+
+	// identifier of server call awaiting result of the client method, set
+	// only by protocols supporting client results, see Client.HandleResult
+	ResultID string `json:"-"`
+
+	// result of server call identified by ResultID, sent instead of an
+	// invocation when not nil
+	Completion *Completion `json:"-"`
+}
+
+// Completion carries result of a server call of a client method.
+type Completion struct {
+	// the value returned by the client method
+	Result json.RawMessage
+
+	// error message, sent instead of result if not empty
+	Error string
 }
 
 // ServerMsg represents a message sent to the Hubs API from the server.
@@ -85,38 +167,129 @@ type ServerMsg struct {
 	S *json.RawMessage `json:",omitempty"`
 }
 
-func readMessage(ctx context.Context, conn WebsocketConn, msg *Message, state *State) error {
+// frameBufferSize is the size of buffers frames are read into. Frames which
+// fit are decoded at once, larger frames are decoded while they are read.
+const frameBufferSize = 4096
+
+// keepaliveFrame is the empty message sent by classic servers as keepalive.
+var keepaliveFrame = []byte("{}")
+
+// frameReaders holds buffers of frames being read, so that reading small
+// frames does not allocate them.
+var frameReaders = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, frameBufferSize)
+	},
+}
+
+// readMessage reads the next message skipping keepalives, which are reported
+// to keepalive function if it is not nil.
+func readMessage(ctx context.Context, conn WebsocketConn, msg interface{}, keepalive func()) error {
 	for {
-		t, p, err := conn.ReadMessage(ctx)
+		t, r, err := nextReader(ctx, conn)
 		if err != nil {
 			return fmt.Errorf("message read failed: %w", err)
 		}
 
-		if t != textMessage {
+		_, isRaw := msg.(*rawMessage)
+		if t != textMessage && !isRaw {
 			return fmt.Errorf("unexpected websocket control type: %d", t)
 		}
 
-		// skip empty messages
-		if bytes.Equal(p, []byte("{}")) {
-			continue
-		}
+		br := frameReaders.Get().(*bufio.Reader)
+		br.Reset(r)
+
+		skip, err := readFrame(br, msg)
+
+		br.Reset(nil)
+		frameReaders.Put(br)
 
-		if err := json.Unmarshal(p, msg); err != nil {
+		if !skip {
 			return err
 		}
 
-		// Update the groups token.
-		if msg.GroupsToken != "" {
-			state.GroupsToken = msg.GroupsToken
+		if keepalive != nil {
+			keepalive()
 		}
+	}
+}
 
-		// Update the current message ID.
-		if msg.MessageID != "" {
-			state.MessageID = msg.MessageID
-		}
+// readFrame decodes frame read from br into msg, reporting keepalives, which
+// are skipped.
+func readFrame(br *bufio.Reader, msg interface{}) (keepalive bool, err error) {
+	// peek the whole frame if it fits into the buffer
+	p, peekErr := br.Peek(br.Size())
+	if peekErr != nil && peekErr != io.EOF && peekErr != bufio.ErrBufferFull {
+		return false, peekErr
+	}
+
+	small := peekErr == io.EOF
 
-		return nil
+	if small && bytes.Equal(p, keepaliveFrame) {
+		return true, nil
 	}
+
+	if raw, ok := msg.(*rawMessage); ok {
+		return false, raw.read(br)
+	}
+
+	// report empty frame as invalid JSON; decoded messages do not refer to
+	// the buffer, which is reused
+	if small || len(p) == 0 {
+		return false, json.Unmarshal(p, msg)
+	}
+
+	// decode while reading, so that large frames are not buffered twice
+	return false, json.NewDecoder(br).Decode(msg)
+}
+
+// rawMessage holds payload of a frame read by Conn.ReadRaw along with
+// connection state it carries, if it is a standard message.
+type rawMessage struct {
+	data []byte
+	msg  Message
+}
+
+func (m *rawMessage) read(r io.Reader) (err error) {
+	if m.data, err = ioutil.ReadAll(r); err != nil {
+		return err
+	}
+
+	// payloads which are not standard messages carry no state
+	if err := json.Unmarshal(m.data, &m.msg); err != nil {
+		m.msg = Message{}
+	}
+
+	return nil
+}
+
+func (m *rawMessage) envelope() (messageID, groupsToken string, disconnect bool) {
+	return m.msg.envelope()
+}
+
+// MessagesMissed describes messages missed while reconnecting.
+type MessagesMissed struct {
+	// the last message ID received before reconnect
+	PrevMessageID string
+
+	// the first message ID received after reconnect
+	MessageID string
+}
+
+// sequentialMessageIDGap reports gap between integer message IDs. Non-integer
+// message IDs are never reported.
+func sequentialMessageIDGap(prev, next string) bool {
+	p, err := strconv.ParseUint(prev, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	n, err := strconv.ParseUint(next, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return n > p+1
 }
 
 type negotiateResponse struct {
@@ -130,6 +303,86 @@ type negotiateResponse struct {
 	ProtocolVersion         string  `json:"ProtocolVersion"`
 	TransportConnectTimeout float64 `json:"TransportConnectTimeout"`
 	LongPollDelay           float64 `json:"LongPollDelay"`
+
+	// ASP.NET Core servers
+	NegotiateVersion     int             `json:"negotiateVersion"`
+	AvailableTransports  json.RawMessage `json:"availableTransports"`
+	UseStatefulReconnect bool            `json:"useStatefulReconnect"`
+}
+
+// core reports whether the response was sent by an ASP.NET Core server.
+func (r *negotiateResponse) core() bool {
+	return r.ProtocolVersion == "" && (r.NegotiateVersion > 0 || r.AvailableTransports != nil)
+}
+
+// statefulReconnect reports whether ASP.NET Core server supports stateful
+// reconnect of the connection, which the client requested.
+func (r *negotiateResponse) statefulReconnect() bool {
+	return r.core() && r.UseStatefulReconnect
+}
+
+func (r *negotiateResponse) info() NegotiateInfo {
+	if r.core() {
+		return NegotiateInfo{
+			URL:              r.URL,
+			ConnectionID:     r.ConnectionID,
+			NegotiateVersion: r.NegotiateVersion,
+			KeepAliveTimeout: coreServerTimeout,
+		}
+	}
+
+	return NegotiateInfo{
+		URL:                     r.URL,
+		ConnectionID:            r.ConnectionID,
+		ProtocolVersion:         r.ProtocolVersion,
+		KeepAliveTimeout:        seconds(r.KeepAliveTimeout),
+		DisconnectTimeout:       seconds(r.DisconnectTimeout),
+		ConnectionTimeout:       seconds(r.ConnectionTimeout),
+		TransportConnectTimeout: seconds(r.TransportConnectTimeout),
+		LongPollDelay:           seconds(r.LongPollDelay),
+		TryWebSockets:           r.TryWebSockets,
+	}
+}
+
+// NegotiateInfo contains values provided by the server in negotiate response.
+type NegotiateInfo struct {
+	URL             string
+	ConnectionID    string
+	ProtocolVersion string
+
+	// the amount of time after which the client should assume the connection
+	// is dead if no keepalive was received (zero if keepalives are disabled)
+	KeepAliveTimeout time.Duration
+
+	// the amount of time within which the client may reconnect
+	DisconnectTimeout time.Duration
+
+	// the amount of time server keeps a poll request open
+	ConnectionTimeout time.Duration
+
+	// the amount of time the client should wait for transport to connect
+	TransportConnectTimeout time.Duration
+
+	LongPollDelay time.Duration
+	TryWebSockets bool
+
+	// negotiate protocol version of ASP.NET Core servers, which do not
+	// report ProtocolVersion and other values above except for keepalive
+	// timeout assumed by the client
+	NegotiateVersion int
+}
+
+// seconds converts seconds sent by the server to duration, clamping values
+// which are negative or do not fit.
+func seconds(v float64) time.Duration {
+	switch d := v * float64(time.Second); {
+	case d <= 0:
+		return 0
+	case d >= math.MaxInt64:
+		return math.MaxInt64
+	default:
+		return time.Duration(d)
+	}
 }
 
 type startResponse struct {
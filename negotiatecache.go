@@ -0,0 +1,99 @@
+package signalr
+
+import (
+	"sync"
+	"time"
+)
+
+// negotiation is a negotiate response cached by endpoint, see CacheNegotiate.
+type negotiation struct {
+	info            NegotiateInfo
+	connectionID    string
+	connectionToken string
+	protocol        string
+
+	// the time the response expires, once the server may have forgotten
+	// the connection
+	expires time.Time
+}
+
+// negotiateCache holds the latest negotiate response of every endpoint. Nil
+// cache holds nothing.
+type negotiateCache struct {
+	mtx     sync.Mutex
+	entries map[string]negotiation
+}
+
+func newNegotiateCache() *negotiateCache {
+	return &negotiateCache{entries: make(map[string]negotiation)}
+}
+
+// put caches response negotiated at now, which left state with the connection
+// token. Responses of servers which forget the connection along with its
+// transport, such as ASP.NET Core, are not cached.
+func (nc *negotiateCache) put(endpoint string, info NegotiateInfo, state *State, now time.Time) {
+	if nc == nil || info.DisconnectTimeout <= 0 || !protocolOf(state).canReconnect() {
+		return
+	}
+
+	nc.mtx.Lock()
+	defer nc.mtx.Unlock()
+
+	nc.entries[endpoint] = negotiation{
+		info:            info,
+		connectionID:    state.ConnectionID,
+		connectionToken: state.ConnectionToken,
+		protocol:        state.Protocol,
+		expires:         now.Add(info.DisconnectTimeout),
+	}
+}
+
+// get returns response cached for endpoint, unless it expired by now.
+func (nc *negotiateCache) get(endpoint string, now time.Time) (negotiation, bool) {
+	if nc == nil {
+		return negotiation{}, false
+	}
+
+	nc.mtx.Lock()
+	defer nc.mtx.Unlock()
+
+	entry, ok := nc.entries[endpoint]
+	if !ok || !now.Before(entry.expires) {
+		delete(nc.entries, endpoint)
+		return negotiation{}, false
+	}
+
+	return entry, true
+}
+
+// drop removes response cached for endpoint, e.g. once the server rejected
+// its token.
+func (nc *negotiateCache) drop(endpoint string) {
+	if nc == nil {
+		return
+	}
+
+	nc.mtx.Lock()
+	delete(nc.entries, endpoint)
+	nc.mtx.Unlock()
+}
+
+// clear removes all cached responses.
+func (nc *negotiateCache) clear() {
+	if nc == nil {
+		return
+	}
+
+	nc.mtx.Lock()
+	nc.entries = make(map[string]negotiation)
+	nc.mtx.Unlock()
+}
+
+// restore sets connection token, protocol and disconnect timeout of cached
+// response to state.
+func (n negotiation) restore(state *State) {
+	state.ConnectionID = n.connectionID
+	state.ConnectionToken = n.connectionToken
+	state.Protocol = n.protocol
+	state.DisconnectTimeout = n.info.DisconnectTimeout
+}
@@ -0,0 +1,19 @@
+package signalr
+
+import (
+	"runtime/debug"
+)
+
+// recoverPanic converts panic into PanicError stored in err and logs it along
+// with the stack trace. It has to be deferred directly.
+func recoverPanic(logger Logger, err *error, keyvals ...interface{}) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	panicErr := &PanicError{Value: r, Stack: debug.Stack()}
+	*err = panicErr
+
+	logger.Log(LevelError, "recovered from panic", append(keyvals, "panic", r, "stack", string(panicErr.Stack))...)
+}
@@ -0,0 +1,73 @@
+package signalr
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// MethodPattern matches names of hub methods, for hubs which encode
+// parameters into method names, e.g. market symbols. See
+// Client.CallbackPattern.
+type MethodPattern interface {
+	MatchMethod(method string) bool
+
+	// String identifies the pattern, streams of equal patterns are
+	// duplicates.
+	String() string
+}
+
+type prefixPattern string
+
+// MethodPrefix matches methods whose names start with prefix.
+func MethodPrefix(prefix string) MethodPattern {
+	return prefixPattern(prefix)
+}
+
+func (p prefixPattern) MatchMethod(method string) bool {
+	return strings.HasPrefix(method, string(p))
+}
+
+func (p prefixPattern) String() string {
+	return string(p) + "*"
+}
+
+type globPattern string
+
+// MethodGlob matches methods by shell pattern, e.g. "orderbook:*", with the
+// syntax of path.Match. It returns path.ErrBadPattern if the pattern is
+// malformed.
+func MethodGlob(pattern string) (MethodPattern, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	return globPattern(pattern), nil
+}
+
+func (p globPattern) MatchMethod(method string) bool {
+	ok, _ := path.Match(string(p), method)
+	return ok
+}
+
+func (p globPattern) String() string {
+	return string(p)
+}
+
+type regexpPattern struct {
+	re *regexp.Regexp
+}
+
+// MethodRegexp matches methods by regular expression, e.g. `^uE\.`. The
+// expression is not anchored unless it says so.
+func MethodRegexp(re *regexp.Regexp) MethodPattern {
+	return regexpPattern{re: re}
+}
+
+func (p regexpPattern) MatchMethod(method string) bool {
+	return p.re.MatchString(method)
+}
+
+func (p regexpPattern) String() string {
+	return "/" + p.re.String() + "/"
+}
@@ -0,0 +1,91 @@
+package signalr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+)
+
+// PersistentClient talks to raw SignalR PersistentConnection endpoints, which
+// exchange plain data frames without the hub envelope. Connection should be
+// dialed with empty connection data.
+type PersistentClient struct {
+	conn *Conn
+}
+
+// PersistentMessage represents a message received over persistent connection.
+type PersistentMessage struct {
+	// message id, present for all non-KeepAlive messages
+	MessageID string `json:"C"`
+
+	// groups token – an encrypted string representing group membership
+	GroupsToken string `json:"G"`
+
+	// data sent by the server
+	Messages []json.RawMessage `json:"M"`
+
+	// indicates that the server asked client to disconnect and not to
+	// reconnect (sent as "D":1)
+	Disconnect bool `json:"-"`
+}
+
+func (m *PersistentMessage) envelope() (messageID, groupsToken string, disconnect bool) {
+	return m.MessageID, m.GroupsToken, m.Disconnect
+}
+
+// UnmarshalJSON decodes message and the disconnect command.
+func (m *PersistentMessage) UnmarshalJSON(data []byte) error {
+	type message PersistentMessage
+
+	raw := struct {
+		*message
+		D json.RawMessage `json:"D"`
+	}{message: (*message)(m)}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	d := bytes.TrimSpace(raw.D)
+	m.Disconnect = bytes.Equal(d, []byte("1")) || bytes.Equal(d, []byte("true"))
+
+	return nil
+}
+
+func NewPersistentClient(conn *Conn) *PersistentClient {
+	return &PersistentClient{conn: conn}
+}
+
+// Close closes underlying websocket connection
+func (c *PersistentClient) Close() error {
+	return c.conn.Close()
+}
+
+// Receive blocks until the server sends data and returns it.
+func (c *PersistentClient) Receive(ctx context.Context) ([]json.RawMessage, error) {
+	for {
+		var msg PersistentMessage
+		if err := c.conn.read(ctx, &msg); err != nil {
+			return nil, err
+		}
+
+		if len(msg.Messages) != 0 {
+			return msg.Messages, nil
+		}
+	}
+}
+
+// Send sends raw data to the server.
+func (c *PersistentClient) Send(ctx context.Context, data []byte) error {
+	return c.conn.write(ctx, data)
+}
+
+// SendJSON sends JSON encoded value to the server.
+func (c *PersistentClient) SendJSON(ctx context.Context, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return &WriteError{cause: err}
+	}
+
+	return c.conn.write(ctx, data)
+}
@@ -0,0 +1,68 @@
+package signalr
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// pinger keeps connections to ASP.NET Core servers alive until ctx is done,
+// sending pings every ping interval while nothing else is written and
+// answering pings received from the server. Connections to classic servers
+// are left alone until they are replaced by a Core connection.
+func (c *Conn) pinger(ctx context.Context) {
+	interval := c.config.PingInterval
+	if interval <= 0 {
+		return
+	}
+
+	for {
+		_, state := c.current()
+
+		var (
+			timer Timer
+			tick  <-chan time.Time
+		)
+		if protocolOf(&state).ping() != nil {
+			timer = c.config.Clock.NewTimer(interval)
+			tick = timer.C()
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-tick:
+		case <-c.pings:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := c.ping(ctx); err != nil {
+			// failed connection is detected and reestablished by reading
+			c.log(LevelDebug, "failed to send ping", "error", err)
+		}
+	}
+}
+
+// ping sends ping to ASP.NET Core server unless a message was written within
+// ping interval.
+func (c *Conn) ping(ctx context.Context) error {
+	_, state := c.current()
+
+	data := protocolOf(&state).ping()
+	if data == nil {
+		return nil
+	}
+
+	lastWrite := time.Unix(0, atomic.LoadInt64(&c.lastWrite))
+	if c.config.Clock.Now().Sub(lastWrite) < c.config.PingInterval {
+		return nil
+	}
+
+	return c.write(ctx, data)
+}
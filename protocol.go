@@ -0,0 +1,502 @@
+package signalr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// CoreProtocol is the value of State.Protocol for connections to ASP.NET Core
+// SignalR servers, which speak the JSON hub protocol instead of a classic
+// client protocol version.
+const CoreProtocol = "core/json"
+
+// coreServerTimeout is the amount of time after which a connection to an
+// ASP.NET Core server is considered dead if no ping was received, matching
+// the default of the official clients. Core servers do not advertise it.
+const coreServerTimeout = 30 * time.Second
+
+// recordSeparator terminates every message of the Core JSON hub protocol.
+const recordSeparator = 0x1e
+
+// corePingMessage is the ping message of the Core JSON hub protocol, which
+// serves as keepalive in both directions, as returned by recordConn.
+const corePingMessage = `{"type":6}`
+
+// corePingRecord is the ping message terminated by the record separator, as
+// written to the wire.
+const corePingRecord = corePingMessage + "\x1e"
+
+// Message types of the Core JSON hub protocol.
+const (
+	coreInvocation       = 1
+	coreStreamItem       = 2
+	coreCompletion       = 3
+	coreStreamInvocation = 4
+	coreCancelInvocation = 5
+	corePing             = 6
+	coreClose            = 7
+	coreAck              = 8
+	coreSequence         = 9
+)
+
+// protocol speaks the wire format of a server generation, either classic
+// ASP.NET SignalR or ASP.NET Core SignalR. It is selected by the negotiate
+// response, so that Conn and Client work the same with both.
+type protocol interface {
+	// connectURL returns URL of websocket connect or reconnect request.
+	connectURL(endpoint, command string, state *State) (string, error)
+
+	// handshake completes the connection sequence once websocket is
+	// connected, returning connection to read messages from.
+	handshake(ctx context.Context, c *Conn, conn WebsocketConn, endpoint string, state *State) (WebsocketConn, error)
+
+	// resume restores the session of connection which was dropped over
+	// websocket reestablished by reconnect, returning connection to read
+	// messages from.
+	resume(ctx context.Context, dropped, conn WebsocketConn) (WebsocketConn, error)
+
+	// read reads the next message other than keepalive, which is reported
+	// to keepalive function if it is not nil.
+	read(ctx context.Context, conn WebsocketConn, msg envelope, keepalive func()) error
+
+	// marshal encodes message sent to the hub.
+	marshal(e *encoder, msg ClientMsg) error
+
+	// canReconnect reports whether dropped connection can be reestablished
+	// using the same connection token.
+	canReconnect() bool
+
+	// canBatch reports whether multiple messages can be sent in a single
+	// frame.
+	canBatch() bool
+
+	// ping returns ping message keeping the connection alive, nil if the
+	// client does not send pings.
+	ping() []byte
+}
+
+var (
+	_ protocol = classicProtocol{}
+	_ protocol = coreProtocol{}
+)
+
+// protocolOf returns protocol of connection with given state, which was
+// already checked by selectProtocol.
+func protocolOf(state *State) protocol {
+	if state.Protocol == CoreProtocol {
+		return coreProtocol{stateful: state.StatefulReconnect}
+	}
+
+	v, _ := parseProtocolVersion(state.Protocol)
+
+	return classicProtocol{version: v}
+}
+
+// selectProtocol returns protocol of connection negotiated by the client
+// which requested given classic protocol version.
+func selectProtocol(requested string, state *State) (protocol, error) {
+	if state.Protocol == CoreProtocol {
+		return coreProtocol{stateful: state.StatefulReconnect}, nil
+	}
+
+	v, err := checkProtocol(requested, state.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	return classicProtocol{version: v}, nil
+}
+
+// classicProtocol implements given version of the classic ASP.NET SignalR
+// client protocol.
+type classicProtocol struct {
+	version protoVersion
+}
+
+func (classicProtocol) connectURL(endpoint, command string, state *State) (string, error) {
+	return makeURL(endpoint, command, state)
+}
+
+func (p classicProtocol) handshake(ctx context.Context, c *Conn, conn WebsocketConn, endpoint string, state *State) (WebsocketConn, error) {
+	switch {
+	case p.version.hasStart():
+		return start(ctx, c.client, conn, endpoint, c.config.Headers, state, c.config.StartRetry, c.config.InitTimeout)
+	case p.version.hasInitMessage():
+		return readInitMessage(ctx, conn, state, c.config.InitTimeout)
+	}
+
+	return conn, nil
+}
+
+func (classicProtocol) read(ctx context.Context, conn WebsocketConn, msg envelope, keepalive func()) error {
+	return readMessage(ctx, conn, msg, keepalive)
+}
+
+// classicNamedMessage is ClientMsg whose arguments are bound by parameter
+// name, which classic servers accept as an object in place of the array.
+type classicNamedMessage struct {
+	InvocationID uint64                     `json:"I,omitempty"`
+	Hub          string                     `json:"H"`
+	Method       string                     `json:"M"`
+	Args         map[string]json.RawMessage `json:"A"`
+	State        *json.RawMessage           `json:"S,omitempty"`
+}
+
+func (classicProtocol) resume(_ context.Context, _, conn WebsocketConn) (WebsocketConn, error) {
+	return conn, nil
+}
+
+func (classicProtocol) marshal(e *encoder, msg ClientMsg) error {
+	if msg.Completion != nil {
+		return errors.New("client results are not supported by classic servers")
+	}
+
+	if msg.NamedArgs != nil {
+		return e.encode(classicNamedMessage{
+			InvocationID: msg.InvocationID,
+			Hub:          msg.Hub,
+			Method:       msg.Method,
+			Args:         msg.NamedArgs,
+			State:        msg.State,
+		})
+	}
+
+	return e.encode(msg)
+}
+
+func (classicProtocol) canReconnect() bool {
+	return true
+}
+
+// The hub dispatcher of classic servers parses a single request per frame,
+// whatever the protocol version.
+func (classicProtocol) canBatch() bool {
+	return false
+}
+
+func (classicProtocol) ping() []byte {
+	return nil
+}
+
+// coreProtocol implements the ASP.NET Core SignalR JSON hub protocol. Dropped
+// connection is replaced by running the whole connection sequence, unless the
+// server supports stateful reconnect, see StatefulReconnect.
+type coreProtocol struct {
+	stateful bool
+}
+
+// coreMessage represents a message of the Core JSON hub protocol.
+type coreMessage struct {
+	Type           int               `json:"type"`
+	InvocationID   string            `json:"invocationId,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	Arguments      []json.RawMessage `json:"arguments,omitempty"`
+	Result         json.RawMessage   `json:"result,omitempty"`
+	Error          string            `json:"error,omitempty"`
+	AllowReconnect bool              `json:"allowReconnect,omitempty"`
+}
+
+// coreInvocationMessage represents an invocation sent to a Core server, which
+// requires arguments even if there are none.
+type coreInvocationMessage struct {
+	Type         int               `json:"type"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	InvocationID string            `json:"invocationId,omitempty"`
+	Target       string            `json:"target"`
+	Arguments    []json.RawMessage `json:"arguments"`
+}
+
+// coreCompletionMessage represents result of a server call of a client method
+// sent to a Core server.
+type coreCompletionMessage struct {
+	Type         int             `json:"type"`
+	InvocationID string          `json:"invocationId"`
+	Result       json.RawMessage `json:"result,omitempty"`
+	Error        string          `json:"error,omitempty"`
+}
+
+func (coreProtocol) connectURL(endpoint, _ string, state *State) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	default:
+		return "", &url.Error{
+			Op:  "Get",
+			URL: endpoint,
+			Err: errors.New("unsupported scheme"),
+		}
+	}
+
+	query := u.Query()
+
+	// negotiate version 0 servers identify connections by ID
+	id := state.ConnectionToken
+	if id == "" {
+		id = state.ConnectionID
+	}
+
+	query.Set("id", id)
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+func (p coreProtocol) handshake(ctx context.Context, c *Conn, conn WebsocketConn, _ string, _ *State) (WebsocketConn, error) {
+	timeout := c.config.HandshakeTimeout
+	hctx, cancel, bounded := withDeadline(ctx, timeout)
+	defer cancel()
+
+	// servers enable stateful reconnect only for version 2 of the protocol,
+	// which older servers do not support
+	version := 1
+	if p.stateful {
+		version = 2
+	}
+
+	req := append([]byte(`{"protocol":"json","version":`+strconv.Itoa(version)+`}`), recordSeparator)
+	if err := conn.WriteMessage(hctx, textMessage, req); err != nil {
+		return nil, &WriteError{cause: stepTimedOut(ctx, bounded, err, "handshake", timeout)}
+	}
+
+	rc := &recordConn{WebsocketConn: conn}
+
+	_, data, err := rc.ReadMessage(hctx)
+	if err != nil {
+		return nil, &ReadError{cause: stepTimedOut(ctx, bounded, err, "handshake", timeout)}
+	}
+
+	var res struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, &ReadError{cause: err}
+	}
+
+	if res.Error != "" {
+		return nil, fmt.Errorf("handshake rejected: %s", res.Error)
+	}
+
+	if p.stateful {
+		return &statefulConn{WebsocketConn: rc, session: newSession(c.config.ReplayBufferSize), acks: c.acks}, nil
+	}
+
+	return rc, nil
+}
+
+// resume continues the session of dropped connection without another
+// handshake, sending again messages the server did not acknowledge.
+func (p coreProtocol) resume(ctx context.Context, dropped, conn WebsocketConn) (WebsocketConn, error) {
+	prev, ok := dropped.(*statefulConn)
+	if !p.stateful || !ok {
+		return nil, errors.New("stateful reconnect is not supported")
+	}
+
+	sc := &statefulConn{WebsocketConn: &recordConn{WebsocketConn: conn}, session: prev.session, acks: prev.acks}
+	if err := sc.session.resend(ctx, sc.WebsocketConn); err != nil {
+		return nil, &WriteError{cause: err}
+	}
+
+	return sc, nil
+}
+
+func (coreProtocol) read(ctx context.Context, conn WebsocketConn, msg envelope, keepalive func()) error {
+	for {
+		t, data, err := conn.ReadMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("message read failed: %w", err)
+		}
+
+		raw, isRaw := msg.(*rawMessage)
+		if t != textMessage && !isRaw {
+			return fmt.Errorf("unexpected websocket control type: %d", t)
+		}
+
+		// pings are recognized without decoding them
+		if string(data) == corePingMessage {
+			if keepalive != nil {
+				keepalive()
+			}
+
+			continue
+		}
+
+		var m coreMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			// payloads which are not standard messages carry no state
+			if isRaw {
+				*raw = rawMessage{data: data}
+				return nil
+			}
+
+			return err
+		}
+
+		switch m.Type {
+		case corePing:
+			if keepalive != nil {
+				keepalive()
+			}
+
+			continue
+		case coreClose:
+			return &serverCloseError{reason: m.Error, allowReconnect: m.AllowReconnect}
+		}
+
+		if isRaw {
+			*raw = rawMessage{data: data}
+			_, _ = m.decode(&raw.msg)
+
+			return nil
+		}
+
+		ok, err := m.decode(msg.(*Message))
+		if err != nil {
+			return err
+		}
+
+		// messages of unsupported types are ignored
+		if ok {
+			return nil
+		}
+	}
+}
+
+// decode converts Core message to its classic equivalent, reporting whether
+// the message is of a supported type.
+func (m *coreMessage) decode(msg *Message) (bool, error) {
+	switch m.Type {
+	case coreInvocation:
+		// invocations with ID await result of the client method
+		*msg = Message{Messages: []ClientMsg{{Method: m.Target, Args: m.Arguments, ResultID: m.InvocationID}}}
+	case coreCompletion:
+		id, err := strconv.ParseUint(m.InvocationID, 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid invocation ID %q: %w", m.InvocationID, err)
+		}
+
+		*msg = Message{InvocationID: id, Result: m.Result, Error: m.Error, HubError: m.Error != ""}
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (coreProtocol) marshal(e *encoder, msg ClientMsg) error {
+	if msg.Completion != nil {
+		return marshalCompletion(e, msg.ResultID, msg.Completion)
+	}
+
+	m := coreInvocationMessage{
+		Type:      coreInvocation,
+		Headers:   msg.Headers,
+		Target:    msg.Method,
+		Arguments: msg.Args,
+	}
+
+	// Core servers bind arguments by position only, named arguments are
+	// sent as a single object argument, which binds to a parameter object
+	if msg.NamedArgs != nil {
+		data, err := json.Marshal(msg.NamedArgs)
+		if err != nil {
+			return err
+		}
+
+		m.Arguments = []json.RawMessage{data}
+	}
+
+	if msg.InvocationID != 0 {
+		m.InvocationID = strconv.FormatUint(msg.InvocationID, 10)
+	}
+
+	if m.Arguments == nil {
+		m.Arguments = []json.RawMessage{}
+	}
+
+	if err := e.encode(m); err != nil {
+		return err
+	}
+
+	return e.buf.WriteByte(recordSeparator)
+}
+
+// marshalCompletion encodes result of server call with given ID, which is
+// null if the client method returned neither result nor error.
+func marshalCompletion(e *encoder, id string, c *Completion) error {
+	m := coreCompletionMessage{Type: coreCompletion, InvocationID: id, Error: c.Error}
+
+	if m.Error == "" {
+		m.Result = c.Result
+		if m.Result == nil {
+			m.Result = json.RawMessage("null")
+		}
+	}
+
+	if err := e.encode(m); err != nil {
+		return err
+	}
+
+	return e.buf.WriteByte(recordSeparator)
+}
+
+func (p coreProtocol) canReconnect() bool {
+	return p.stateful
+}
+
+func (coreProtocol) canBatch() bool {
+	return true
+}
+
+func (coreProtocol) ping() []byte {
+	return []byte(corePingRecord)
+}
+
+// recordConn splits frames of the Core protocol, which may carry multiple
+// messages, and reads one message at a time.
+type recordConn struct {
+	WebsocketConn
+	messageType int
+	pending     [][]byte
+}
+
+func (c *recordConn) ReadMessage(ctx context.Context) (messageType int, p []byte, err error) {
+	for len(c.pending) == 0 {
+		c.messageType, p, err = c.WebsocketConn.ReadMessage(ctx)
+		if err != nil {
+			return c.messageType, nil, err
+		}
+
+		// most frames carry a single record, which is returned as is
+		if i := bytes.IndexByte(p, recordSeparator); i == len(p)-1 && i > 0 {
+			return c.messageType, p[:i], nil
+		}
+
+		for _, record := range bytes.Split(p, []byte{recordSeparator}) {
+			if len(record) != 0 {
+				c.pending = append(c.pending, record)
+			}
+		}
+	}
+
+	p = c.pending[0]
+	c.pending = c.pending[1:]
+
+	return c.messageType, p, nil
+}
+
+func (c *recordConn) Metadata() ConnMetadata {
+	return metadataOf(c.WebsocketConn)
+}
@@ -0,0 +1,62 @@
+package signalr
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// RunWithReconnect runs the client like Run, but when the connection is lost
+// and can not be reestablished by reconnect, it renegotiates a new connection
+// according to policy and continues. Callback streams and handlers stay
+// registered and declared calls are replayed. It returns when ctx is done,
+// renegotiation fails or on permanent failure such as server disconnect or
+// handler error.
+func (c *Client) RunWithReconnect(ctx context.Context, policy RetryPolicy) error {
+	defer c.callbacks.removeAll()
+
+	for {
+		err := c.run(ctx)
+
+		if atomic.LoadInt32(&c.shutdown) == 1 || c.conn.isClosed() {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if permanent(err) {
+			return err
+		}
+
+		c.log(LevelWarn, "connection lost, renegotiating", "error", err)
+
+		if err := policy.retry(ctx, func() error { return c.conn.Renegotiate(ctx) }); err != nil {
+			return err
+		}
+	}
+}
+
+// permanent reports whether client failed for a reason which renegotiation
+// can not fix, including websocket closed with a permanent close code.
+func permanent(err error) bool {
+	var (
+		disconnectedErr *ServerDisconnectedError
+		handlerErr      *HandlerError
+		panicErr        *PanicError
+		unknownErr      *UnknownMessageError
+		shutdownErr     *ShutdownError
+		closeErr        *CloseError
+	)
+
+	if errors.As(err, &closeErr) && !closeErr.Temporary() {
+		return true
+	}
+
+	return errors.As(err, &disconnectedErr) ||
+		errors.As(err, &handlerErr) ||
+		errors.As(err, &panicErr) ||
+		errors.As(err, &unknownErr) ||
+		errors.As(err, &shutdownErr)
+}
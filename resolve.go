@@ -0,0 +1,135 @@
+package signalr
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+)
+
+// IPFamilyMode defines which IP addresses of the endpoint host are dialed.
+type IPFamilyMode int
+
+const (
+	// AnyIPFamily dials addresses as resolved, racing both families.
+	AnyIPFamily IPFamilyMode = iota
+
+	// IPv4Only dials only IPv4 addresses.
+	IPv4Only
+
+	// IPv6Only dials only IPv6 addresses.
+	IPv6Only
+
+	// PreferIPv4 dials IPv4 addresses first, and IPv6 addresses only if none
+	// of them can be connected to.
+	PreferIPv4
+
+	// PreferIPv6 dials IPv6 addresses first, and IPv4 addresses only if none
+	// of them can be connected to.
+	PreferIPv6
+)
+
+// resolvingDialer resolves host on every dial and dials its addresses one by
+// one, in the order of IP family preference. Rotating dialer starts from the
+// address following the one dialed first last time, so that subsequent
+// connections spread over the addresses and skip dead ones.
+type resolvingDialer struct {
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+	family IPFamilyMode
+	rotate bool
+
+	mtx  sync.Mutex
+	next map[string]int
+}
+
+func newResolvingDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error), family IPFamilyMode, rotate bool) *resolvingDialer {
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+
+	return &resolvingDialer{
+		dial:   dial,
+		lookup: net.DefaultResolver.LookupIPAddr,
+		family: family,
+		rotate: rotate,
+		next:   make(map[string]int),
+	}
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "tcp" {
+		switch d.family {
+		case IPv4Only:
+			network = "tcp4"
+		case IPv6Only:
+			network = "tcp6"
+		}
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dial(ctx, network, addr)
+	}
+
+	// restricted network is resolved by the dialer itself
+	if !d.rotate && d.family != PreferIPv4 && d.family != PreferIPv6 {
+		return d.dial(ctx, network, addr)
+	}
+
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips = filterIPs(network, ips)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}
+	}
+
+	if d.rotate {
+		d.mtx.Lock()
+		first := d.next[host] % len(ips)
+		d.next[host] = first + 1
+		d.mtx.Unlock()
+
+		ips = append(ips[first:len(ips):len(ips)], ips[:first]...)
+	}
+
+	if d.family == PreferIPv4 || d.family == PreferIPv6 {
+		sort.SliceStable(ips, func(i, j int) bool {
+			return d.preferred(ips[i]) && !d.preferred(ips[j])
+		})
+	}
+
+	var conn net.Conn
+	for _, ip := range ips {
+		conn, err = d.dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return conn, err
+}
+
+// preferred reports whether ip belongs to preferred IP family.
+func (d *resolvingDialer) preferred(ip net.IPAddr) bool {
+	return (ip.IP.To4() != nil) == (d.family == PreferIPv4)
+}
+
+// filterIPs returns addresses usable with network.
+func filterIPs(network string, ips []net.IPAddr) []net.IPAddr {
+	var res []net.IPAddr
+	for _, ip := range ips {
+		v4 := ip.IP.To4() != nil
+		if network == "tcp4" && !v4 || network == "tcp6" && v4 {
+			continue
+		}
+
+		res = append(res, ip)
+	}
+
+	return res
+}
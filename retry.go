@@ -0,0 +1,156 @@
+package signalr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// RetryPolicy controls how failed negotiate, connect, start and reconnect
+// steps are retried.
+type RetryPolicy struct {
+	// The maximum number of times to re-attempt a step.
+	MaxRetries int
+
+	// The time to wait before retrying, used when Backoff is not set.
+	Interval time.Duration
+
+	// Backoff creates backoff curve used between attempts, e.g.
+	// backoff.NewExponentialBackOff. MaxRetries is applied on top of it.
+	Backoff func() backoff.BackOff
+
+	// HTTP status codes which are worth retrying. When empty, all failures
+	// are retried. 429 Too Many Requests is always retried.
+	RetryableStatusCodes []int
+
+	// Wait for the duration advertised in Retry-After response header when
+	// it is longer than the backoff delay. It is always honored for 429 Too
+	// Many Requests.
+	HonorRetryAfter bool
+
+	// onRetry is called before every retry with the number of the attempt,
+	// the delay before it and the error of the previous attempt
+	onRetry func(attempt int, delay time.Duration, err error)
+}
+
+func (p RetryPolicy) newBackOff() backoff.BackOff {
+	var bo backoff.BackOff
+	if p.Backoff != nil {
+		bo = p.Backoff()
+	} else {
+		bo = backoff.NewConstantBackOff(p.Interval)
+	}
+
+	return backoff.WithMaxRetries(bo, uint64(p.MaxRetries))
+}
+
+// retry calls op until it succeeds, the error is not retryable, retries are
+// exhausted or ctx is done.
+func (p RetryPolicy) retry(ctx context.Context, op func() error) error {
+	bo := p.newBackOff()
+	bo.Reset()
+
+	for attempt := 2; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		if stop, ok := err.(*stopRetry); ok {
+			return stop.cause
+		}
+
+		if !p.retryable(err) {
+			return err
+		}
+
+		delay := bo.NextBackOff()
+		if delay == backoff.Stop {
+			return err
+		}
+
+		if retryAfter := p.retryAfter(err); retryAfter > delay {
+			delay = retryAfter
+		}
+
+		if p.onRetry != nil {
+			p.onRetry(attempt, delay, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// stopRetry is returned by operations retried by RetryPolicy to fail without
+// retries, with the error it wraps, which retrying can not fix.
+type stopRetry struct {
+	cause error
+}
+
+func (e *stopRetry) Error() string {
+	return e.cause.Error()
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if len(p.RetryableStatusCodes) == 0 {
+		return true
+	}
+
+	code, _ := responseStatus(err)
+	if code == 0 || code == http.StatusTooManyRequests {
+		return true
+	}
+
+	for _, retryable := range p.RetryableStatusCodes {
+		if code == retryable {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p RetryPolicy) retryAfter(err error) time.Duration {
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) {
+		return 0
+	}
+
+	if !p.HonorRetryAfter && statusErr.code != http.StatusTooManyRequests {
+		return 0
+	}
+
+	return statusErr.retryAfter
+}
+
+// parseRetryAfter parses Retry-After header value given either in seconds or
+// as HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+
+	return 0
+}
@@ -1,14 +1,27 @@
 package signalr
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,14 +35,66 @@ import (
 )
 
 var (
-	connectionData  = "connection-data"
+	connectionData  = `[{"name":"hub"}]`
 	connectionToken = "connection-token"
 	connectionID    = "connection-id"
-	protocolVersion = "1337"
+	protocolVersion = "1.5"
 	groupsToken     = "42"
 	retryInterval   = 5 * time.Millisecond
 )
 
+// TestMain fails the suite if goroutines of the package outlive the tests, as
+// all of them should stop once clients and connections are closed.
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	if code == 0 {
+		if leaked := leakedGoroutines(5 * time.Second); leaked != "" {
+			fmt.Fprintf(os.Stderr, "goroutines leaked by the package:\n\n%s\n", leaked)
+			code = 1
+		}
+	}
+
+	os.Exit(code)
+}
+
+// leakedGoroutines waits for goroutines running functions defined in the
+// package, other than tests, to stop and returns their stacks if they do not.
+func leakedGoroutines(timeout time.Duration) string {
+	_, file, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(file) + "/"
+
+	deadline := time.Now().Add(timeout)
+	for {
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+
+		var leaked []string
+		for _, g := range strings.Split(string(buf), "\n\n") {
+			for _, line := range strings.Split(g, "\n") {
+				line = strings.TrimSpace(line)
+
+				// file lines of package frames, e.g. /path/client.go:42 +0x1f
+				rest := strings.TrimPrefix(line, dir)
+				if rest == line || strings.Contains(rest, "/") {
+					continue
+				}
+
+				if name, _, _ := strings.Cut(rest, ":"); !strings.HasSuffix(name, "_test.go") {
+					leaked = append(leaked, g)
+					break
+				}
+			}
+		}
+
+		if len(leaked) == 0 || time.Now().After(deadline) {
+			return strings.Join(leaked, "\n\n")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestClient(t *testing.T) {
 	t.Parallel()
 
@@ -86,6 +151,11 @@ func TestClient(t *testing.T) {
 
 			if tc.expectedErr != nil {
 				expectErrorMatch(t, tc.expectedErr, err)
+
+				if code, _ := responseStatus(err); code != 404 {
+					t.Errorf("expected status code %d, got %d", 404, code)
+				}
+
 				return
 			}
 
@@ -101,10 +171,11 @@ func TestClient(t *testing.T) {
 			})
 
 			expectState(t, State{
-				ConnectionData:  connectionData,
-				ConnectionToken: connectionToken,
-				ConnectionID:    connectionID,
-				Protocol:        protocolVersion,
+				ConnectionData:    connectionData,
+				ConnectionToken:   connectionToken,
+				ConnectionID:      connectionID,
+				Protocol:          protocolVersion,
+				DisconnectTimeout: 30 * time.Second,
 			}, *c.State())
 
 			var msg Message
@@ -113,236 +184,269 @@ func TestClient(t *testing.T) {
 			}
 
 			expectState(t, State{
-				ConnectionData:  connectionData,
-				ConnectionToken: connectionToken,
-				ConnectionID:    connectionID,
-				Protocol:        protocolVersion,
-				GroupsToken:     groupsToken,
-				MessageID:       "0",
+				ConnectionData:    connectionData,
+				ConnectionToken:   connectionToken,
+				ConnectionID:      connectionID,
+				Protocol:          protocolVersion,
+				DisconnectTimeout: 30 * time.Second,
+				GroupsToken:       groupsToken,
+				MessageID:         "0",
 			}, *c.State())
 		})
 	}
 }
 
-func TestReadMessage(t *testing.T) {
+func TestParams(t *testing.T) {
 	t.Parallel()
 
-	initMessage := readResult{msg: `{"S":1}`}
+	var (
+		mtx     sync.Mutex
+		queries = make(map[string]url.Values)
+	)
 
-	cases := []struct {
-		name        string
-		dialResults []dialResult
-		readResults []readResult
-		retries     int
-		expectedMsg Message
-		expectedErr error
-	}{
-		{
-			name:        "normal message",
-			readResults: []readResult{{msg: `{"C":"test message"}`}},
-			expectedMsg: Message{MessageID: "test message"},
-		},
-		{
-			name:        "groups token",
-			readResults: []readResult{{msg: `{"C":"test message","G":"custom-groups-token"}`}},
-			expectedMsg: Message{MessageID: "test message", GroupsToken: "custom-groups-token"},
-		},
-		{
-			name: "recover after websocket closed",
-			readResults: []readResult{
-				{err: &CloseError{code: 1001}},
-				{msg: `{"C":"test message"}`},
-			},
-			expectedMsg: Message{MessageID: "test message"},
-		},
-		{
-			name: "reconnect failed",
-			readResults: []readResult{
-				{err: &CloseError{code: 1001}},
-				{msg: `{"C":"test message"}`},
-			},
-			dialResults: []dialResult{
-				{err: io.EOF},
-			},
-			expectedErr: &ConnectError{},
-		},
-		{
-			name:        "read failed",
-			readResults: []readResult{{err: io.EOF}},
-			expectedErr: &ReadError{},
-		},
-		{
-			name:        "empty message",
-			readResults: []readResult{{msg: ""}},
-			expectedErr: &json.SyntaxError{},
-		},
-		{
-			name:        "bad json",
-			readResults: []readResult{{msg: "{invalid json"}},
-			expectedErr: &json.SyntaxError{},
-		},
-	}
+	handler := newRootHandler()
+	ts := httptest.NewServer(wrapHandler(t, func(t testing.TB, w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		queries[req.URL.Path] = req.URL.Query()
+		mtx.Unlock()
 
-	for _, tc := range cases {
-		tc := tc
+		handler(t, w, req)
+	}))
+	t.Cleanup(ts.Close)
 
-		t.Run(tc.name, func(t *testing.T) {
-			ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
-			t.Cleanup(ts.Close)
+	ctx := context.Background()
 
-			readResults := append([]readResult{initMessage}, tc.readResults...)
-			conn := &fakeConn{results: readResults}
+	var calls int
+	c, err := Dial(
+		ctx,
+		ts.URL+"?version=2",
+		connectionData,
+		Params(url.Values{"tenant": []string{"tenant-1"}}),
+		ParamsFunc(func(context.Context) (url.Values, error) {
+			calls++
+			return url.Values{"token": []string{strconv.Itoa(calls)}}, nil
+		}),
+		RetryInterval(retryInterval),
+	)
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = c.Close() })
 
-			dialResults := append([]dialResult{{conn: conn}}, tc.dialResults...)
-			dialer := func(*http.Client) WebsocketDialer {
-				return &mockDialer{conn: conn, results: dialResults}
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	for _, path := range []string{"/negotiate", "/connect", "/start"} {
+		query := queries[path]
+		for key, expected := range map[string]string{"version": "2", "tenant": "tenant-1", "token": "1"} {
+			if actual := query.Get(key); actual != expected {
+				t.Errorf("expected %s query param %q to be %q, got %q", path, key, expected, actual)
 			}
+		}
+	}
+}
 
-			ctx := context.Background()
-			c, err := Dial(ctx, ts.URL, connectionData, Dialer(dialer), RetryInterval(retryInterval), MaxReconnectRetries(tc.retries))
+func TestNetDialContext(t *testing.T) {
+	t.Parallel()
 
-			if !expectNoError(t, err) {
-				return
-			}
+	ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
 
-			var msg Message
-			err = c.ReadMessage(ctx, &msg)
+	ctx := context.Background()
 
-			if tc.expectedErr != nil {
-				expectErrorMatch(t, tc.expectedErr, err)
-				return
-			}
+	// endpoint host can not be resolved, so dial only succeeds if both HTTP
+	// requests and websocket connection go through custom dialer
+	var dials int32
+	c, err := Dial(
+		ctx,
+		"http://signalr.invalid",
+		connectionData,
+		HTTPClient(ts.Client()),
+		NetDialContext(func(ctx context.Context, network, _ string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+
+			var d net.Dialer
+			return d.DialContext(ctx, network, ts.Listener.Addr().String())
+		}),
+		RetryInterval(retryInterval),
+	)
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = c.Close() })
 
-			expectNoError(t, err)
-			expectState(t, State{
-				ConnectionData:  connectionData,
-				ConnectionID:    connectionID,
-				ConnectionToken: connectionToken,
-				Protocol:        protocolVersion,
-				GroupsToken:     tc.expectedMsg.GroupsToken,
-				MessageID:       tc.expectedMsg.MessageID,
-			}, *c.State())
-			expectMessage(t, tc.expectedMsg, msg)
-		})
+	if n := atomic.LoadInt32(&dials); n < 2 {
+		t.Errorf("expected at least 2 dials, got %d", n)
 	}
 }
 
-func TestNegotiate(t *testing.T) {
+type syncBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.buf.String()
+}
+
+func TestTLSKeyLog(t *testing.T) {
 	t.Parallel()
 
-	cases := []struct {
-		name        string
-		endpoint    string
-		retries     int
-		handler     testHandlerFunc
-		headers     http.Header
-		expectedErr error
-	}{
-		{
-			name: "successful negotiate",
-		},
-		{
-			name:    "recover after failure",
-			handler: errorResponseOnce(503),
-			retries: 1,
-		},
-		{
-			name:        "invalid scheme",
-			endpoint:    "ssh://invalid-endpoint",
-			expectedErr: &url.Error{},
-		},
-		{
-			name:        "503 error",
-			handler:     errorResponse(503),
-			expectedErr: &url.Error{},
-		},
-		{
-			name:        "failed get request",
-			handler:     timeout(2 * retryInterval),
-			expectedErr: &ReadError{},
-		},
-		{
-			name:        "invalid json",
-			handler:     response("invalid json"),
-			expectedErr: &json.SyntaxError{},
-		},
+	ts := httptest.NewTLSServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
+
+	ctx := context.Background()
+
+	var keyLog syncBuffer
+	c, err := Dial(ctx, ts.URL, connectionData, HTTPClient(ts.Client()), TLSKeyLog(&keyLog), RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
 	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	// secrets are logged per connection, identified by client random
+	randoms := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(keyLog.String()), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("expected NSS key log line, got %q", line)
+		}
 
-	for _, tc := range cases {
-		tc := tc
+		randoms[fields[1]] = true
+	}
 
-		t.Run(tc.name, func(t *testing.T) {
-			ctx, cancel := context.WithCancel(context.Background())
-			t.Cleanup(cancel)
+	// HTTP requests and websocket connection
+	if len(randoms) < 2 {
+		t.Errorf("expected secrets of at least 2 connections, got %d", len(randoms))
+	}
 
-			handler := tc.handler
-			if handler == nil {
-				handler = newRootHandler()
-			}
+	if ts.Client().Transport.(*http.Transport).TLSClientConfig.KeyLogWriter != nil {
+		t.Error("expected transport of the client not to be modified")
+	}
+}
 
-			// Create a test server.
-			ts := httptest.NewServer(wrapHandler(t, handler))
-			t.Cleanup(ts.Close)
+func TestRotateAddresses(t *testing.T) {
+	t.Parallel()
 
-			endpoint := tc.endpoint
-			if endpoint == "" {
-				endpoint = ts.URL
-			}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-			state := State{
-				ConnectionData: connectionData,
-				Protocol:       protocolVersion,
-			}
+	var dialed []string
 
-			bo := backoff.WithMaxRetries(backoff.NewConstantBackOff(retryInterval), uint64(tc.retries))
-			err := negotiate(ctx, ts.Client(), endpoint, tc.headers, &state, bo)
+	d := newResolvingDialer(func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if strings.HasPrefix(addr, "10.0.0.1:") {
+			return nil, errors.New("connection refused")
+		}
 
-			if tc.expectedErr != nil {
-				expectErrorMatch(t, tc.expectedErr, err)
-				return
-			}
+		client, server := net.Pipe()
+		_ = server.Close()
 
-			expectNoError(t, err)
-			expectState(t, State{
-				ConnectionData:  connectionData,
-				ConnectionID:    connectionID,
-				ConnectionToken: connectionToken,
-				Protocol:        protocolVersion,
-			}, state)
-		})
+		return client, nil
+	}, AnyIPFamily, true)
+	d.lookup = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		if host != "signalr.test" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("::3")}}, nil
+	}
+
+	dial := func(network, addr string) {
+		conn, err := d.DialContext(ctx, network, addr)
+		if expectNoError(t, err) {
+			_ = conn.Close()
+		}
+	}
+
+	// dead address is skipped, and every dial starts from the next address
+	dial("tcp", "signalr.test:443")
+	dial("tcp", "signalr.test:443")
+	dial("tcp", "signalr.test:443")
+	dial("tcp4", "signalr.test:443")
+	dial("tcp", "10.0.0.9:443")
+
+	expected := []string{
+		"10.0.0.1:443", "10.0.0.2:443",
+		"10.0.0.2:443",
+		"[::3]:443",
+		"10.0.0.2:443",
+		"10.0.0.9:443",
+	}
+	if !reflect.DeepEqual(expected, dialed) {
+		t.Errorf("expected dialed addresses %v, got %v", expected, dialed)
+	}
+
+	_, err := d.DialContext(ctx, "tcp", "unknown.test:443")
+	expectErrorMatch(t, &net.DNSError{}, err)
+
+	// both HTTP requests and websocket connection resolve the host
+	ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	c, err := Dial(ctx, "http://localhost:"+port, connectionData, RotateAddresses(), RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
 	}
+
+	expectNoError(t, c.Close())
 }
 
-func TestConnect(t *testing.T) {
+func TestIPFamily(t *testing.T) {
 	t.Parallel()
 
-	endpoint := "http://fake-endpoint"
-	headers := make(http.Header)
-
-	notFoundResult := dialResult{status: http.StatusNotFound, err: websocket.ErrBadHandshake}
-	eofResult := dialResult{err: io.EOF}
-	validResult := dialResult{conn: &fakeConn{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
 
 	cases := []struct {
-		name        string
-		dialResults []dialResult
-		retries     int
-		expectedErr error
+		name     string
+		family   IPFamilyMode
+		rotate   bool
+		dials    int
+		expected []string
 	}{
 		{
-			name:        "successful reconnect",
-			dialResults: []dialResult{notFoundResult, eofResult, validResult},
-			retries:     5,
+			name:     "IPv4 only",
+			family:   IPv4Only,
+			dials:    1,
+			expected: []string{"tcp4 signalr.test:443"},
 		},
 		{
-			name:        "unsuccessful reconnect with http status",
-			dialResults: []dialResult{notFoundResult},
-			expectedErr: &DialError{},
+			name:     "IPv6 only",
+			family:   IPv6Only,
+			dials:    1,
+			expected: []string{"tcp6 signalr.test:443"},
 		},
 		{
-			name:        "unsuccessful reconnect with other error",
-			dialResults: []dialResult{eofResult},
-			expectedErr: &DialError{},
+			name:     "prefer IPv4",
+			family:   PreferIPv4,
+			dials:    1,
+			expected: []string{"tcp 10.0.0.1:443", "tcp 10.0.0.2:443"},
+		},
+		{
+			name:     "prefer IPv6",
+			family:   PreferIPv6,
+			dials:    1,
+			expected: []string{"tcp [::3]:443"},
+		},
+		{
+			name:     "rotate IPv6 only",
+			family:   IPv6Only,
+			rotate:   true,
+			dials:    2,
+			expected: []string{"tcp6 [::3]:443", "tcp6 [::3]:443"},
 		},
 	}
 
@@ -350,102 +454,225 @@ func TestConnect(t *testing.T) {
 		tc := tc
 
 		t.Run(tc.name, func(t *testing.T) {
-			ctx := context.Background()
-			bo := backoff.WithMaxRetries(backoff.NewConstantBackOff(1*time.Millisecond), uint64(tc.retries))
+			t.Parallel()
 
-			for _, command := range []string{"connect", "reconnect"} {
-				dialer := &mockDialer{results: tc.dialResults}
+			var dialed []string
 
-				state := State{
-					ConnectionData: connectionData,
-					Protocol:       protocolVersion,
+			d := newResolvingDialer(func(_ context.Context, network, addr string) (net.Conn, error) {
+				dialed = append(dialed, network+" "+addr)
+				if strings.HasPrefix(addr, "10.0.0.1:") {
+					return nil, errors.New("connection refused")
 				}
 
-				conn, err := connect(ctx, dialer, endpoint, command, headers, &state, bo)
+				client, server := net.Pipe()
+				_ = server.Close()
 
-				if tc.expectedErr != nil {
-					expectErrorMatch(t, tc.expectedErr, err)
-					return
-				}
+				return client, nil
+			}, tc.family, tc.rotate)
+			d.lookup = func(context.Context, string) ([]net.IPAddr, error) {
+				return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("::3")}}, nil
+			}
 
-				if conn == nil {
-					t.Error("expected non-nil conn")
+			for i := 0; i < tc.dials; i++ {
+				conn, err := d.DialContext(ctx, "tcp", "signalr.test:443")
+				if expectNoError(t, err) {
+					_ = conn.Close()
 				}
 			}
+
+			if !reflect.DeepEqual(tc.expected, dialed) {
+				t.Errorf("expected dials %v, got %v", tc.expected, dialed)
+			}
 		})
 	}
 }
 
-func TestStart(t *testing.T) {
+func TestUnixSocket(t *testing.T) {
 	t.Parallel()
 
-	headers := make(http.Header)
-	initMessage := readResult{msgType: 1, msg: `{"S":1}`}
+	path := filepath.Join(t.TempDir(), "signalr.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets are not supported: %v", err)
+	}
+
+	var host string
+	handler := newRootHandler()
+	ts := httptest.NewUnstartedServer(wrapHandler(t, func(t testing.TB, w http.ResponseWriter, req *http.Request) {
+		host = req.Host
+		handler(t, w, req)
+	}))
+	ts.Listener = listener
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	ctx := context.Background()
+
+	c, err := Dial(ctx, "http://signalr.local/hub", connectionData, UnixSocket(path), RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	if host != "signalr.local" {
+		t.Errorf("expected host %q, got %q", "signalr.local", host)
+	}
+}
+
+func TestResume(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mtx      sync.Mutex
+		requests = make(map[string]int)
+		rejected int32
+	)
+
+	handler := newRootHandler()
+	ts := httptest.NewServer(wrapHandler(t, func(t testing.TB, w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		requests[req.URL.Path]++
+		mtx.Unlock()
+
+		if req.URL.Path == "/reconnect" && atomic.LoadInt32(&rejected) == 1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		handler(t, w, req)
+	}))
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	dial := func(opts ...DialOpt) map[string]int {
+		mtx.Lock()
+		requests = make(map[string]int)
+		mtx.Unlock()
+
+		c, err := Dial(ctx, ts.URL, connectionData, append(opts, RetryInterval(retryInterval))...)
+		if !expectNoError(t, err) {
+			return nil
+		}
+		_ = c.Close()
+
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		return requests
+	}
+
+	c, err := Dial(ctx, ts.URL, connectionData, RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+	state := *c.State()
+	_ = c.Close()
+
+	if reqs := dial(Resume(state)); reqs["/negotiate"] != 0 || reqs["/reconnect"] != 1 {
+		t.Errorf("expected session to be resumed, got requests %v", reqs)
+	}
+
+	// resumed connection keeps the disconnect timeout saved with state, so
+	// that it is not reconnected once the server forgot it
+	resumed, err := Dial(ctx, ts.URL, connectionData, Resume(state), RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+	_ = resumed.Close()
+
+	if timeout := resumed.NegotiateInfo().DisconnectTimeout; timeout != 30*time.Second {
+		t.Errorf("expected disconnect timeout %s, got %s", 30*time.Second, timeout)
+	}
+
+	atomic.StoreInt32(&rejected, 1)
+	if reqs := dial(Resume(state)); reqs["/negotiate"] != 1 || reqs["/reconnect"] != 1 {
+		t.Errorf("expected fallback to negotiate, got requests %v", reqs)
+	}
+
+	state.ConnectionData = Hubs("other")
+	if reqs := dial(Resume(state)); reqs["/negotiate"] != 1 || reqs["/reconnect"] != 0 {
+		t.Errorf("expected negotiate for different connection data, got requests %v", reqs)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mtx     sync.Mutex
+		protos  = make(map[string]string)
+		resumed bool
+	)
+
+	handler := newRootHandler()
+	ts := httptest.NewUnstartedServer(wrapHandler(t, func(t testing.TB, w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		protos[req.URL.Path] = req.Proto
+		if req.URL.Path == "/connect" {
+			resumed = req.TLS.DidResume
+		}
+		mtx.Unlock()
+
+		handler(t, w, req)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(8)
+
+	ctx := context.Background()
+
+	c, err := Dial(ctx, ts.URL, connectionData, Transport(transport), RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	for path, expected := range map[string]string{"/negotiate": "HTTP/2.0", "/start": "HTTP/2.0", "/connect": "HTTP/1.1"} {
+		if actual := protos[path]; actual != expected {
+			t.Errorf("expected %s to use %s, got %s", path, expected, actual)
+		}
+	}
+
+	if !resumed {
+		t.Error("expected websocket handshake to resume TLS session")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	tlsServer := httptest.NewTLSServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(tlsServer.Close)
+
+	plainServer := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(plainServer.Close)
 
 	cases := []struct {
-		name        string
-		handler     testHandlerFunc
-		readResult  readResult
-		retries     int
-		expectedErr error
+		name string
+		ts   *httptest.Server
+		opts []DialOpt
 	}{
 		{
-			name:       "successful start",
-			readResult: initMessage,
-		},
-		{
-			name:       "recover after failure",
-			handler:    errorResponseOnce(503),
-			retries:    1,
-			readResult: initMessage,
-		},
-		{
-			name:        "request failed with http status",
-			handler:     errorResponse(503),
-			expectedErr: &url.Error{},
-		},
-		{
-			name:        "request timed out",
-			handler:     timeout(2 * retryInterval),
-			expectedErr: &ReadError{},
-		},
-		{
-			name:        "invalid json",
-			handler:     response("invalid json"),
-			expectedErr: &json.SyntaxError{},
-		},
-		{
-			name:        "non-started response 1",
-			handler:     response(`{"hello":"world"}`),
-			expectedErr: &InvalidStartResponseError{},
-		},
-		{
-			name:        "non-stared response 2",
-			handler:     response(`{"Response":"blabla"}`),
-			expectedErr: &InvalidStartResponseError{},
-		},
-		{
-			name:        "read error",
-			readResult:  readResult{err: io.EOF},
-			expectedErr: &ReadError{},
-		},
-		{
-			name:        "wrong message type",
-			handler:     response(`{"Response":"started"}`),
-			readResult:  readResult{msgType: 9001},
-			expectedErr: &ReadError{},
-		},
-		{
-			name:        "message json unmarshal failure",
-			handler:     response(`{"Response":"started"}`),
-			readResult:  readResult{msg: "invalid json"},
-			expectedErr: &json.SyntaxError{},
+			name: "tls",
+			ts:   tlsServer,
+			opts: []DialOpt{HTTPClient(tlsServer.Client())},
 		},
 		{
-			name:        "server not initialized",
-			handler:     response(`{"Response":"started"}`),
-			readResult:  readResult{msg: `{"S":9002}`},
-			expectedErr: &InvalidInitMessageError{},
+			name: "wrapped connection",
+			ts:   plainServer,
+			opts: []DialOpt{Dialer(FaultInjector(NewDefaultDialer, Faults{}))},
 		},
 	}
 
@@ -453,73 +680,133 @@ func TestStart(t *testing.T) {
 		tc := tc
 
 		t.Run(tc.name, func(t *testing.T) {
-			ctx, cancel := context.WithCancel(context.Background())
-			t.Cleanup(cancel)
+			t.Parallel()
 
-			handler := tc.handler
-			if handler == nil {
-				handler = newRootHandler()
+			c, err := Dial(ctx, tc.ts.URL, connectionData, append(tc.opts, RetryInterval(retryInterval))...)
+			if !expectNoError(t, err) {
+				return
 			}
+			t.Cleanup(func() { _ = c.Close() })
 
-			// Create a test server.
-			ts := httptest.NewServer(wrapHandler(t, handler))
-			t.Cleanup(ts.Close)
+			md := NewClient("hub", c).Metadata()
 
-			conn := &fakeConn{results: []readResult{tc.readResult}}
+			if md.ConnectionID != "connection-id" {
+				t.Errorf("expected connection ID connection-id, got %q", md.ConnectionID)
+			}
 
-			state := State{
-				ConnectionData:  connectionData,
-				ConnectionID:    connectionID,
-				ConnectionToken: connectionToken,
-				Protocol:        protocolVersion,
+			if md.LocalAddr == nil || md.RemoteAddr == nil || md.RemoteAddr.String() != tc.ts.Listener.Addr().String() {
+				t.Errorf("expected remote address %s, got %v", tc.ts.Listener.Addr(), md.RemoteAddr)
 			}
 
-			bo := backoff.WithMaxRetries(backoff.NewConstantBackOff(retryInterval), uint64(tc.retries))
-			err := start(ctx, ts.Client(), conn, ts.URL, headers, &state, bo)
+			if encrypted := tc.ts.TLS != nil; (md.TLS != nil) != encrypted || encrypted && !md.TLS.HandshakeComplete {
+				t.Errorf("expected TLS state to be reported for encrypted connection, got %+v", md.TLS)
+			}
+		})
+	}
 
-			if tc.expectedErr != nil {
-				expectErrorMatch(t, tc.expectedErr, err)
-				return
+	header := http.Header{}
+	header.Add("Sec-WebSocket-Extensions", "permessage-deflate; client_no_context_takeover, x-custom")
+
+	expected := []string{"permessage-deflate; client_no_context_takeover", "x-custom"}
+	if extensions := parseExtensions(header); !reflect.DeepEqual(expected, extensions) {
+		t.Errorf("expected extensions %v, got %v", expected, extensions)
+	}
+}
+
+func TestSetupTiming(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	ts := httptest.NewTLSServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
+
+	endpoint := ts.URL + "/?token=secret"
+
+	c, err := Dial(ctx, endpoint, connectionData, HTTPClient(ts.Client()), RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	var timings []SetupTiming
+
+	for done := false; !done; {
+		select {
+		case ev := <-c.events:
+			if timing, ok := ev.(SetupTiming); ok {
+				timings = append(timings, timing)
 			}
+		default:
+			done = true
+		}
+	}
 
-			expectNoError(t, err)
-			expectState(t, State{
-				ConnectionData:  connectionData,
-				ConnectionID:    connectionID,
-				ConnectionToken: connectionToken,
-				Protocol:        protocolVersion,
-			}, state)
-		})
+	var steps []string
+	for _, timing := range timings {
+		steps = append(steps, timing.Step)
+	}
+
+	if expected := []string{"negotiate", "connect", "start"}; !reflect.DeepEqual(expected, steps) {
+		t.Fatalf("expected setup steps %v, got %v", expected, steps)
+	}
+
+	for _, timing := range timings {
+		if timing.Err != nil {
+			t.Errorf("%s: expected no error, got %v", timing.Step, timing.Err)
+		}
+
+		if strings.Contains(timing.Endpoint, "secret") || !strings.HasPrefix(timing.Endpoint, "http") && !strings.HasPrefix(timing.Endpoint, "ws") {
+			t.Errorf("%s: expected endpoint without query, got %q", timing.Step, timing.Endpoint)
+		}
+
+		if timing.FirstByte <= 0 || timing.Total < timing.FirstByte {
+			t.Errorf("%s: expected first byte within total time, got %+v", timing.Step, timing)
+		}
+
+		// websocket dialer does not pool connections
+		if !timing.Reused && (timing.Connect <= 0 || timing.TLS <= 0) {
+			t.Errorf("%s: expected connect and TLS handshake to be timed, got %+v", timing.Step, timing)
+		}
 	}
 }
 
-func TestPrepareRequest(t *testing.T) {
+func TestSetupTimeouts(t *testing.T) {
 	t.Parallel()
 
-	ctx := context.Background()
+	root := newRootHandler()
+
+	// connect requests are never answered
+	stalled := func(t testing.TB, w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/connect") {
+			<-r.Context().Done()
+			return
+		}
+
+		root(t, w, r)
+	}
 
 	cases := []struct {
-		name        string
-		url         string
-		headers     http.Header
-		expectedErr error
+		name     string
+		handler  testHandlerFunc
+		opts     []DialOpt
+		expected SetupTimeoutError
 	}{
 		{
-			name: "simple request with no headers",
-			url:  "http://example.org",
+			name:     "handshake",
+			handler:  stalled,
+			opts:     []DialOpt{HandshakeTimeout(50 * time.Millisecond), ConnectRetry(RetryPolicy{})},
+			expected: SetupTimeoutError{Step: "handshake", Timeout: 50 * time.Millisecond},
 		},
 		{
-			name: "complex request with headers",
-			url:  "https://example.org/custom/path?param=123",
-			headers: http.Header{
-				"header1": []string{"value1"},
-				"header2": []string{"value1", "value2"},
+			name:    "init",
+			handler: newRootHandler(),
+			opts: []DialOpt{
+				InitTimeout(50 * time.Millisecond),
+				Dialer(func(*http.Client) WebsocketDialer { return &mockDialer{conn: blockingConn{}} }),
 			},
-		},
-		{
-			name:        "invalid URL",
-			url:         ":",
-			expectedErr: &url.Error{},
+			expected: SetupTimeoutError{Step: "init", Timeout: 50 * time.Millisecond},
 		},
 	}
 
@@ -527,31 +814,5563 @@ func TestPrepareRequest(t *testing.T) {
 		tc := tc
 
 		t.Run(tc.name, func(t *testing.T) {
-			req, err := prepareRequest(ctx, tc.url, tc.headers)
+			t.Parallel()
 
-			if tc.expectedErr != nil {
-				expectErrorMatch(t, tc.expectedErr, err)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			t.Cleanup(cancel)
+
+			ts := httptest.NewServer(wrapHandler(t, tc.handler))
+			t.Cleanup(ts.Close)
+
+			began := time.Now()
+
+			_, err := Dial(ctx, ts.URL, connectionData, append(tc.opts, RetryInterval(retryInterval))...)
+
+			var timeoutErr *SetupTimeoutError
+			if !errors.As(err, &timeoutErr) {
+				t.Fatalf("expected SetupTimeoutError, got %v", err)
+			}
+
+			if timeoutErr.Step != tc.expected.Step || timeoutErr.Timeout != tc.expected.Timeout {
+				t.Errorf("expected %s timeout after %s, got %s after %s", tc.expected.Step, tc.expected.Timeout, timeoutErr.Step, timeoutErr.Timeout)
+			}
+
+			if ctx.Err() != nil {
+				t.Errorf("expected Dial to fail before its context, took %s", time.Since(began))
+			}
+		})
+	}
+}
+
+func TestFailover(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	var (
+		mtx      sync.Mutex
+		hijacked []net.Conn
+		failed   int32
+	)
+
+	handler := newRootHandler()
+	primary := httptest.NewUnstartedServer(wrapHandler(t, func(t testing.TB, w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failed) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		handler(t, w, req)
+	}))
+	primary.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateHijacked {
+			mtx.Lock()
+			hijacked = append(hijacked, conn)
+			mtx.Unlock()
+		}
+	}
+	primary.Start()
+	t.Cleanup(primary.Close)
+
+	secondary := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(secondary.Close)
+
+	opts := []DialOpt{MaxNegotiateRetries(0), MaxReconnectRetries(0), RetryInterval(retryInterval)}
+
+	c, err := Dial(ctx, down.URL, connectionData, append(opts, Endpoints(primary.URL, secondary.URL))...)
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	if endpoint := c.Endpoint(); endpoint != primary.URL {
+		t.Errorf("expected endpoint %s, got %s", primary.URL, endpoint)
+	}
+
+	var msg Message
+	if !expectNoError(t, c.ReadMessage(ctx, &msg)) {
+		return
+	}
+
+	// make primary unavailable and drop its websocket connection
+	atomic.StoreInt32(&failed, 1)
+
+	mtx.Lock()
+	for _, conn := range hijacked {
+		_ = conn.Close()
+	}
+	mtx.Unlock()
+
+	// drain messages buffered before the connection was dropped
+	for c.Endpoint() != secondary.URL {
+		if !expectNoError(t, c.ReadMessage(ctx, &msg)) {
+			return
+		}
+	}
+
+	if !expectNoError(t, c.ReadMessage(ctx, &msg)) {
+		return
+	}
+
+	if first := FailoverRoundRobin.first(2, 3); first != 0 {
+		t.Errorf("expected round robin to wrap around, got %d", first)
+	}
+
+	if first := FailoverPriority.first(2, 3); first != 0 {
+		t.Errorf("expected priority to start from primary, got %d", first)
+	}
+}
+
+func TestRenegotiate(t *testing.T) {
+	t.Parallel()
+
+	var negotiations int64
+
+	handler := newRootHandler()
+	ts := httptest.NewServer(wrapHandler(t, func(t testing.TB, w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/negotiate") {
+			atomic.AddInt64(&negotiations, 1)
+		}
+
+		handler(t, w, req)
+	}))
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	c, err := Dial(ctx, ts.URL, connectionData, RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	read := make(chan error)
+	go func() {
+		defer close(read)
+
+		for {
+			var msg Message
+			err := c.ReadMessage(ctx, &msg)
+
+			select {
+			case <-ctx.Done():
+				return
+			case read <- err:
+			}
+		}
+	}()
+
+	expectNoError(t, <-read)
+	expectNoError(t, c.Renegotiate(ctx))
+
+	for i := 0; i < 10; i++ {
+		if !expectNoError(t, <-read) {
+			break
+		}
+	}
+
+	if n := atomic.LoadInt64(&negotiations); n != 2 {
+		t.Errorf("expected %d negotiate requests, got %d", 2, n)
+	}
+}
+
+func TestCacheNegotiate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name                 string
+		elapsed              time.Duration
+		rejected             bool
+		expectedNegotiations int64
+	}{
+		{name: "within disconnect timeout", elapsed: 29 * time.Second, expectedNegotiations: 1},
+		{name: "after disconnect timeout", elapsed: 30 * time.Second, expectedNegotiations: 2},
+		{name: "cached token rejected", rejected: true, expectedNegotiations: 2},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var negotiations, connects int64
+
+			handler := newRootHandler()
+			ts := httptest.NewServer(wrapHandler(t, func(t testing.TB, w http.ResponseWriter, req *http.Request) {
+				switch {
+				case strings.HasSuffix(req.URL.Path, "/negotiate"):
+					atomic.AddInt64(&negotiations, 1)
+				case strings.HasSuffix(req.URL.Path, "/connect"):
+					if atomic.AddInt64(&connects, 1) == 2 && tc.rejected {
+						w.WriteHeader(http.StatusForbidden)
+						return
+					}
+				}
+
+				handler(t, w, req)
+			}))
+			t.Cleanup(ts.Close)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			t.Cleanup(cancel)
+
+			clock := &fakeClock{now: time.Now()}
+
+			c, err := Dial(ctx, ts.URL, connectionData, CacheNegotiate(), TimeSource(clock), ConnectRetry(RetryPolicy{}))
+			if !expectNoError(t, err) {
+				return
+			}
+			t.Cleanup(func() { _ = c.Close() })
+
+			clock.now = clock.now.Add(tc.elapsed)
+
+			if !expectNoError(t, c.Renegotiate(ctx)) {
+				return
+			}
+
+			if n := atomic.LoadInt64(&negotiations); n != tc.expectedNegotiations {
+				t.Errorf("expected %d negotiate requests, got %d", tc.expectedNegotiations, n)
+			}
+
+			if state := c.State(); state.ConnectionToken != connectionToken || state.ConnectionID != connectionID {
+				t.Errorf("expected connection %s, got %s", connectionID, state.ConnectionID)
+			}
+		})
+	}
+}
+
+func TestConnectionData(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		data        string
+		expectedErr bool
+	}{
+		{name: "persistent connection", data: ""},
+		{name: "single hub", data: Hubs("corehub")},
+		{name: "multiple hubs", data: Hubs("corehub", "c2")},
+		{name: "escaped hub", data: Hubs(`quoted"hub`)},
+		{name: "no hubs", data: Hubs(), expectedErr: true},
+		{name: "empty hub name", data: Hubs(""), expectedErr: true},
+		{name: "duplicate hub", data: Hubs("c2", "C2"), expectedErr: true},
+		{name: "invalid json", data: "corehub", expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateConnectionData(tc.data)
+			if tc.expectedErr {
+				expectErrorMatch(t, &InvalidConnectionDataError{}, err)
+				return
+			}
+
+			expectNoError(t, err)
+		})
+	}
+
+	if data := Hubs("corehub", "c2"); data != `[{"name":"corehub"},{"name":"c2"}]` {
+		t.Errorf("unexpected connection data %s", data)
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		client      string
+		server      string
+		expectStart bool
+		expectedErr error
+	}{
+		{name: "1.2", client: "1.2", server: "1.2"},
+		{name: "1.3", client: "1.3", server: "1.3"},
+		{name: "1.4", client: "1.4", server: "1.4", expectStart: true},
+		{name: "2.1", client: "2.1", server: "2.1", expectStart: true},
+		{name: "older server", client: "2.0", server: "1.5", expectStart: true},
+		{name: "unsupported", client: "1.1", expectedErr: &UnsupportedProtocolError{}},
+		{name: "newer server", client: "1.5", server: "2.0", expectedErr: &IncompatibleProtocolError{}},
+		{name: "unknown server", client: "1.5", server: "1337", expectedErr: &IncompatibleProtocolError{}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var started int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.Contains(r.URL.Path, "/negotiate"):
+					_ = json.NewEncoder(w).Encode(negotiateResponse{
+						ConnectionToken: connectionToken,
+						ConnectionID:    connectionID,
+						ProtocolVersion: tc.server,
+					})
+				case strings.Contains(r.URL.Path, "/connect"):
+					upgrader := websocket.Upgrader{}
+					conn, err := upgrader.Upgrade(w, r, nil)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer conn.Close()
+
+					if tc.server != "1.2" {
+						_ = conn.WriteJSON(Message{Status: statusStarted})
+					}
+
+					_, _, _ = conn.ReadMessage()
+				case strings.Contains(r.URL.Path, "/start"):
+					atomic.StoreInt32(&started, 1)
+					_ = json.NewEncoder(w).Encode(startResponse{Response: "started"})
+				default:
+					w.WriteHeader(http.StatusOK)
+				}
+			}))
+			defer ts.Close()
+
+			c, err := Dial(ctx, ts.URL, connectionData, HTTPClient(ts.Client()), Protocol(tc.client), MaxNegotiateRetries(0))
+			if tc.expectedErr != nil {
+				expectErrorMatch(t, tc.expectedErr, err)
+				return
+			}
+
+			if !expectNoError(t, err) {
+				return
+			}
+			defer c.Close()
+
+			if s := atomic.LoadInt32(&started) == 1; s != tc.expectStart {
+				t.Errorf("expected start request %v, got %v", tc.expectStart, s)
+			}
+
+			if p := c.State().Protocol; p != tc.server {
+				t.Errorf("expected protocol %s, got %s", tc.server, p)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		opt           DialOpt
+		expectedField string
+	}{
+		{
+			name: "default config",
+			opt:  func(*Config) {},
+		},
+		{
+			name:          "unsupported protocol",
+			opt:           Protocol("1.1"),
+			expectedField: "Protocol",
+		},
+		{
+			name:          "missing client",
+			opt:           HTTPClient(nil),
+			expectedField: "Client",
+		},
+		{
+			name:          "invalid endpoint",
+			opt:           Endpoints("ftp://example.com"),
+			expectedField: "Endpoints[0]",
+		},
+		{
+			name:          "zero close timeout",
+			opt:           CloseTimeout(0),
+			expectedField: "CloseTimeout",
+		},
+		{
+			name:          "negative message size",
+			opt:           MaxMessageSize(-1),
+			expectedField: "MaxMessageSize",
+		},
+		{
+			name:          "negative retries",
+			opt:           func(c *Config) { c.StartRetry.MaxRetries = -1 },
+			expectedField: "StartRetry",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := DefaultConfig()
+			tc.opt(&cfg)
+
+			err := cfg.Validate()
+			if tc.expectedField == "" {
+				expectNoError(t, err)
+				return
+			}
+
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("expected config error, got %v", err)
+			}
+
+			if configErr.Field != tc.expectedField {
+				t.Errorf("expected field %q, got %q", tc.expectedField, configErr.Field)
+			}
+		})
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		code              int
+		expectedTemporary bool
+		expectedPermanent bool
+	}{
+		{code: CloseNormal, expectedTemporary: true},
+		{code: CloseGoingAway, expectedTemporary: true},
+		{code: CloseAbnormal, expectedTemporary: true},
+		{code: CloseServiceRestart, expectedTemporary: true},
+		{code: CloseTryAgainLater, expectedTemporary: true},
+		{code: CloseProtocolError, expectedPermanent: true},
+		{code: ClosePolicyViolation, expectedPermanent: true},
+		{code: CloseMessageTooBig, expectedPermanent: true},
+		{code: 4000, expectedPermanent: true},
+	}
+
+	for _, tc := range cases {
+		err := fmt.Errorf("read failed: %w", &CloseError{Code: tc.code, Text: "reason"})
+
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("expected close error, got %v", err)
+		}
+
+		if temporary := closeErr.Temporary(); temporary != tc.expectedTemporary {
+			t.Errorf("expected close code %d temporary %t, got %t", tc.code, tc.expectedTemporary, temporary)
+		}
+
+		if p := permanent(err); p != tc.expectedPermanent {
+			t.Errorf("expected close code %d permanent %t, got %t", tc.code, tc.expectedPermanent, p)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	t.Parallel()
+
+	initMessage := readResult{msg: `{"S":1}`}
+
+	cases := []struct {
+		name        string
+		dialResults []dialResult
+		readResults []readResult
+		retries     int
+		expectedMsg Message
+		expectedErr error
+	}{
+		{
+			name:        "normal message",
+			readResults: []readResult{{msg: `{"C":"test message"}`}},
+			expectedMsg: Message{MessageID: "test message"},
+		},
+		{
+			name:        "groups token",
+			readResults: []readResult{{msg: `{"C":"test message","G":"custom-groups-token"}`}},
+			expectedMsg: Message{MessageID: "test message", GroupsToken: "custom-groups-token"},
+		},
+		{
+			name: "recover after websocket closed",
+			readResults: []readResult{
+				{err: &CloseError{Code: 1001}},
+				{msg: `{"C":"test message"}`},
+			},
+			expectedMsg: Message{MessageID: "test message"},
+		},
+		{
+			name: "reconnect failed",
+			readResults: []readResult{
+				{err: &CloseError{Code: 1001}},
+				{msg: `{"C":"test message"}`},
+			},
+			dialResults: []dialResult{
+				{err: io.EOF},
+			},
+			expectedErr: &ConnectError{},
+		},
+		{
+			name: "renegotiate after handshake unauthorized",
+			readResults: []readResult{
+				{err: &CloseError{Code: 1001}},
+				initMessage,
+				{msg: `{"C":"test message"}`},
+			},
+			dialResults: []dialResult{
+				{err: &HandshakeError{StatusCode: http.StatusUnauthorized}, status: http.StatusUnauthorized},
+			},
+			expectedMsg: Message{MessageID: "test message"},
+		},
+		{
+			name: "renegotiate after policy violation",
+			readResults: []readResult{
+				{err: &CloseError{Code: 1008}},
+				initMessage,
+				{msg: `{"C":"test message"}`},
+			},
+			expectedMsg: Message{MessageID: "test message"},
+		},
+		{
+			name:        "hub error detail",
+			readResults: []readResult{{msg: `{"I":"1","E":"failure","H":true,"D":{"code":42},"T":"at Hub.Method()"}`}},
+			expectedMsg: Message{
+				InvocationID: 1,
+				Error:        "failure",
+				HubError:     true,
+				ErrorDetail:  &map[string]interface{}{"code": float64(42)},
+				StackTrace:   "at Hub.Method()",
+			},
+		},
+		{
+			name:        "server disconnect",
+			readResults: []readResult{{msg: `{"D":1}`}},
+			expectedErr: &ServerDisconnectedError{},
+		},
+		{
+			name:        "read failed",
+			readResults: []readResult{{err: io.EOF}},
+			expectedErr: &ReadError{},
+		},
+		{
+			name:        "empty message",
+			readResults: []readResult{{msg: ""}},
+			expectedErr: &json.SyntaxError{},
+		},
+		{
+			name:        "message larger than frame buffer",
+			readResults: []readResult{{msg: `{"C":"` + strings.Repeat("x", frameBufferSize) + `"}`}},
+			expectedMsg: Message{MessageID: strings.Repeat("x", frameBufferSize)},
+		},
+		{
+			name:        "bad json",
+			readResults: []readResult{{msg: "{invalid json"}},
+			expectedErr: &json.SyntaxError{},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+			t.Cleanup(ts.Close)
+
+			readResults := append([]readResult{initMessage}, tc.readResults...)
+			conn := &fakeConn{results: readResults}
+
+			dialResults := append([]dialResult{{conn: conn}}, tc.dialResults...)
+			dialer := func(*http.Client) WebsocketDialer {
+				return &mockDialer{conn: conn, results: dialResults}
+			}
+
+			ctx := context.Background()
+			c, err := Dial(ctx, ts.URL, connectionData, Dialer(dialer), RetryInterval(retryInterval), MaxReconnectRetries(tc.retries))
+
+			if !expectNoError(t, err) {
+				return
+			}
+
+			var msg Message
+			err = c.ReadMessage(ctx, &msg)
+
+			if tc.expectedErr != nil {
+				expectErrorMatch(t, tc.expectedErr, err)
+				return
+			}
+
+			expectNoError(t, err)
+			expectState(t, State{
+				ConnectionData:    connectionData,
+				ConnectionID:      connectionID,
+				ConnectionToken:   connectionToken,
+				Protocol:          protocolVersion,
+				DisconnectTimeout: 30 * time.Second,
+				GroupsToken:       tc.expectedMsg.GroupsToken,
+				MessageID:         tc.expectedMsg.MessageID,
+			}, *c.State())
+			expectMessage(t, tc.expectedMsg, msg)
+		})
+	}
+}
+
+// TestKeepaliveAllocs is not parallel, as counting allocations requires.
+func TestKeepaliveAllocs(t *testing.T) {
+	var (
+		msg Message
+		r   = bytes.NewReader(nil)
+		br  = bufio.NewReaderSize(nil, frameBufferSize)
+	)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(keepaliveFrame)
+		br.Reset(r)
+
+		if keepalive, err := readFrame(br, &msg); !keepalive || err != nil {
+			t.Errorf("expected keepalive, got %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations reading keepalive, got %v", allocs)
+	}
+}
+func TestStreamReader(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	conn := &streamConn{fakeConn: fakeConn{results: []readResult{
+		{msg: `{}`},
+		{msg: `{"C":"1","M":[{"H":"hub","M":"method"}]}`},
+	}}}
+
+	var msg Message
+	expectNoError(t, readMessage(ctx, conn, &msg, nil))
+	expectMessage(t, Message{MessageID: "1", Messages: []ClientMsg{{Hub: "hub", Method: "method"}}}, msg)
+}
+
+func TestOnKeepalive(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	now := time.Unix(42, 0)
+
+	var keepalives []time.Time
+
+	cfg := newDefaultConfig()
+	cfg.Clock = &fakeClock{now: now}
+	cfg.OnKeepalive = func(at time.Time) { keepalives = append(keepalives, at) }
+
+	conn := &Conn{state: &State{}, config: &cfg, conn: &fakeConn{results: []readResult{
+		{msg: `{}`},
+		{msg: `{}`},
+		{msg: `{"C":"1"}`},
+	}}}
+
+	var msg Message
+	expectNoError(t, conn.ReadMessage(ctx, &msg))
+
+	if expected := []time.Time{now, now}; !reflect.DeepEqual(expected, keepalives) {
+		t.Errorf("expected keepalives %v, got %v", expected, keepalives)
+	}
+}
+
+func TestDisconnectTimeout(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
+
+	initMessage := readResult{msg: `{"S":1}`}
+	conn := &fakeConn{results: []readResult{
+		initMessage,
+		{err: &CloseError{Code: CloseGoingAway}},
+		initMessage,
+		{msg: `{"C":"test message"}`},
+	}}
+
+	dialer := &recordingDialer{mockDialer: mockDialer{conn: conn}}
+	clock := &fakeClock{now: time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, ts.URL, connectionData, TimeSource(clock), RetryInterval(retryInterval),
+		Dialer(func(*http.Client) WebsocketDialer { return dialer }))
+	if !expectNoError(t, err) {
+		return
+	}
+
+	// disconnect timeout advertised by the server elapses
+	clock.now = clock.now.Add(c.NegotiateInfo().DisconnectTimeout + time.Second)
+
+	var msg Message
+	if !expectNoError(t, c.ReadMessage(ctx, &msg)) {
+		return
+	}
+
+	if expected := []string{"connect", "connect"}; !reflect.DeepEqual(expected, dialer.commands()) {
+		t.Errorf("expected commands %v, got %v", expected, dialer.commands())
+	}
+}
+
+func TestRaw(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cfg := newDefaultConfig()
+	conn := &Conn{state: &State{}, config: &cfg}
+	conn.conn = conn.wrap(&fakeConn{results: []readResult{
+		{msg: `{}`},
+		{msg: `{"C":"1","G":"groups-token"}`},
+		{msgType: websocket.BinaryMessage, msg: "\x00\x01"},
+	}})
+
+	data, err := conn.ReadRaw(ctx)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	if expected := `{"C":"1","G":"groups-token"}`; string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+
+	expectState(t, State{MessageID: "1", GroupsToken: "groups-token"}, *conn.State())
+
+	data, err = conn.ReadRaw(ctx)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	if !bytes.Equal([]byte{0, 1}, data) {
+		t.Errorf("expected binary payload, got %q", data)
+	}
+
+	payload := []byte(`{"custom":true}`)
+	expectNoError(t, conn.WriteRaw(ctx, payload))
+
+	if stats := conn.stats.snapshot(); stats.BytesWritten != int64(len(payload)) {
+		t.Errorf("expected %d bytes written, got %d", len(payload), stats.BytesWritten)
+	}
+}
+
+func TestStatefulReconnect(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	acks := make(chan uint64, 4)
+
+	ts := httptest.NewServer(wrapHandler(t, newStatefulHandler(acks)))
+	t.Cleanup(ts.Close)
+
+	conn, err := Dial(ctx, ts.URL+"/hub", connectionData, StatefulReconnect(0))
+	if !expectNoError(t, err) {
+		return
+	}
+
+	if !conn.State().StatefulReconnect {
+		t.Fatal("expected stateful reconnect")
+	}
+
+	client := NewClient("hub", conn)
+	t.Cleanup(func() { _ = client.Close() })
+
+	stream, err := client.Callback(ctx, "notify")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	go func() { _ = client.Run(ctx) }()
+
+	// invocation sent before the connection dropped is completed after
+	// reconnect
+	var res string
+	if expectNoError(t, client.Invoke(ctx, "echo", "ping").Unmarshal(&res)) && res != "ping" {
+		t.Errorf("expected result %q, got %q", "ping", res)
+	}
+
+	// call sent again by the server is delivered once
+	for i := 1; i <= 3; i++ {
+		var arg int
+		if expectNoError(t, stream.Read(&arg)) && arg != i {
+			t.Errorf("expected argument %d, got %d", i, arg)
+		}
+	}
+
+	// acknowledgements catch up with the completion
+	for acked := uint64(0); acked != 4; {
+		select {
+		case acked = <-acks:
+		case <-ctx.Done():
+			t.Fatalf("expected ack of 4 messages, got %d", acked)
+		}
+	}
+
+	if reconnects := conn.stats.snapshot().Reconnects; reconnects != 1 {
+		t.Errorf("expected 1 reconnect, got %d", reconnects)
+	}
+
+	// servers not supporting it keep the protocol version
+	ts = httptest.NewServer(wrapHandler(t, newCoreHandler(`{"type":6}`+"\x1e")))
+	t.Cleanup(ts.Close)
+
+	conn, err = Dial(ctx, ts.URL+"/hub", connectionData, StatefulReconnect(0))
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	if conn.State().StatefulReconnect || protocolOf(conn.State()).canReconnect() {
+		t.Error("expected no stateful reconnect")
+	}
+}
+
+func TestCoalesceWrites(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		protocol string
+		frames   int
+	}{
+		{"core", CoreProtocol, 1},
+		{"classic", protocolVersion, 3},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			t.Cleanup(cancel)
+
+			cfg := newDefaultConfig()
+			CoalesceWrites(500 * time.Millisecond)(&cfg)
+
+			ws := &frameConn{frames: make(chan []byte, 3)}
+			conn := &Conn{conn: ws, state: &State{Protocol: tt.protocol}, config: &cfg}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+
+				go func(i int) {
+					defer wg.Done()
+					expectNoError(t, conn.WriteMessage(ctx, ClientMsg{Hub: "hub", Method: "send", Args: []json.RawMessage{json.RawMessage(strconv.Itoa(i))}}))
+				}(i)
+			}
+
+			wg.Wait()
+
+			if n := len(ws.frames); n != tt.frames {
+				t.Fatalf("expected %d frames, got %d", tt.frames, n)
+			}
+
+			if tt.protocol != CoreProtocol {
+				return
+			}
+
+			frame := <-ws.frames
+			if n := bytes.Count(frame, []byte{recordSeparator}); n != 3 {
+				t.Errorf("expected 3 records, got %d in %q", n, frame)
+			}
+		})
+	}
+}
+
+func TestStatefulConn(t *testing.T) {
+	t.Parallel()
+
+	invocation := `{"type":1,"target":"send","arguments":[]}` + "\x1e"
+
+	tests := []struct {
+		name      string
+		reads     []string
+		delivered int
+		ack       uint64
+	}{
+		{
+			name:      "counted",
+			reads:     []string{invocation, `{"type":6}` + "\x1e", invocation},
+			delivered: 3,
+			ack:       2,
+		},
+		{
+			// the server resends messages following the sequence ID it
+			// announces after reconnect
+			name:      "resent",
+			reads:     []string{invocation, invocation, `{"type":9,"sequenceId":2}` + "\x1e", invocation, invocation},
+			delivered: 3,
+			ack:       3,
+		},
+		{
+			name:      "acknowledged",
+			reads:     []string{`{"type":8,"sequenceId":1}` + "\x1e"},
+			delivered: 0,
+			ack:       0,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			t.Cleanup(cancel)
+
+			conn := &statefulConn{WebsocketConn: &scriptedConn{reads: tt.reads}, session: newSession(0), acks: make(chan struct{}, 1)}
+
+			for i := 0; i < tt.delivered; i++ {
+				_, p, err := conn.ReadMessage(ctx)
+				expectNoError(t, err)
+
+				if p == nil {
+					t.Fatalf("expected message %d", i)
+				}
+			}
+
+			rctx, rcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			t.Cleanup(rcancel)
+
+			if _, p, err := conn.ReadMessage(rctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected no more messages, got %q: %v", p, err)
+			}
+
+			if id := conn.session.pendingAck(); id != tt.ack {
+				t.Errorf("expected ack of %d, got %d", tt.ack, id)
+			}
+		})
+	}
+}
+
+func TestStatefulResend(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	dropped := &statefulConn{WebsocketConn: &frameConn{frames: make(chan []byte, 3)}, session: newSession(0)}
+
+	frames := []string{
+		`{"type":1,"target":"a","arguments":[]}` + "\x1e",
+		`{"type":6}` + "\x1e",
+		`{"type":1,"target":"b","arguments":[]}` + "\x1e" + `{"type":5,"invocationId":"1"}` + "\x1e",
+	}
+	for _, frame := range frames {
+		expectNoError(t, dropped.WriteMessage(ctx, textMessage, []byte(frame)))
+	}
+
+	// the server got the first message only
+	dropped.session.ack(1)
+
+	ws := &frameConn{frames: make(chan []byte, 2)}
+	expectNoError(t, dropped.session.resend(ctx, ws))
+
+	expected := []string{`{"type":9,"sequenceId":2}` + "\x1e", frames[2]}
+	for _, e := range expected {
+		if frame := string(<-ws.frames); frame != e {
+			t.Errorf("expected frame %q, got %q", e, frame)
+		}
+	}
+}
+
+func TestStatefulBufferFull(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	cfg := newDefaultConfig()
+
+	ws := &frameConn{frames: make(chan []byte, 2)}
+	conn := &Conn{conn: &statefulConn{WebsocketConn: ws, session: newSession(1)}, state: &State{}, config: &cfg}
+
+	invocation := []byte(`{"type":1,"target":"send","arguments":[]}` + "\x1e")
+	expectNoError(t, conn.write(ctx, invocation))
+	<-ws.frames
+
+	// the buffer is full until the server acknowledges the invocation
+	wctx, wcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	t.Cleanup(wcancel)
+
+	if err := conn.write(wctx, invocation); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected write to wait for room in the buffer, got: %v", err)
+	}
+
+	// acks are not counted, so they are sent even though the buffer is full
+	sessionOf(conn.conn).receive()
+	expectNoError(t, conn.ack(ctx))
+
+	if frame := string(<-ws.frames); frame != `{"type":8,"sequenceId":1}`+"\x1e" {
+		t.Errorf("expected ack, got %q", frame)
+	}
+}
+
+func TestCoreProtocol(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	ts := httptest.NewServer(wrapHandler(t, newCoreHandler(`{"type":6}`+"\x1e"+`{"type":1,"target":"notify","arguments":[42]}`+"\x1e")))
+	t.Cleanup(ts.Close)
+
+	conn, err := Dial(ctx, ts.URL+"/hub", connectionData)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	if protocol := conn.State().Protocol; protocol != CoreProtocol {
+		t.Fatalf("expected protocol %q, got %q", CoreProtocol, protocol)
+	}
+
+	if info := conn.NegotiateInfo(); info.NegotiateVersion != 1 || info.KeepAliveTimeout != coreServerTimeout {
+		t.Errorf("unexpected negotiate info %+v", info)
+	}
+
+	client := NewClient("hub", conn)
+	t.Cleanup(func() { _ = client.Close() })
+
+	stream, err := client.Callback(ctx, "notify")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	go func() { _ = client.Run(ctx) }()
+
+	var arg int
+	if expectNoError(t, stream.Read(&arg)) && arg != 42 {
+		t.Errorf("expected argument 42, got %d", arg)
+	}
+
+	var res string
+	if expectNoError(t, client.Invoke(ctx, "echo", "ping").Unmarshal(&res)) && res != "ping" {
+		t.Errorf("expected result %q, got %q", "ping", res)
+	}
+
+	expectErrorMatch(t, &InvocationError{}, client.Invoke(ctx, "fail").Unmarshal(&res))
+	expectNoError(t, client.Send(ctx, "echo"))
+}
+
+func TestCoreClose(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	ts := httptest.NewServer(wrapHandler(t, newCoreHandler(
+		`{"type":7,"error":"restarting","allowReconnect":true}`+"\x1e",
+		`{"type":1,"target":"notify","arguments":[1]}`+"\x1e"+`{"type":7,"error":"shutting down"}`+"\x1e",
+	)))
+	t.Cleanup(ts.Close)
+
+	conn, err := Dial(ctx, ts.URL+"/hub", connectionData)
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	// close message allowing reconnect is followed by a new connection
+	var msg Message
+	if !expectNoError(t, conn.ReadMessage(ctx, &msg)) {
+		return
+	}
+
+	if len(msg.Messages) != 1 || msg.Messages[0].Method != "notify" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	if reconnects := conn.stats.snapshot().Reconnects; reconnects != 1 {
+		t.Errorf("expected 1 reconnect, got %d", reconnects)
+	}
+
+	err = conn.ReadMessage(ctx, &msg)
+
+	var disconnectedErr *ServerDisconnectedError
+	if !errors.As(err, &disconnectedErr) {
+		t.Fatalf("expected ServerDisconnectedError, got %v", err)
+	}
+
+	if disconnectedErr.Reason != "shutting down" {
+		t.Errorf("expected reason %q, got %q", "shutting down", disconnectedErr.Reason)
+	}
+
+	if !permanent(err) {
+		t.Error("expected close message not allowing reconnect to be permanent")
+	}
+}
+
+func TestCorePing(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clock := &fakeClock{now: time.Unix(42, 0), timers: make(chan *fakeTimer, 1)}
+
+	cfg := newDefaultConfig()
+	cfg.Clock = clock
+
+	ws := &frameConn{frames: make(chan []byte, 4)}
+	conn := &Conn{conn: ws, state: &State{Protocol: CoreProtocol}, config: &cfg, pings: make(chan struct{}, 1)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.pinger(ctx)
+	}()
+
+	ping := append([]byte(`{"type":6}`), recordSeparator)
+
+	// idle connection is pinged every ping interval
+	timer := <-clock.timers
+	timer.ch <- clock.now
+
+	if frame := <-ws.frames; !bytes.Equal(ping, frame) {
+		t.Errorf("expected ping %q, got %q", ping, frame)
+	}
+
+	// server ping is not answered right after a write
+	<-clock.timers
+	conn.keepalive()
+
+	// but it is once the connection is idle for ping interval
+	<-clock.timers
+	clock.now = clock.now.Add(cfg.PingInterval)
+	conn.keepalive()
+
+	if frame := <-ws.frames; !bytes.Equal(ping, frame) {
+		t.Errorf("expected ping %q, got %q", ping, frame)
+	}
+
+	if n := len(ws.frames); n != 0 {
+		t.Errorf("expected no more pings, got %d", n)
+	}
+
+	// server pings are counted as keepalives
+	counted := conn.wrap(&fakeConn{results: []readResult{{msg: string(ping)}}})
+	if _, _, err := counted.ReadMessage(ctx); expectNoError(t, err) && conn.stats.snapshot().Keepalives != 1 {
+		t.Errorf("expected one keepalive, got %+v", conn.stats.snapshot())
+	}
+
+	// every ping is a buffer of its own
+	written := coreProtocol{}.ping()
+	written[0] = 0
+
+	if p := (coreProtocol{}).ping(); !bytes.Equal(ping, p) {
+		t.Errorf("expected ping %q, got %q", ping, p)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	// init message fits into the limit, while regular messages with message
+	// ID and groups token do not
+	initMessage, err := json.Marshal(Message{Status: statusStarted})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Dial(ctx, ts.URL, connectionData, MaxMessageSize(int64(len(initMessage))), RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	var msg Message
+	expectErrorMatch(t, &MessageTooLargeError{}, c.ReadMessage(ctx, &msg))
+
+	conn := limitMessageSize(&fakeConn{results: []readResult{{msg: `{"C":"1"}`}, {msg: `{"C":"1","M":[]}`}}}, 10)
+	expectNoError(t, readMessage(ctx, conn, &msg, nil))
+	expectErrorMatch(t, &MessageTooLargeError{}, readMessage(ctx, conn, &msg, nil))
+}
+
+func TestMessagesMissed(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		messageID   string
+		expectedGap bool
+	}{
+		{
+			name:      "consecutive",
+			messageID: "2",
+		},
+		{
+			name:        "gap",
+			messageID:   "5",
+			expectedGap: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+			t.Cleanup(ts.Close)
+
+			conn := &fakeConn{results: []readResult{
+				{msg: `{"S":1}`},
+				{msg: `{"C":"1"}`},
+				{err: &CloseError{Code: 1006}},
+				{msg: `{"C":"` + tc.messageID + `"}`},
+			}}
+			dialer := func(*http.Client) WebsocketDialer {
+				return &mockDialer{conn: conn}
+			}
+
+			var missed []MessagesMissed
+
+			ctx := context.Background()
+			c, err := Dial(ctx, ts.URL, connectionData, Dialer(dialer), RetryInterval(retryInterval), OnMessagesMissed(func(m MessagesMissed) {
+				missed = append(missed, m)
+			}))
+			if !expectNoError(t, err) {
+				return
+			}
+
+			client := NewClient("hub", c)
+
+			for i := 0; i < 2; i++ {
+				var msg Message
+				if !expectNoError(t, c.ReadMessage(ctx, &msg)) {
+					return
+				}
+			}
+
+			if id := client.LastMessageID(); id != tc.messageID {
+				t.Errorf("expected last message ID %q, got %q", tc.messageID, id)
+			}
+
+			var expected []MessagesMissed
+			if tc.expectedGap {
+				expected = []MessagesMissed{{PrevMessageID: "1", MessageID: tc.messageID}}
+			}
+
+			if !reflect.DeepEqual(expected, missed) {
+				t.Errorf("expected missed messages %+v, got %+v", expected, missed)
+			}
+		})
+	}
+}
+
+func TestPersistentClient(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
+
+	conn := &fakeConn{results: []readResult{
+		{msg: `{"S":1}`},
+		{msg: `{"C":"1"}`},
+		{msg: `{"C":"2","M":["hello",{"a":1}]}`},
+		{msg: `{"C":"3","D":1}`},
+	}}
+	dialer := func(*http.Client) WebsocketDialer {
+		return &mockDialer{conn: conn}
+	}
+
+	ctx := context.Background()
+	c, err := Dial(ctx, ts.URL, "", Dialer(dialer), RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+
+	client := NewPersistentClient(c)
+	expectNoError(t, client.Send(ctx, []byte("raw data")))
+	expectNoError(t, client.SendJSON(ctx, map[string]int{"a": 1}))
+
+	data, err := client.Receive(ctx)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	expected := []json.RawMessage{json.RawMessage(`"hello"`), json.RawMessage(`{"a":1}`)}
+	if !reflect.DeepEqual(expected, data) {
+		t.Errorf("expected data %s, got %s", expected, data)
+	}
+
+	if id := c.State().MessageID; id != "2" {
+		t.Errorf("expected message ID %q, got %q", "2", id)
+	}
+
+	_, err = client.Receive(ctx)
+	expectErrorMatch(t, &ServerDisconnectedError{}, err)
+}
+
+func TestNegotiate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		endpoint    string
+		retries     int
+		handler     testHandlerFunc
+		headers     http.Header
+		deadline    time.Duration
+		expectedErr error
+	}{
+		{
+			name: "successful negotiate",
+		},
+		{
+			name:    "recover after failure",
+			handler: errorResponseOnce(503),
+			retries: 1,
+		},
+		{
+			name:        "invalid scheme",
+			endpoint:    "ssh://invalid-endpoint",
+			expectedErr: &url.Error{},
+		},
+		{
+			name:        "503 error",
+			handler:     errorResponse(503),
+			expectedErr: &statusError{},
+		},
+		{
+			name:        "429 error",
+			handler:     errorResponse(429),
+			retries:     1,
+			expectedErr: &ThrottledError{},
+		},
+		{
+			name:        "failed get request",
+			handler:     timeout(2 * retryInterval),
+			deadline:    retryInterval,
+			expectedErr: context.DeadlineExceeded,
+		},
+		{
+			name:        "invalid json",
+			handler:     response("invalid json"),
+			expectedErr: &json.SyntaxError{},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+
+			if tc.deadline > 0 {
+				ctx, cancel = context.WithTimeout(ctx, tc.deadline)
+				t.Cleanup(cancel)
+			}
+
+			handler := tc.handler
+			if handler == nil {
+				handler = newRootHandler()
+			}
+
+			// Create a test server.
+			ts := httptest.NewServer(wrapHandler(t, handler))
+			t.Cleanup(ts.Close)
+
+			endpoint := tc.endpoint
+			if endpoint == "" {
+				endpoint = ts.URL
+			}
+
+			state := State{
+				ConnectionData: connectionData,
+				Protocol:       protocolVersion,
+			}
+
+			policy := RetryPolicy{MaxRetries: tc.retries, Interval: retryInterval}
+			info, err := negotiate(ctx, ts.Client(), endpoint, tc.headers, &state, policy, false)
+
+			if tc.expectedErr != nil {
+				expectErrorMatch(t, tc.expectedErr, err)
+				return
+			}
+
+			expectNoError(t, err)
+			expectState(t, State{
+				ConnectionData:    connectionData,
+				ConnectionID:      connectionID,
+				ConnectionToken:   connectionToken,
+				Protocol:          protocolVersion,
+				DisconnectTimeout: 30 * time.Second,
+			}, state)
+
+			expectedInfo := NegotiateInfo{
+				ConnectionID:      connectionID,
+				ProtocolVersion:   protocolVersion,
+				KeepAliveTimeout:  20 * time.Second,
+				DisconnectTimeout: 30 * time.Second,
+			}
+			if !reflect.DeepEqual(expectedInfo, info) {
+				t.Errorf("expected negotiate info %+v, got: %+v", expectedInfo, info)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	unavailable := &statusError{code: 503, retryAfter: 50 * time.Millisecond}
+	unauthorized := &statusError{code: 401}
+	throttled := &statusError{code: 429, retryAfter: 50 * time.Millisecond}
+
+	cases := []struct {
+		name             string
+		policy           RetryPolicy
+		errs             []error
+		expectedAttempts int
+		minDuration      time.Duration
+		expectedErr      error
+	}{
+		{
+			name:             "retry until success",
+			policy:           RetryPolicy{MaxRetries: 3, Interval: time.Millisecond},
+			errs:             []error{io.EOF, io.EOF},
+			expectedAttempts: 3,
+		},
+		{
+			name:             "retries exhausted",
+			policy:           RetryPolicy{MaxRetries: 1, Interval: time.Millisecond},
+			errs:             []error{io.EOF, io.EOF},
+			expectedAttempts: 2,
+			expectedErr:      io.EOF,
+		},
+		{
+			name:             "non-retryable status code",
+			policy:           RetryPolicy{MaxRetries: 3, Interval: time.Millisecond, RetryableStatusCodes: []int{503}},
+			errs:             []error{unauthorized},
+			expectedAttempts: 1,
+			expectedErr:      unauthorized,
+		},
+		{
+			name:             "honor retry after",
+			policy:           RetryPolicy{MaxRetries: 3, Interval: time.Millisecond, HonorRetryAfter: true},
+			errs:             []error{unavailable},
+			expectedAttempts: 2,
+			minDuration:      50 * time.Millisecond,
+		},
+		{
+			name:             "always retry throttled",
+			policy:           RetryPolicy{MaxRetries: 3, Interval: time.Millisecond, RetryableStatusCodes: []int{503}},
+			errs:             []error{throttled},
+			expectedAttempts: 2,
+			minDuration:      50 * time.Millisecond,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts int
+			started := time.Now()
+
+			err := tc.policy.retry(ctx, func() error {
+				attempts++
+				if attempts <= len(tc.errs) {
+					return tc.errs[attempts-1]
+				}
+
+				return nil
+			})
+
+			if err != tc.expectedErr {
+				t.Errorf("expected error %v, got: %v", tc.expectedErr, err)
+			}
+
+			if attempts != tc.expectedAttempts {
+				t.Errorf("expected %d attempts, got %d", tc.expectedAttempts, attempts)
+			}
+
+			if elapsed := time.Since(started); elapsed < tc.minDuration {
+				t.Errorf("expected retry to take at least %v, took %v", tc.minDuration, elapsed)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := map[string]time.Duration{
+		"":                              0,
+		"5":                             5 * time.Second,
+		"-1":                            0,
+		"invalid":                       0,
+		"Wed, 01 Jan 2020 00:00:30 GMT": 30 * time.Second,
+		"Tue, 31 Dec 2019 00:00:00 GMT": 0,
+	}
+
+	for value, expected := range cases {
+		if actual := parseRetryAfter(value, now); actual != expected {
+			t.Errorf("expected Retry-After %q to be %v, got %v", value, expected, actual)
+		}
+	}
+}
+
+func TestConnect(t *testing.T) {
+	t.Parallel()
+
+	endpoint := "http://fake-endpoint"
+	headers := make(http.Header)
+
+	notFoundResult := dialResult{status: http.StatusNotFound, err: websocket.ErrBadHandshake}
+	eofResult := dialResult{err: io.EOF}
+	validResult := dialResult{conn: &fakeConn{}}
+
+	cases := []struct {
+		name        string
+		dialResults []dialResult
+		retries     int
+		expectedErr error
+	}{
+		{
+			name:        "successful reconnect",
+			dialResults: []dialResult{notFoundResult, eofResult, validResult},
+			retries:     5,
+		},
+		{
+			name:        "unsuccessful reconnect with http status",
+			dialResults: []dialResult{notFoundResult},
+			expectedErr: &DialError{},
+		},
+		{
+			name:        "unsuccessful reconnect with other error",
+			dialResults: []dialResult{eofResult},
+			expectedErr: &DialError{},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			policy := RetryPolicy{MaxRetries: tc.retries, Interval: 1 * time.Millisecond}
+
+			for _, command := range []string{"connect", "reconnect"} {
+				dialer := &mockDialer{results: tc.dialResults}
+
+				state := State{
+					ConnectionData: connectionData,
+					Protocol:       protocolVersion,
+				}
+
+				conn, err := connect(ctx, dialer, endpoint, command, headers, &state, policy, 0)
+
+				if tc.expectedErr != nil {
+					expectErrorMatch(t, tc.expectedErr, err)
+					return
+				}
+
+				if conn == nil {
+					t.Error("expected non-nil conn")
+				}
+			}
+		})
+	}
+}
+
+func TestStart(t *testing.T) {
+	t.Parallel()
+
+	headers := make(http.Header)
+	initMessage := readResult{msgType: 1, msg: `{"S":1}`}
+
+	cases := []struct {
+		name        string
+		handler     testHandlerFunc
+		readAhead   []readResult
+		readResult  readResult
+		retries     int
+		requeued    []string
+		deadline    time.Duration
+		expectedErr error
+	}{
+		{
+			name:       "successful start",
+			readResult: initMessage,
+		},
+		{
+			name:       "frames before init message",
+			readAhead:  []readResult{{msg: `{}`}, {msg: `{"C":"1","M":[]}`}, {msg: `{}`}, {msg: `{"C":"2","M":[]}`}},
+			readResult: initMessage,
+			requeued:   []string{`{"C":"1","M":[]}`, `{"C":"2","M":[]}`},
+		},
+		{
+			name:       "recover after failure",
+			handler:    errorResponseOnce(503),
+			retries:    1,
+			readResult: initMessage,
+		},
+		{
+			name:        "request failed with http status",
+			handler:     errorResponse(503),
+			expectedErr: &statusError{},
+		},
+		{
+			name:        "request timed out",
+			handler:     timeout(2 * retryInterval),
+			deadline:    retryInterval,
+			expectedErr: context.DeadlineExceeded,
+		},
+		{
+			name:        "invalid json",
+			handler:     response("invalid json"),
+			expectedErr: &json.SyntaxError{},
+		},
+		{
+			name:        "invalid response not retried",
+			handler:     responseOnce("invalid json", "/start"),
+			retries:     1,
+			readResult:  initMessage,
+			expectedErr: &json.SyntaxError{},
+		},
+		{
+			name:        "non-started response 1",
+			handler:     response(`{"hello":"world"}`),
+			expectedErr: &InvalidStartResponseError{},
+		},
+		{
+			name:        "non-stared response 2",
+			handler:     response(`{"Response":"blabla"}`),
+			expectedErr: &InvalidStartResponseError{},
+		},
+		{
+			name:        "read error",
+			readResult:  readResult{err: io.EOF},
+			expectedErr: &ReadError{},
+		},
+		{
+			name:        "wrong message type",
+			handler:     response(`{"Response":"started"}`),
+			readResult:  readResult{msgType: 9001},
+			expectedErr: &ReadError{},
+		},
+		{
+			name:        "message json unmarshal failure",
+			handler:     response(`{"Response":"started"}`),
+			readResult:  readResult{msg: "invalid json"},
+			expectedErr: &json.SyntaxError{},
+		},
+		{
+			name:        "server not initialized",
+			handler:     response(`{"Response":"started"}`),
+			readResult:  readResult{msg: `{"S":9002}`},
+			expectedErr: &InvalidInitMessageError{},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+
+			if tc.deadline > 0 {
+				ctx, cancel = context.WithTimeout(ctx, tc.deadline)
+				t.Cleanup(cancel)
+			}
+
+			handler := tc.handler
+			if handler == nil {
+				handler = newRootHandler()
+			}
+
+			// Create a test server.
+			ts := httptest.NewServer(wrapHandler(t, handler))
+			t.Cleanup(ts.Close)
+
+			conn := &fakeConn{results: append(tc.readAhead, tc.readResult)}
+
+			state := State{
+				ConnectionData:  connectionData,
+				ConnectionID:    connectionID,
+				ConnectionToken: connectionToken,
+				Protocol:        protocolVersion,
+			}
+
+			policy := RetryPolicy{MaxRetries: tc.retries, Interval: retryInterval}
+			started, err := start(ctx, ts.Client(), conn, ts.URL, headers, &state, policy, 0)
+
+			if tc.expectedErr != nil {
+				expectErrorMatch(t, tc.expectedErr, err)
+				return
+			}
+
+			expectNoError(t, err)
+			expectState(t, State{
+				ConnectionData:  connectionData,
+				ConnectionID:    connectionID,
+				ConnectionToken: connectionToken,
+				Protocol:        protocolVersion,
+			}, state)
+
+			for _, expected := range tc.requeued {
+				_, p, err := started.ReadMessage(ctx)
+				if !expectNoError(t, err) {
+					return
+				}
+
+				if string(p) != expected {
+					t.Errorf("expected requeued frame %s, got %s", expected, p)
+				}
+			}
+		})
+	}
+}
+
+func TestProxy(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
+
+	var requests, tunnels int32
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+		if user, password, ok := auth.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		if req.Method != http.MethodConnect {
+			atomic.AddInt32(&requests, 1)
+
+			out := req.Clone(req.Context())
+			out.RequestURI = ""
+			out.Header.Del("Proxy-Authorization")
+
+			res, err := http.DefaultTransport.RoundTrip(out)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer res.Body.Close()
+
+			for key, values := range res.Header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(res.StatusCode)
+			_, _ = io.Copy(w, res.Body)
+
+			return
+		}
+
+		atomic.AddInt32(&tunnels, 1)
+
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		go func() {
+			_, _ = io.Copy(target, rw)
+			_ = target.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(conn, target)
+			_ = conn.Close()
+		}()
+	}))
+	t.Cleanup(proxy.Close)
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+
+	_, err = Dial(ctx, ts.URL, connectionData, HTTPClient(client), Proxy(http.ProxyURL(proxyURL)), MaxNegotiateRetries(0))
+	expectErrorMatch(t, &NegotiateError{}, err)
+
+	conn, err := Dial(ctx, ts.URL, connectionData, HTTPClient(client), Proxy(http.ProxyURL(proxyURL)), ProxyCredentials("user", "secret"))
+	if !expectNoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	if n := atomic.LoadInt32(&requests); n == 0 {
+		t.Error("expected HTTP requests to go through proxy")
+	}
+
+	if n := atomic.LoadInt32(&tunnels); n != 1 {
+		t.Errorf("expected websocket to be tunneled through proxy, got %d tunnels", n)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	t.Parallel()
+
+	var rounds int32
+
+	handler := newRootHandler()
+	ts := httptest.NewServer(wrapHandler(t, func(t testing.TB, w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+
+		// websocket handshake carries the first token only
+		if strings.HasSuffix(req.URL.Path, "/connect") && auth == "Test type1" {
+			handler(t, w, req)
+			return
+		}
+
+		atomic.AddInt32(&rounds, 1)
+
+		switch auth {
+		case "Test type3":
+			handler(t, w, req)
+		case "Test type1":
+			w.Header().Set("WWW-Authenticate", "Test challenge")
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.Header().Set("WWW-Authenticate", "Test")
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, ts.URL, connectionData, Authentication(testAuthenticator{}), MaxNegotiateRetries(0), MaxConnectRetries(0))
+	if !expectNoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// negotiate and start take two rounds each
+	if n := atomic.LoadInt32(&rounds); n != 4 {
+		t.Errorf("expected 4 authentication rounds, got %d", n)
+	}
+
+	_, err = Dial(ctx, ts.URL, connectionData, Authentication(testAuthenticator{fail: true}), MaxNegotiateRetries(0))
+	expectErrorMatch(t, &AuthError{}, err)
+}
+
+func TestHandshakeHeaders(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mtx     sync.Mutex
+		headers = make(map[string]http.Header)
+	)
+
+	handler := newRootHandler()
+	ts := httptest.NewServer(wrapHandler(t, func(t testing.TB, w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		headers[path.Base(req.URL.Path)] = req.Header.Clone()
+		mtx.Unlock()
+
+		handler(t, w, req)
+	}))
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// test server upgrader rejects cross origin requests
+	conn, err := Dial(ctx, ts.URL, connectionData, Subprotocols("a", "b"), Origin(ts.URL), RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if protocol := headers["connect"].Get("Sec-WebSocket-Protocol"); protocol != "a, b" {
+		t.Errorf("expected subprotocols %q, got %q", "a, b", protocol)
+	}
+
+	if origin := headers["connect"].Get("Origin"); origin != ts.URL {
+		t.Errorf("expected origin %q, got %q", ts.URL, origin)
+	}
+
+	if protocol := headers["negotiate"].Get("Sec-WebSocket-Protocol"); protocol != "" {
+		t.Errorf("expected no subprotocols in negotiate request, got %q", protocol)
+	}
+}
+
+func TestMergeNegotiateURL(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		endpoint    string
+		negotiated  string
+		mode        NegotiateURLMode
+		expectedURL string
+	}{
+		{
+			name:        "ignored",
+			endpoint:    "https://example.com/app",
+			negotiated:  "/signalr",
+			mode:        IgnoreNegotiateURL,
+			expectedURL: "https://example.com/app",
+		},
+		{
+			name:        "merged with prefix",
+			endpoint:    "https://example.com/app/?key=value",
+			negotiated:  "/signalr",
+			mode:        MergeNegotiateURL,
+			expectedURL: "https://example.com/app/signalr?key=value",
+		},
+		{
+			name:        "endpoint already ends with path",
+			endpoint:    "https://example.com/app/signalr",
+			negotiated:  "/signalr",
+			mode:        MergeNegotiateURL,
+			expectedURL: "https://example.com/app/signalr",
+		},
+		{
+			name:        "empty negotiate URL",
+			endpoint:    "https://example.com/app",
+			mode:        MergeNegotiateURL,
+			expectedURL: "https://example.com/app",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := mergeNegotiateURL(tc.endpoint, tc.negotiated, tc.mode)
+			if !expectNoError(t, err) {
+				return
+			}
+
+			if u != tc.expectedURL {
+				t.Errorf("expected %q, got %q", tc.expectedURL, u)
+			}
+
+			// trailing slash does not produce empty path segment
+			u, err = makeURL(u, "negotiate", &State{})
+			if !expectNoError(t, err) {
+				return
+			}
+
+			if strings.Contains(u, "//negotiate") {
+				t.Errorf("unexpected empty path segment in %q", u)
+			}
+		})
+	}
+}
+
+func TestPrepareRequest(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name        string
+		url         string
+		headers     http.Header
+		expectedErr error
+	}{
+		{
+			name: "simple request with no headers",
+			url:  "http://example.org",
+		},
+		{
+			name: "complex request with headers",
+			url:  "https://example.org/custom/path?param=123",
+			headers: http.Header{
+				"header1": []string{"value1"},
+				"header2": []string{"value1", "value2"},
+			},
+		},
+		{
+			name:        "invalid URL",
+			url:         ":",
+			expectedErr: &url.Error{},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := prepareRequest(ctx, tc.url, tc.headers)
+
+			if tc.expectedErr != nil {
+				expectErrorMatch(t, tc.expectedErr, err)
+				return
+			}
+
+			if !expectNoError(t, err) {
+				return
+			}
+
+			if tc.url != req.URL.String() {
+				t.Errorf("expected request url %q, got %q", tc.url, req.URL)
+			}
+
+			if !reflect.DeepEqual(tc.headers, req.Header) {
+				t.Errorf("expected request headers %+v, got %+v", tc.headers, req.Header)
+			}
+		})
+	}
+}
+
+func TestManager(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	m := NewManager(RestartBackoff(func() backoff.BackOff {
+		return backoff.NewConstantBackOff(retryInterval)
+	}))
+
+	err := m.Add("healthy", func(ctx context.Context) (*Client, error) {
+		conn, err := Dial(ctx, ts.URL, connectionData, RetryInterval(retryInterval))
+		if err != nil {
+			return nil, err
+		}
+
+		return NewClient("hub", conn), nil
+	})
+	expectNoError(t, err)
+
+	err = m.Add("healthy", nil)
+	expectErrorMatch(t, &DuplicateClientError{}, err)
+
+	err = m.Add("failing", func(ctx context.Context) (*Client, error) {
+		return nil, io.EOF
+	})
+	expectNoError(t, err)
+
+	done := make(chan error, 1)
+	go func() { done <- m.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := m.Status()
+		if status[1].Connected && status[0].Restarts > 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("manager did not start clients: %+v", status)
+		}
+
+		time.Sleep(retryInterval)
+	}
+
+	if m.Client("healthy") == nil {
+		t.Error("expected healthy client to be available")
+	}
+
+	expectErrorMatch(t, &UnhealthyError{}, m.Health())
+
+	cancel()
+
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestRunWithReconnect(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mtx          sync.Mutex
+		hijacked     []net.Conn
+		negotiations int32
+	)
+
+	handler := newRootHandler()
+	ts := httptest.NewUnstartedServer(wrapHandler(t, func(t testing.TB, w http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/reconnect"):
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case strings.HasSuffix(req.URL.Path, "/negotiate"):
+			atomic.AddInt32(&negotiations, 1)
+		}
+
+		handler(t, w, req)
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateHijacked {
+			mtx.Lock()
+			hijacked = append(hijacked, conn)
+			mtx.Unlock()
+		}
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, ts.URL, connectionData, MaxReconnectRetries(0), RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+
+	client := NewClient("hub", conn)
+
+	stream, err := client.Callback(ctx, "method")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	rctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	done := make(chan error, 1)
+	go func() { done <- client.RunWithReconnect(rctx, RetryPolicy{MaxRetries: 1, Interval: retryInterval}) }()
+
+	// drop websocket connection, which can not be reestablished by reconnect
+	for atomic.LoadInt32(&negotiations) < 2 {
+		mtx.Lock()
+		for _, conn := range hijacked {
+			_ = conn.Close()
+		}
+		hijacked = nil
+		mtx.Unlock()
+
+		time.Sleep(retryInterval)
+	}
+
+	for client.Healthy(ctx) != nil {
+		time.Sleep(retryInterval)
+	}
+
+	// callback stream survives renegotiation
+	select {
+	case <-stream.ctx.Done():
+		t.Error("expected callback stream to stay open")
+	default:
+	}
+
+	stop()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
+
+	ctx := context.Background()
+
+	conn, err := Dial(ctx, ts.URL, connectionData, RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+
+	client := NewClient("hub", conn)
+
+	done := make(chan error, 1)
+	go func() { done <- client.Run(ctx) }()
+
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	expectNoError(t, client.Shutdown(sctx))
+	expectNoError(t, <-done)
+	expectErrorMatch(t, &ShutdownError{}, client.Invoke(ctx, "method").Exec())
+}
+
+func TestBreaker(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clock := &fakeClock{now: time.Unix(42, 0), timers: make(chan *fakeTimer, 1)}
+
+	var opened []BreakerOpen
+
+	cfg := newDefaultConfig()
+	cfg.Clock = clock
+	cfg.Breaker = CircuitBreaker{
+		Threshold:   2,
+		MinLifetime: time.Minute,
+		Cooldown:    time.Hour,
+		OnOpen:      func(e BreakerOpen) { opened = append(opened, e) },
+	}
+
+	conn := &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg}
+	conn.connected()
+
+	cooldown := func() {
+		t.Helper()
+
+		done := make(chan error, 1)
+		go func() { done <- conn.cooldown(ctx) }()
+
+		select {
+		case timer := <-clock.timers:
+			timer.ch <- clock.now
+		case err := <-done:
+			t.Fatalf("expected breaker to open, got %v", err)
+		}
+
+		expectNoError(t, <-done)
+	}
+
+	// the first short-lived connection does not open the breaker
+	expectNoError(t, conn.cooldown(ctx))
+
+	cooldown()
+
+	// half-open breaker opens after a single short-lived connection
+	conn.connected()
+	cooldown()
+
+	expected := []BreakerOpen{{ShortLived: 2, Cooldown: time.Hour}, {ShortLived: 2, Cooldown: time.Hour}}
+	if !reflect.DeepEqual(expected, opened) {
+		t.Errorf("expected %+v, got %+v", expected, opened)
+	}
+
+	// long-lived connection closes the breaker
+	conn.connected()
+	clock.now = clock.now.Add(time.Minute)
+	expectNoError(t, conn.cooldown(ctx))
+	expectNoError(t, conn.cooldown(ctx))
+}
+
+func TestClientClose(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, ts.URL, connectionData, RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+
+	client := NewClient("hub", conn)
+
+	done := make(chan error, 1)
+	go func() { done <- client.Run(ctx) }()
+
+	var g errgroup.Group
+	for i := 0; i < 4; i++ {
+		g.Go(func() error { return client.CloseContext(ctx) })
+	}
+	expectNoError(t, g.Wait())
+	expectNoError(t, client.Close())
+
+	select {
+	case err := <-done:
+		expectNoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("expected run to return after close")
+	}
+
+	if err := conn.Renegotiate(ctx); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected %v, got %v", net.ErrClosed, err)
+	}
+}
+
+func TestClientHealthy(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(wrapHandler(t, newRootHandler()))
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, ts.URL, connectionData, RetryInterval(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+
+	client := NewClient("hub", conn, MaxBacklog(2))
+	expectErrorMatch(t, &HealthCheckError{}, client.Healthy(ctx))
+
+	rctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	done := make(chan error, 1)
+	go func() { done <- client.Run(rctx) }()
+
+	for client.Healthy(ctx) != nil {
+		time.Sleep(retryInterval)
+	}
+
+	stream, err := client.Callback(ctx, "method")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	stream.ch <- callbackResult{}
+	stream.ch <- callbackResult{}
+	expectErrorMatch(t, &HealthCheckError{}, client.Healthy(ctx))
+
+	expectNoError(t, stream.Read())
+	expectNoError(t, client.Healthy(ctx))
+
+	stop()
+	<-done
+	expectErrorMatch(t, &HealthCheckError{}, client.Healthy(ctx))
+
+	// pretend the client is still running, but keepalive timeout advertised
+	// by the server has elapsed
+	atomic.StoreInt32(&client.running, 1)
+	atomic.StoreInt64(&conn.lastRead, time.Now().Add(-time.Minute).UnixNano())
+	expectErrorMatch(t, &HealthCheckError{}, client.Healthy(ctx))
+
+	conn.touch()
+	expectNoError(t, client.Healthy(ctx))
+}
+
+func TestInvocationError(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	invs := newInvocations()
+	inv, err := invs.create(ctx, "method")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	invs.process(&Message{
+		InvocationID: inv.id,
+		Error:        "failure",
+		HubError:     true,
+		ErrorDetail:  &map[string]interface{}{"code": float64(42)},
+		StackTrace:   "at Hub.Method()",
+	})
+
+	var invErr *InvocationError
+	if !errors.As(inv.Unmarshal(nil), &invErr) {
+		t.Fatalf("expected invocation error")
+	}
+
+	expected := InvocationError{
+		HubError:   true,
+		Data:       map[string]interface{}{"code": float64(42)},
+		StackTrace: "at Hub.Method()",
+		method:     "method",
+		id:         inv.id,
+		message:    "failure",
+	}
+
+	if !reflect.DeepEqual(expected, *invErr) {
+		t.Errorf("expected error %+v, got: %+v", expected, *invErr)
+	}
+}
+
+func TestTyped(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the invocation is completed once it is written
+	conn := &fakeConn{}
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: conn, state: &State{}, config: &cfg})
+
+	conn.written = func(data []byte) {
+		var msg ClientMsg
+		if expectNoError(t, json.Unmarshal(data, &msg)) {
+			client.invocations.process(&Message{InvocationID: msg.InvocationID, Result: json.RawMessage(`{"value":42}`)})
+		}
+	}
+
+	type result struct {
+		Value int `json:"value"`
+	}
+
+	res, err := InvokeResult[result](ctx, client, "method", "arg")
+	if expectNoError(t, err) && res.Value != 42 {
+		t.Errorf("expected result 42, got %d", res.Value)
+	}
+
+	single, err := Subscribe[string](ctx, client, "single")
+	if !expectNoError(t, err) {
+		return
+	}
+	defer single.Close()
+
+	multiple, err := Subscribe[[]int](ctx, client, "multiple")
+	if !expectNoError(t, err) {
+		return
+	}
+	defer multiple.Close()
+
+	client.callbacks.process(&Message{Messages: []ClientMsg{
+		{Method: "single", Args: []json.RawMessage{json.RawMessage(`"value"`)}},
+		{Method: "multiple", Args: []json.RawMessage{json.RawMessage(`1`), json.RawMessage(`2`)}},
+		{Method: "single", Args: []json.RawMessage{json.RawMessage(`42`)}},
+	}})
+
+	if v, err := single.Read(); expectNoError(t, err) && v != "value" {
+		t.Errorf("expected %q, got %q", "value", v)
+	}
+
+	if v, err := multiple.Read(); expectNoError(t, err) && !reflect.DeepEqual(v, []int{1, 2}) {
+		t.Errorf("expected %v, got %v", []int{1, 2}, v)
+	}
+
+	expectErrorMatch(t, &json.UnmarshalTypeError{}, func() error { _, err := single.Read(); return err }())
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg})
+
+	errNoArgs := errors.New("no arguments")
+	stream, err := client.Callback(ctx, "method", Validate(func(args []json.RawMessage) error {
+		if len(args) == 0 {
+			return errNoArgs
+		}
+
+		return nil
+	}))
+	if !expectNoError(t, err) {
+		return
+	}
+	defer stream.Close()
+
+	client.callbacks.process(&Message{Messages: []ClientMsg{
+		{Method: "method"},
+		{Method: "method", Args: []json.RawMessage{json.RawMessage(`42`)}},
+	}})
+
+	err = stream.Read()
+	expectErrorMatch(t, &ValidationError{}, err)
+	if !errors.Is(err, errNoArgs) {
+		t.Errorf("expected validation error to wrap %v, got %v", errNoArgs, err)
+	}
+
+	var v int
+	if expectNoError(t, stream.Read(&v)) && v != 42 {
+		t.Errorf("expected 42, got %d", v)
+	}
+}
+
+func TestTransformArgs(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg})
+
+	compress := func(data string) json.RawMessage {
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _ = w.Write([]byte(data))
+		_ = w.Close()
+
+		res, err := json.Marshal(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	stream, err := client.Callback(ctx, "method", TransformArgs(Base64Deflate))
+	if !expectNoError(t, err) {
+		return
+	}
+	defer stream.Close()
+
+	client.callbacks.process(&Message{Messages: []ClientMsg{
+		{Method: "method", Args: []json.RawMessage{compress(`{"sequence":42}`)}},
+		{Method: "method", Args: []json.RawMessage{json.RawMessage(`"not compressed"`)}},
+	}})
+
+	var res struct {
+		Sequence int `json:"sequence"`
+	}
+	if expectNoError(t, stream.Read(&res)) && res.Sequence != 42 {
+		t.Errorf("expected sequence 42, got %d", res.Sequence)
+	}
+
+	expectErrorMatch(t, &TransformError{}, stream.Read(&res))
+}
+
+func TestCallbackReadRaw(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg})
+
+	stream, err := client.Callback(ctx, "method")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	args := []json.RawMessage{json.RawMessage(`{"large": [1, 2, 3]}`), json.RawMessage(`"b"`)}
+	client.callbacks.process(&Message{Messages: []ClientMsg{{Hub: "hub", Method: "method", Args: args}}})
+
+	msg, err := stream.ReadRaw()
+	if !expectNoError(t, err) {
+		return
+	}
+
+	if msg.Hub != "hub" || msg.Method != "method" {
+		t.Errorf("expected hub.method, got %s.%s", msg.Hub, msg.Method)
+	}
+
+	if len(msg.Args) != len(args) || string(msg.Args[0]) != string(args[0]) || string(msg.Args[1]) != string(args[1]) {
+		t.Errorf("expected arguments %s, got %s", args, msg.Args)
+	}
+
+	stream.Close()
+
+	if _, err := stream.ReadRaw(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestCallbackNext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg})
+
+	stream, err := client.Callback(ctx, "method", Validate(func(args []json.RawMessage) error {
+		if len(args) != 2 {
+			return errors.New("expected two arguments")
+		}
+
+		return nil
+	}))
+	if !expectNoError(t, err) {
+		return
+	}
+	defer stream.Close()
+
+	client.callbacks.process(&Message{Messages: []ClientMsg{
+		{Method: "method", Args: []json.RawMessage{json.RawMessage(`1`), json.RawMessage(`"a"`)}},
+		{Method: "method"},
+		{Method: "method", Args: []json.RawMessage{json.RawMessage(`2`), json.RawMessage(`"b"`)}},
+	}})
+
+	var (
+		numbers []int
+		errs    int
+	)
+
+	readCtx, readCancel := context.WithTimeout(ctx, retryInterval)
+	defer readCancel()
+
+	for stream.Next(readCtx) {
+		var (
+			n int
+			s string
+		)
+
+		if err := stream.Scan(&n, &s); err != nil {
+			expectErrorMatch(t, &ValidationError{}, err)
+			errs++
+
+			continue
+		}
+
+		numbers = append(numbers, n)
+	}
+
+	if len(numbers) != 2 || numbers[0] != 1 || numbers[1] != 2 || errs != 1 {
+		t.Errorf("expected numbers [1 2] and one error, got %v and %d errors", numbers, errs)
+	}
+
+	if err := stream.Err(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if stream.Next(ctx) {
+		t.Error("expected iteration to remain stopped")
+	}
+
+	if err := stream.Scan(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected Scan to report %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg}, FanOut())
+
+	first, err := client.Callback(ctx, "method")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	second, err := client.Callback(ctx, "method", Validate(func(args []json.RawMessage) error {
+		if string(args[0]) == "1" {
+			return errors.New("odd")
+		}
+
+		return nil
+	}))
+	if !expectNoError(t, err) {
+		return
+	}
+	defer second.Close()
+
+	process := func(arg string) {
+		client.callbacks.process(&Message{Messages: []ClientMsg{{Method: "method", Args: []json.RawMessage{json.RawMessage(arg)}}}})
+	}
+
+	process("1")
+	process("2")
+
+	var v int
+	for _, exp := range []int{1, 2} {
+		if expectNoError(t, first.Read(&v)) && v != exp {
+			t.Errorf("expected first stream to read %d, got %d", exp, v)
+		}
+	}
+
+	expectErrorMatch(t, &ValidationError{}, second.Read(&v))
+	if expectNoError(t, second.Read(&v)) && v != 2 {
+		t.Errorf("expected second stream to read 2, got %d", v)
+	}
+
+	if stats := client.CallbackStats(); len(stats) != 1 || stats[0].Subscribers != 2 || stats[0].Capacity != 2*callbackBufferSize {
+		t.Errorf("expected two subscribers, got %+v", stats)
+	}
+
+	// closed stream is removed while the other one keeps receiving calls
+	first.Close()
+	process("4")
+
+	if expectNoError(t, second.Read(&v)) && v != 4 {
+		t.Errorf("expected second stream to read 4, got %d", v)
+	}
+
+	if registered, _ := client.callbacks.counts(); registered != 1 {
+		t.Errorf("expected one registered stream, got %d", registered)
+	}
+}
+
+func TestCallbackPattern(t *testing.T) {
+	t.Parallel()
+
+	glob, err := MethodGlob("orderbook:*")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	if _, err := MethodGlob("["); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("expected ErrBadPattern, got %v", err)
+	}
+
+	for _, shards := range []int{1, 4} {
+		shards := shards
+
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			cfg := newDefaultConfig()
+			client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg}, DispatchShards(shards))
+
+			streams := make(map[string]*CallbackStream)
+			for _, pattern := range []MethodPattern{MethodPrefix("uE."), glob, MethodRegexp(regexp.MustCompile(`^uE\.B`))} {
+				stream, err := client.CallbackPattern(ctx, pattern)
+				if !expectNoError(t, err) {
+					return
+				}
+				defer stream.Close()
+
+				streams[pattern.String()] = stream
+			}
+
+			_, err := client.CallbackPattern(ctx, MethodPrefix("uE."))
+			expectErrorMatch(t, &DuplicateCallbackError{}, err)
+
+			exact, err := client.Callback(ctx, "uE.ETH")
+			if !expectNoError(t, err) {
+				return
+			}
+			defer exact.Close()
+
+			var calls []ClientMsg
+			for _, method := range []string{"uE.BTC", "uE.ETH", "orderbook:BTC", "trades"} {
+				calls = append(calls, ClientMsg{Method: method})
+			}
+
+			client.callbacks.process(&Message{Messages: calls})
+
+			// exact stream takes precedence over patterns
+			expected := map[string][]string{
+				"uE.*":           {"uE.BTC"},
+				"orderbook:*":    {"orderbook:BTC"},
+				`/^uE\.B/`:       {"uE.BTC"},
+				"uE.ETH (exact)": {"uE.ETH"},
+			}
+			streams["uE.ETH (exact)"] = exact
+
+			for name, stream := range streams {
+				var methods []string
+				for len(stream.ch) > 0 && stream.Next(ctx) {
+					methods = append(methods, stream.Method())
+				}
+
+				if !reflect.DeepEqual(expected[name], methods) {
+					t.Errorf("%s: expected methods %v, got %v", name, expected[name], methods)
+				}
+			}
+
+			stats := client.CallbackStats()
+			if len(stats) != 4 || stats[0].Method != "/^uE\\.B/" || stats[3].Method != "uE.ETH" {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestNameCase(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		camel  string
+		pascal string
+	}{
+		{name: "GetOrders", camel: "getOrders", pascal: "GetOrders"},
+		{name: "getOrders", camel: "getOrders", pascal: "GetOrders"},
+		{name: "URLFor", camel: "urlFor", pascal: "URLFor"},
+		{name: "GetURL", camel: "getURL", pascal: "GetURL"},
+		{name: "ID", camel: "id", pascal: "ID"},
+		{name: "Émettre", camel: "émettre", pascal: "Émettre"},
+		{name: "", camel: "", pascal: ""},
+	}
+
+	for _, tc := range cases {
+		if camel := CamelCase.apply(tc.name); camel != tc.camel {
+			t.Errorf("expected %q in camel case to be %q, got %q", tc.name, tc.camel, camel)
+		}
+
+		if pascal := PascalCase.apply(tc.name); pascal != tc.pascal {
+			t.Errorf("expected %q in pascal case to be %q, got %q", tc.name, tc.pascal, pascal)
+		}
+
+		if name := KeepCase.apply(tc.name); name != tc.name {
+			t.Errorf("expected %q to be kept, got %q", tc.name, name)
+		}
+	}
+
+	for _, shards := range []int{1, 4} {
+		shards := shards
+
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			cfg := newDefaultConfig()
+			rec := &recordingConn{writes: make(chan ClientMsg, 1)}
+			client := NewClient("CoreHub", &Conn{conn: rec, state: &State{}, config: &cfg},
+				MethodNames(CamelCase), HubNames(CamelCase), DispatchShards(shards))
+
+			if err := client.Send(ctx, "SubscribeToDeltas", "BTC"); !expectNoError(t, err) {
+				return
+			}
+
+			if msg := <-rec.writes; msg.Hub != "coreHub" || msg.Method != "subscribeToDeltas" {
+				t.Errorf("expected coreHub.subscribeToDeltas to be sent, got %s.%s", msg.Hub, msg.Method)
+			}
+
+			stream, err := client.Callback(ctx, "UpdateDeltas")
+			if !expectNoError(t, err) {
+				return
+			}
+			defer stream.Close()
+
+			_, err = client.Callback(ctx, "updateDeltas")
+			expectErrorMatch(t, &DuplicateCallbackError{}, err)
+
+			client.callbacks.process(&Message{Messages: []ClientMsg{{Method: "updateDeltas"}, {Method: "UPDATEDELTAS"}}})
+
+			var methods []string
+			for len(stream.ch) > 0 && stream.Next(ctx) {
+				methods = append(methods, stream.Method())
+			}
+
+			if expected := []string{"updateDeltas", "UPDATEDELTAS"}; !reflect.DeepEqual(expected, methods) {
+				t.Errorf("expected methods %v, got %v", expected, methods)
+			}
+		})
+	}
+}
+
+func TestDispatchShards(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	cfg.MaxMessageProcessDuration = time.Minute
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg}, DispatchShards(4))
+
+	// find a method in another shard than the slow one
+	fast := "fast"
+	for i := 0; client.callbacks.shard(fast) == client.callbacks.shard("slow"); i++ {
+		fast = fmt.Sprintf("fast%d", i)
+	}
+
+	sctx, scancel := context.WithCancel(ctx)
+	defer scancel()
+
+	slow, err := client.Callback(sctx, "slow")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	// delivery to the fast stream must not wait for the slow one
+	fctx, fcancel := context.WithTimeout(ctx, time.Second)
+	defer fcancel()
+
+	stream, err := client.Callback(fctx, fast)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	wctx, wcancel := context.WithCancel(ctx)
+	client.callbacks.start(wctx)
+
+	msgs := make([]ClientMsg, callbackBufferSize+1)
+	for i := range msgs {
+		msgs[i] = ClientMsg{Method: "slow"}
+	}
+
+	// the slow stream is full, so its shard blocks
+	client.callbacks.process(&Message{Messages: msgs})
+
+	for i := 1; i <= 3; i++ {
+		client.callbacks.process(&Message{Messages: []ClientMsg{{Method: fast, Args: []json.RawMessage{json.RawMessage(strconv.Itoa(i))}}}})
+	}
+
+	var v int
+	for exp := 1; exp <= 3; exp++ {
+		if expectNoError(t, stream.Read(&v)) && v != exp {
+			t.Errorf("expected %d, got %d", exp, v)
+		}
+	}
+
+	// the shard is blocked delivering the last message, until the slow
+	// stream is closed
+	for len(slow.ch) < callbackBufferSize {
+		select {
+		case <-ctx.Done():
+			t.Fatal("expected slow stream to fill up")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	scancel()
+	wcancel()
+	client.callbacks.stop()
+	client.CloseCallbacks()
+
+	if _, dropped := client.callbacks.counts(); dropped != int64(len(msgs)) {
+		t.Errorf("expected %d dropped messages, got %d", len(msgs), dropped)
+	}
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	unhandled := make(chan string, 100)
+
+	cfg := newDefaultConfig()
+	cfg.MaxMessageProcessDuration = time.Minute
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg},
+		DispatchShards(4),
+		OrderedDelivery(),
+		OnUnhandledMessage(func(msg UnhandledMessage) {
+			unhandled <- msg.Call.Method
+		}),
+	)
+
+	// find a method matching the pattern in another shard than the slow one
+	fast := "feed.fast"
+	for i := 0; client.callbacks.shard(fast) == client.callbacks.shard("slow"); i++ {
+		fast = fmt.Sprintf("feed.fast%d", i)
+	}
+
+	slow, err := client.Callback(ctx, "slow")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	feed, err := client.CallbackPattern(ctx, MethodPrefix("feed."))
+	if !expectNoError(t, err) {
+		return
+	}
+
+	wctx, wcancel := context.WithCancel(ctx)
+	defer wcancel()
+
+	client.callbacks.start(wctx)
+
+	msgs := make([]ClientMsg, callbackBufferSize+1)
+	for i := range msgs {
+		msgs[i] = ClientMsg{Method: "slow"}
+	}
+
+	// the slow stream is full, so its shard blocks, and calls read after it
+	// are held back
+	client.callbacks.process(&Message{Messages: msgs})
+	client.callbacks.process(&Message{Messages: []ClientMsg{{Method: fast}, {Method: "other"}}})
+
+	time.Sleep(retryInterval)
+
+	if n := len(feed.ch); n != 0 {
+		t.Errorf("expected no calls delivered ahead of the slow shard, got %d", n)
+	}
+
+	for range msgs {
+		if _, err := slow.ReadRaw(); !expectNoError(t, err) {
+			return
+		}
+	}
+
+	if msg, err := feed.ReadRaw(); expectNoError(t, err) && msg.Method != fast {
+		t.Errorf("expected call of %s, got %s", fast, msg.Method)
+	}
+
+	// calls of methods in every shard keep the order they were read in
+	n := 3 * callbackBufferSize
+	received := make(chan []string, 1)
+
+	go func() {
+		var methods []string
+		for i := 0; i < n; i++ {
+			msg, err := feed.ReadRaw()
+			if err != nil {
+				break
+			}
+
+			methods = append(methods, msg.Method)
+		}
+
+		received <- methods
+	}()
+
+	var expected []string
+	for i := 0; i < n; i++ {
+		method := fmt.Sprintf("feed.%d", i%7)
+		expected = append(expected, method)
+		client.callbacks.process(&Message{Messages: []ClientMsg{{Method: method}, {Method: fmt.Sprintf("other.%d", i%5)}}})
+	}
+
+	if methods := <-received; !reflect.DeepEqual(expected, methods) {
+		t.Errorf("expected calls %q, got %q", expected, methods)
+	}
+
+	client.callbacks.stop()
+
+	close(unhandled)
+
+	var methods []string
+	for method := range unhandled {
+		methods = append(methods, method)
+	}
+
+	if len(methods) != 1+n || methods[0] != "other" {
+		t.Errorf("expected unhandled calls in order, got %q", methods)
+	}
+
+	for i, method := range methods[1:] {
+		if exp := fmt.Sprintf("other.%d", i%5); method != exp {
+			t.Errorf("expected unhandled call of %s, got %s", exp, method)
+		}
+	}
+}
+
+func TestCloseCallbacks(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	letters := make(chan DeadLetter, 1)
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg}, OnDeadLetter(func(l DeadLetter) {
+		letters <- l
+	}))
+
+	// stream is removed once its context is done, with no call to process
+	streamCtx, streamCancel := context.WithCancel(ctx)
+	defer streamCancel()
+
+	if _, err := client.Callback(streamCtx, "cancelled"); !expectNoError(t, err) {
+		return
+	}
+
+	streamCancel()
+
+	for {
+		if registered, _ := client.callbacks.counts(); registered == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("expected cancelled stream to be removed")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	stream, err := client.Callback(ctx, "method")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	if !expectNoError(t, client.Handle("handled", func(context.Context, []json.RawMessage) error { return nil })) {
+		return
+	}
+
+	client.callbacks.process(&Message{Messages: []ClientMsg{{Method: "method", Args: []json.RawMessage{json.RawMessage(`1`)}}}})
+
+	client.CloseCallbacks()
+
+	if registered, _ := client.callbacks.counts(); registered != 0 {
+		t.Errorf("expected no registered streams, got %d", registered)
+	}
+
+	if err := stream.Read(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+
+	if l := <-letters; l.Message.Method != "method" || !errors.Is(l.Reason, context.Canceled) {
+		t.Errorf("expected buffered call to be dead letter, got %+v", l)
+	}
+
+	// the client accepts callbacks again
+	if _, err := client.Callback(ctx, "method"); !expectNoError(t, err) {
+		return
+	}
+
+	expectNoError(t, client.Handle("handled", func(context.Context, []json.RawMessage) error { return nil }))
+
+	client.CloseCallbacks()
+}
+
+func TestSlowConsumer(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	cfg.MaxMessageProcessDuration = retryInterval
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg})
+
+	stream, err := client.Callback(ctx, "slow")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	msgs := make([]ClientMsg, callbackBufferSize)
+	for i := range msgs {
+		msgs[i] = ClientMsg{Method: "slow"}
+	}
+
+	client.callbacks.process(&Message{Messages: msgs})
+
+	expected := []CallbackStats{{Method: "slow", Subscribers: 1, Queued: callbackBufferSize, Capacity: callbackBufferSize}}
+	if stats := client.CallbackStats(); !reflect.DeepEqual(expected, stats) {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+
+	// buffer is full, so the stream is stopped
+	client.callbacks.process(&Message{Messages: msgs[:1]})
+
+	expectErrorMatch(t, &SlowConsumerError{}, stream.Read())
+
+	expected = []CallbackStats{{Method: "slow", SlowConsumers: 1}}
+	if stats := client.CallbackStats(); !reflect.DeepEqual(expected, stats) {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestMessageTimestamp(t *testing.T) {
+	t.Parallel()
+
+	stamped := func(ms int64) LagStats {
+		return LagStats{Count: 1, Last: time.Duration(ms) * time.Millisecond, Mean: time.Duration(ms) * time.Millisecond, Max: time.Duration(ms) * time.Millisecond}
+	}
+
+	cases := []struct {
+		name string
+
+		// the first argument of every call is the time it was sent in
+		// milliseconds, calls are received at 1100 and read at 1150
+		args     []string
+		expected CallbackStats
+	}{
+		{
+			name:     "timestamp",
+			args:     []string{`[1000]`},
+			expected: CallbackStats{NetworkLag: stamped(100), ConsumerLag: stamped(50)},
+		},
+		{
+			name:     "no timestamp",
+			args:     []string{`[]`},
+			expected: CallbackStats{},
+		},
+		{
+			name: "several calls",
+			args: []string{`[900]`, `[]`, `[1000]`},
+			expected: CallbackStats{
+				NetworkLag:  LagStats{Count: 2, Last: 100 * time.Millisecond, Mean: 150 * time.Millisecond, Max: 200 * time.Millisecond},
+				ConsumerLag: LagStats{Count: 2, Last: 50 * time.Millisecond, Mean: 50 * time.Millisecond, Max: 50 * time.Millisecond},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			clock := &fakeClock{now: time.UnixMilli(1100)}
+
+			cfg := newDefaultConfig()
+			cfg.Clock = clock
+			cfg.MaxMessageProcessDuration = 0
+
+			timestamp := MessageTimestamp(func(msg ClientMsg) (time.Time, bool) {
+				var ms int64
+				if len(msg.Args) == 0 || json.Unmarshal(msg.Args[0], &ms) != nil {
+					return time.Time{}, false
+				}
+
+				return time.UnixMilli(ms), true
+			})
+
+			client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg}, timestamp)
+
+			stream, err := client.Callback(ctx, "feed")
+			if !expectNoError(t, err) {
+				return
+			}
+
+			msgs := make([]ClientMsg, len(c.args))
+			for i, args := range c.args {
+				msgs[i] = ClientMsg{Method: "feed"}
+				if !expectNoError(t, json.Unmarshal([]byte(args), &msgs[i].Args)) {
+					return
+				}
+			}
+
+			client.callbacks.process(&Message{Messages: msgs})
+
+			clock.now = time.UnixMilli(1150)
+
+			for range msgs {
+				if _, err := stream.ReadRaw(); !expectNoError(t, err) {
+					return
+				}
+			}
+
+			expected := c.expected
+			expected.Method = "feed"
+			expected.Subscribers = 1
+			expected.Capacity = callbackBufferSize
+
+			if stats := client.CallbackStats(); !reflect.DeepEqual([]CallbackStats{expected}, stats) {
+				t.Errorf("expected stats %+v, got %+v", expected, stats)
+			}
+		})
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		window int
+
+		// IDs of received calls, empty for calls without ID
+		ids        []string
+		delivered  []string
+		duplicates int
+	}{
+		{
+			name:      "unique",
+			ids:       []string{"1", "2", "3"},
+			delivered: []string{"1", "2", "3"},
+		},
+		{
+			name:       "replayed",
+			ids:        []string{"1", "2", "1", "2", "3"},
+			delivered:  []string{"1", "2", "3"},
+			duplicates: 2,
+		},
+		{
+			name:      "without ID",
+			ids:       []string{"", "", "1"},
+			delivered: []string{"", "", "1"},
+		},
+		{
+			name:      "forgotten",
+			window:    2,
+			ids:       []string{"1", "2", "3", "1"},
+			delivered: []string{"1", "2", "3", "1"},
+		},
+		{
+			name:       "recently seen",
+			window:     2,
+			ids:        []string{"1", "2", "1", "3", "1", "2"},
+			delivered:  []string{"1", "2", "3", "2"},
+			duplicates: 2,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			cfg := newDefaultConfig()
+			cfg.MaxMessageProcessDuration = 0
+			client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg})
+
+			id := func(msg ClientMsg) (string, bool) {
+				var id string
+				if len(msg.Args) == 0 || json.Unmarshal(msg.Args[0], &id) != nil {
+					return "", false
+				}
+
+				return id, true
+			}
+
+			stream, err := client.Callback(ctx, "book", Dedupe(c.window, id))
+			if !expectNoError(t, err) {
+				return
+			}
+
+			msgs := make([]ClientMsg, len(c.ids))
+			for i, id := range c.ids {
+				msgs[i] = ClientMsg{Method: "book"}
+				if id != "" {
+					msgs[i].Args = []json.RawMessage{json.RawMessage(strconv.Quote(id))}
+				}
+			}
+
+			client.callbacks.process(&Message{Messages: msgs})
+
+			delivered := make([]string, len(c.delivered))
+			for i := range delivered {
+				msg, err := stream.ReadRaw()
+				if !expectNoError(t, err) {
+					return
+				}
+
+				delivered[i], _ = id(msg)
+			}
+
+			if !reflect.DeepEqual(c.delivered, delivered) {
+				t.Errorf("expected calls %q delivered, got %q", c.delivered, delivered)
+			}
+
+			if stats := client.CallbackStats(); len(stats) != 1 || stats[0].Duplicates != c.duplicates || stats[0].Queued != 0 {
+				t.Errorf("expected %d duplicates and nothing queued, got %+v", c.duplicates, stats)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	cfg.MaxMessageProcessDuration = retryInterval
+
+	conn := &Conn{state: &State{}, config: &cfg}
+	conn.conn = conn.wrap(&fakeConn{results: []readResult{
+		{msg: `{}`},
+		{msg: `{"C":"1"}`},
+		{err: errors.New("read failed")},
+	}})
+
+	client := NewClient("hub", conn)
+
+	if _, err := client.Callback(ctx, "method"); !expectNoError(t, err) {
+		return
+	}
+
+	var msg Message
+	expectNoError(t, conn.ReadMessage(ctx, &msg))
+	expectNoError(t, conn.WriteMessage(ctx, ClientMsg{InvocationID: 1, Hub: "hub", Method: "method"}))
+	expectErrorMatch(t, &ReadError{}, conn.ReadMessage(ctx, &msg))
+
+	msgs := make([]ClientMsg, callbackBufferSize+1)
+	for i := range msgs {
+		msgs[i] = ClientMsg{Method: "method"}
+	}
+
+	// buffer overflows, so the stream is stopped dropping all messages
+	client.callbacks.process(&Message{Messages: msgs})
+
+	stats := client.Stats()
+	expectErrorMatch(t, &ReadError{}, stats.LastError)
+
+	stats.LastError = nil
+	expected := Stats{
+		FramesRead:      2,
+		FramesWritten:   1,
+		BytesRead:       11,
+		BytesWritten:    stats.BytesWritten,
+		Keepalives:      1,
+		DroppedMessages: callbackBufferSize + 1,
+	}
+	if !reflect.DeepEqual(expected, stats) {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+
+	if stats.BytesWritten == 0 {
+		t.Error("expected bytes written to be counted")
+	}
+}
+
+func TestErr(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	conn := &Conn{state: &State{}, config: &cfg}
+	conn.conn = conn.wrap(&fakeConn{results: []readResult{
+		{err: errors.New("read failed")},
+	}})
+
+	client := NewClient("hub", conn)
+
+	err := client.Run(ctx)
+	expectErrorMatch(t, &ReadError{}, err)
+
+	if err != client.Err() {
+		t.Errorf("expected %v, got %v", err, client.Err())
+	}
+
+	// reason of the reconnect is reported by stats, the test server sends a
+	// single frame per connection
+	ts := httptest.NewServer(wrapHandler(t, newCoreHandler(`{"type":1,"target":"notify","arguments":[1]}`+"\x1e")))
+	t.Cleanup(ts.Close)
+
+	c, err := Dial(ctx, ts.URL+"/hub", connectionData,
+		RetryInterval(retryInterval),
+		Dialer(FaultInjector(NewDefaultDialer, Faults{DisconnectAfter: 1})),
+	)
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	if reason := c.stats.snapshot().ReconnectReason; reason != nil {
+		t.Errorf("expected no reconnect reason, got %v", reason)
+	}
+
+	var msg Message
+	for i := 0; i < 2; i++ {
+		if !expectNoError(t, c.ReadMessage(ctx, &msg)) {
+			return
+		}
+	}
+
+	if reason := c.stats.snapshot().ReconnectReason; !IsCloseError(reason, CloseAbnormal) {
+		t.Errorf("expected CloseError, got %v", reason)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// collect returns events buffered so far
+	collect := func(events <-chan Event) (res []Event) {
+		for {
+			select {
+			case ev := <-events:
+				res = append(res, ev)
+			default:
+				return res
+			}
+		}
+	}
+
+	cfg := newDefaultConfig()
+	cfg.MaxMessageProcessDuration = retryInterval
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg})
+
+	if _, err := client.Callback(ctx, "slow"); !expectNoError(t, err) {
+		return
+	}
+
+	msgs := make([]ClientMsg, callbackBufferSize+1)
+	for i := range msgs {
+		msgs[i] = ClientMsg{Method: "slow"}
+	}
+
+	// buffer overflows, so the stream is stopped dropping all messages
+	client.callbacks.process(&Message{Messages: msgs})
+
+	events := collect(client.Events())
+	if len(events) != len(msgs)+1 {
+		t.Fatalf("expected %d events, got %+v", len(msgs)+1, events)
+	}
+
+	if ev := (SlowConsumer{Method: "slow", Timeout: retryInterval}); events[0] != ev {
+		t.Errorf("expected event %+v, got %+v", ev, events[0])
+	}
+
+	for _, ev := range events[1:] {
+		dropped, ok := ev.(MessageDropped)
+		if !ok || dropped.Method != "slow" {
+			t.Errorf("expected MessageDropped event, got %+v", ev)
+			continue
+		}
+
+		expectErrorMatch(t, &SlowConsumerError{}, dropped.Reason)
+	}
+
+	// connection is reestablished after injected disconnect, the test server
+	// sends a single frame per connection
+	ts := httptest.NewServer(wrapHandler(t, newCoreHandler(`{"type":1,"target":"notify","arguments":[1]}`+"\x1e")))
+	t.Cleanup(ts.Close)
+
+	endpoint := ts.URL + "/hub"
+
+	conn, err := Dial(ctx, endpoint, connectionData,
+		RetryInterval(retryInterval),
+		Dialer(FaultInjector(NewDefaultDialer, Faults{DisconnectAfter: 1})),
+	)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	client = NewClient("hub", conn)
+
+	var msg Message
+	for i := 0; i < 2; i++ {
+		if !expectNoError(t, conn.ReadMessage(ctx, &msg)) {
+			return
+		}
+	}
+
+	expectNoError(t, client.Close())
+	expectNoError(t, client.Run(ctx))
+
+	var steps []string
+	events = events[:0]
+
+	for _, ev := range collect(client.Events()) {
+		if timing, ok := ev.(SetupTiming); ok {
+			steps = append(steps, timing.Step)
+			continue
+		}
+
+		events = append(events, ev)
+	}
+
+	var types []string
+	for _, ev := range events {
+		types = append(types, fmt.Sprintf("%T", ev))
+	}
+
+	// core server rejects classic negotiate request, and has no reconnect and
+	// start steps
+	if expected := []string{"negotiate", "negotiate", "connect", "negotiate", "negotiate", "connect"}; !reflect.DeepEqual(expected, steps) {
+		t.Errorf("expected setup steps %v, got %v", expected, steps)
+	}
+
+	expected := []string{
+		"signalr.Negotiated",
+		"signalr.Connected",
+		"signalr.Reconnecting",
+		"signalr.Negotiated",
+		"signalr.Reconnected",
+		"signalr.Closed",
+	}
+	if !reflect.DeepEqual(expected, types) {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+
+	if ev := events[1].(Connected); ev.Endpoint != endpoint {
+		t.Errorf("expected endpoint %s, got %s", endpoint, ev.Endpoint)
+	}
+
+	if ev := events[2].(Reconnecting); ev.Attempt != 1 || !IsCloseError(ev.Reason, CloseAbnormal) {
+		t.Errorf("expected first attempt caused by CloseError, got %+v", ev)
+	}
+
+	if ev := events[5].(Closed); ev.Err != nil {
+		t.Errorf("expected no error, got %v", ev.Err)
+	}
+}
+
+func TestClock(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clock := &fakeClock{now: time.Unix(42, 0), timers: make(chan *fakeTimer, callbackBufferSize+1)}
+
+	cfg := newDefaultConfig()
+	cfg.Clock = clock
+
+	rec := &recordingConn{writes: make(chan ClientMsg, 1)}
+	conn := &Conn{conn: rec, state: &State{}, config: &cfg}
+
+	conn.touch()
+	if lastRead := conn.LastRead(); !lastRead.Equal(clock.now) {
+		t.Errorf("expected last read %v, got %v", clock.now, lastRead)
+	}
+
+	client := NewClient("hub", conn, InvocationIDs(func() uint64 { return 42 }))
+
+	inv := client.Invoke(ctx, "method")
+	if !expectNoError(t, inv.err) {
+		return
+	}
+
+	if msg := <-rec.writes; msg.InvocationID != 42 {
+		t.Errorf("expected invocation ID 42, got %d", msg.InvocationID)
+	}
+
+	stream, err := client.Callback(ctx, "slow")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	msgs := make([]ClientMsg, callbackBufferSize+1)
+	for i := range msgs {
+		msgs[i] = ClientMsg{Method: "slow"}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.callbacks.process(&Message{Messages: msgs})
+	}()
+
+	// the last message does not fit into the buffer and waits for the timer
+	var timer *fakeTimer
+	for range msgs {
+		timer = <-clock.timers
+	}
+	timer.ch <- clock.now
+
+	<-done
+
+	expectErrorMatch(t, &SlowConsumerError{}, stream.Read())
+}
+
+func TestProcessDuration(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg})
+
+	fast, err := client.Callback(ctx, "fast", ProcessDuration(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+
+	blocking, err := client.Callback(ctx, "blocking", ProcessDuration(0))
+	if !expectNoError(t, err) {
+		return
+	}
+	defer blocking.Close()
+
+	overflow := func(method string) *Message {
+		msgs := make([]ClientMsg, callbackBufferSize+1)
+		for i := range msgs {
+			msgs[i] = ClientMsg{Method: method}
+		}
+
+		return &Message{Messages: msgs}
+	}
+
+	// overridden duration is used instead of the default one
+	client.callbacks.process(overflow("fast"))
+	expectErrorMatch(t, &SlowConsumerError{}, fast.Read())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.callbacks.process(overflow("blocking"))
+	}()
+
+	for i := 0; i <= callbackBufferSize; i++ {
+		expectNoError(t, blocking.Read())
+	}
+
+	<-done
+}
+
+func TestDeadLetter(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var letters []DeadLetter
+
+	cfg := newDefaultConfig()
+	client := NewClient(
+		"hub",
+		&Conn{conn: &fakeConn{}, state: &State{}, config: &cfg},
+		OnDeadLetter(func(letter DeadLetter) { letters = append(letters, letter) }),
+	)
+
+	stream, err := client.Callback(ctx, "method", ProcessDuration(retryInterval))
+	if !expectNoError(t, err) {
+		return
+	}
+
+	msgs := make([]ClientMsg, callbackBufferSize+1)
+	for i := range msgs {
+		msgs[i] = ClientMsg{Method: "method", Args: []json.RawMessage{json.RawMessage(strconv.Itoa(i))}}
+	}
+
+	client.callbacks.process(&Message{Messages: msgs})
+	expectErrorMatch(t, &SlowConsumerError{}, stream.Read())
+
+	if len(letters) != len(msgs) {
+		t.Fatalf("expected %d dead letters, got %d", len(msgs), len(letters))
+	}
+
+	for i, letter := range letters {
+		if !reflect.DeepEqual(msgs[i], letter.Message) {
+			t.Errorf("expected dead letter %+v, got %+v", msgs[i], letter.Message)
+		}
+
+		expectErrorMatch(t, &SlowConsumerError{}, letter.Reason)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var logged []interface{}
+
+	cfg := newDefaultConfig()
+	cfg.Logger = LoggerFunc(func(level LogLevel, msg string, keyvals ...interface{}) {
+		logged = keyvals
+	})
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg})
+
+	stream, err := client.Callback(ctx, "method", Validate(func([]json.RawMessage) error {
+		panic("validator failed")
+	}))
+	if !expectNoError(t, err) {
+		return
+	}
+	defer stream.Close()
+
+	msg := &Message{Messages: []ClientMsg{{Method: "method"}}}
+
+	var panicErr *PanicError
+	if !errors.As(client.dispatch(msg), &panicErr) {
+		t.Fatal("expected panic error")
+	}
+
+	if panicErr.Value != "validator failed" || len(panicErr.Stack) == 0 {
+		t.Errorf("unexpected panic error %+v", panicErr)
+	}
+
+	if len(logged) != 6 || logged[0] != "hub" || logged[2] != "panic" || logged[4] != "stack" {
+		t.Errorf("unexpected log keyvals %v", logged)
+	}
+
+	// dispatching is not blocked after panic
+	expectErrorMatch(t, &PanicError{}, client.dispatch(msg))
+}
+
+type fakeSugaredLogger struct {
+	logged []string
+}
+
+func (l *fakeSugaredLogger) log(level, msg string, keyvals []interface{}) {
+	l.logged = append(l.logged, strings.TrimSpace(fmt.Sprintln(append([]interface{}{level, msg}, keyvals...)...)))
+}
+
+func (l *fakeSugaredLogger) Debugw(msg string, keyvals ...interface{}) { l.log("debug", msg, keyvals) }
+func (l *fakeSugaredLogger) Infow(msg string, keyvals ...interface{})  { l.log("info", msg, keyvals) }
+func (l *fakeSugaredLogger) Warnw(msg string, keyvals ...interface{})  { l.log("warn", msg, keyvals) }
+func (l *fakeSugaredLogger) Errorw(msg string, keyvals ...interface{}) { l.log("error", msg, keyvals) }
+
+func TestZapLogger(t *testing.T) {
+	t.Parallel()
+
+	var logger fakeSugaredLogger
+
+	cfg := newDefaultConfig()
+	cfg.Logger = ZapLogger(&logger)
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{ConnectionID: "connection-id"}, config: &cfg})
+
+	client.conn.log(LevelDebug, "connection message", "key", 1)
+	client.log(LevelInfo, "client message")
+	client.log(LevelWarn, "method message", "method", "method", "invocation_id", uint64(42))
+	cfg.Logger.Log(LevelError, "error message")
+
+	expected := []string{
+		"debug connection message connection_id connection-id key 1",
+		"info client message connection_id connection-id hub hub",
+		"warn method message connection_id connection-id hub hub method method invocation_id 42",
+		"error error message",
+	}
+	if !reflect.DeepEqual(expected, logger.logged) {
+		t.Errorf("expected logged %q, got %q", expected, logger.logged)
+	}
+}
+
+func TestRunWaitsForHandlers(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: blockingConn{}, state: &State{}, config: &cfg})
+
+	var returned int32
+
+	started := make(chan struct{})
+	err := client.Handle("method", func(ctx context.Context, _ []json.RawMessage) error {
+		close(started)
+		<-ctx.Done()
+
+		atomic.StoreInt32(&returned, 1)
+
+		return nil
+	})
+	if !expectNoError(t, err) {
+		return
+	}
+
+	runCtx, runCancel := context.WithCancel(ctx)
+
+	done := make(chan error, 1)
+	go func() { done <- client.Run(runCtx) }()
+
+	client.callbacks.process(&Message{Messages: []ClientMsg{{Method: "method"}}})
+	<-started
+
+	// handler blocked on its context is cancelled and waited for
+	runCancel()
+	<-done
+
+	if atomic.LoadInt32(&returned) != 1 {
+		t.Error("expected handler to return before Run")
+	}
+}
+
+func TestHandle(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: blockingConn{}, state: &State{}, config: &cfg})
+
+	errStop := errors.New("stop")
+
+	var handled []string
+	err := client.Handle("method", func(ctx context.Context, args []json.RawMessage) error {
+		handled = append(handled, string(args[0]))
+		if string(args[0]) == "2" {
+			return errStop
+		}
+
+		return nil
+	})
+	if !expectNoError(t, err) {
+		return
+	}
+
+	expectErrorMatch(t, &DuplicateCallbackError{}, client.Handle("method", nil))
+
+	done := make(chan error, 1)
+	go func() { done <- client.Run(ctx) }()
+
+	for _, arg := range []string{"1", "2"} {
+		client.callbacks.process(&Message{Messages: []ClientMsg{{Method: "method", Args: []json.RawMessage{json.RawMessage(arg)}}}})
+	}
+
+	err = <-done
+	expectErrorMatch(t, &HandlerError{}, err)
+	if !errors.Is(err, errStop) {
+		t.Errorf("expected handler error to wrap %v, got %v", errStop, err)
+	}
+
+	if !reflect.DeepEqual([]string{"1", "2"}, handled) {
+		t.Errorf("unexpected handled calls %v", handled)
+	}
+}
+
+func TestHandleResult(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	ts := httptest.NewServer(wrapHandler(t, newCoreHandler(
+		`{"type":1,"invocationId":"1","target":"add","arguments":[1,2]}`+"\x1e"+
+			`{"type":1,"invocationId":"2","target":"add","arguments":["x"]}`+"\x1e"+
+			`{"type":1,"invocationId":"3","target":"panic","arguments":[]}`+"\x1e"+
+			`{"type":1,"invocationId":"4","target":"void","arguments":[]}`+"\x1e",
+	)))
+	t.Cleanup(ts.Close)
+
+	conn, err := Dial(ctx, ts.URL+"/hub", connectionData)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	client := NewClient("hub", conn)
+	t.Cleanup(func() { _ = client.Close() })
+
+	// callbacks are registered before any call is read
+	stream, err := client.Callback(ctx, "completed")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	expectNoError(t, client.HandleResult("add", func(_ context.Context, args []json.RawMessage) (interface{}, error) {
+		var a, b int
+		if err := json.Unmarshal(args[0], &a); err != nil {
+			return nil, err
+		}
+
+		if len(args) < 2 {
+			return nil, errors.New("missing argument")
+		}
+
+		if err := json.Unmarshal(args[1], &b); err != nil {
+			return nil, err
+		}
+
+		return a + b, nil
+	}))
+
+	expectNoError(t, client.HandleResult("panic", func(context.Context, []json.RawMessage) (interface{}, error) {
+		panic("boom")
+	}))
+
+	expectNoError(t, client.HandleResult("void", func(context.Context, []json.RawMessage) (interface{}, error) {
+		return nil, nil
+	}))
+
+	go func() { _ = client.Run(ctx) }()
+
+	expected := []coreMessage{
+		{Type: coreCompletion, InvocationID: "1", Result: json.RawMessage("3")},
+		{Type: coreCompletion, InvocationID: "2", Error: "json: cannot unmarshal string into Go value of type int"},
+		{Type: coreCompletion, InvocationID: "3", Error: "recovered from panic: boom"},
+		{Type: coreCompletion, InvocationID: "4", Result: json.RawMessage("null")},
+	}
+
+	// handlers of different methods run concurrently
+	completions := make(map[string]coreMessage)
+	for range expected {
+		var completion coreMessage
+		if !expectNoError(t, stream.Read(&completion)) {
+			return
+		}
+
+		completions[completion.InvocationID] = completion
+	}
+
+	for _, e := range expected {
+		if completion := completions[e.InvocationID]; !reflect.DeepEqual(e, completion) {
+			t.Errorf("expected completion %+v, got %+v", e, completion)
+		}
+	}
+
+	// classic servers do not support client results
+	err = (classicProtocol{}).marshal(getEncoder(), ClientMsg{ResultID: "1", Completion: &Completion{}})
+	if err == nil {
+		t.Error("expected classic protocol to reject completion")
+	}
+}
+
+func TestRequireAck(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		maxDeliveries int
+
+		// whether every read message is acknowledged
+		acks []bool
+
+		// arguments of messages read and of dead letters
+		read    []int
+		letters []int
+	}{
+		{
+			name:          "acknowledged",
+			maxDeliveries: 2,
+			acks:          []bool{true, true},
+			read:          []int{1, 2},
+		},
+		{
+			name:          "redelivered",
+			maxDeliveries: 2,
+			acks:          []bool{false, true, true},
+			read:          []int{1, 1, 2},
+		},
+		{
+			name:          "dead lettered",
+			maxDeliveries: 2,
+			acks:          []bool{false, false, true},
+			read:          []int{1, 1, 2},
+			letters:       []int{1},
+		},
+		{
+			name: "unlimited deliveries",
+			acks: []bool{false, false, false, true, true},
+			read: []int{1, 1, 1, 1, 2},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var letters []int
+
+			cfg := newDefaultConfig()
+			client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg}, OnDeadLetter(func(l DeadLetter) {
+				var v int
+				_ = json.Unmarshal(l.Message.Args[0], &v)
+				letters = append(letters, v)
+
+				expectErrorMatch(t, &UnacknowledgedError{}, l.Reason)
+			}))
+
+			stream, err := client.Callback(ctx, "method", RequireAck(c.maxDeliveries))
+			if !expectNoError(t, err) {
+				return
+			}
+
+			client.callbacks.process(&Message{Messages: []ClientMsg{
+				{Method: "method", Args: []json.RawMessage{json.RawMessage("1")}},
+				{Method: "method", Args: []json.RawMessage{json.RawMessage("2")}},
+			}})
+
+			var read []int
+			for _, ack := range c.acks {
+				var v int
+				if !expectNoError(t, stream.Read(&v)) {
+					return
+				}
+
+				read = append(read, v)
+
+				if ack {
+					stream.Ack()
+				}
+			}
+
+			if !reflect.DeepEqual(c.read, read) {
+				t.Errorf("expected messages %v read, got %v", c.read, read)
+			}
+
+			if !reflect.DeepEqual(c.letters, letters) {
+				t.Errorf("expected dead letters %v, got %v", c.letters, letters)
+			}
+
+			if _, dropped := client.callbacks.counts(); dropped != int64(len(c.letters)) {
+				t.Errorf("expected %d dropped messages, got %d", len(c.letters), dropped)
+			}
+		})
+	}
+}
+
+func TestHandleRequireAck(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errFailed := errors.New("failed")
+	letters := make(chan DeadLetter, 1)
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: blockingConn{}, state: &State{}, config: &cfg}, OnDeadLetter(func(l DeadLetter) {
+		letters <- l
+	}))
+
+	handled := make(chan string, 8)
+	var n int
+	err := client.Handle("method", func(ctx context.Context, args []json.RawMessage) error {
+		handled <- string(args[0])
+		n++
+
+		// the first call fails once, the second one every time
+		if string(args[0]) == "2" || n == 1 {
+			return errFailed
+		}
+
+		return nil
+	}, RequireAck(2))
+	if !expectNoError(t, err) {
+		return
+	}
+
+	for _, arg := range []string{"1", "2", "3"} {
+		client.callbacks.process(&Message{Messages: []ClientMsg{{Method: "method", Args: []json.RawMessage{json.RawMessage(arg)}}}})
+	}
+
+	var calls []string
+	for len(calls) < 5 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected 5 calls handled, got %v", calls)
+		case arg := <-handled:
+			calls = append(calls, arg)
+		}
+	}
+
+	if expected := []string{"1", "1", "2", "2", "3"}; !reflect.DeepEqual(expected, calls) {
+		t.Errorf("expected calls %v handled, got %v", expected, calls)
+	}
+
+	letter := <-letters
+	expectErrorMatch(t, &UnacknowledgedError{}, letter.Reason)
+	if !errors.Is(letter.Reason, errFailed) || string(letter.Message.Args[0]) != "2" {
+		t.Errorf("expected dead letter of call 2 failing with %v, got %+v", errFailed, letter)
+	}
+
+	select {
+	case err := <-client.errs:
+		t.Errorf("expected handler errors not to fail Run, got %v", err)
+	default:
+	}
+
+	client.CloseCallbacks()
+}
+
+func TestDeclare(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := &recordingConn{writes: make(chan ClientMsg, 8)}
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: conn, state: &State{}, config: &cfg})
+
+	// respond to every invocation
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-conn.writes:
+				client.invocations.process(&Message{InvocationID: msg.InvocationID})
+			}
+		}
+	}()
+
+	expectNoError(t, client.Declare(ctx, "Subscribe", "USD-BTC"))
+	expectNoError(t, client.Declare(ctx, "Heartbeat"))
+	client.Undeclare("Heartbeat")
+
+	expected := []Declaration{{Method: "Subscribe", Args: []interface{}{"USD-BTC"}}}
+	if declared := client.Declarations(); !reflect.DeepEqual(expected, declared) {
+		t.Errorf("expected declarations %+v, got %+v", expected, declared)
+	}
+
+	conn.mtx.Lock()
+	conn.sent = nil
+	conn.mtx.Unlock()
+
+	// calls are replayed by Run
+	go client.replayer(ctx)
+
+	client.conn.reconnectedHooks()
+
+	for {
+		conn.mtx.Lock()
+		sent := conn.sent
+		conn.mtx.Unlock()
+
+		if len(sent) != 0 {
+			if sent[0].Method != "Subscribe" || string(sent[0].Args[0]) != `"USD-BTC"` {
+				t.Errorf("unexpected replayed call %+v", sent[0])
+			}
+
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("expected declared call to be replayed")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := &recordingConn{writes: make(chan ClientMsg, 8)}
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: conn, state: &State{}, config: &cfg})
+
+	// respond to every invocation, failing subscriptions to unknown markets
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-conn.writes:
+				res := &Message{InvocationID: msg.InvocationID}
+				if string(msg.Args[0]) == `"UNKNOWN"` {
+					res.Error = "unknown market"
+				}
+
+				client.invocations.process(res)
+			}
+		}
+	}()
+
+	subs := NewSubscriptions(client, UnsubscribeMethod("Subscribe", "Unsubscribe"))
+
+	first, err := subs.Acquire(ctx, "Subscribe", "USD-BTC")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	second, err := subs.Acquire(ctx, "Subscribe", "USD-BTC")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	other, err := subs.Acquire(ctx, "Subscribe", "USD-ETH")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	_, err = subs.Acquire(ctx, "Subscribe", "UNKNOWN")
+	expectErrorMatch(t, &InvocationError{}, err)
+
+	if refs := subs.Refs("Subscribe", "USD-BTC"); refs != 2 {
+		t.Errorf("expected 2 references, got %d", refs)
+	}
+
+	// repeated release of a reference has no effect
+	expectNoError(t, first.Release(ctx))
+	expectNoError(t, first.Release(ctx))
+
+	if refs := subs.Refs("Subscribe", "USD-BTC"); refs != 1 {
+		t.Errorf("expected 1 reference, got %d", refs)
+	}
+
+	expectNoError(t, second.Release(ctx))
+
+	var calls []string
+	conn.mtx.Lock()
+	for _, msg := range conn.sent {
+		calls = append(calls, msg.Method+" "+string(msg.Args[0]))
+	}
+	conn.mtx.Unlock()
+
+	expected := []string{`Subscribe "USD-BTC"`, `Subscribe "USD-ETH"`, `Subscribe "UNKNOWN"`, `Unsubscribe "USD-BTC"`}
+	if !reflect.DeepEqual(expected, calls) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+
+	// only acquired subscriptions are replayed
+	declared := []Declaration{{Method: "Subscribe", Args: []interface{}{"USD-ETH"}}}
+	if d := client.Declarations(); !reflect.DeepEqual(declared, d) {
+		t.Errorf("expected declarations %+v, got %+v", declared, d)
+	}
+
+	expectNoError(t, other.Release(ctx))
+
+	if d := client.Declarations(); len(d) != 0 {
+		t.Errorf("expected no declarations, got %+v", d)
+	}
+}
+func TestJournal(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	if err := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg}).Enqueue(ctx, "Cancel"); err == nil {
+		t.Error("expected error without journal")
+	}
+
+	clock := &fakeClock{now: time.Unix(42, 0)}
+	cfg.Clock = clock
+
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, err := OpenFileJournal(path)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	// calls made by a previous process
+	expectNoError(t, j.Append(JournalEntry{ID: 1, Method: "Expired", Queued: clock.now.Add(-time.Hour)}))
+
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg}, WriteJournal(JournalConfig{Journal: j}))
+	expectNoError(t, client.Enqueue(ctx, "Cancel", 1))
+	expectNoError(t, client.Enqueue(ctx, "Cancel", 2))
+	expectNoError(t, j.Close())
+
+	// journal survives restart
+	if j, err = OpenFileJournal(path); !expectNoError(t, err) {
+		return
+	}
+	defer j.Close()
+
+	var (
+		mtx       sync.Mutex
+		expired   []JournalEntry
+		conflicts []error
+	)
+
+	conn := &recordingConn{writes: make(chan ClientMsg, 8)}
+	client = NewClient("hub", &Conn{conn: conn, state: &State{}, config: &cfg}, WriteJournal(JournalConfig{
+		Journal: j,
+		MaxAge:  time.Minute,
+		OnExpired: func(entry JournalEntry) {
+			mtx.Lock()
+			expired = append(expired, entry)
+			mtx.Unlock()
+		},
+		OnConflict: func(entry JournalEntry, err error) {
+			mtx.Lock()
+			conflicts = append(conflicts, err)
+			mtx.Unlock()
+		},
+	}))
+
+	// the second cancellation conflicts
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-conn.writes:
+				res := &Message{InvocationID: msg.InvocationID}
+				if string(msg.Args[0]) == "2" {
+					res.Error = "order filled"
+				}
+
+				client.invocations.process(res)
+			}
+		}
+	}()
+
+	go client.flusher(ctx)
+
+	// callbacks are called once calls are removed from the journal
+	for {
+		entries, err := j.Entries()
+		if !expectNoError(t, err) {
+			return
+		}
+
+		mtx.Lock()
+		reported := len(conflicts)
+		mtx.Unlock()
+
+		if len(entries) == 0 && reported != 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected journal to be flushed, got %+v", entries)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	conn.mtx.Lock()
+	sent := conn.sent
+	conn.mtx.Unlock()
+
+	if len(sent) != 2 || string(sent[0].Args[0]) != "1" || string(sent[1].Args[0]) != "2" {
+		t.Errorf("expected calls to be sent in order, got %+v", sent)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if len(expired) != 1 || expired[0].Method != "Expired" {
+		t.Errorf("expected expired call, got %+v", expired)
+	}
+
+	if len(conflicts) != 1 {
+		t.Fatalf("expected conflict, got %v", conflicts)
+	}
+	expectErrorMatch(t, &InvocationError{}, conflicts[0])
+
+	// removed calls are gone after restart
+	if entries, err := readJournalFile(path); expectNoError(t, err) && len(entries) != 0 {
+		t.Errorf("expected empty journal file, got %+v", entries)
+	}
+
+	// record truncated by a crash is ignored
+	expectNoError(t, os.WriteFile(path, []byte(`{"Append":{"ID":1,"Method":"Cancel"}}`+"\n"+`{"Append":{"ID":2`), 0o600))
+
+	if entries, err := readJournalFile(path); expectNoError(t, err) && (len(entries) != 1 || entries[0].ID != 1) {
+		t.Errorf("expected single entry, got %+v", entries)
+	}
+}
+
+func TestJournalRetry(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clock := &fakeClock{now: time.Unix(42, 0), timers: make(chan *fakeTimer)}
+
+	cfg := newDefaultConfig()
+	cfg.Clock = clock
+
+	j, err := OpenFileJournal(filepath.Join(t.TempDir(), "journal"))
+	if !expectNoError(t, err) {
+		return
+	}
+	defer j.Close()
+
+	conn := &recordingConn{writes: make(chan ClientMsg, 2)}
+	client := NewClient("hub", &Conn{conn: conn, state: &State{}, config: &cfg}, WriteJournal(JournalConfig{
+		Journal: j,
+		Timeout: 50 * time.Millisecond,
+	}))
+	expectNoError(t, client.Enqueue(ctx, "Cancel", 1))
+
+	go client.flusher(ctx)
+
+	// the first attempt is not answered and times out, stalling the journal
+	// until the retry scheduled by the flusher fires
+	<-conn.writes
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("expected retry to be scheduled")
+	case timer := <-clock.timers:
+		timer.ch <- clock.now
+	}
+
+	msg := <-conn.writes
+	client.invocations.process(&Message{InvocationID: msg.InvocationID})
+
+	for {
+		entries, err := j.Entries()
+		if !expectNoError(t, err) || len(entries) == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected journal to be flushed, got %+v", entries)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := &recordingConn{writes: make(chan ClientMsg, 1)}
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: conn, state: &State{}, config: &cfg})
+
+	if !expectNoError(t, client.Send(ctx, "Notify", 42)) {
+		return
+	}
+
+	msg := <-conn.writes
+	if msg.Method != "Notify" || msg.InvocationID != 0 || string(msg.Args[0]) != "42" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	data, err := json.Marshal(msg)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	if bytes.Contains(data, []byte(`"I"`)) {
+		t.Errorf("expected no invocation ID, got %s", data)
+	}
+
+	if n := client.invocations.len(); n != 0 {
+		t.Errorf("expected no pending invocations, got %d", n)
+	}
+
+	client.invocations.shutdown()
+	expectErrorMatch(t, &ShutdownError{}, client.Send(ctx, "Notify"))
+}
+
+func TestInvokeRaw(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := &recordingConn{writes: make(chan ClientMsg, 1)}
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: conn, state: &State{}, config: &cfg})
+
+	args := []json.RawMessage{json.RawMessage(`{"channel":"trades"}`), json.RawMessage(`7`)}
+
+	inv := client.InvokeRaw(ctx, "Subscribe", args)
+	if !expectNoError(t, inv.Exec()) {
+		return
+	}
+
+	msg := <-conn.writes
+	if msg.Method != "Subscribe" || msg.InvocationID != inv.id || len(msg.Args) != 2 ||
+		string(msg.Args[0]) != string(args[0]) || string(msg.Args[1]) != string(args[1]) {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	client.invocations.process(&Message{InvocationID: inv.id, Result: json.RawMessage(`true`)})
+
+	var ok bool
+	if expectNoError(t, inv.Unmarshal(&ok)) && !ok {
+		t.Error("expected true result")
+	}
+
+	if err := client.InvokeRaw(ctx, "Subscribe", []json.RawMessage{json.RawMessage(`{`)}).Exec(); err == nil {
+		t.Error("expected error for invalid argument")
+	}
+
+	if n := client.invocations.len(); n != 0 {
+		t.Errorf("expected no pending invocations, got %d", n)
+	}
+}
+
+func TestFaultInjector(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	dial := func(conn WebsocketConn, faults Faults) WebsocketConn {
+		dialer := FaultInjector(func(*http.Client) WebsocketDialer {
+			return &mockDialer{conn: conn}
+		}, faults)
+
+		res, _, err := dialer(http.DefaultClient).Dial(ctx, "ws://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	read := func(conn WebsocketConn) string {
+		_, data, err := conn.ReadMessage(ctx)
+		if err != nil {
+			return err.Error()
+		}
+
+		return string(data)
+	}
+
+	frames := func() *fakeConn {
+		return &fakeConn{results: []readResult{{msg: "1"}, {msg: "2"}, {msg: "3"}, {msg: "4"}}}
+	}
+
+	// every frame is delivered twice
+	conn := dial(frames(), Faults{DuplicateRate: 1})
+	for _, exp := range []string{"1", "1", "2", "2"} {
+		if frame := read(conn); frame != exp {
+			t.Errorf("expected frame %s, got %s", exp, frame)
+		}
+	}
+
+	// frames are dropped until the connection is disconnected
+	conn = dial(frames(), Faults{DropRate: 1, DisconnectAfter: 3})
+
+	_, _, err := conn.ReadMessage(ctx)
+
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || !closeErr.Temporary() {
+		t.Errorf("expected temporary CloseError, got %v", err)
+	}
+
+	// blocked read fails once the connection is disconnected by schedule
+	clock := &fakeClock{now: time.Unix(42, 0), timers: make(chan *fakeTimer, 1)}
+	conn = dial(blockingConn{}, Faults{DisconnectEvery: time.Minute, Clock: clock})
+
+	timer := <-clock.timers
+	timer.ch <- clock.now
+
+	if _, _, err := conn.ReadMessage(ctx); !IsCloseError(err, CloseAbnormal) {
+		t.Errorf("expected CloseError, got %v", err)
+	}
+
+	// connection is reestablished after injected disconnects, the test server
+	// sends a single frame per connection
+	ts := httptest.NewServer(wrapHandler(t, newCoreHandler(`{"type":1,"target":"notify","arguments":[1]}`+"\x1e")))
+	t.Cleanup(ts.Close)
+
+	c, err := Dial(ctx, ts.URL+"/hub", connectionData,
+		RetryInterval(retryInterval),
+		Dialer(FaultInjector(NewDefaultDialer, Faults{DisconnectAfter: 1, Rand: rand.New(rand.NewSource(1))})),
+	)
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	var msg Message
+	for i := 0; i < 3; i++ {
+		if !expectNoError(t, c.ReadMessage(ctx, &msg)) {
+			return
+		}
+
+		if len(msg.Messages) != 1 || msg.Messages[0].Method != "notify" {
+			t.Errorf("unexpected message %+v", msg)
+		}
+	}
+
+	if reconnects := c.stats.snapshot().Reconnects; reconnects != 2 {
+		t.Errorf("expected 2 reconnects, got %d", reconnects)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the test server sends a single frame per connection and then hangs
+	ts := httptest.NewServer(wrapHandler(t, newCoreHandler(`{"type":1,"target":"notify","arguments":[1]}`+"\x1e")))
+	t.Cleanup(ts.Close)
+
+	c, err := Dial(ctx, ts.URL+"/hub", connectionData, RetryInterval(retryInterval), ReadTimeout(50*time.Millisecond))
+	if !expectNoError(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	var msg Message
+	for i := 0; i < 2; i++ {
+		if !expectNoError(t, c.ReadMessage(ctx, &msg)) {
+			return
+		}
+	}
+
+	stats := c.stats.snapshot()
+	if stats.Reconnects != 1 {
+		t.Errorf("expected 1 reconnect, got %d", stats.Reconnects)
+	}
+
+	if !IsCloseError(stats.ReconnectReason, CloseAbnormal) {
+		t.Errorf("expected CloseError, got %v", stats.ReconnectReason)
+	}
+
+	// deadline of ctx takes precedence over the timeout
+	conn := withDeadlines(blockingConn{}, time.Hour, time.Hour)
+
+	rctx, rcancel := context.WithTimeout(ctx, time.Millisecond)
+	defer rcancel()
+
+	if _, _, err := conn.ReadMessage(rctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	conn = withDeadlines(blockingConn{}, time.Millisecond, 0)
+	if _, _, err := conn.ReadMessage(ctx); !IsCloseError(err, CloseAbnormal) {
+		t.Errorf("expected CloseError, got %v", err)
+	}
+
+	cfg := DefaultConfig()
+	ReadTimeout(-time.Second)(&cfg)
+	expectErrorMatch(t, &ConfigError{}, cfg.Validate())
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws := &exclusiveConn{}
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: ws, state: &State{}, config: &cfg})
+
+	var g errgroup.Group
+	for i := 0; i < 16; i++ {
+		i := i
+
+		g.Go(func() error {
+			if i%2 == 0 {
+				return client.Invoke(ctx, "method", i).Exec()
+			}
+
+			return client.Send(ctx, "method", i)
+		})
+	}
+
+	expectNoError(t, g.Wait())
+
+	if overlaps := atomic.LoadInt32(&ws.overlaps); overlaps != 0 {
+		t.Errorf("expected serialized writes, got %d overlapping", overlaps)
+	}
+}
+
+func TestPendingInvocations(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clock := &fakeClock{now: time.Unix(42, 0), timers: make(chan *fakeTimer, 1)}
+
+	cfg := newDefaultConfig()
+	cfg.Clock = clock
+
+	conn := &Conn{conn: &recordingConn{writes: make(chan ClientMsg, 2)}, state: &State{}, config: &cfg}
+	client := NewClient("hub", conn, InvocationTimeout(time.Minute))
+
+	slow := client.Invoke(ctx, "slow")
+	clock.now = clock.now.Add(30 * time.Second)
+	fast := client.Invoke(ctx, "fast")
+
+	expected := []PendingInvocation{
+		{ID: 1, Method: "slow", Age: 30 * time.Second},
+		{ID: 2, Method: "fast"},
+	}
+	if pending := client.PendingInvocations(); !reflect.DeepEqual(expected, pending) {
+		t.Errorf("expected pending invocations %+v, got %+v", expected, pending)
+	}
+
+	go client.invocations.expire(ctx, client.config.InvocationTimeout)
+
+	// the slow invocation becomes stale first
+	timer := <-clock.timers
+	clock.now = clock.now.Add(30 * time.Second)
+	timer.ch <- clock.now
+	<-clock.timers
+
+	var timeoutErr *InvocationTimeoutError
+	if err := slow.Unmarshal(nil); !errors.As(err, &timeoutErr) || timeoutErr.Age != time.Minute {
+		t.Errorf("expected InvocationTimeoutError after a minute, got %v", err)
+	}
+
+	expected = []PendingInvocation{{ID: 2, Method: "fast", Age: 30 * time.Second}}
+	if pending := client.PendingInvocations(); !reflect.DeepEqual(expected, pending) {
+		t.Errorf("expected pending invocations %+v, got %+v", expected, pending)
+	}
+
+	expectNoError(t, fast.Exec())
+}
+
+func TestCorrelationID(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var logged []interface{}
+
+	clock := &fakeClock{now: time.Unix(42, 0)}
+
+	cfg := newDefaultConfig()
+	cfg.Clock = clock
+	cfg.Logger = LoggerFunc(func(level LogLevel, msg string, keyvals ...interface{}) {
+		logged = keyvals
+	})
+
+	rec := &recordingConn{writes: make(chan ClientMsg, 1)}
+	client := NewClient("hub", &Conn{conn: rec, state: &State{}, config: &cfg})
+
+	inv := client.Invoke(WithCorrelationID(ctx, "trace-id"), "method")
+	if msg := <-rec.writes; msg.InvocationID != inv.id {
+		t.Fatalf("expected invocation %d to be sent, got %+v", inv.id, msg)
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	client.invocations.process(&Message{InvocationID: inv.id, Error: "failed"})
+
+	ev := <-client.Events()
+	completed, ok := ev.(InvocationCompleted)
+	if !ok || completed.Method != "method" || completed.ID != inv.id || completed.CorrelationID != "trace-id" || completed.Duration != time.Second {
+		t.Errorf("expected InvocationCompleted event of the invocation, got %+v", ev)
+	}
+
+	expectErrorMatch(t, &InvocationError{}, completed.Err)
+
+	expected := []interface{}{"hub", "hub", "method", "method", "invocation_id", inv.id, "duration", time.Second, "correlation_id", "trace-id", "error", completed.Err}
+	if !reflect.DeepEqual(expected, logged) {
+		t.Errorf("expected log keyvals %v, got %v", expected, logged)
+	}
+
+	// headers are sent only by Core protocol
+	msg := ClientMsg{Hub: "hub", Method: "method", InvocationID: 1, Headers: correlationHeaders(WithCorrelationID(ctx, "trace-id"))}
+
+	cases := []struct {
+		protocol protocol
+		expected string
+	}{
+		{classicProtocol{}, `{"I":1,"H":"hub","M":"method","A":null}`},
+		{coreProtocol{}, `{"type":1,"headers":{"correlation-id":"trace-id"},"invocationId":"1","target":"method","arguments":[]}` + "\x1e"},
+	}
+
+	for _, tc := range cases {
+		e := getEncoder()
+		if expectNoError(t, tc.protocol.marshal(e, msg)) && e.buf.String() != tc.expected {
+			t.Errorf("expected %s, got %s", tc.expected, e.buf.String())
+		}
+		putEncoder(e)
+	}
+
+	if headers := correlationHeaders(ctx); headers != nil {
+		t.Errorf("expected no headers without correlation ID, got %v", headers)
+	}
+}
+
+func TestInvokeNamed(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	args := map[string]interface{}{"symbol": "BTC", "quantity": 2, "raw": json.RawMessage(`[1]`)}
+
+	cfg := newDefaultConfig()
+	conn := &frameConn{frames: make(chan []byte, 1)}
+	client := NewClient("hub", &Conn{conn: conn, state: &State{}, config: &cfg})
+
+	inv := client.InvokeNamed(ctx, "placeOrder", args)
+
+	expected := `{"I":` + strconv.FormatUint(inv.id, 10) + `,"H":"hub","M":"placeOrder","A":{"quantity":2,"raw":[1],"symbol":"BTC"}}`
+	if frame := <-conn.frames; string(frame) != expected {
+		t.Fatalf("expected %s to be sent, got %s", expected, frame)
+	}
+
+	client.invocations.process(&Message{InvocationID: inv.id, Result: json.RawMessage(`true`)})
+
+	var ok bool
+	if expectNoError(t, inv.Unmarshal(&ok)) && !ok {
+		t.Error("expected result true")
+	}
+
+	failed := client.InvokeNamed(ctx, "placeOrder", map[string]interface{}{"quantity": math.Inf(1)})
+	expectErrorMatch(t, &json.UnsupportedValueError{}, failed.Exec())
+
+	// Core servers receive the object as the single argument
+	namedArgs, err := client.codec.marshalNamedArgs(args)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	e := getEncoder()
+	defer putEncoder(e)
+
+	expected = `{"type":1,"invocationId":"1","target":"placeOrder","arguments":[{"quantity":2,"raw":[1],"symbol":"BTC"}]}` + "\x1e"
+	if expectNoError(t, coreProtocol{}.marshal(e, ClientMsg{InvocationID: 1, Method: "placeOrder", NamedArgs: namedArgs})) && e.buf.String() != expected {
+		t.Errorf("expected %s, got %s", expected, e.buf.String())
+	}
+}
+
+func TestBytes(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		data        string
+		expected    []byte
+		expectedErr bool
+	}{
+		{name: "standard", data: `"+/8A"`, expected: []byte{0xfb, 0xff, 0x00}},
+		{name: "padded", data: `"+/8="`, expected: []byte{0xfb, 0xff}},
+		{name: "unpadded", data: `"+/8"`, expected: []byte{0xfb, 0xff}},
+		{name: "url-safe", data: `"-_8="`, expected: []byte{0xfb, 0xff}},
+		{name: "url-safe unpadded", data: `"-_8"`, expected: []byte{0xfb, 0xff}},
+		{name: "empty", data: `""`, expected: []byte{}},
+		{name: "array", data: `[251, 255]`, expected: []byte{0xfb, 0xff}},
+		{name: "null", data: `null`},
+		{name: "invalid base64", data: `"!!"`, expectedErr: true},
+		{name: "number", data: `1`, expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var b []byte
+			err := codec{}.unmarshal([]byte(tc.data), &b)
+
+			if tc.expectedErr {
+				if err == nil {
+					t.Errorf("expected error, got %v", b)
+				}
+
+				return
+			}
+
+			if expectNoError(t, err) && !reflect.DeepEqual(tc.expected, b) {
+				t.Errorf("expected %v, got %v", tc.expected, b)
+			}
+		})
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		cfg := newDefaultConfig()
+		client := NewClient("hub", &Conn{conn: &echoConn{results: make(chan []byte, 1)}, state: &State{}, config: &cfg})
+
+		go func() { _ = client.Run(ctx) }()
+
+		payload := []byte{0x00, 0xfb, 0xff, 0x10}
+
+		var res []byte
+		if expectNoError(t, client.Invoke(ctx, "echo", payload).Unmarshal(&res)) && !bytes.Equal(payload, res) {
+			t.Errorf("expected %v, got %v", payload, res)
+		}
+	})
+}
+
+func TestInvocationWriteTo(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: &echoConn{results: make(chan []byte, 1)}, state: &State{}, config: &cfg})
+
+	go func() { _ = client.Run(ctx) }()
+
+	snapshot := map[string][]float64{"bids": {1, 2}, "asks": {3, 4}}
+
+	var buf bytes.Buffer
+	n, err := client.Invoke(ctx, "echo", snapshot).WriteTo(&buf)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	expected := `{"asks":[3,4],"bids":[1,2]}`
+	if buf.String() != expected || n != int64(len(expected)) {
+		t.Errorf("expected %d bytes %s, got %d bytes %s", len(expected), expected, n, buf.String())
+	}
+
+	// the result can be decoded while it is written
+	r, w := io.Pipe()
+	go func() {
+		_, err := client.Invoke(ctx, "echo", snapshot).WriteTo(w)
+		_ = w.CloseWithError(err)
+	}()
+
+	var decoded map[string][]float64
+	if expectNoError(t, json.NewDecoder(r).Decode(&decoded)) && !reflect.DeepEqual(snapshot, decoded) {
+		t.Errorf("expected %v, got %v", snapshot, decoded)
+	}
+
+	failed := client.Invoke(ctx, "echo", math.Inf(1))
+	if _, err := failed.WriteTo(&buf); err == nil {
+		t.Error("expected error of invocation which failed to be sent")
+	}
+}
+
+func TestUnknownMessages(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		mode     UnknownMessageMode
+		events   []Event
+		expected error
+	}{
+		{name: "ignore", mode: IgnoreUnknown},
+		{
+			name:   "report",
+			mode:   ReportUnknown,
+			events: []Event{UnknownMessage{InvocationID: 42}, UnknownMessage{Method: "unknown"}},
+		},
+		{
+			name:     "fail",
+			mode:     FailOnUnknown,
+			events:   []Event{UnknownMessage{InvocationID: 42}, UnknownMessage{Method: "unknown"}},
+			expected: &UnknownMessageError{InvocationID: 42},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			cfg := newDefaultConfig()
+			client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg}, UnknownMessages(tc.mode))
+
+			stream, err := client.Callback(ctx, "known")
+			if !expectNoError(t, err) {
+				return
+			}
+			defer stream.Close()
+
+			expectNoError(t, client.dispatch(&Message{InvocationID: 42}))
+			expectNoError(t, client.dispatch(&Message{Messages: []ClientMsg{{Method: "known"}, {Method: "unknown"}}}))
+
+			var events []Event
+			for len(client.Events()) > 0 {
+				events = append(events, <-client.Events())
+			}
+
+			if !reflect.DeepEqual(tc.events, events) {
+				t.Errorf("expected events %+v, got %+v", tc.events, events)
+			}
+
+			var runErr error
+			select {
+			case runErr = <-client.errs:
+			default:
+			}
+
+			if !reflect.DeepEqual(tc.expected, runErr) {
+				t.Errorf("expected error %v, got %v", tc.expected, runErr)
+			}
+
+			if runErr != nil && !permanent(runErr) {
+				t.Errorf("expected error %v to be permanent", runErr)
+			}
+		})
+	}
+}
+
+func TestOnUnhandledMessage(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var unhandled []UnhandledMessage
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{}, config: &cfg}, OnUnhandledMessage(func(msg UnhandledMessage) {
+		unhandled = append(unhandled, msg)
+	}))
+
+	stream, err := client.Callback(ctx, "known")
+	if !expectNoError(t, err) {
+		return
+	}
+	defer stream.Close()
+
+	call := ClientMsg{Hub: "hub", Method: "updateBTC-USD", Args: []json.RawMessage{json.RawMessage(`42`)}}
+
+	expectNoError(t, client.dispatch(&Message{MessageID: "1", InvocationID: 42, Result: json.RawMessage(`"late"`)}))
+	expectNoError(t, client.dispatch(&Message{MessageID: "2", Messages: []ClientMsg{{Method: "known"}, call}}))
+
+	expected := []UnhandledMessage{
+		{Completion: &Message{InvocationID: 42, Result: json.RawMessage(`"late"`)}},
+		{Call: call},
+	}
+	if !reflect.DeepEqual(expected, unhandled) {
+		t.Errorf("expected unhandled messages %+v, got %+v", expected, unhandled)
+	}
+
+	// unknown messages are not reported by default
+	if n := len(client.Events()); n != 0 {
+		t.Errorf("expected no events, got %d", n)
+	}
+}
+
+func TestInvocationEpochs(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	conn := &Conn{conn: &recordingConn{writes: make(chan ClientMsg, 1)}, state: &State{}, config: &cfg, generation: 1}
+	client := NewClient("hub", conn)
+
+	lost := client.Invoke(ctx, "lost")
+	if !expectNoError(t, lost.Exec()) {
+		return
+	}
+
+	// renegotiate replaces the connection, which loses pending responses
+	next := &recordingConn{writes: make(chan ClientMsg, 1)}
+	conn.replace(next, &State{}, NegotiateInfo{}, 0)
+	conn.reconnectedHooks()
+
+	expectErrorMatch(t, &InvocationLostError{}, lost.Unmarshal(nil))
+
+	inv := client.Invoke(ctx, "method")
+	if msg := <-next.writes; msg.InvocationID != inv.id {
+		t.Fatalf("expected invocation %d sent over the new connection, got %+v", inv.id, msg)
+	}
+
+	// stale completion does not match new invocation
+	client.invocations.process(&Message{InvocationID: lost.id, Result: json.RawMessage(`"stale"`)})
+	client.invocations.process(&Message{InvocationID: inv.id, Result: json.RawMessage(`"fresh"`)})
+
+	var res string
+	if expectNoError(t, inv.Unmarshal(&res)) && res != "fresh" {
+		t.Errorf("expected fresh result, got %q", res)
+	}
+
+	// invocation sent over replaced connection fails once it is recorded
+	late, err := client.invocations.create(ctx, "late")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	client.invocations.sent(late, 1)
+	expectErrorMatch(t, &InvocationLostError{}, late.Unmarshal(nil))
+
+	// IDs of Core completions span 64 bits
+	var msg Message
+	m := coreMessage{Type: coreCompletion, InvocationID: "18446744073709551615"}
+	if _, err := m.decode(&msg); expectNoError(t, err) && msg.InvocationID != math.MaxUint64 {
+		t.Errorf("expected invocation ID %d, got %d", uint64(math.MaxUint64), msg.InvocationID)
+	}
+}
+
+func TestUseNumber(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	conn := &Conn{conn: &recordingConn{writes: make(chan ClientMsg, 1)}, state: &State{}, config: &cfg}
+	client := NewClient("hub", conn, UseNumber())
+
+	const price = "0.12345678901234567890"
+
+	stream, err := client.Callback(ctx, "update")
+	if !expectNoError(t, err) {
+		return
+	}
+
+	client.callbacks.process(&Message{Messages: []ClientMsg{{Method: "update", Args: []json.RawMessage{json.RawMessage(`{"price":` + price + `}`)}}}})
+
+	var update map[string]interface{}
+	if expectNoError(t, stream.Read(&update)) && update["price"] != json.Number(price) {
+		t.Errorf("expected price %s, got %#v", price, update["price"])
+	}
+
+	inv := client.Invoke(ctx, "price")
+	client.invocations.process(&Message{InvocationID: inv.id, Result: json.RawMessage(price)})
+
+	var res interface{}
+	if expectNoError(t, inv.Unmarshal(&res)) && res != json.Number(price) {
+		t.Errorf("expected result %s, got %#v", price, res)
+	}
+
+	if err := (codec{useNumber: true}).unmarshal([]byte(`1 2`), &res); err == nil {
+		t.Error("expected error for trailing data")
+	}
+}
+
+type cents int64
+
+func TestTypeCodec(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	encodeCents := func(v cents) ([]byte, error) {
+		return []byte(fmt.Sprintf(`"%d.%02d"`, v/100, v%100)), nil
+	}
+
+	decodeCents := func(data []byte) (cents, error) {
+		var units, hundredths int64
+		if _, err := fmt.Sscanf(string(data), `"%d.%d"`, &units, &hundredths); err != nil {
+			return 0, err
+		}
+
+		return cents(units*100 + hundredths), nil
+	}
+
+	writes := make(chan ClientMsg, 1)
+	cfg := newDefaultConfig()
+	conn := &Conn{conn: &recordingConn{writes: writes}, state: &State{}, config: &cfg}
+	client := NewClient("hub", conn, DotNetDate(), TypeCodec(encodeCents, decodeCents))
+
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	inv := client.Invoke(ctx, "buy", cents(1250), date, 3)
+
+	msg := <-writes
+	for i, exp := range []string{`"12.50"`, `"\/Date(1577836800000)\/"`, `3`} {
+		if string(msg.Args[i]) != exp {
+			t.Errorf("expected argument %d to be %s, got %s", i, exp, msg.Args[i])
+		}
+	}
+
+	client.invocations.process(&Message{InvocationID: inv.id, Result: json.RawMessage(`"7.05"`)})
+
+	var price cents
+	if expectNoError(t, inv.Unmarshal(&price)) && price != 705 {
+		t.Errorf("expected price 705, got %d", price)
+	}
+
+	cases := []struct {
+		data string
+		exp  time.Time
+	}{
+		{`"\/Date(1577836800000)\/"`, date},
+		{`"/Date(-1000)/"`, time.Unix(-1, 0)},
+		{`"/Date(1577836800000+0130)/"`, date.In(time.FixedZone("", 90*60))},
+		{`"/Date(1577836800000-0500)/"`, date.In(time.FixedZone("", -5*60*60))},
+		{`"2020-01-01T00:00:00Z"`, date},
+	}
+
+	for _, c := range cases {
+		var res time.Time
+		if err := client.codec.unmarshal([]byte(c.data), &res); err != nil {
+			t.Errorf("unexpected error decoding %s: %v", c.data, err)
+			continue
+		}
+
+		_, offset := res.Zone()
+		_, expOffset := c.exp.Zone()
+
+		if !res.Equal(c.exp) || offset != expOffset {
+			t.Errorf("expected %s to decode to %v, got %v", c.data, c.exp, res)
+		}
+	}
+
+	for _, data := range []string{`"/Date(x)/"`, `"/Date(1+01)/"`, `1`} {
+		var res time.Time
+		if err := client.codec.unmarshal([]byte(data), &res); err == nil {
+			t.Errorf("expected error decoding %s", data)
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	ws := &frameConn{frames: make(chan []byte, 2)}
+	cfg := newDefaultConfig()
+	conn := &Conn{conn: ws, state: &State{}, config: &cfg}
+
+	raw := json.RawMessage(`{"a": 1}`)
+
+	args, err := codec{}.marshalArgs([]interface{}{raw, "b"})
+	if !expectNoError(t, err) {
+		return
+	}
+
+	if &args[0][0] != &raw[0] {
+		t.Error("expected raw argument to be used as is")
+	}
+
+	msg := ClientMsg{InvocationID: 1, Hub: "hub", Method: "method", Args: args}
+	if !expectNoError(t, conn.WriteMessage(ctx, msg)) {
+		return
+	}
+
+	expected, err := json.Marshal(msg)
+	if !expectNoError(t, err) {
+		return
+	}
+
+	if frame := <-ws.frames; !bytes.Equal(expected, frame) {
+		t.Errorf("expected frame %s, got %s", expected, frame)
+	}
+
+	msg.Args = []json.RawMessage{json.RawMessage(`{invalid`)}
+	expectErrorMatch(t, &WriteError{}, conn.WriteMessage(ctx, msg))
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	const payload = `{"H":"hub","M":"update","A":[{"symbol":"BTC-USD","bids":[[42000.5,1.25],[41999,0.5]],"asks":[[42001,2]],"sequence":123456}]}`
+
+	conns := []struct {
+		name  string
+		proto protocol
+		conn  WebsocketConn
+	}{
+		{"classic", classicProtocol{}, repeatConn(`{"C":"d-1,0|A,0","M":[` + payload + `]}`)},
+		{"core", coreProtocol{}, &recordConn{WebsocketConn: repeatConn(`{"type":1,"target":"update","arguments":[{"symbol":"BTC-USD","bids":[[42000.5,1.25],[41999,0.5]],"asks":[[42001,2]],"sequence":123456}]}` + "\x1e")}},
+		{"classic keepalive", classicProtocol{}, &cycleConn{frames: [][]byte{[]byte(`{}`), []byte(`{"C":"d-1,0|A,0","M":[]}`)}}},
+		{"core ping", coreProtocol{}, &recordConn{WebsocketConn: &cycleConn{frames: [][]byte{[]byte(corePingRecord), []byte(`{"type":3,"invocationId":"1"}` + "\x1e")}}}},
+	}
+
+	for _, c := range conns {
+		c := c
+
+		b.Run(c.name, func(b *testing.B) {
+			ctx := context.Background()
+			b.ReportAllocs()
+
+			var msg Message
+			for i := 0; i < b.N; i++ {
+				if err := c.proto.read(ctx, c.conn, &msg, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCallbackDispatch(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: blockingConn{}, state: &State{}, config: &cfg})
+
+	stream, err := client.Callback(ctx, "update")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var update struct {
+			Sequence int `json:"sequence"`
+		}
+		for {
+			if err := stream.Read(&update); err != nil {
+				return
+			}
+		}
+	}()
+
+	msg := &Message{Messages: []ClientMsg{{Method: "update", Args: []json.RawMessage{json.RawMessage(`{"sequence":123456}`)}}}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		client.callbacks.process(msg)
+	}
+
+	b.StopTimer()
+	stream.Close()
+	<-done
+}
+
+func BenchmarkInvoke(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := newDefaultConfig()
+	client := NewClient("hub", &Conn{conn: &echoConn{results: make(chan []byte, 1)}, state: &State{}, config: &cfg})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = client.Run(ctx)
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var res string
+	for i := 0; i < b.N; i++ {
+		if err := client.Invoke(ctx, "echo", "ping").Unmarshal(&res); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+	cancel()
+	<-done
+}
+
+func BenchmarkMarshalArgs(b *testing.B) {
+	type order struct {
+		Symbol   string  `json:"symbol"`
+		Price    float64 `json:"price"`
+		Quantity float64 `json:"quantity"`
+	}
+
+	args := []interface{}{"BTC-USD", 42, order{Symbol: "BTC-USD", Price: 42000.5, Quantity: 1.25}, json.RawMessage(`{"raw":true}`)}
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := (codec{}).marshalArgs(args); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func FuzzMessage(f *testing.F) {
+	for _, seed := range []string{
+		`{}`,
+		`{"C":"d-1,0|A,0","G":"token","M":[{"H":"hub","M":"method","A":[1,"a",{"b":null}]}]}`,
+		`{"I":"1","R":{"a":1},"E":"failed","H":true,"D":{"detail":1},"T":"trace"}`,
+		`{"C":"1","D":1}`,
+		`{"S":1,"M":[]}`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := &fakeConn{results: []readResult{{msgType: textMessage, msg: string(data)}}}
+
+		var msg Message
+		if err := readMessage(context.Background(), conn, &msg, nil); err != nil {
+			return
+		}
+
+		// decoded message can be decoded again once encoded
+		encoded, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var again Message
+		if err := json.Unmarshal(encoded, &again); err != nil {
+			t.Fatalf("failed to decode %s: %v", encoded, err)
+		}
+	})
+}
+
+func FuzzClientMsg(f *testing.F) {
+	for _, seed := range []string{
+		`{"I":1,"H":"hub","M":"method","A":[]}`,
+		`{"H":"hub","M":"method","A":[1,"a",{"b":[true]}],"S":{"c":1}}`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg ClientMsg
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return
+		}
+
+		for _, proto := range []protocol{classicProtocol{}, coreProtocol{}} {
+			e := getEncoder()
+			if err := proto.marshal(e, msg); err != nil {
+				t.Fatalf("failed to encode %+v: %v", msg, err)
+			}
+			putEncoder(e)
+		}
+	})
+}
+
+func FuzzNegotiateResponse(f *testing.F) {
+	for _, seed := range []string{
+		`{"Url":"/signalr","ConnectionToken":"token","ConnectionId":"id","KeepAliveTimeout":20,"DisconnectTimeout":30,"ProtocolVersion":"1.5"}`,
+		`{"negotiateVersion":1,"connectionId":"id","connectionToken":"token","availableTransports":[]}`,
+		`{"KeepAliveTimeout":1e308,"DisconnectTimeout":-1}`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var res negotiateResponse
+		if err := json.Unmarshal(data, &res); err != nil {
+			return
+		}
+
+		info := res.info()
+		if info.KeepAliveTimeout < 0 || info.DisconnectTimeout < 0 || info.ConnectionTimeout < 0 ||
+			info.TransportConnectTimeout < 0 || info.LongPollDelay < 0 {
+			t.Errorf("negative timeout in %+v", info)
+		}
+	})
+}
+
+func FuzzCoreProtocol(f *testing.F) {
+	for _, seed := range []string{
+		"{}\x1e",
+		"{\"error\":\"unsupported\"}\x1e",
+		"{}\x1e{\"type\":1,\"target\":\"notify\",\"arguments\":[1]}\x1e{\"type\":6}\x1e",
+		"{}\x1e{\"type\":3,\"invocationId\":\"1\",\"result\":2}\x1e",
+		"{}\x1e{\"type\":7,\"error\":\"closing\",\"allowReconnect\":true}\x1e",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ctx := context.Background()
+		conn := &fakeConn{results: []readResult{{msgType: textMessage, msg: string(data)}, {err: io.EOF}}}
+
+		proto := coreProtocol{}
+
+		rc, err := proto.handshake(ctx, &Conn{config: &Config{}}, conn, "", &State{})
+		if err != nil {
+			return
+		}
+
+		for {
+			var msg Message
+			if err := proto.read(ctx, rc, &msg, nil); err != nil {
 				return
 			}
+		}
+	})
+}
 
-			if !expectNoError(t, err) {
-				return
-			}
+type mockDialer struct {
+	conn    WebsocketConn
+	results []dialResult
+}
 
-			if tc.url != req.URL.String() {
-				t.Errorf("expected request url %q, got %q", tc.url, req.URL)
-			}
+// recordingDialer records paths of dialed endpoints.
+type recordingDialer struct {
+	mockDialer
 
-			if !reflect.DeepEqual(tc.headers, req.Header) {
-				t.Errorf("expected request headers %+v, got %+v", tc.headers, req.Header)
-			}
-		})
+	mtx   sync.Mutex
+	paths []string
+}
+
+func (d *recordingDialer) Dial(ctx context.Context, endpoint string, headers http.Header) (WebsocketConn, int, error) {
+	if u, err := url.Parse(endpoint); err == nil {
+		d.mtx.Lock()
+		d.paths = append(d.paths, path.Base(u.Path))
+		d.mtx.Unlock()
 	}
+
+	return d.mockDialer.Dial(ctx, endpoint, headers)
 }
 
-type mockDialer struct {
-	conn    WebsocketConn
-	results []dialResult
+func (d *recordingDialer) commands() []string {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	return append([]string(nil), d.paths...)
 }
 
 type dialResult struct {
@@ -577,6 +6396,223 @@ func (d *mockDialer) Dial(ctx context.Context, endpoint string, headers http.Hea
 type fakeConn struct {
 	msg     string
 	results []readResult
+
+	// called with every written frame, if set
+	written func(data []byte)
+}
+
+// blockingConn blocks reads until context is done.
+type blockingConn struct{}
+
+func (blockingConn) ReadMessage(ctx context.Context) (int, []byte, error) {
+	<-ctx.Done()
+	return 0, nil, ctx.Err()
+}
+
+func (blockingConn) WriteMessage(context.Context, int, []byte) error {
+	return nil
+}
+
+func (blockingConn) Close() error {
+	return nil
+}
+
+// repeatConn reads the same text frame over and over.
+type repeatConn string
+
+func (c repeatConn) ReadMessage(context.Context) (int, []byte, error) {
+	return textMessage, []byte(c), nil
+}
+
+func (repeatConn) WriteMessage(context.Context, int, []byte) error {
+	return nil
+}
+
+func (repeatConn) Close() error {
+	return nil
+}
+
+// cycleConn returns frames in a loop.
+type cycleConn struct {
+	repeatConn
+	frames [][]byte
+	next   int
+}
+
+func (c *cycleConn) ReadMessage(context.Context) (int, []byte, error) {
+	frame := c.frames[c.next%len(c.frames)]
+	c.next++
+
+	return textMessage, frame, nil
+}
+
+// echoConn is an in-memory server completing every invocation with its first
+// argument.
+type echoConn struct {
+	results chan []byte
+}
+
+func (c *echoConn) ReadMessage(ctx context.Context) (int, []byte, error) {
+	select {
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	case data := <-c.results:
+		return textMessage, data, nil
+	}
+}
+
+func (c *echoConn) WriteMessage(ctx context.Context, _ int, data []byte) error {
+	var msg ClientMsg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+
+	res := []byte(`{"I":"` + strconv.FormatUint(msg.InvocationID, 10) + `","R":` + string(msg.Args[0]) + `}`)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case c.results <- res:
+		return nil
+	}
+}
+
+func (c *echoConn) Close() error {
+	return nil
+}
+
+// frameConn blocks reads until context is done and records written frames.
+type frameConn struct {
+	blockingConn
+	frames chan []byte
+}
+
+func (c *frameConn) WriteMessage(_ context.Context, _ int, data []byte) error {
+	c.frames <- append([]byte(nil), data...)
+	return nil
+}
+
+// scriptedConn returns reads in order and then blocks until context is done.
+type scriptedConn struct {
+	blockingConn
+	reads []string
+}
+
+func (c *scriptedConn) ReadMessage(ctx context.Context) (int, []byte, error) {
+	if len(c.reads) == 0 {
+		return c.blockingConn.ReadMessage(ctx)
+	}
+
+	p := c.reads[0]
+	c.reads = c.reads[1:]
+
+	return textMessage, []byte(p), nil
+}
+
+// exclusiveConn blocks reads until context is done and counts writes
+// overlapping with other writes.
+type exclusiveConn struct {
+	blockingConn
+	writing  int32
+	overlaps int32
+}
+
+func (c *exclusiveConn) WriteMessage(context.Context, int, []byte) error {
+	if !atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
+		atomic.AddInt32(&c.overlaps, 1)
+		return nil
+	}
+
+	time.Sleep(time.Millisecond)
+	atomic.StoreInt32(&c.writing, 0)
+
+	return nil
+}
+
+// recordingConn blocks reads until context is done and records written
+// client messages.
+type recordingConn struct {
+	blockingConn
+
+	mtx    sync.Mutex
+	sent   []ClientMsg
+	writes chan ClientMsg
+}
+
+func (c *recordingConn) WriteMessage(ctx context.Context, _ int, data []byte) error {
+	var msg ClientMsg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	c.sent = append(c.sent, msg)
+	c.mtx.Unlock()
+
+	c.writes <- msg
+
+	return nil
+}
+
+// streamConn implements StreamReader, failing reads of whole messages.
+type streamConn struct {
+	fakeConn
+}
+
+func (c *streamConn) ReadMessage(context.Context) (int, []byte, error) {
+	return 0, nil, errors.New("unexpected buffered read")
+}
+
+func (c *streamConn) NextReader(ctx context.Context) (int, io.Reader, error) {
+	msgType, p, err := c.fakeConn.ReadMessage(ctx)
+	return msgType, bytes.NewReader(p), err
+}
+
+// testAuthenticator performs two round trip challenge-response handshake.
+type testAuthenticator struct {
+	fail bool
+}
+
+func (a testAuthenticator) Authorize(_ context.Context, _ *http.Request, challenges []string) (string, error) {
+	switch {
+	case len(challenges) == 0:
+		return "Test type1", nil
+	case a.fail:
+		return "", errors.New("invalid challenge")
+	case challenges[0] == "Test challenge":
+		return "Test type3", nil
+	default:
+		return "", nil
+	}
+}
+
+// fakeClock returns fixed time and timers which fire only when told to.
+type fakeClock struct {
+	now    time.Time
+	timers chan *fakeTimer
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(time.Duration) Timer {
+	timer := &fakeTimer{ch: make(chan time.Time, 1)}
+	c.timers <- timer
+
+	return timer
+}
+
+type fakeTimer struct {
+	ch chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	return true
 }
 
 type readResult struct {
@@ -605,7 +6641,11 @@ func (c *fakeConn) ReadMessage(ctx context.Context) (msgType int, p []byte, err
 	return msgType, p, r.err
 }
 
-func (c *fakeConn) WriteMessage(context.Context, int, []byte) (err error) {
+func (c *fakeConn) WriteMessage(_ context.Context, _ int, data []byte) (err error) {
+	if c.written != nil {
+		c.written(data)
+	}
+
 	return
 }
 
@@ -621,14 +6661,223 @@ func wrapHandler(t testing.TB, handler testHandlerFunc) http.HandlerFunc {
 	}
 }
 
+// newCoreHandler returns handler of an ASP.NET Core hub, which sends records
+// following handshake response, the n-th connection gets the n-th records or
+// the last ones, and completes invocations echoing their first argument, or
+// failing those of "fail" method. Results of client methods are passed back
+// as calls of "completed" method.
+func newCoreHandler(records ...string) testHandlerFunc {
+	var connections int32
+
+	return func(t testing.TB, w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/negotiate") {
+			if r.Method != http.MethodPost || r.URL.Query().Get("negotiateVersion") != "1" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"negotiateVersion":1,"connectionId":"` + connectionID + `","connectionToken":"` + connectionToken + `","availableTransports":[{"transport":"WebSockets","transferFormats":["Text"]}]}`))
+
+			return
+		}
+
+		if r.URL.Query().Get("id") != connectionToken {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		upgrader := websocket.Upgrader{}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+
+		if _, p, err := ws.ReadMessage(); err != nil || string(p) != `{"protocol":"json","version":1}`+"\x1e" {
+			t.Errorf("unexpected handshake %q: %v", p, err)
+			return
+		}
+
+		n := int(atomic.AddInt32(&connections, 1)) - 1
+		if n >= len(records) {
+			n = len(records) - 1
+		}
+
+		if err := ws.WriteMessage(websocket.TextMessage, []byte("{}\x1e"+records[n])); err != nil {
+			return
+		}
+
+		for {
+			_, p, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var msg coreInvocationMessage
+			if err := json.Unmarshal(bytes.TrimSuffix(p, []byte{recordSeparator}), &msg); err != nil {
+				t.Errorf("invalid message %q: %v", p, err)
+				return
+			}
+
+			// results of client methods are passed back to the client
+			if msg.Type == coreCompletion {
+				res := coreInvocationMessage{Type: coreInvocation, Target: "completed", Arguments: []json.RawMessage{bytes.TrimSuffix(p, []byte{recordSeparator})}}
+
+				data, _ := json.Marshal(res)
+				if err := ws.WriteMessage(websocket.TextMessage, append(data, recordSeparator)); err != nil {
+					return
+				}
+
+				continue
+			}
+
+			if msg.InvocationID == "" {
+				continue
+			}
+
+			res := coreMessage{Type: coreCompletion, InvocationID: msg.InvocationID}
+			if msg.Target == "fail" {
+				res.Error = "failed"
+			} else {
+				res.Result = msg.Arguments[0]
+			}
+
+			data, _ := json.Marshal(res)
+			if err := ws.WriteMessage(websocket.TextMessage, append(data, recordSeparator)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// newStatefulHandler returns handler of an ASP.NET Core hub supporting
+// stateful reconnect, which sends two calls of "notify" method and drops the
+// first connection once it receives an invocation. Over the reconnected one
+// it expects the invocation to be sent again, sends again the second call
+// followed by a new one and the completion, and reports acknowledgements.
+func newStatefulHandler(acks chan<- uint64) testHandlerFunc {
+	var connections int32
+
+	return func(t testing.TB, w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/negotiate") {
+			if r.Method != http.MethodPost || r.URL.Query().Get("useStatefulReconnect") != "true" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"negotiateVersion":1,"connectionId":"` + connectionID + `","connectionToken":"` + connectionToken + `","useStatefulReconnect":true,"availableTransports":[{"transport":"WebSockets","transferFormats":["Text"]}]}`))
+
+			return
+		}
+
+		if r.URL.Query().Get("id") != connectionToken {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		upgrader := websocket.Upgrader{}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+
+		read := func() (coreInvocationMessage, []byte) {
+			for {
+				_, p, err := ws.ReadMessage()
+				if err != nil {
+					return coreInvocationMessage{}, nil
+				}
+
+				var msg coreInvocationMessage
+				if err := json.Unmarshal(bytes.TrimSuffix(p, []byte{recordSeparator}), &msg); err != nil {
+					t.Errorf("invalid message %q: %v", p, err)
+					return coreInvocationMessage{}, nil
+				}
+
+				if msg.Type != corePing {
+					return msg, p
+				}
+			}
+		}
+
+		if atomic.AddInt32(&connections, 1) == 1 {
+			if _, p, err := ws.ReadMessage(); err != nil || string(p) != `{"protocol":"json","version":2}`+"\x1e" {
+				t.Errorf("unexpected handshake %q: %v", p, err)
+				return
+			}
+
+			_ = ws.WriteMessage(websocket.TextMessage, []byte("{}\x1e"+
+				`{"type":1,"target":"notify","arguments":[1]}`+"\x1e"+
+				`{"type":1,"target":"notify","arguments":[2]}`+"\x1e"))
+
+			// connection drops without close frame once the invocation
+			// is received
+			if msg, _ := read(); msg.Target != "echo" {
+				t.Errorf("unexpected message %+v", msg)
+			}
+
+			_ = ws.UnderlyingConn().Close()
+
+			return
+		}
+
+		// reconnected connection resumes without handshake
+		if _, p := read(); string(p) != `{"type":9,"sequenceId":1}`+"\x1e" {
+			t.Errorf("expected sequence message, got %q", p)
+			return
+		}
+
+		msg, _ := read()
+		if msg.Target != "echo" {
+			t.Errorf("expected invocation sent again, got %+v", msg)
+			return
+		}
+
+		res, _ := json.Marshal(coreMessage{Type: coreCompletion, InvocationID: msg.InvocationID, Result: msg.Arguments[0]})
+
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(`{"type":9,"sequenceId":2}`+"\x1e"+
+			`{"type":1,"target":"notify","arguments":[2]}`+"\x1e"+
+			`{"type":1,"target":"notify","arguments":[3]}`+"\x1e"+
+			string(res)+"\x1e"))
+
+		for {
+			var ack struct {
+				Type       int    `json:"type"`
+				SequenceID uint64 `json:"sequenceId"`
+			}
+
+			_, p, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if err := json.Unmarshal(bytes.TrimSuffix(p, []byte{recordSeparator}), &ack); err == nil && ack.Type == coreAck {
+				acks <- ack.SequenceID
+			}
+		}
+	}
+}
+
 type rootHandler struct {
 	mtx     sync.Mutex
 	conn    WebsocketConn
-	started bool
+	started WebsocketConn
+
+	// the number of connections being upgraded, signalled by connected once
+	// it drops
+	connecting int
+	connected  *sync.Cond
 }
 
 func newRootHandler() testHandlerFunc {
-	handler := rootHandler{}
+	handler := &rootHandler{}
+	handler.connected = sync.NewCond(&handler.mtx)
+
 	return handler.ServeHTTP
 }
 
@@ -642,6 +6891,8 @@ func (h *rootHandler) ServeHTTP(t testing.TB, w http.ResponseWriter, r *http.Req
 		h.connect(t, w, r)
 	case strings.Contains(r.URL.Path, "/start"):
 		h.start(t, w, r)
+	case strings.Contains(r.URL.Path, "/abort"):
+		w.WriteHeader(http.StatusOK)
 	default:
 		w.WriteHeader(http.StatusNotFound)
 	}
@@ -649,9 +6900,11 @@ func (h *rootHandler) ServeHTTP(t testing.TB, w http.ResponseWriter, r *http.Req
 
 func (h *rootHandler) negotiate(t testing.TB, w http.ResponseWriter, _ *http.Request) {
 	data, err := json.Marshal(negotiateResponse{
-		ConnectionToken: connectionToken,
-		ConnectionID:    connectionID,
-		ProtocolVersion: protocolVersion,
+		ConnectionToken:   connectionToken,
+		ConnectionID:      connectionID,
+		ProtocolVersion:   protocolVersion,
+		KeepAliveTimeout:  20,
+		DisconnectTimeout: 30,
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -663,16 +6916,31 @@ func (h *rootHandler) negotiate(t testing.TB, w http.ResponseWriter, _ *http.Req
 }
 
 func (h *rootHandler) connect(t testing.TB, w http.ResponseWriter, req *http.Request) {
+	// client may send start request as soon as it receives upgrade response,
+	// so start has to wait until the new connection is recorded
+	h.mtx.Lock()
+	h.connecting++
+	h.mtx.Unlock()
+
 	upgrader := websocket.Upgrader{}
 
 	var err error
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
+		h.mtx.Lock()
+		h.connecting--
+		h.connected.Broadcast()
+		h.mtx.Unlock()
+
 		t.Fatal(err)
 	}
 
+	wsConn := &serverConn{WebsocketConn: &defaultConn{Conn: conn}}
+
 	h.mtx.Lock()
-	h.conn = &defaultConn{Conn: conn}
+	h.conn = wsConn
+	h.connecting--
+	h.connected.Broadcast()
 	h.mtx.Unlock()
 
 	errg, ctx := errgroup.WithContext(req.Context())
@@ -684,7 +6952,7 @@ func (h *rootHandler) connect(t testing.TB, w http.ResponseWriter, req *http.Req
 			default:
 			}
 
-			if _, _, err := h.conn.ReadMessage(ctx); err != nil {
+			if _, _, err := wsConn.ReadMessage(ctx); err != nil {
 				return err
 			}
 		}
@@ -699,14 +6967,14 @@ func (h *rootHandler) connect(t testing.TB, w http.ResponseWriter, req *http.Req
 			}
 
 			h.mtx.Lock()
-			started := h.started
+			started := h.started == wsConn
 			h.mtx.Unlock()
 
 			if !started {
 				continue
 			}
 
-			err := h.writeMessage(ctx, Message{
+			err := h.writeMessage(ctx, wsConn, Message{
 				GroupsToken: groupsToken,
 				MessageID:   strconv.FormatInt(int64(messageID), 10),
 			})
@@ -723,7 +6991,11 @@ func (h *rootHandler) connect(t testing.TB, w http.ResponseWriter, req *http.Req
 
 func (h *rootHandler) start(t testing.TB, w http.ResponseWriter, req *http.Request) {
 	h.mtx.Lock()
-	h.started = false
+	for h.connecting != 0 {
+		h.connected.Wait()
+	}
+
+	h.started = nil
 	conn := h.conn
 	h.mtx.Unlock()
 
@@ -742,25 +7014,36 @@ func (h *rootHandler) start(t testing.TB, w http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	if err := h.writeMessage(req.Context(), Message{Status: statusStarted}); err != nil {
+	if err := h.writeMessage(req.Context(), conn, Message{Status: statusStarted}); err != nil {
 		t.Fatal(err)
 	}
 
 	h.mtx.Lock()
-	h.started = true
+	h.started = conn
 	h.mtx.Unlock()
 }
 
-func (h *rootHandler) writeMessage(ctx context.Context, msg Message) error {
+func (h *rootHandler) writeMessage(ctx context.Context, conn WebsocketConn, msg Message) error {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
-	h.mtx.Lock()
-	defer h.mtx.Unlock()
+	return conn.WriteMessage(ctx, textMessage, data)
+}
+
+// serverConn serializes writes of the test server to a websocket connection,
+// without blocking other connections while the client is not reading.
+type serverConn struct {
+	WebsocketConn
+	wmtx sync.Mutex
+}
+
+func (c *serverConn) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
 
-	return h.conn.WriteMessage(ctx, textMessage, data)
+	return c.WebsocketConn.WriteMessage(ctx, messageType, data)
 }
 
 func errorResponse(status int, paths ...string) testHandlerFunc {
@@ -809,6 +7092,22 @@ func response(response string, paths ...string) testHandlerFunc {
 	}
 }
 
+// responseOnce writes response to the first request matching paths.
+func responseOnce(response string, paths ...string) testHandlerFunc {
+	var done int64
+
+	handler := newRootHandler()
+
+	return func(t testing.TB, w http.ResponseWriter, req *http.Request) {
+		if !pathMatches(req, paths) || !atomic.CompareAndSwapInt64(&done, 0, 1) {
+			handler(t, w, req)
+			return
+		}
+
+		_, _ = w.Write([]byte(response))
+	}
+}
+
 func timeout(timeout time.Duration, paths ...string) testHandlerFunc {
 	handler := newRootHandler()
 
@@ -839,8 +7138,15 @@ func pathMatches(req *http.Request, paths []string) bool {
 func expectErrorMatch(t testing.TB, expected, actual error) {
 	t.Helper()
 
-	if !errors.As(actual, &expected) {
-		t.Errorf("expected error %+v, got: %+v", expected, actual)
+	target := reflect.New(reflect.TypeOf(expected))
+	if !errors.As(actual, target.Interface()) {
+		t.Errorf("expected error %T, got: %+v", expected, actual)
+		return
+	}
+
+	// untyped errors are told apart only by their messages
+	if plain, ok := target.Elem().Interface().(error); ok && reflect.TypeOf(expected) == reflect.TypeOf(errors.New("")) && plain.Error() != expected.Error() {
+		t.Errorf("expected error %q, got: %+v", expected, actual)
 	}
 }
 
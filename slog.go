@@ -0,0 +1,31 @@
+//go:build go1.21
+
+package signalr
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLogger adapts slog logger to Logger. Messages are logged along with the
+// connection ID and, where they apply, hub, method and invocation ID:
+//
+//	signalr.Logging(signalr.SlogLogger(slog.Default()))
+func SlogLogger(logger *slog.Logger) Logger {
+	return LoggerFunc(func(level LogLevel, msg string, keyvals ...interface{}) {
+		logger.Log(context.Background(), slogLevel(level), msg, keyvals...)
+	})
+}
+
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelInfo:
+		return slog.LevelInfo
+	case LevelWarn:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
@@ -0,0 +1,55 @@
+//go:build go1.21
+
+package signalr
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+
+			return attr
+		},
+	})
+
+	cfg := newDefaultConfig()
+	cfg.Logger = SlogLogger(slog.New(handler))
+	client := NewClient("hub", &Conn{conn: &fakeConn{}, state: &State{ConnectionID: "connection-id"}, config: &cfg})
+
+	client.conn.log(LevelDebug, "connection message")
+	client.log(LevelWarn, "method message", "method", "method", "invocation_id", uint64(42))
+
+	expected := []map[string]interface{}{
+		{"level": "DEBUG", "msg": "connection message", "connection_id": "connection-id"},
+		{"level": "WARN", "msg": "method message", "connection_id": "connection-id", "hub": "hub", "method": "method", "invocation_id": 42.0},
+	}
+
+	var logged []map[string]interface{}
+
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var record map[string]interface{}
+		if err := dec.Decode(&record); !expectNoError(t, err) {
+			return
+		}
+
+		logged = append(logged, record)
+	}
+
+	if !reflect.DeepEqual(expected, logged) {
+		t.Errorf("expected logged %v, got %v", expected, logged)
+	}
+}
@@ -0,0 +1,351 @@
+package signalr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// defaultReplayBufferSize is the number of bytes of unacknowledged messages
+// buffered by StatefulReconnect with non-positive buffer size, matching the
+// default of the official clients.
+const defaultReplayBufferSize = 100000
+
+// sequenced reports whether messages of given type of the Core JSON hub
+// protocol are counted by stateful reconnect: invocations, stream items,
+// completions, stream invocations and cancel invocations.
+func sequenced(messageType int) bool {
+	return messageType >= coreInvocation && messageType <= coreCancelInvocation
+}
+
+// countSequenced returns the number of messages counted by stateful reconnect
+// in frame of messages terminated by the record separator.
+func countSequenced(data []byte) uint64 {
+	var n uint64
+	for _, record := range bytes.Split(data, []byte{recordSeparator}) {
+		// pings, the most frequent messages, are not counted
+		if len(record) == 0 || string(record) == corePingMessage {
+			continue
+		}
+
+		var m struct {
+			Type int `json:"type"`
+		}
+		if err := json.Unmarshal(record, &m); err == nil && sequenced(m.Type) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// sequenceRecord returns message of given type carrying sequence ID,
+// terminated by the record separator.
+func sequenceRecord(messageType int, id uint64) []byte {
+	return []byte(`{"type":` + strconv.Itoa(messageType) + `,"sequenceId":` + strconv.FormatUint(id, 10) + "}\x1e")
+}
+
+// sentFrame is a frame sent to the server carrying messages with sequence IDs
+// from first to last.
+type sentFrame struct {
+	data        []byte
+	first, last uint64
+}
+
+// session keeps messages exchanged with ASP.NET Core server over connection
+// supporting stateful reconnect, so that messages the other side missed while
+// the connection was dropped are sent again once it is reestablished. It
+// outlives websocket connections replaced by reconnect, while connections
+// replaced by running the whole connection sequence start a new one.
+type session struct {
+	mtx sync.Mutex
+
+	// frames not acknowledged by the server, the oldest first, and their
+	// total size, limited by limit
+	unacked []sentFrame
+	size    int
+	limit   int
+
+	// closed once acknowledged frames are dropped or the session ends
+	freed chan struct{}
+
+	// sequence ID of the next message sent
+	next uint64
+
+	// sequence ID of the next message received, of the latest one processed
+	// and of the latest one acknowledged to the server
+	receiving uint64
+	received  uint64
+	acked     uint64
+}
+
+func newSession(limit int) *session {
+	if limit <= 0 {
+		limit = defaultReplayBufferSize
+	}
+
+	return &session{limit: limit, freed: make(chan struct{}), next: 1, receiving: 1}
+}
+
+// wait waits until there is room for more messages in the buffer.
+func (s *session) wait(ctx context.Context) error {
+	for {
+		s.mtx.Lock()
+		full, freed := s.size >= s.limit, s.freed
+		s.mtx.Unlock()
+
+		if !full {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+// sent buffers frame carrying messages sent to the server, assigning sequence
+// IDs to those which are counted. It must be called in the order frames are
+// written.
+func (s *session) sent(data []byte) {
+	n := countSequenced(data)
+	if n == 0 {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.unacked = append(s.unacked, sentFrame{data: append([]byte(nil), data...), first: s.next, last: s.next + n - 1})
+	s.size += len(data)
+	s.next += n
+}
+
+// ack drops frames whose messages the server acknowledged up to sequence ID.
+func (s *session) ack(id uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	n := 0
+	for ; n < len(s.unacked) && s.unacked[n].last <= id; n++ {
+		s.size -= len(s.unacked[n].data)
+	}
+
+	if n == 0 {
+		return
+	}
+
+	s.unacked = append([]sentFrame(nil), s.unacked[n:]...)
+	s.signal()
+}
+
+// end lifts the limit of the buffer once connection of the session is closed,
+// so that writes waiting for room fail on the closed connection.
+func (s *session) end() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.limit = math.MaxInt
+	s.signal()
+}
+
+// signal wakes writes waiting for room in the buffer.
+func (s *session) signal() {
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
+
+// receive counts message received from the server, reporting whether it is
+// the first delivery rather than a duplicate sent again after reconnect.
+func (s *session) receive() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	id := s.receiving
+	s.receiving++
+
+	if id <= s.received {
+		return false
+	}
+
+	s.received = id
+
+	return true
+}
+
+// resequence sets sequence ID of the next message received, as announced by
+// the server once the connection is reestablished.
+func (s *session) resequence(id uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if id > s.receiving {
+		return fmt.Errorf("sequence ID %d is greater than the number of messages received", id)
+	}
+
+	s.receiving = id
+
+	return nil
+}
+
+// pendingAck returns sequence ID of the latest message received which was not
+// acknowledged yet, zero if there is none.
+func (s *session) pendingAck() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.received == s.acked {
+		return 0
+	}
+
+	s.acked = s.received
+
+	return s.acked
+}
+
+// resend writes to conn reestablished by reconnect the sequence message,
+// which tells the server the sequence ID of the first message that follows,
+// and frames it did not acknowledge.
+func (s *session) resend(ctx context.Context, conn WebsocketConn) error {
+	s.mtx.Lock()
+	first := s.next
+	if len(s.unacked) != 0 {
+		first = s.unacked[0].first
+	}
+	frames := append([]sentFrame(nil), s.unacked...)
+	s.mtx.Unlock()
+
+	if err := conn.WriteMessage(ctx, textMessage, sequenceRecord(coreSequence, first)); err != nil {
+		return err
+	}
+
+	for _, frame := range frames {
+		if err := conn.WriteMessage(ctx, textMessage, frame.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// statefulConn tracks messages exchanged over connection to ASP.NET Core
+// server supporting stateful reconnect, which reads a single message at a
+// time. Messages the server sends again after reconnect are skipped, and
+// acknowledgements are requested from acknowledge.
+type statefulConn struct {
+	WebsocketConn
+	session *session
+	acks    chan struct{}
+}
+
+// sessionOf returns session of connection supporting stateful reconnect, nil
+// for other connections.
+func sessionOf(conn WebsocketConn) *session {
+	if sc, ok := conn.(*statefulConn); ok {
+		return sc.session
+	}
+
+	return nil
+}
+
+func (c *statefulConn) ReadMessage(ctx context.Context) (int, []byte, error) {
+	for {
+		t, p, err := c.WebsocketConn.ReadMessage(ctx)
+		if err != nil {
+			return t, p, err
+		}
+
+		if string(p) == corePingMessage {
+			return t, p, nil
+		}
+
+		var m struct {
+			Type       int    `json:"type"`
+			SequenceID uint64 `json:"sequenceId"`
+		}
+		if err := json.Unmarshal(bytes.TrimSuffix(p, []byte{recordSeparator}), &m); err != nil {
+			return t, p, nil
+		}
+
+		switch {
+		case m.Type == coreAck:
+			c.session.ack(m.SequenceID)
+			continue
+		case m.Type == coreSequence:
+			if err := c.session.resequence(m.SequenceID); err != nil {
+				return t, nil, err
+			}
+
+			continue
+		case sequenced(m.Type):
+			if !c.session.receive() {
+				continue
+			}
+
+			select {
+			case c.acks <- struct{}{}:
+			default:
+			}
+		}
+
+		return t, p, nil
+	}
+}
+
+func (c *statefulConn) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	if messageType == textMessage {
+		c.session.sent(data)
+	}
+
+	return c.WebsocketConn.WriteMessage(ctx, messageType, data)
+}
+
+func (c *statefulConn) Close() error {
+	c.session.end()
+	return c.WebsocketConn.Close()
+}
+
+func (c *statefulConn) Metadata() ConnMetadata {
+	return metadataOf(c.WebsocketConn)
+}
+
+// acknowledge acknowledges messages received over connections supporting
+// stateful reconnect until ctx is done, as they are counted by statefulConn.
+func (c *Conn) acknowledge(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.acks:
+		}
+
+		if err := c.ack(ctx); err != nil {
+			// failed connection is detected and reestablished by reading
+			c.log(LevelDebug, "failed to send ack", "error", err)
+		}
+	}
+}
+
+// ack acknowledges messages received from ASP.NET Core server over connection
+// supporting stateful reconnect, unless they are acknowledged already.
+func (c *Conn) ack(ctx context.Context) error {
+	conn, _ := c.current()
+
+	s := sessionOf(conn)
+	if s == nil {
+		return nil
+	}
+
+	id := s.pendingAck()
+	if id == 0 {
+		return nil
+	}
+
+	return c.write(ctx, sequenceRecord(coreAck, id))
+}
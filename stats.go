@@ -0,0 +1,172 @@
+package signalr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Stats holds cumulative counters of a client and its connection.
+type Stats struct {
+	// websocket frames and their payload bytes, including keepalives
+	FramesRead    int64
+	FramesWritten int64
+	BytesRead     int64
+	BytesWritten  int64
+
+	// keepalive messages received
+	Keepalives int64
+
+	// connections reestablished by reconnect, failover or renegotiate
+	Reconnects int64
+
+	// invocations waiting for a response
+	InvocationsInFlight int
+
+	// open callback streams
+	CallbacksRegistered int
+
+	// messages not delivered to stopped callback streams
+	DroppedMessages int64
+
+	// the latest read, write or run error, nil if there was none
+	LastError error
+
+	// the error which caused the latest reconnect, nil if the connection was
+	// not reestablished after a failure
+	ReconnectReason error
+}
+
+// Stats returns cumulative counters, which are cheap to collect and suitable
+// for dashboards.
+func (c *Client) Stats() Stats {
+	res := c.conn.stats.snapshot()
+	res.InvocationsInFlight = c.invocations.len()
+	res.CallbacksRegistered, res.DroppedMessages = c.callbacks.counts()
+
+	return res
+}
+
+// connStats collects counters of a connection surviving reconnects.
+type connStats struct {
+	framesRead    int64
+	framesWritten int64
+	bytesRead     int64
+	bytesWritten  int64
+	keepalives    int64
+	reconnects    int64
+
+	mtx             sync.Mutex
+	lastErr         error
+	reconnectReason error
+}
+
+func (s *connStats) fail(err error) {
+	s.mtx.Lock()
+	s.lastErr = err
+	s.mtx.Unlock()
+}
+
+// reconnecting records the reason of reconnect.
+func (s *connStats) reconnecting(reason error) {
+	s.mtx.Lock()
+	s.reconnectReason = reason
+	s.mtx.Unlock()
+}
+
+func (s *connStats) snapshot() Stats {
+	s.mtx.Lock()
+	lastErr, reconnectReason := s.lastErr, s.reconnectReason
+	s.mtx.Unlock()
+
+	return Stats{
+		FramesRead:      atomic.LoadInt64(&s.framesRead),
+		FramesWritten:   atomic.LoadInt64(&s.framesWritten),
+		BytesRead:       atomic.LoadInt64(&s.bytesRead),
+		BytesWritten:    atomic.LoadInt64(&s.bytesWritten),
+		Keepalives:      atomic.LoadInt64(&s.keepalives),
+		Reconnects:      atomic.LoadInt64(&s.reconnects),
+		LastError:       lastErr,
+		ReconnectReason: reconnectReason,
+	}
+}
+
+// countConn counts frames passing through the connection.
+type countConn struct {
+	WebsocketConn
+	stats *connStats
+}
+
+func (c *countConn) ReadMessage(ctx context.Context) (messageType int, p []byte, err error) {
+	messageType, p, err = c.WebsocketConn.ReadMessage(ctx)
+	if err != nil {
+		return messageType, p, err
+	}
+
+	atomic.AddInt64(&c.stats.framesRead, 1)
+	atomic.AddInt64(&c.stats.bytesRead, int64(len(p)))
+
+	if bytes.Equal(p, keepaliveFrame) || string(p) == corePingRecord {
+		atomic.AddInt64(&c.stats.keepalives, 1)
+	}
+
+	return messageType, p, nil
+}
+
+func (c *countConn) NextReader(ctx context.Context) (messageType int, r io.Reader, err error) {
+	messageType, r, err = nextReader(ctx, c.WebsocketConn)
+	if err != nil {
+		return messageType, r, err
+	}
+
+	atomic.AddInt64(&c.stats.framesRead, 1)
+
+	return messageType, &countReader{Reader: r, stats: c.stats}, nil
+}
+
+func (c *countConn) Metadata() ConnMetadata {
+	return metadataOf(c.WebsocketConn)
+}
+
+// countReader counts bytes of a message and recognizes keepalives once the
+// message is read to the end.
+type countReader struct {
+	io.Reader
+	stats *connStats
+	head  [2]byte
+	n     int
+	eof   bool
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+
+	if r.n < len(r.head) {
+		copy(r.head[r.n:], p[:n])
+	}
+
+	r.n += n
+	atomic.AddInt64(&r.stats.bytesRead, int64(n))
+
+	if err == io.EOF && !r.eof {
+		r.eof = true
+		if r.n == 2 && r.head == [2]byte{'{', '}'} {
+			atomic.AddInt64(&r.stats.keepalives, 1)
+		}
+	}
+
+	return n, err
+}
+
+func (c *countConn) WriteMessage(ctx context.Context, messageType int, p []byte) error {
+	if err := c.WebsocketConn.WriteMessage(ctx, messageType, p); err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&c.stats.framesWritten, 1)
+	atomic.AddInt64(&c.stats.bytesWritten, int64(len(p)))
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package signalr
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+type SubscriptionsOpt func(*subscriptionsConfig)
+
+// UnsubscribeMethod sets hub method invoked with the same arguments once the
+// last subscription acquired with subscribe method is released. Without it,
+// released subscriptions are only no longer replayed.
+func UnsubscribeMethod(subscribe, unsubscribe string) SubscriptionsOpt {
+	return func(c *subscriptionsConfig) {
+		c.Unsubscribe[subscribe] = unsubscribe
+	}
+}
+
+type subscriptionsConfig struct {
+	Unsubscribe map[string]string
+}
+
+// Subscriptions shares hub subscriptions between consumers. The subscribe
+// method is invoked on the first Acquire of a method and arguments, declared
+// so that it is replayed after every reconnect (see Client.Declare), and the
+// unsubscribe method on the last Release.
+type Subscriptions struct {
+	client *Client
+	config subscriptionsConfig
+
+	mtx     sync.Mutex
+	entries map[string]*subscriptionEntry
+}
+
+type subscriptionEntry struct {
+	// held while subscribing or unsubscribing
+	mtx  sync.Mutex
+	refs int
+
+	// set once the entry is dropped from the map, so that consumers waiting
+	// for it look it up again
+	removed bool
+}
+
+// Subscription is a reference to a shared subscription, see
+// Subscriptions.Acquire.
+type Subscription struct {
+	subs   *Subscriptions
+	key    string
+	method string
+	args   []interface{}
+	once   sync.Once
+}
+
+func NewSubscriptions(client *Client, opts ...SubscriptionsOpt) *Subscriptions {
+	cfg := subscriptionsConfig{Unsubscribe: make(map[string]string)}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return &Subscriptions{
+		client:  client,
+		config:  cfg,
+		entries: make(map[string]*subscriptionEntry),
+	}
+}
+
+// Acquire subscribes by invoking method with args unless the subscription is
+// already acquired, and returns a reference which must be released.
+// Concurrent acquires of the same subscription wait for the first one to
+// complete.
+func (s *Subscriptions) Acquire(ctx context.Context, method string, args ...interface{}) (*Subscription, error) {
+	key, err := subscriptionKey(method, args)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		entry := s.entry(key)
+
+		entry.mtx.Lock()
+		if entry.removed {
+			entry.mtx.Unlock()
+			continue
+		}
+
+		if entry.refs == 0 {
+			if err := s.client.Declare(ctx, method, args...); err != nil {
+				s.drop(key, entry)
+				entry.mtx.Unlock()
+
+				return nil, err
+			}
+		}
+
+		entry.refs++
+		entry.mtx.Unlock()
+
+		return &Subscription{subs: s, key: key, method: method, args: args}, nil
+	}
+}
+
+// Refs returns the number of references to subscription acquired with method
+// and args.
+func (s *Subscriptions) Refs(method string, args ...interface{}) int {
+	key, err := subscriptionKey(method, args)
+	if err != nil {
+		return 0
+	}
+
+	s.mtx.Lock()
+	entry, ok := s.entries[key]
+	s.mtx.Unlock()
+
+	if !ok {
+		return 0
+	}
+
+	entry.mtx.Lock()
+	defer entry.mtx.Unlock()
+
+	return entry.refs
+}
+
+// Release drops the reference. Once the last reference to the subscription is
+// released, it is no longer replayed and the unsubscribe method, if set by
+// UnsubscribeMethod, is invoked. Only the first Release of a reference has an
+// effect.
+func (sub *Subscription) Release(ctx context.Context) error {
+	var err error
+	sub.once.Do(func() {
+		err = sub.subs.release(ctx, sub)
+	})
+
+	return err
+}
+
+func (s *Subscriptions) release(ctx context.Context, sub *Subscription) error {
+	s.mtx.Lock()
+	entry := s.entries[sub.key]
+	s.mtx.Unlock()
+
+	entry.mtx.Lock()
+	defer entry.mtx.Unlock()
+
+	entry.refs--
+	if entry.refs > 0 {
+		return nil
+	}
+
+	s.drop(sub.key, entry)
+	s.client.undeclareCall(sub.method, sub.args)
+
+	unsubscribe, ok := s.config.Unsubscribe[sub.method]
+	if !ok {
+		return nil
+	}
+
+	return s.client.Invoke(ctx, unsubscribe, sub.args...).wait()
+}
+
+// entry returns entry of subscription, creating it if needed.
+func (s *Subscriptions) entry(key string) *subscriptionEntry {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &subscriptionEntry{}
+		s.entries[key] = entry
+	}
+
+	return entry
+}
+
+// drop removes entry without references, it must be called with the entry
+// locked.
+func (s *Subscriptions) drop(key string, entry *subscriptionEntry) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	entry.removed = true
+	delete(s.entries, key)
+}
+
+// subscriptionKey identifies subscription by method and encoded arguments.
+func subscriptionKey(method string, args []interface{}) (string, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+
+	return method + "\x00" + string(data), nil
+}
+
+// undeclareCall stops replaying a single call of method with args.
+func (c *Client) undeclareCall(method string, args []interface{}) {
+	c.declared.mtx.Lock()
+	defer c.declared.mtx.Unlock()
+
+	for i, d := range c.declared.data {
+		if d.Method == method && reflect.DeepEqual(d.Args, args) {
+			c.declared.data = append(c.declared.data[:i:i], c.declared.data[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package signalr
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// SetupTiming is emitted for every request of the connection sequence, which
+// attributes slow connection setup to DNS, TCP, TLS or the server.
+type SetupTiming struct {
+	// the step of the sequence: negotiate, connect, reconnect or start
+	Step string
+
+	// the URL requested, without query which carries connection token
+	Endpoint string
+
+	// durations of DNS lookup, TCP connect and TLS handshake, zero if the
+	// request reused a connection
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+
+	// the time since the request started until the first byte of response
+	FirstByte time.Duration
+
+	// the time since the request started until it completed, either when
+	// response headers were received or when it failed
+	Total time.Duration
+
+	// whether the request reused a pooled connection
+	Reused bool
+
+	// the error the request failed with
+	Err error
+}
+
+type setupTraceKey struct{}
+
+// withSetupTrace makes requests of the connection sequence made with ctx emit
+// SetupTiming events.
+func withSetupTrace(ctx context.Context, events eventChan) context.Context {
+	if events == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, setupTraceKey{}, events)
+}
+
+// traceStep traces a request of the connection sequence, returning ctx to
+// make the request with and a function to call once the request completes.
+func traceStep(ctx context.Context, step, endpoint string) (context.Context, func(error)) {
+	events, _ := ctx.Value(setupTraceKey{}).(eventChan)
+	if events == nil {
+		return ctx, func(error) {}
+	}
+
+	t := &stepTrace{start: time.Now()}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mark(&t.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mark(&t.dnsDone)
+		},
+		ConnectStart: func(string, string) {
+			t.mark(&t.connectStart)
+		},
+		ConnectDone: func(string, string, error) {
+			t.mark(&t.connectDone)
+		},
+		TLSHandshakeStart: func() {
+			t.mark(&t.tlsStart)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mark(&t.tlsDone)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mtx.Lock()
+			t.reused = info.Reused
+			t.mtx.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mark(&t.firstByte)
+		},
+	}
+
+	done := func(err error) {
+		timing := t.timing()
+		timing.Step = step
+		timing.Endpoint = stripQuery(endpoint)
+		timing.Err = err
+
+		events.emit(timing)
+	}
+
+	return httptrace.WithClientTrace(ctx, trace), done
+}
+
+// stepTrace collects times of request phases, which may be reported from
+// different goroutines. The first start and the last end of a phase are kept,
+// e.g. when connecting to multiple addresses.
+type stepTrace struct {
+	start time.Time
+
+	mtx          sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	firstByte    time.Time
+	reused       bool
+}
+
+func (t *stepTrace) mark(at *time.Time) {
+	now := time.Now()
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	// start times are kept, end times updated
+	switch at {
+	case &t.dnsStart, &t.connectStart, &t.tlsStart:
+		if !at.IsZero() {
+			return
+		}
+	}
+
+	*at = now
+}
+
+func (t *stepTrace) timing() SetupTiming {
+	end := time.Now()
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	since := func(start, end time.Time) time.Duration {
+		if start.IsZero() || end.IsZero() {
+			return 0
+		}
+
+		return end.Sub(start)
+	}
+
+	return SetupTiming{
+		DNS:       since(t.dnsStart, t.dnsDone),
+		Connect:   since(t.connectStart, t.connectDone),
+		TLS:       since(t.tlsStart, t.tlsDone),
+		FirstByte: since(t.start, t.firstByte),
+		Total:     end.Sub(t.start),
+		Reused:    t.reused,
+	}
+}
+
+// stripQuery returns URL without query, which is not logged as it carries
+// connection token.
+func stripQuery(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+
+	u.RawQuery = ""
+	u.User = nil
+
+	return u.String()
+}
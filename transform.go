@@ -0,0 +1,78 @@
+package signalr
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ArgTransform converts a single callback argument, e.g. decompresses payloads
+// sent by exchange feeds. Result must be valid JSON.
+type ArgTransform func(arg json.RawMessage) (json.RawMessage, error)
+
+var (
+	_ ArgTransform = Base64Deflate
+	_ ArgTransform = Base64Gzip
+)
+
+// Base64Deflate decodes argument sent as base64 encoded string of raw deflate
+// compressed JSON, as used by Bittrex feeds.
+func Base64Deflate(arg json.RawMessage) (json.RawMessage, error) {
+	return decompressBase64(arg, func(r io.Reader) (io.ReadCloser, error) {
+		return flate.NewReader(r), nil
+	})
+}
+
+// Base64Gzip decodes argument sent as base64 encoded string of gzip
+// compressed JSON.
+func Base64Gzip(arg json.RawMessage) (json.RawMessage, error) {
+	return decompressBase64(arg, func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	})
+}
+
+func decompressBase64(arg json.RawMessage, decompressor func(io.Reader) (io.ReadCloser, error)) (json.RawMessage, error) {
+	// encoding/json decodes base64 strings into byte slices
+	var data []byte
+	if err := json.Unmarshal(arg, &data); err != nil {
+		return nil, fmt.Errorf("failed to decode base64: %w", err)
+	}
+
+	reader, err := decompressor(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	defer reader.Close()
+
+	res, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+
+	return res, nil
+}
+
+// transformArgs applies transforms in order to every argument.
+func transformArgs(args []json.RawMessage, transforms []ArgTransform) ([]json.RawMessage, error) {
+	if len(transforms) == 0 {
+		return args, nil
+	}
+
+	res := make([]json.RawMessage, len(args))
+	for i, arg := range args {
+		for _, transform := range transforms {
+			var err error
+			if arg, err = transform(arg); err != nil {
+				return nil, fmt.Errorf("argument %d: %w", i, err)
+			}
+		}
+
+		res[i] = arg
+	}
+
+	return res, nil
+}
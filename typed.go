@@ -0,0 +1,68 @@
+package signalr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// InvokeResult invokes hub method and unmarshals its result into T.
+func InvokeResult[T any](ctx context.Context, c *Client, method string, args ...interface{}) (T, error) {
+	var res T
+	if err := c.Invoke(ctx, method, args...).Unmarshal(&res); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// Stream is a typed callback stream created by Subscribe.
+type Stream[T any] struct {
+	stream *CallbackStream
+}
+
+// Subscribe creates a stream of hub method calls with arguments unmarshalled
+// into T. If the method is called with a single argument, it is unmarshalled
+// into T directly, otherwise T receives JSON array of all arguments.
+func Subscribe[T any](ctx context.Context, c *Client, method string, opts ...CallbackOpt) (*Stream[T], error) {
+	stream, err := c.Callback(ctx, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stream[T]{stream: stream}, nil
+}
+
+// Read blocks until the next call is received and returns its arguments.
+func (s *Stream[T]) Read() (T, error) {
+	var res T
+
+	msg := s.stream.readResult()
+	if msg.err != nil {
+		return res, msg.err
+	}
+
+	var data json.RawMessage
+	switch args := msg.message.Args; len(args) {
+	case 0:
+		return res, nil
+	case 1:
+		data = args[0]
+	default:
+		var err error
+		if data, err = json.Marshal(args); err != nil {
+			return res, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+	}
+
+	if err := s.stream.codec.unmarshal(data, &res); err != nil {
+		return res, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+
+	return res, nil
+}
+
+// Close stops the stream.
+func (s *Stream[T]) Close() {
+	s.stream.Close()
+}
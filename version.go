@@ -0,0 +1,86 @@
+package signalr
+
+import (
+	"strconv"
+	"strings"
+)
+
+// protoVersion is a parsed clientProtocol value, e.g. 1.5 is {1, 5}.
+type protoVersion struct {
+	major, minor int
+}
+
+// supportedProtocols lists client protocol versions understood by this
+// package, see Protocol.
+var supportedProtocols = []protoVersion{
+	{1, 2}, {1, 3}, {1, 4}, {1, 5}, {2, 0}, {2, 1},
+}
+
+func parseProtocolVersion(s string) (protoVersion, bool) {
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 {
+		return protoVersion{}, false
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return protoVersion{}, false
+	}
+
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return protoVersion{}, false
+	}
+
+	v := protoVersion{major: major, minor: minor}
+	for _, supported := range supportedProtocols {
+		if v == supported {
+			return v, true
+		}
+	}
+
+	return protoVersion{}, false
+}
+
+func (v protoVersion) less(other protoVersion) bool {
+	if v.major != other.major {
+		return v.major < other.major
+	}
+
+	return v.minor < other.minor
+}
+
+// hasInitMessage reports whether the server sends init message ("S":1) once
+// the transport is connected. It was introduced in protocol 1.3.
+func (v protoVersion) hasInitMessage() bool {
+	return !v.less(protoVersion{1, 3})
+}
+
+// hasStart reports whether the connection has to be confirmed with the start
+// request. It was introduced in protocol 1.4.
+func (v protoVersion) hasStart() bool {
+	return !v.less(protoVersion{1, 4})
+}
+
+// hasAbort reports whether the server accepts the abort request. It was
+// introduced in protocol 1.3.
+func (v protoVersion) hasAbort() bool {
+	return !v.less(protoVersion{1, 3})
+}
+
+func (v protoVersion) String() string {
+	return strconv.Itoa(v.major) + "." + strconv.Itoa(v.minor)
+}
+
+// checkProtocol verifies that the version reported by the server in negotiate
+// response can be spoken by the client which requested given version.
+func checkProtocol(client, server string) (protoVersion, error) {
+	requested, _ := parseProtocolVersion(client)
+
+	v, ok := parseProtocolVersion(server)
+	if !ok || requested.less(v) {
+		return protoVersion{}, &IncompatibleProtocolError{Client: client, Server: server}
+	}
+
+	return v, nil
+}
@@ -1,11 +1,17 @@
 package signalr
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -20,17 +26,57 @@ type WebsocketDialer interface {
 
 // WebsocketConn is a combination of MessageReader and JSONWriter. It is used to
 // provide an interface to objects that can read from and write to a websocket
-// connection.
+// connection. WriteMessage must not retain p, whose buffer is reused.
 type WebsocketConn interface {
 	ReadMessage(ctx context.Context) (messageType int, p []byte, err error)
 	WriteMessage(ctx context.Context, messageType int, p []byte) error
 	Close() error
 }
 
+// StreamReader can be implemented by WebsocketConn to let messages be decoded
+// while they are read, instead of buffering whole frames first.
+type StreamReader interface {
+	NextReader(ctx context.Context) (messageType int, r io.Reader, err error)
+}
+
+// ConnMetadata describes the underlying connection, see Conn.Metadata.
+type ConnMetadata struct {
+	// the ID of the connection assigned by the server
+	ConnectionID string
+
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// state of the TLS connection, nil if the connection is not encrypted
+	TLS *tls.ConnectionState
+
+	// websocket extensions negotiated in handshake, e.g. permessage-deflate
+	// with its parameters
+	Extensions []string
+}
+
+// MetadataProvider can be implemented by WebsocketConn to report details of
+// the network connection, see Conn.Metadata.
+type MetadataProvider interface {
+	Metadata() ConnMetadata
+}
+
+// metadataOf returns metadata of conn, which is empty unless conn implements
+// MetadataProvider.
+func metadataOf(conn WebsocketConn) ConnMetadata {
+	if p, ok := conn.(MetadataProvider); ok {
+		return p.Metadata()
+	}
+
+	return ConnMetadata{}
+}
+
 var (
 	_ WebsocketDialerFunc = NewDefaultDialer
 	_ WebsocketDialer     = &defaultDialer{}
 	_ WebsocketConn       = &defaultConn{}
+	_ StreamReader        = &defaultConn{}
+	_ MetadataProvider    = &defaultConn{}
 )
 
 type defaultDialer struct {
@@ -40,14 +86,28 @@ type defaultDialer struct {
 func NewDefaultDialer(client *http.Client) WebsocketDialer {
 	proxy := http.ProxyFromEnvironment
 	var tlsConfig *tls.Config
+	var netDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	transport := client.Transport
+	if t, ok := transport.(*authTransport); ok {
+		transport = t.base
+	}
 
-	if t, ok := client.Transport.(*http.Transport); ok {
+	if t, ok := transport.(*http.Transport); ok {
 		proxy = t.Proxy
-		tlsConfig = t.TLSClientConfig
+		netDialContext = t.DialContext
+
+		if t.TLSClientConfig != nil {
+			// websocket handshake requires HTTP/1.1, while the clone still
+			// shares session cache with the transport
+			tlsConfig = t.TLSClientConfig.Clone()
+			tlsConfig.NextProtos = []string{"http/1.1"}
+		}
 	}
 
 	return defaultDialer{
 		Dialer: websocket.Dialer{
+			NetDialContext:  netDialContext,
 			TLSClientConfig: tlsConfig,
 			Proxy:           proxy,
 			Jar:             client.Jar,
@@ -64,15 +124,58 @@ func (d defaultDialer) Dial(ctx context.Context, u string, headers http.Header)
 		status = res.StatusCode
 	}
 
+	if errors.Is(err, websocket.ErrBadHandshake) && res != nil {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+		return nil, status, &HandshakeError{StatusCode: status, Body: body, cause: err}
+	}
+
 	if err != nil {
 		return nil, status, err
 	}
 
-	return &defaultConn{Conn: conn}, status, err
+	return &defaultConn{Conn: conn, extensions: parseExtensions(res.Header)}, status, err
 }
 
 type defaultConn struct {
 	*websocket.Conn
+	limit      int64
+	extensions []string
+}
+
+// parseExtensions returns websocket extensions accepted by the server.
+func parseExtensions(header http.Header) []string {
+	var res []string
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(value, ",") {
+			if ext = strings.TrimSpace(ext); ext != "" {
+				res = append(res, ext)
+			}
+		}
+	}
+
+	return res
+}
+
+// Metadata implements MetadataProvider.
+func (c *defaultConn) Metadata() ConnMetadata {
+	md := ConnMetadata{
+		LocalAddr:  c.Conn.LocalAddr(),
+		RemoteAddr: c.Conn.RemoteAddr(),
+		Extensions: c.extensions,
+	}
+
+	if conn, ok := c.Conn.UnderlyingConn().(*tls.Conn); ok {
+		state := conn.ConnectionState()
+		md.TLS = &state
+	}
+
+	return md
+}
+
+// SetReadLimit sets the maximum size of a message read from the peer.
+func (c *defaultConn) SetReadLimit(limit int64) {
+	c.limit = limit
+	c.Conn.SetReadLimit(limit)
 }
 
 func (c *defaultConn) ReadMessage(ctx context.Context) (messageType int, p []byte, err error) {
@@ -91,12 +194,208 @@ func (c *defaultConn) ReadMessage(ctx context.Context) (messageType int, p []byt
 
 	var closeErr *websocket.CloseError
 	if errors.As(err, &closeErr) {
-		return 0, nil, &CloseError{code: closeErr.Code, text: closeErr.Text}
+		return 0, nil, &CloseError{Code: closeErr.Code, Text: closeErr.Text}
+	}
+
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return 0, nil, &MessageTooLargeError{Limit: c.limit}
 	}
 
 	return messageType, p, err
 }
 
+func (c *defaultConn) NextReader(ctx context.Context) (messageType int, r io.Reader, err error) {
+	select {
+	case <-ctx.Done():
+		return -1, nil, ctx.Err()
+	default:
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return -1, nil, err
+	}
+
+	messageType, r, err = c.Conn.NextReader()
+
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return 0, nil, &CloseError{Code: closeErr.Code, Text: closeErr.Text}
+	}
+
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return 0, nil, &MessageTooLargeError{Limit: c.limit}
+	}
+
+	if err != nil {
+		return messageType, nil, err
+	}
+
+	return messageType, &limitReader{Reader: r, limit: c.limit}, nil
+}
+
+// limitReader reports exceeded read limit as MessageTooLargeError.
+type limitReader struct {
+	io.Reader
+	limit int64
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return n, &MessageTooLargeError{Limit: r.limit}
+	}
+
+	return n, err
+}
+
+// nextReader returns a reader of the next message, falling back to reading
+// the whole message if conn does not implement StreamReader.
+func nextReader(ctx context.Context, conn WebsocketConn) (messageType int, r io.Reader, err error) {
+	if s, ok := conn.(StreamReader); ok {
+		return s.NextReader(ctx)
+	}
+
+	messageType, p, err := conn.ReadMessage(ctx)
+	if err != nil {
+		return messageType, nil, err
+	}
+
+	return messageType, bytes.NewReader(p), nil
+}
+
+// limitConn rejects messages exceeding the limit for connections which can
+// not enforce it while reading.
+type limitConn struct {
+	WebsocketConn
+	limit int64
+}
+
+// limitMessageSize makes conn reject messages larger than limit bytes. Zero
+// limit means no limit.
+func limitMessageSize(conn WebsocketConn, limit int64) WebsocketConn {
+	if limit <= 0 {
+		return conn
+	}
+
+	if c, ok := conn.(interface{ SetReadLimit(int64) }); ok {
+		c.SetReadLimit(limit)
+		return conn
+	}
+
+	return &limitConn{WebsocketConn: conn, limit: limit}
+}
+
+func (c *limitConn) ReadMessage(ctx context.Context) (messageType int, p []byte, err error) {
+	messageType, p, err = c.WebsocketConn.ReadMessage(ctx)
+	if err == nil && int64(len(p)) > c.limit {
+		return 0, nil, &MessageTooLargeError{Limit: c.limit}
+	}
+
+	return messageType, p, err
+}
+
+func (c *limitConn) Metadata() ConnMetadata {
+	return metadataOf(c.WebsocketConn)
+}
+
+// deadlineConn bounds every read and write by a timeout, see ReadTimeout and
+// WriteTimeout.
+type deadlineConn struct {
+	WebsocketConn
+	read  time.Duration
+	write time.Duration
+}
+
+// withDeadlines makes reads and writes of conn fail with CloseError once they
+// take longer than read and write timeout respectively. Zero timeout means no
+// limit.
+func withDeadlines(conn WebsocketConn, read, write time.Duration) WebsocketConn {
+	if read <= 0 && write <= 0 {
+		return conn
+	}
+
+	return &deadlineConn{WebsocketConn: conn, read: read, write: write}
+}
+
+func (c *deadlineConn) ReadMessage(ctx context.Context) (messageType int, p []byte, err error) {
+	dctx, cancel, bounded := withDeadline(ctx, c.read)
+	defer cancel()
+
+	messageType, p, err = c.WebsocketConn.ReadMessage(dctx)
+
+	return messageType, p, timedOut(ctx, bounded, err, "read timeout")
+}
+
+func (c *deadlineConn) NextReader(ctx context.Context) (messageType int, r io.Reader, err error) {
+	dctx, cancel, bounded := withDeadline(ctx, c.read)
+	defer cancel()
+
+	messageType, r, err = nextReader(dctx, c.WebsocketConn)
+
+	return messageType, r, timedOut(ctx, bounded, err, "read timeout")
+}
+
+func (c *deadlineConn) WriteMessage(ctx context.Context, messageType int, p []byte) error {
+	dctx, cancel, bounded := withDeadline(ctx, c.write)
+	defer cancel()
+
+	return timedOut(ctx, bounded, c.WebsocketConn.WriteMessage(dctx, messageType, p), "write timeout")
+}
+
+func (c *deadlineConn) Metadata() ConnMetadata {
+	return metadataOf(c.WebsocketConn)
+}
+
+// withDeadline bounds ctx by timeout, reporting whether the timeout is sooner
+// than the deadline of ctx.
+func withDeadline(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc, bool) {
+	if timeout <= 0 {
+		return ctx, func() {}, false
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= timeout {
+		return ctx, func() {}, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	return ctx, cancel, true
+}
+
+// timedOut reports err caused by the timeout, rather than by ctx, as abnormal
+// closure, so that the connection is reestablished.
+func timedOut(ctx context.Context, bounded bool, err error, text string) error {
+	if err == nil || !bounded || ctx.Err() != nil {
+		return err
+	}
+
+	if isTimeout(err) {
+		return &CloseError{Code: CloseAbnormal, Text: text}
+	}
+
+	return err
+}
+
+// stepTimedOut reports err caused by the timeout of a step of the connection
+// sequence, rather than by ctx, as SetupTimeoutError.
+func stepTimedOut(ctx context.Context, bounded bool, err error, step string, timeout time.Duration) error {
+	if err == nil || !bounded || ctx.Err() != nil {
+		return err
+	}
+
+	if isTimeout(err) {
+		return &SetupTimeoutError{Step: step, Timeout: timeout, cause: err}
+	}
+
+	return err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func (c *defaultConn) WriteMessage(ctx context.Context, messageType int, p []byte) error {
 	deadline, _ := ctx.Deadline()
 	if err := c.Conn.SetWriteDeadline(deadline); err != nil {